@@ -0,0 +1,56 @@
+"use client";
+import { useEffect, useState } from "react";
+
+interface MapThumbnailProps {
+  url?: string;
+  alt: string;
+  className?: string;
+}
+
+// Thumbnails sit behind the gateway's auth check, which an <img> src can't
+// satisfy, so they are fetched with the token and shown from an object URL.
+export default function MapThumbnail({ url, alt, className }: MapThumbnailProps) {
+  const [src, setSrc] = useState<string | null>(null);
+
+  useEffect(() => {
+    if (!url) return;
+
+    const token = localStorage.getItem("token");
+    const apiHost = process.env.NEXT_PUBLIC_API_GATEWAY_URL;
+    let objectUrl: string | null = null;
+    let cancelled = false;
+
+    const load = async () => {
+      try {
+        const response = await fetch(`${apiHost}${url}`, {
+          headers: {
+            Accept: "image/webp,image/png",
+            Authorization: `Bearer ${token}`,
+          },
+        });
+        if (!response.ok) return;
+
+        const blob = await response.blob();
+        if (cancelled) return;
+        objectUrl = URL.createObjectURL(blob);
+        setSrc(objectUrl);
+      } catch (err) {
+        console.error("Error fetching thumbnail:", err);
+      }
+    };
+
+    load();
+    return () => {
+      cancelled = true;
+      if (objectUrl) {
+        URL.revokeObjectURL(objectUrl);
+      }
+    };
+  }, [url]);
+
+  if (!src) {
+    return <div className={className} />;
+  }
+  // eslint-disable-next-line @next/next/no-img-element
+  return <img src={src} alt={alt} className={className} />;
+}
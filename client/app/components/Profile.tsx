@@ -1,24 +1,41 @@
 "use client";
-import { useEffect, useState } from "react";
+import { useCallback, useEffect, useState } from "react";
 import { useRouter } from "next/navigation";
 import styles from "./styles/Profile.module.css";
+import MapThumbnail from "./MapThumbnail";
 
 interface Map {
   id: string;
   name: string;
   createdAt: string;
+  thumbnailUrls?: Record<string, string>;
 }
 
+interface MapPage {
+  items: Map[];
+  nextCursor?: string;
+  total: number;
+}
+
+type SortOption = "created" | "updated" | "name";
+
+const PAGE_SIZE = 12;
+
 export default function Profile() {
   const router = useRouter();
   const [userName, setUserName] = useState("");
   const [userEmail, setUserEmail] = useState("");
   const [maps, setMaps] = useState<Map[] | null>(null); // Initialize as null
+  const [total, setTotal] = useState(0);
+  const [nextCursor, setNextCursor] = useState<string | undefined>();
+  const [search, setSearch] = useState("");
+  const [sort, setSort] = useState<SortOption>("created");
   const [isLoading, setIsLoading] = useState(true);
+  const [isLoadingMore, setIsLoadingMore] = useState(false);
   const [error, setError] = useState("");
 
-  useEffect(() => {
-    const fetchUserData = async () => {
+  const fetchMaps = useCallback(
+    async (cursor?: string) => {
       const token = localStorage.getItem("token");
       const userId = localStorage.getItem("userId");
 
@@ -32,39 +49,70 @@ export default function Profile() {
         throw new Error("API host is not defined");
       }
 
-      const storedEmail = localStorage.getItem("email");
-      setUserEmail(storedEmail || "user@gmail.com");
-
-      const storedUserName = localStorage.getItem("name");
-      setUserName(storedUserName || "User");
+      const params = new URLSearchParams({
+        userId,
+        limit: String(PAGE_SIZE),
+        sort,
+      });
+      if (search) {
+        params.set("q", search);
+      }
+      if (cursor) {
+        params.set("cursor", cursor);
+      }
 
       try {
-        const response = await fetch(
-          `${apiHost}/api/v1/maps?userId=${userId}`,
-          {
-            headers: {
-              Authorization: `Bearer ${token}`,
-            },
-          }
-        );
+        const response = await fetch(`${apiHost}/api/v1/maps?${params}`, {
+          headers: {
+            Authorization: `Bearer ${token}`,
+          },
+        });
 
         if (!response.ok) {
           throw new Error(`HTTP error! status: ${response.status}`);
         }
 
-        const data = await response.json();
-        setMaps(Array.isArray(data) ? data : []);
+        const data: MapPage = await response.json();
+        const items = Array.isArray(data.items) ? data.items : [];
+        setMaps((previous) =>
+          cursor && previous ? [...previous, ...items] : items
+        );
+        setTotal(data.total ?? items.length);
+        setNextCursor(data.nextCursor);
+        setError("");
       } catch (err) {
         console.error("Error fetching maps:", err);
         setError("Failed to load maps. Please try again later.");
-        setMaps([]);
-      } finally {
-        setIsLoading(false);
+        if (!cursor) {
+          setMaps([]);
+        }
       }
-    };
+    },
+    [router, search, sort]
+  );
 
-    fetchUserData();
-  }, [router]);
+  useEffect(() => {
+    const storedEmail = localStorage.getItem("email");
+    setUserEmail(storedEmail || "user@gmail.com");
+
+    const storedUserName = localStorage.getItem("name");
+    setUserName(storedUserName || "User");
+  }, []);
+
+  useEffect(() => {
+    // Debounce so typing in the search box doesn't fire a request per key.
+    const timer = setTimeout(async () => {
+      await fetchMaps();
+      setIsLoading(false);
+    }, 300);
+    return () => clearTimeout(timer);
+  }, [fetchMaps]);
+
+  const handleLoadMore = async () => {
+    setIsLoadingMore(true);
+    await fetchMaps(nextCursor);
+    setIsLoadingMore(false);
+  };
 
   const handleMapClick = (mapId: string) => {
     router.push(`/maps/${mapId}`);
@@ -96,7 +144,25 @@ export default function Profile() {
         </div>
 
         <div className={styles.profileSection}>
-          <h2>Maps</h2>
+          <h2>Maps ({total})</h2>
+          <div className={styles.mapControls}>
+            <input
+              type="search"
+              placeholder="Search by name"
+              value={search}
+              onChange={(e) => setSearch(e.target.value)}
+              className={styles.searchInput}
+            />
+            <select
+              value={sort}
+              onChange={(e) => setSort(e.target.value as SortOption)}
+              className={styles.sortSelect}
+            >
+              <option value="created">Newest</option>
+              <option value="updated">Recently updated</option>
+              <option value="name">Name</option>
+            </select>
+          </div>
           {error && (
             <div className="text-red-500 text-center my-4">{error}</div>
           )}
@@ -110,6 +176,15 @@ export default function Profile() {
                   className={styles.mapCard}
                   onClick={() => handleMapClick(map.id)}
                 >
+                  <MapThumbnail
+                    url={
+                      map.thumbnailUrls &&
+                      (map.thumbnailUrls["256"] ??
+                        Object.values(map.thumbnailUrls)[0])
+                    }
+                    alt={map.name}
+                    className={styles.mapThumbnail}
+                  />
                   <h3>{map.name}</h3>
                   <p className={styles.mapDate}>
                     Created: {new Date(map.createdAt).toLocaleDateString()}
@@ -118,6 +193,15 @@ export default function Profile() {
               ))}
             </div>
           )}
+          {nextCursor && (
+            <button
+              className={styles.button}
+              onClick={handleLoadMore}
+              disabled={isLoadingMore}
+            >
+              {isLoadingMore ? "Loading..." : "Load more"}
+            </button>
+          )}
         </div>
 
         <div className={styles.profileSection}>
@@ -5,11 +5,12 @@ import { useParams, useRouter } from "next/navigation";
 interface MapData {
   id: string;
   name: string;
-  imageData: string;
+  imageUrl?: string;
   matrix: number[][];
   width: number;
   height: number;
   createdAt: string;
+  access?: "owner" | "editor" | "viewer";
 }
 
 export default function MapView() {
@@ -19,6 +20,7 @@ export default function MapView() {
   const [error, setError] = useState<string>("");
   const [isLoading, setIsLoading] = useState(true);
   const [isDeleting, setIsDeleting] = useState(false);
+  const [shareUrl, setShareUrl] = useState<string>("");
   const canvasRef = useRef<HTMLCanvasElement>(null);
 
   useEffect(() => {
@@ -62,26 +64,55 @@ export default function MapView() {
   }, [params.id]);
 
   useEffect(() => {
-    if (mapData && canvasRef.current) {
-      const canvas = canvasRef.current;
-      const ctx = canvas.getContext("2d");
-      if (!ctx) return;
-
-      canvas.width = mapData.width;
-      canvas.height = mapData.height;
-
-      const img = new Image();
-      img.onload = () => {
-        ctx.drawImage(img, 0, 0, canvas.width, canvas.height);
-      };
-      img.src = mapData.imageData;
-    }
+    if (!mapData || !mapData.imageUrl || !canvasRef.current) return;
+
+    const canvas = canvasRef.current;
+    const ctx = canvas.getContext("2d");
+    if (!ctx) return;
+
+    canvas.width = mapData.width;
+    canvas.height = mapData.height;
+
+    // The image endpoint needs the Authorization header, which an <img>
+    // src can't send, so fetch it and draw from an object URL.
+    const token = localStorage.getItem("token");
+    const apiHost = process.env.NEXT_PUBLIC_API_GATEWAY_URL;
+    let objectUrl: string | null = null;
+
+    const loadImage = async () => {
+      try {
+        const response = await fetch(`${apiHost}${mapData.imageUrl}`, {
+          headers: {
+            Authorization: `Bearer ${token}`,
+          },
+        });
+        if (!response.ok) {
+          throw new Error(`HTTP error! status: ${response.status}`);
+        }
+
+        objectUrl = URL.createObjectURL(await response.blob());
+        const img = new Image();
+        img.onload = () => {
+          ctx.drawImage(img, 0, 0, canvas.width, canvas.height);
+        };
+        img.src = objectUrl;
+      } catch (err) {
+        console.error("Error fetching map image:", err);
+      }
+    };
+
+    loadImage();
+    return () => {
+      if (objectUrl) {
+        URL.revokeObjectURL(objectUrl);
+      }
+    };
   }, [mapData]);
 
   const handleDelete = async () => {
     if (
       !window.confirm(
-        "Are you sure you want to delete this map? This action cannot be undone."
+        "Move this map to the trash? You can restore it from the trash until it is purged."
       )
     ) {
       return;
@@ -117,6 +148,40 @@ export default function MapView() {
     }
   };
 
+  const handleShare = async () => {
+    const token = localStorage.getItem("token");
+    const apiHost = process.env.NEXT_PUBLIC_API_GATEWAY_URL;
+
+    if (!token || !apiHost) {
+      setError("Authentication error");
+      return;
+    }
+
+    try {
+      const response = await fetch(
+        `${apiHost}/api/v1/maps/${params.id}/share-links`,
+        {
+          method: "POST",
+          headers: {
+            Authorization: `Bearer ${token}`,
+            "Content-Type": "application/json",
+          },
+          body: JSON.stringify({}),
+        }
+      );
+
+      if (!response.ok) {
+        throw new Error(`HTTP error! status: ${response.status}`);
+      }
+
+      const link = await response.json();
+      setShareUrl(`${window.location.origin}/share/${link.token}`);
+    } catch (err) {
+      console.error("Error creating share link:", err);
+      setError("Failed to create share link. Please try again later.");
+    }
+  };
+
   if (isLoading) {
     return (
       <div className="flex justify-center items-center min-h-screen">
@@ -154,34 +219,55 @@ export default function MapView() {
                 Created on: {new Date(mapData.createdAt).toLocaleDateString()}
               </p>
             </div>
-            <button
-              onClick={handleDelete}
-              disabled={isDeleting}
-              className={`flex items-center gap-2 px-4 py-2 rounded-lg 
-                ${
-                  isDeleting
-                    ? "bg-gray-300 cursor-not-allowed"
-                    : "bg-red-500 hover:bg-red-600"
-                } 
-                text-white transition-colors`}
-            >
-              <svg
-                className="w-5 h-5"
-                fill="none"
-                stroke="currentColor"
-                viewBox="0 0 24 24"
-                xmlns="http://www.w3.org/2000/svg"
-              >
-                <path
-                  strokeLinecap="round"
-                  strokeLinejoin="round"
-                  strokeWidth={2}
-                  d="M19 7l-.867 12.142A2 2 0 0116.138 21H7.862a2 2 0 01-1.995-1.858L5 7m5 4v6m4-6v6m1-10V4a1 1 0 00-1-1h-4a1 1 0 00-1 1v3M4 7h16"
-                />
-              </svg>
-              {isDeleting ? "Deleting..." : "Delete Map"}
-            </button>
+            {mapData.access === "owner" && (
+              <div className="flex gap-2">
+                <button
+                  onClick={handleShare}
+                  className="px-4 py-2 rounded-lg bg-blue-500 hover:bg-blue-600 text-white transition-colors"
+                >
+                  Share Link
+                </button>
+                <button
+                  onClick={handleDelete}
+                  disabled={isDeleting}
+                  className={`flex items-center gap-2 px-4 py-2 rounded-lg 
+                    ${
+                      isDeleting
+                        ? "bg-gray-300 cursor-not-allowed"
+                        : "bg-red-500 hover:bg-red-600"
+                    } 
+                    text-white transition-colors`}
+                >
+                  <svg
+                    className="w-5 h-5"
+                    fill="none"
+                    stroke="currentColor"
+                    viewBox="0 0 24 24"
+                    xmlns="http://www.w3.org/2000/svg"
+                  >
+                    <path
+                      strokeLinecap="round"
+                      strokeLinejoin="round"
+                      strokeWidth={2}
+                      d="M19 7l-.867 12.142A2 2 0 0116.138 21H7.862a2 2 0 01-1.995-1.858L5 7m5 4v6m4-6v6m1-10V4a1 1 0 00-1-1h-4a1 1 0 00-1 1v3M4 7h16"
+                    />
+                  </svg>
+                  {isDeleting ? "Deleting..." : "Delete Map"}
+                </button>
+              </div>
+            )}
           </div>
+          {shareUrl && (
+            <div className="mb-4 text-sm text-gray-700">
+              Anyone with this link can view the map:{" "}
+              <input
+                readOnly
+                value={shareUrl}
+                onFocus={(e) => e.target.select()}
+                className="w-full mt-1 px-2 py-1 border border-gray-300 rounded"
+              />
+            </div>
+          )}
           <div className="relative w-full overflow-auto">
             <canvas
               ref={canvasRef}
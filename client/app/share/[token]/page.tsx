@@ -0,0 +1,115 @@
+"use client";
+import { useEffect, useState, useRef } from "react";
+import { useParams } from "next/navigation";
+
+interface SharedMap {
+  name: string;
+  ownerName?: string;
+  imageUrl?: string;
+  width: number;
+  height: number;
+  createdAt: string;
+}
+
+// SharedMapView shows a map opened through a share link. It needs no
+// login: the token in the URL is what grants access.
+export default function SharedMapView() {
+  const params = useParams();
+  const [mapData, setMapData] = useState<SharedMap | null>(null);
+  const [error, setError] = useState<string>("");
+  const [isLoading, setIsLoading] = useState(true);
+  const canvasRef = useRef<HTMLCanvasElement>(null);
+
+  useEffect(() => {
+    const fetchMapData = async () => {
+      const apiHost = process.env.NEXT_PUBLIC_API_GATEWAY_URL;
+      if (!apiHost) {
+        throw new Error("API host is not defined");
+      }
+
+      try {
+        const response = await fetch(
+          `${apiHost}/api/v1/public/maps/${params.token}`
+        );
+
+        if (response.status === 404) {
+          setError("This link has expired or been revoked.");
+          return;
+        }
+        if (!response.ok) {
+          throw new Error(`HTTP error! status: ${response.status}`);
+        }
+
+        setMapData(await response.json());
+      } catch (err) {
+        console.error("Error fetching shared map:", err);
+        setError("Failed to load map. Please try again later.");
+      } finally {
+        setIsLoading(false);
+      }
+    };
+
+    fetchMapData();
+  }, [params.token]);
+
+  useEffect(() => {
+    if (!mapData || !mapData.imageUrl || !canvasRef.current) return;
+
+    const canvas = canvasRef.current;
+    const ctx = canvas.getContext("2d");
+    if (!ctx) return;
+
+    canvas.width = mapData.width;
+    canvas.height = mapData.height;
+
+    const img = new Image();
+    img.onload = () => {
+      ctx.drawImage(img, 0, 0, canvas.width, canvas.height);
+    };
+    img.src = `${process.env.NEXT_PUBLIC_API_GATEWAY_URL}${mapData.imageUrl}`;
+  }, [mapData]);
+
+  if (isLoading) {
+    return (
+      <div className="flex justify-center items-center min-h-screen">
+        <div className="animate-spin rounded-full h-12 w-12 border-t-2 border-b-2 border-blue-500"></div>
+      </div>
+    );
+  }
+
+  if (error || !mapData) {
+    return (
+      <div className="flex justify-center items-center min-h-screen">
+        <div className="bg-red-100 border border-red-400 text-red-700 px-4 py-3 rounded">
+          {error || "Map not found"}
+        </div>
+      </div>
+    );
+  }
+
+  return (
+    <div className="min-h-screen p-8">
+      <div className="max-w-4xl mx-auto">
+        <div className="bg-white rounded-lg shadow-lg p-6">
+          <div className="mb-4">
+            <h1 className="text-2xl font-bold">{mapData.name}</h1>
+            <p className="text-gray-600">
+              {mapData.ownerName ? `Shared by ${mapData.ownerName} · ` : ""}
+              Created on: {new Date(mapData.createdAt).toLocaleDateString()}
+            </p>
+          </div>
+          <div className="relative w-full overflow-auto">
+            <canvas
+              ref={canvasRef}
+              className="border border-gray-200 rounded mx-auto"
+              style={{
+                maxWidth: "100%",
+                height: "auto",
+              }}
+            />
+          </div>
+        </div>
+      </div>
+    </div>
+  );
+}
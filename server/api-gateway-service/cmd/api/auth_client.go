@@ -0,0 +1,21 @@
+package main
+
+import (
+	authpb "contracts/auth"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// authClient calls the authentication service's gRPC API. The connection
+// is established lazily, so the gateway starts even if auth is not up yet.
+var authClient authpb.AuthServiceClient
+
+func connectToAuth(addr string) (*grpc.ClientConn, error) {
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, err
+	}
+	authClient = authpb.NewAuthServiceClient(conn)
+	return conn, nil
+}
@@ -3,12 +3,18 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
+
+	authpb "contracts/auth"
 )
 
 func handleMapColoring(w http.ResponseWriter, r *http.Request) {
@@ -116,12 +122,10 @@ func handleMapStorage(w http.ResponseWriter, r *http.Request) {
 	baseURL := config.MapStorageService + r.URL.Path
 	targetURL := baseURL
 
-	// If it's a GET request, append any query parameters
-	if r.Method == http.MethodGet {
-		queryParams := r.URL.Query()
-		if len(queryParams) > 0 {
-			targetURL = fmt.Sprintf("%s?%s", baseURL, queryParams.Encode())
-		}
+	// Append any query parameters, e.g. ?permanent=true on DELETE
+	queryParams := r.URL.Query()
+	if len(queryParams) > 0 {
+		targetURL = fmt.Sprintf("%s?%s", baseURL, queryParams.Encode())
 	}
 
 	log.Printf("Forwarding request to map storage service: %s", targetURL)
@@ -138,13 +142,23 @@ func handleMapStorage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Copy headers
-	req.Header = r.Header
+	// Copy headers. The map storage service trusts X-User-ID to say who is
+	// calling, so it is only ever set from the verified token; requests on
+	// public routes go without one.
+	req.Header = r.Header.Clone()
+	req.Header.Del("X-User-ID")
+	if info, ok := tokenInfoFrom(r); ok {
+		req.Header.Set("X-User-ID", strconv.Itoa(info.UserID))
+	}
 	log.Printf("Request headers: %v", req.Header)
 
-	// Send request
+	// Send request. Archives can take a while to stream either way.
+	timeout := 10 * time.Second
+	if r.URL.Path == "/api/v1/maps/export" || r.URL.Path == "/api/v1/maps/import" {
+		timeout = 10 * time.Minute
+	}
 	client := &http.Client{
-		Timeout: 10 * time.Second,
+		Timeout: timeout,
 	}
 
 	resp, err := client.Do(req)
@@ -170,25 +184,38 @@ func handleMapStorage(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func verifyToken(token string) bool {
-	config, _ := loadConfig()
+// TokenInfo is the auth service's view of a token's session.
+type TokenInfo struct {
+	Valid         bool     `json:"valid"`
+	UserID        int      `json:"user_id"`
+	EmailVerified bool     `json:"email_verified"`
+	Roles         []string `json:"roles"`
+}
 
-	req, err := http.NewRequest("POST", config.AuthService+"/auth/verify", nil)
-	if err != nil {
-		return false
+func verifyToken(token string) (*TokenInfo, bool) {
+	// Reject forged or expired tokens locally before asking the auth
+	// service whether the session is still active.
+	if _, err := jwksCache.parseToken(token); err != nil {
+		log.Printf("Token signature verification failed: %v", err)
+		return nil, false
 	}
 
-	// Add "Bearer" prefix to the token
-	req.Header.Set("Authorization", "Bearer "+token)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := authClient.VerifyToken(ctx, &authpb.VerifyTokenRequest{Token: token})
 	if err != nil {
-		return false
+		log.Printf("Error verifying token with auth service: %v", err)
+		return nil, false
 	}
-	defer resp.Body.Close()
 
-	return resp.StatusCode == http.StatusOK
+	info := &TokenInfo{
+		Valid:         resp.Valid,
+		UserID:        int(resp.UserId),
+		EmailVerified: resp.EmailVerified,
+		Roles:         resp.Roles,
+	}
+	return info, info.Valid
 }
 
 func handleRegister(w http.ResponseWriter, r *http.Request) {
@@ -222,11 +249,18 @@ func handleRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	resp, err := http.Post(
-		config.AuthService+"/auth/register",
-		"application/json",
-		bytes.NewBuffer(jsonData),
-	)
+	req, err := http.NewRequest("POST", config.AuthService+"/auth/register", bytes.NewBuffer(jsonData))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Failed to create request",
+		})
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	forwardClientInfo(req, r)
+
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		w.WriteHeader(http.StatusServiceUnavailable)
 		json.NewEncoder(w).Encode(map[string]string{
@@ -266,11 +300,16 @@ func handleLogin(w http.ResponseWriter, r *http.Request) {
 
 	// Forward the request to auth service
 	log.Printf("Forwarding request to auth service: %s", config.AuthService+"/auth/login")
-	resp, err := http.Post(
-		config.AuthService+"/auth/login",
-		"application/json",
-		r.Body,
-	)
+	req, err := http.NewRequest("POST", config.AuthService+"/auth/login", r.Body)
+	if err != nil {
+		http.Error(w, "Failed to create request", http.StatusInternalServerError)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	forwardClientInfo(req, r)
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
 	if err != nil {
 		http.Error(w, "Failed to connect to auth service", http.StatusServiceUnavailable)
 		return
@@ -299,6 +338,7 @@ func handleLogout(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	req.Header.Set("Authorization", token)
+	forwardClientInfo(req, r)
 
 	// Send request to auth service
 	client := &http.Client{}
@@ -313,3 +353,89 @@ func handleLogout(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(resp.StatusCode)
 	io.Copy(w, resp.Body)
 }
+
+// handleAuthProxy forwards a request under /api/v1/auth/ to the same path on
+// the auth service, passing the body, query string and credentials through.
+func handleAuthProxy(w http.ResponseWriter, r *http.Request) {
+	proxyToAuth(w, r, strings.TrimPrefix(r.URL.Path, "/api/v1"))
+}
+
+// handleAdminProxy forwards /api/v1/admin/* to the auth service's
+// /auth/admin/* endpoints.
+func handleAdminProxy(w http.ResponseWriter, r *http.Request) {
+	proxyToAuth(w, r, "/auth"+strings.TrimPrefix(r.URL.Path, "/api/v1"))
+}
+
+func proxyToAuth(w http.ResponseWriter, r *http.Request, path string) {
+	config, _ := loadConfig()
+
+	targetURL := config.AuthService + path
+	if r.URL.RawQuery != "" {
+		targetURL += "?" + r.URL.RawQuery
+	}
+
+	req, err := http.NewRequest(r.Method, targetURL, r.Body)
+	if err != nil {
+		http.Error(w, "Failed to create request", http.StatusInternalServerError)
+		return
+	}
+
+	for _, header := range []string{"Authorization", "Content-Type"} {
+		if value := r.Header.Get(header); value != "" {
+			req.Header.Set(header, value)
+		}
+	}
+	forwardClientInfo(req, r)
+
+	// Redirects (e.g. to an identity provider) are meant for the browser.
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		http.Error(w, "Failed to connect to auth service", http.StatusServiceUnavailable)
+		return
+	}
+	defer resp.Body.Close()
+
+	for key, values := range resp.Header {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// clientIP returns the caller's address. Proxy headers are only honoured
+// when the gateway sits behind a trusted proxy such as the ingress.
+func clientIP(r *http.Request) string {
+	config, _ := loadConfig()
+	if config.TrustProxyHeaders {
+		if ip := r.Header.Get("X-Real-IP"); ip != "" {
+			return ip
+		}
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// forwardClientInfo passes the caller's address and user agent on to a
+// backend, which would otherwise only see the gateway.
+func forwardClientInfo(dst, src *http.Request) {
+	dst.Header.Set("X-Real-IP", clientIP(src))
+	if ua := src.Header.Get("User-Agent"); ua != "" {
+		dst.Header.Set("User-Agent", ua)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// jwksRefreshInterval bounds how stale the cached key set may get, and
+// jwksMinRefreshInterval limits refetches triggered by unknown kids so that
+// forged tokens cannot be used to hammer the auth service.
+const (
+	jwksRefreshInterval    = 5 * time.Minute
+	jwksMinRefreshInterval = 30 * time.Second
+)
+
+type Claims struct {
+	UserID  int    `json:"user_id"`
+	Purpose string `json:"purpose,omitempty"`
+	jwt.StandardClaims
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// JWKSCache holds the auth service's public signing keys. The gateway never
+// sees a private key or shared secret.
+type JWKSCache struct {
+	url string
+
+	mu          sync.RWMutex
+	keys        map[string]*rsa.PublicKey
+	lastFetched time.Time
+}
+
+var jwksCache *JWKSCache
+
+func newJWKSCache(authServiceURL string) *JWKSCache {
+	return &JWKSCache{
+		url:  authServiceURL + "/auth/.well-known/jwks.json",
+		keys: make(map[string]*rsa.PublicKey),
+	}
+}
+
+func (c *JWKSCache) refresh() error {
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(c.url)
+	if err != nil {
+		return fmt.Errorf("failed to fetch JWKS: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("JWKS endpoint returned status %d", resp.StatusCode)
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return fmt.Errorf("failed to decode JWKS: %v", err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return fmt.Errorf("invalid modulus for key %s: %v", k.Kid, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return fmt.Errorf("invalid exponent for key %s: %v", k.Kid, err)
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+
+	c.mu.Lock()
+	c.keys = keys
+	c.lastFetched = time.Now()
+	c.mu.Unlock()
+
+	return nil
+}
+
+func (c *JWKSCache) key(kid string) (*rsa.PublicKey, error) {
+	c.mu.RLock()
+	key, ok := c.keys[kid]
+	sinceFetch := time.Since(c.lastFetched)
+	c.mu.RUnlock()
+
+	if ok && sinceFetch < jwksRefreshInterval {
+		return key, nil
+	}
+
+	// Unknown kid (likely a freshly rotated key) or a stale cache.
+	if !ok && sinceFetch < jwksMinRefreshInterval {
+		return nil, fmt.Errorf("unknown signing key %s", kid)
+	}
+	if err := c.refresh(); err != nil {
+		if ok {
+			// Keep serving from the cache while the auth service is unreachable.
+			return key, nil
+		}
+		return nil, err
+	}
+
+	c.mu.RLock()
+	key, ok = c.keys[kid]
+	c.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %s", kid)
+	}
+	return key, nil
+}
+
+// parseToken checks the token's signature and expiry against the cached
+// public keys.
+func (c *JWKSCache) parseToken(tokenString string) (*Claims, error) {
+	claims := &Claims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		kid, _ := token.Header["kid"].(string)
+		if kid == "" {
+			return nil, errors.New("token has no kid header")
+		}
+		return c.key(kid)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, errors.New("invalid token")
+	}
+	// Restricted tokens such as login challenges are not sessions.
+	if claims.Purpose != "" {
+		return nil, fmt.Errorf("%s token cannot be used as a session", claims.Purpose)
+	}
+
+	return claims, nil
+}
@@ -21,7 +21,9 @@ type AppConfig struct {
 	Port              string
 	ColoringService   string
 	AuthService       string
+	AuthGRPCService   string
 	MapStorageService string
+	TrustProxyHeaders bool
 }
 
 func loadConfig() (*AppConfig, error) {
@@ -33,7 +35,9 @@ func loadConfig() (*AppConfig, error) {
 		Port:              getEnvOrDefault("PORT", "80"),
 		ColoringService:   getEnvOrDefault("COLORING_SERVICE_URL", "http://solver-service"),
 		AuthService:       getEnvOrDefault("AUTHENTICATION_SERVICE_URL", "http://authentication-service"),
+		AuthGRPCService:   getEnvOrDefault("AUTHENTICATION_SERVICE_GRPC_ADDR", "authentication-service:50051"),
 		MapStorageService: getEnvOrDefault("MAP_STORAGE_SERVICE_URL", "http://map-storage-service"),
+		TrustProxyHeaders: os.Getenv("TRUST_PROXY_HEADERS") == "true",
 	}, nil
 }
 
@@ -52,14 +56,62 @@ func setupRoutes(router *mux.Router) {
 	}).Methods("GET", "OPTIONS")
 	router.HandleFunc("/api/v1/auth/register", handleRegister).Methods("POST", "OPTIONS")
 	router.HandleFunc("/api/v1/auth/login", handleLogin).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/v1/auth/login/2fa", handleAuthProxy).Methods("POST", "OPTIONS")
 	router.HandleFunc("/api/v1/auth/logout", handleLogout).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/v1/auth/sessions", handleAuthProxy).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/v1/auth/sessions/revoke-others", handleAuthProxy).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/v1/auth/sessions/{id:[0-9]+}", handleAuthProxy).Methods("PATCH", "DELETE", "OPTIONS")
+	router.HandleFunc("/api/v1/auth/me", handleAuthProxy).Methods("GET", "PATCH", "DELETE", "OPTIONS")
+	router.HandleFunc("/api/v1/auth/me/password", handleAuthProxy).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/v1/auth/.well-known/jwks.json", handleAuthProxy).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/v1/auth/password/forgot", handleAuthProxy).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/v1/auth/password/reset", handleAuthProxy).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/v1/auth/verify-email", handleAuthProxy).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/v1/auth/verify-email/resend", handleAuthProxy).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/v1/auth/oidc/{provider}/login", handleAuthProxy).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/v1/auth/oidc/{provider}/callback", handleAuthProxy).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/v1/auth/2fa/{action:enroll|confirm|disable}", handleAuthProxy).Methods("POST", "OPTIONS")
+
+	// Admin routes (protected, admin role)
+	admin := Policy{AnyRole: []string{"admin"}}
+	router.HandleFunc("/api/v1/admin/users", withPolicy(admin, handleAdminProxy)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/v1/admin/users/{id:[0-9]+}/roles", withPolicy(admin, handleAdminProxy)).Methods("PUT", "OPTIONS")
+	router.HandleFunc("/api/v1/admin/roles", withPolicy(admin, handleAdminProxy)).Methods("GET", "POST", "OPTIONS")
+	router.HandleFunc("/api/v1/admin/unlock", withPolicy(admin, handleAdminProxy)).Methods("POST", "OPTIONS")
 
 	// Map solver routes (protected)
 	router.HandleFunc("/api/v1/maps/color", handleMapColoring).Methods("POST", "OPTIONS")
 
 	// Map storage routes (protected)
 	router.HandleFunc("/api/v1/maps", handleMapStorage).Methods("POST", "GET", "OPTIONS")
-	router.HandleFunc("/api/v1/maps/{id}", handleMapStorage).Methods("GET", "PUT", "DELETE", "OPTIONS")
+	router.HandleFunc("/api/v1/maps/trash", handleMapStorage).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/v1/maps/shared-with-me", handleMapStorage).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/v1/maps/export", handleMapStorage).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/v1/maps/import", handleMapStorage).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/v1/maps/{id}", handleMapStorage).Methods("GET", "PUT", "PATCH", "DELETE", "OPTIONS")
+	router.HandleFunc("/api/v1/maps/{id}/restore", handleMapStorage).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/v1/maps/{id}/image", handleMapStorage).Methods("GET", "PUT", "OPTIONS")
+	router.HandleFunc("/api/v1/maps/{id}/thumbnail", handleMapStorage).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/v1/maps/{id}/revisions", handleMapStorage).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/v1/maps/{id}/revisions/{rev:[0-9]+}", handleMapStorage).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/v1/maps/{id}/revisions/{rev:[0-9]+}/image", handleMapStorage).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/v1/maps/{id}/revisions/{rev:[0-9]+}/diff", handleMapStorage).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/v1/maps/{id}/revisions/{rev:[0-9]+}/restore", handleMapStorage).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/v1/maps/{id}/folder", handleMapStorage).Methods("PUT", "OPTIONS")
+	router.HandleFunc("/api/v1/maps/{id}/tags", handleMapStorage).Methods("PUT", "OPTIONS")
+	router.HandleFunc("/api/v1/maps/{id}/share-links", handleMapStorage).Methods("GET", "POST", "OPTIONS")
+	router.HandleFunc("/api/v1/maps/{id}/share-links/{linkId}", handleMapStorage).Methods("DELETE", "OPTIONS")
+	router.HandleFunc("/api/v1/maps/{id}/grants", handleMapStorage).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/v1/maps/{id}/grants/{userId:[0-9]+}", handleMapStorage).Methods("PUT", "DELETE", "OPTIONS")
+
+	router.HandleFunc("/api/v1/folders", handleMapStorage).Methods("GET", "POST", "OPTIONS")
+	router.HandleFunc("/api/v1/folders/{id}", handleMapStorage).Methods("PATCH", "DELETE", "OPTIONS")
+	router.HandleFunc("/api/v1/tags", handleMapStorage).Methods("GET", "OPTIONS")
+
+	// Shared map routes (public, read-only)
+	router.HandleFunc("/api/v1/public/maps/{token}", handleMapStorage).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/v1/public/maps/{token}/image", handleMapStorage).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/v1/public/maps/{token}/thumbnail", handleMapStorage).Methods("GET", "OPTIONS")
 }
 
 func main() {
@@ -68,6 +120,17 @@ func main() {
 		log.Fatal("Failed to load configuration:", err)
 	}
 
+	jwksCache = newJWKSCache(config.AuthService)
+	if err := jwksCache.refresh(); err != nil {
+		log.Printf("Warning: failed to prefetch signing keys: %v", err)
+	}
+
+	authConn, err := connectToAuth(config.AuthGRPCService)
+	if err != nil {
+		log.Fatal("Failed to set up auth service client:", err)
+	}
+	defer authConn.Close()
+
 	router := mux.NewRouter()
 
 	// Apply CORS middleware first
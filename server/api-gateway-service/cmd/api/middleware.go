@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net/http"
 	"strings"
@@ -19,8 +20,9 @@ func loggingMiddleware(next http.Handler) http.Handler {
 func corsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, Authorization")
+		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, PATCH, DELETE")
+		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, Authorization, If-Match")
+		w.Header().Set("Access-Control-Expose-Headers", "ETag, Content-Disposition")
 
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
@@ -39,6 +41,12 @@ func authMiddleware(next http.Handler) http.Handler {
 			return
 		}
 
+		// Shared maps are readable by anyone holding the link's token
+		if strings.HasPrefix(r.URL.Path, "/api/v1/public/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
 		if strings.HasPrefix((r.URL.Path), "/healthcheck") {
 			next.ServeHTTP(w, r)
 			return
@@ -58,11 +66,31 @@ func authMiddleware(next http.Handler) http.Handler {
 		}
 		token := parts[1]
 
-		if !verifyToken(token) {
+		info, ok := verifyToken(token)
+		if !ok {
 			http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
 			return
 		}
+		r = r.WithContext(context.WithValue(r.Context(), tokenInfoKey{}, info))
+
+		// Users who have not confirmed their email may use the solver but
+		// cannot store or change maps.
+		if !info.EmailVerified && isMapStorageWrite(r) {
+			http.Error(w, "Verify your email address to save maps", http.StatusForbidden)
+			return
+		}
 
 		next.ServeHTTP(w, r)
 	})
 }
+
+func isMapStorageWrite(r *http.Request) bool {
+	if r.Method == http.MethodGet || r.Method == http.MethodOptions {
+		return false
+	}
+	if r.URL.Path == "/api/v1/maps/color" {
+		return false
+	}
+	return r.URL.Path == "/api/v1/maps" || strings.HasPrefix(r.URL.Path, "/api/v1/maps/") ||
+		r.URL.Path == "/api/v1/folders" || strings.HasPrefix(r.URL.Path, "/api/v1/folders/")
+}
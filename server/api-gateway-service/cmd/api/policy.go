@@ -0,0 +1,52 @@
+package main
+
+import "net/http"
+
+// tokenInfoKey is the request context key under which authMiddleware stores
+// the caller's *TokenInfo.
+type tokenInfoKey struct{}
+
+func tokenInfoFrom(r *http.Request) (*TokenInfo, bool) {
+	info, ok := r.Context().Value(tokenInfoKey{}).(*TokenInfo)
+	return info, ok
+}
+
+// Policy declares who may call a route, on top of the authentication every
+// protected route gets from authMiddleware. Routes without a policy are open
+// to any signed-in user.
+type Policy struct {
+	// AnyRole lists roles of which the caller needs at least one.
+	AnyRole []string
+}
+
+func (p Policy) allows(info *TokenInfo) bool {
+	if len(p.AnyRole) == 0 {
+		return true
+	}
+	for _, want := range p.AnyRole {
+		for _, have := range info.Roles {
+			if have == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// withPolicy wraps a route's handler so that only callers satisfying p reach
+// it. Roles come from the auth service's verify response, so changes apply
+// without waiting for the token to be refreshed.
+func withPolicy(p Policy, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		info, ok := tokenInfoFrom(r)
+		if !ok {
+			http.Error(w, "No authorization token provided", http.StatusUnauthorized)
+			return
+		}
+		if !p.allows(info) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
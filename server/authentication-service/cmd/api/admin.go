@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var roleName = regexp.MustCompile(`^[a-z][a-z0-9_-]{1,63}$`)
+
+type CreateRoleRequest struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+type SetRolesRequest struct {
+	Roles []string `json:"roles"`
+}
+
+// requireRole authenticates the request and checks that the caller holds
+// role. Roles are read from the database rather than the token, so a
+// revoked role stops working immediately. On failure it writes the response
+// and returns false.
+func (app *App) requireRole(w http.ResponseWriter, r *http.Request, role string) (User, bool) {
+	claims, err := app.authenticate(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Authentication required"})
+		return User{}, false
+	}
+
+	user, err := app.users.ByID(claims.UserID)
+	if err != nil {
+		log.Printf("Error loading user %d: %v", claims.UserID, err)
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Authentication required"})
+		return User{}, false
+	}
+
+	if !hasRole(user.Roles, role) {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Forbidden"})
+		return User{}, false
+	}
+	return user, true
+}
+
+func (app *App) handleListUsers(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if _, ok := app.requireRole(w, r, roleAdmin); !ok {
+		return
+	}
+
+	users, err := app.users.List()
+	if err != nil {
+		log.Printf("Error listing users: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Error listing users"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(users)
+}
+
+// handleSetUserRoles replaces the roles of the user in the {id} route
+// variable. Admins cannot remove their own admin role, so there is always
+// someone left who can undo a mistake.
+func (app *App) handleSetUserRoles(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	admin, ok := app.requireRole(w, r, roleAdmin)
+	if !ok {
+		return
+	}
+
+	userID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "User not found"})
+		return
+	}
+
+	var req SetRolesRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Roles == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Roles are required"})
+		return
+	}
+
+	if userID == admin.ID && !hasRole(req.Roles, roleAdmin) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "You cannot remove your own admin role"})
+		return
+	}
+
+	err = app.users.SetRoles(userID, req.Roles)
+	switch {
+	case err == errNotFound:
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "User not found"})
+		return
+	case err == errUnknownRole:
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Unknown role"})
+		return
+	case err != nil:
+		log.Printf("Error setting roles for user %d: %v", userID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Error updating roles"})
+		return
+	}
+
+	app.audit.Log(r, AuthLog{
+		EventType:   "roles_changed",
+		UserID:      fmt.Sprint(userID),
+		Description: "User roles changed by an administrator",
+		Severity:    1,
+		Metadata: map[string]string{
+			"admin_id": fmt.Sprint(admin.ID),
+			"roles":    strings.Join(req.Roles, ","),
+		},
+	})
+
+	user, err := app.users.ByID(userID)
+	if err != nil {
+		log.Printf("Error loading user %d: %v", userID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Error loading user"})
+		return
+	}
+	json.NewEncoder(w).Encode(user)
+}
+
+func (app *App) handleListRoles(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if _, ok := app.requireRole(w, r, roleAdmin); !ok {
+		return
+	}
+
+	roles, err := app.users.Roles()
+	if err != nil {
+		log.Printf("Error listing roles: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Error listing roles"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(roles)
+}
+
+func (app *App) handleCreateRole(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if _, ok := app.requireRole(w, r, roleAdmin); !ok {
+		return
+	}
+
+	var req CreateRoleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || !roleName.MatchString(req.Name) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Role names are 2-64 lowercase letters, digits, '-' or '_'",
+		})
+		return
+	}
+
+	role := Role{Name: req.Name, Description: strings.TrimSpace(req.Description)}
+	err := app.users.CreateRole(role)
+	if err == errDuplicateRole {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Role already exists"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error creating role: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Error creating role"})
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(role)
+}
+
+// runCreateAdminCommand implements "create-admin -email ADDRESS [-name NAME]",
+// which bootstraps the first administrator. An existing account is granted
+// the admin role; otherwise an account is created with the password from
+// ADMIN_PASSWORD, which is read from the environment to keep it out of the
+// shell history.
+func runCreateAdminCommand(users UserStore, args []string) error {
+	flags := flag.NewFlagSet("create-admin", flag.ContinueOnError)
+	email := flags.String("email", "", "email address of the administrator")
+	name := flags.String("name", "", "display name for a new account")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if !validEmail(*email) {
+		return fmt.Errorf("a valid -email is required")
+	}
+
+	user, err := users.ByEmail(*email)
+	if err == errNotFound {
+		password := os.Getenv("ADMIN_PASSWORD")
+		if len(password) < 8 {
+			return fmt.Errorf("ADMIN_PASSWORD must be set to at least 8 characters to create a new account")
+		}
+
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return err
+		}
+		user = User{Email: *email, PasswordHash: string(hash), Name: *name, EmailVerified: true}
+		if err := users.Create(&user); err != nil {
+			return err
+		}
+		log.Printf("Created user %d (%s)", user.ID, user.Email)
+	} else if err != nil {
+		return err
+	}
+
+	if hasRole(user.Roles, roleAdmin) {
+		log.Printf("User %d (%s) is already an admin", user.ID, user.Email)
+		return nil
+	}
+
+	if err := users.SetRoles(user.ID, append(user.Roles, roleAdmin)); err != nil {
+		return err
+	}
+	log.Printf("Granted admin role to user %d (%s)", user.ID, user.Email)
+	return nil
+}
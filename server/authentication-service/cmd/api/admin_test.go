@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestHandleSetUserRoles(t *testing.T) {
+	app := newTestApp(t)
+	admin := app.createTestUser(t, "admin@example.com", true)
+	if err := app.users.SetRoles(admin.ID, []string{roleUser, roleAdmin}); err != nil {
+		t.Fatal(err)
+	}
+	member := app.createTestUser(t, "member@example.com", true)
+	if err := app.users.CreateRole(Role{Name: "editor"}); err != nil {
+		t.Fatal(err)
+	}
+
+	adminToken := app.login(t, admin.Email)
+	memberToken := app.login(t, member.Email)
+
+	tests := []struct {
+		name     string
+		token    string
+		userID   int
+		roles    []string
+		wantCode int
+	}{
+		{"not an admin", memberToken, member.ID, []string{roleUser, roleAdmin}, http.StatusForbidden},
+		{"grant custom role", adminToken, member.ID, []string{roleUser, "editor"}, http.StatusOK},
+		{"unknown role", adminToken, member.ID, []string{"superuser"}, http.StatusBadRequest},
+		{"unknown user", adminToken, 999, []string{roleUser}, http.StatusNotFound},
+		{"remove own admin role", adminToken, admin.ID, []string{roleUser}, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := func(w http.ResponseWriter, r *http.Request) {
+				r = mux.SetURLVars(r, map[string]string{"id": strconv.Itoa(tt.userID)})
+				app.handleSetUserRoles(w, r)
+			}
+
+			rec := call(handler, "PUT", tt.token, SetRolesRequest{Roles: tt.roles})
+			if rec.Code != tt.wantCode {
+				t.Fatalf("got status %d, want %d: %s", rec.Code, tt.wantCode, rec.Body)
+			}
+		})
+	}
+
+	user, _ := app.users.ByID(member.ID)
+	if !hasRole(user.Roles, "editor") || hasRole(user.Roles, roleAdmin) {
+		t.Errorf("unexpected roles %v", user.Roles)
+	}
+}
+
+func TestRunCreateAdminCommand(t *testing.T) {
+	users := newMemoryUserStore()
+	t.Setenv("ADMIN_PASSWORD", testPassword)
+
+	if err := runCreateAdminCommand(users, []string{"-email", "root@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	// Running it again is a no-op.
+	if err := runCreateAdminCommand(users, []string{"-email", "root@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := users.ByEmail("root@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !user.EmailVerified || !hasRole(user.Roles, roleAdmin) || !hasRole(user.Roles, roleUser) {
+		t.Errorf("unexpected admin account %+v", user)
+	}
+}
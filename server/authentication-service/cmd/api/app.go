@@ -1,8 +1,8 @@
 package main
 
 import (
-	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -14,7 +14,24 @@ import (
 )
 
 type App struct {
-	db *sql.DB
+	users     UserStore
+	twoFactor TwoFactorStore
+	sessions  SessionStore
+	attempts  LoginAttemptStore
+	keys      *KeyManager
+	mailer    Mailer
+	events    *EventPublisher
+	audit     *AuditLogger
+	publicURL string // base URL of the web client, used in emailed links
+
+	// allowUnverifiedLogin lets users sign in before confirming their email.
+	// Their tokens carry email_verified=false so other services can limit
+	// what they may do.
+	allowUnverifiedLogin bool
+
+	oidcProviders   map[string]*OIDCProvider
+	oidcStates      OIDCStateStore
+	oidcRedirectURL string // web client page that receives OIDC logins
 }
 
 type RegisterRequest struct {
@@ -29,11 +46,12 @@ type LoginRequest struct {
 }
 
 type TokenResponse struct {
-	Token     string `json:"token"`
-	Name      string `json:"name"`
-	UserID    int    `json:"user_id"`
-	Email     string `json:"email"`
-	ExpiresAt string `json:"expires_at"`
+	Token         string `json:"token"`
+	Name          string `json:"name"`
+	UserID        int    `json:"user_id"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	ExpiresAt     string `json:"expires_at"`
 }
 
 type RefreshResponse struct {
@@ -54,9 +72,6 @@ func (app *App) handleRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Print out the request body
-	fmt.Println("REQUEST BODY: ", req.Email, req.Password, req.Name)
-
 	// Validate input
 	if req.Email == "" || req.Password == "" {
 		w.WriteHeader(http.StatusBadRequest)
@@ -66,12 +81,10 @@ func (app *App) handleRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Check if database connection is alive
-	if err := app.db.Ping(); err != nil {
-		log.Printf("Database connection error: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
+	if !validEmail(req.Email) {
+		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode(map[string]string{
-			"error": "Database connection error",
+			"error": "Invalid email address",
 		})
 		return
 	}
@@ -88,40 +101,44 @@ func (app *App) handleRegister(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Insert user
-	var userID int
-	err = app.db.QueryRow(
-		`INSERT INTO users (email, password_hash, name) 
-         VALUES ($1, $2, $3) 
-         RETURNING id`,
-		req.Email,
-		string(hashedPassword),
-		req.Name,
-	).Scan(&userID)
+	user := User{
+		Email:        req.Email,
+		PasswordHash: string(hashedPassword),
+		Name:         req.Name,
+	}
+	err = app.users.Create(&user)
+
+	if err == errDuplicateEmail {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "User with this email already exists",
+		})
+		return
+	}
 
 	if err != nil {
 		log.Printf("Database error during user insertion: %v", err)
-
-		if strings.Contains(err.Error(), "unique constraint") ||
-			strings.Contains(err.Error(), "duplicate key") {
-			w.WriteHeader(http.StatusConflict)
-			json.NewEncoder(w).Encode(map[string]string{
-				"error": "User with this email already exists",
-			})
-			return
-		}
-
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(map[string]string{
-			"error":   "Failed to create user",
-			"details": err.Error(),
+			"error": "Failed to create user",
 		})
 		return
 	}
 
+	go app.sendEmailVerification(user)
+
+	app.audit.Log(r, AuthLog{
+		EventType:   "user_registered",
+		UserID:      strconv.Itoa(user.ID),
+		Description: "User registered with email and password",
+		Severity:    1,
+		Metadata:    map[string]string{"account": strings.ToLower(user.Email)},
+	})
+
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(map[string]string{
-		"message": "User created successfully",
-		"userId":  strconv.Itoa(userID),
+		"message": "User created successfully. Check your email to verify your account.",
+		"userId":  strconv.Itoa(user.ID),
 	})
 }
 
@@ -132,49 +149,121 @@ func (app *App) handleLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var user User
-	err := app.db.QueryRow(
-		"SELECT id, email, password_hash, name FROM users WHERE email = $1",
-		req.Email,
-	).Scan(&user.ID, &user.Email, &user.PasswordHash, &user.Name)
-
+	ip := clientIP(r)
+	until, err := app.lockedUntil(accountKey(req.Email), ipKey(ip))
 	if err != nil {
-		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		log.Printf("Error checking login lockout: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if !until.IsZero() {
+		// Name the account by ID as well when it exists, so the entry is
+		// pseudonymized with the rest of its logs if it is deleted.
+		locked, _ := app.users.ByEmail(req.Email)
+		app.auditLoginFailure(r, req.Email, locked.ID, "locked")
+		writeLocked(w, until)
 		return
 	}
 
-	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.Password)); err != nil {
+	user, err := app.users.ByEmail(req.Email)
+	if err != nil && err != errNotFound {
+		log.Printf("Database error during login: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// Always run bcrypt, against a dummy hash if there is no account or it
+	// has no password, so timing does not reveal which emails exist.
+	hash := []byte(user.PasswordHash)
+	if err == errNotFound || user.PasswordHash == "" {
+		hash = dummyPasswordHash
+	}
+	passwordErr := bcrypt.CompareHashAndPassword(hash, []byte(req.Password))
+
+	if err == errNotFound || user.PasswordHash == "" || passwordErr != nil {
+		reason := "invalid_password"
+		if err == errNotFound {
+			reason = "unknown_account"
+		}
+		app.auditLoginFailure(r, req.Email, user.ID, reason)
+		app.registerLoginFailure(r, req.Email, user.ID)
 		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
 		return
 	}
 
-	// Generate JWT token
-	token, expiresAt, err := generateToken(user.ID)
-	if err != nil {
-		http.Error(w, "Error generating token", http.StatusInternalServerError)
+	if err := app.clearFailures(accountKey(req.Email)); err != nil {
+		log.Printf("Error clearing failed logins: %v", err)
+	}
+
+	if !user.EmailVerified && !app.allowUnverifiedLogin {
+		http.Error(w, "Email address not verified", http.StatusForbidden)
 		return
 	}
 
-	// Store session
-	_, err = app.db.Exec(
-		"INSERT INTO sessions (user_id, token, expires_at) VALUES ($1, $2, $3)",
-		user.ID,
-		token,
-		expiresAt,
-	)
+	// With 2FA on, the password only earns a challenge token, which is
+	// exchanged for a session at /auth/login/2fa.
+	challenge, err := app.twoFactorChallenge(user.ID)
+	if err != nil {
+		log.Printf("Error starting 2FA challenge: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if challenge != nil {
+		json.NewEncoder(w).Encode(challenge)
+		return
+	}
 
+	resp, err := app.issueSession(user, r)
 	if err != nil {
+		log.Printf("Error creating session: %v", err)
 		http.Error(w, "Error creating session", http.StatusInternalServerError)
 		return
 	}
 
-	json.NewEncoder(w).Encode(TokenResponse{
-		Token:     token,
-		Name:      user.Name,
+	json.NewEncoder(w).Encode(resp)
+}
+
+// issueSession signs a token for an authenticated user and records the
+// session, along with the device it was created from. Every login method
+// ends here.
+func (app *App) issueSession(user User, r *http.Request) (TokenResponse, error) {
+	sessionID, hash, err := generateOpaqueToken()
+	if err != nil {
+		return TokenResponse{}, fmt.Errorf("error generating session id: %v", err)
+	}
+
+	token, expiresAt, err := app.keys.generateToken(user, sessionID)
+	if err != nil {
+		return TokenResponse{}, fmt.Errorf("error generating token: %v", err)
+	}
+
+	session := Session{
 		UserID:    user.ID,
-		Email:     user.Email,
-		ExpiresAt: expiresAt.Format(time.RFC3339),
+		Hash:      hash,
+		CreatedIP: clientIP(r),
+		UserAgent: truncate(r.UserAgent(), maxUserAgentLength),
+		ExpiresAt: expiresAt,
+	}
+	if err := app.sessions.Create(&session); err != nil {
+		return TokenResponse{}, fmt.Errorf("error storing session: %v", err)
+	}
+
+	app.audit.Log(r, AuthLog{
+		EventType:   "login_succeeded",
+		UserID:      strconv.Itoa(user.ID),
+		Description: "User signed in",
+		Severity:    1,
+		Metadata:    map[string]string{"session_id": strconv.Itoa(session.ID)},
 	})
+
+	return TokenResponse{
+		Token:         token,
+		Name:          user.Name,
+		UserID:        user.ID,
+		Email:         user.Email,
+		EmailVerified: user.EmailVerified,
+		ExpiresAt:     expiresAt.Format(time.RFC3339),
+	}, nil
 }
 
 func (app *App) handleVerifyToken(w http.ResponseWriter, r *http.Request) {
@@ -192,157 +281,213 @@ func (app *App) handleVerifyToken(w http.ResponseWriter, r *http.Request) {
 	}
 	token := parts[1]
 
-	// Verify token
-	claims, err := verifyToken(token)
-	if err != nil {
-		log.Printf("Token verification failed: %v", err)
-		http.Error(w, "Invalid token", http.StatusUnauthorized)
+	claims, user, err := app.verifySession(token)
+	if err == errNotAuthenticated {
+		http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
 		return
 	}
-
-	// Check if token exists in sessions
-	var exists bool
-	err = app.db.QueryRow(
-		"SELECT EXISTS(SELECT 1 FROM sessions WHERE token = $1 AND expires_at > NOW())",
-		token,
-	).Scan(&exists)
-
 	if err != nil {
 		log.Printf("Database error: %v", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
-	if !exists {
-		log.Printf("Token not found in sessions or expired")
-		http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
-		return
-	}
-
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"valid":   true,
-		"user_id": claims.UserID,
+		"valid":          true,
+		"user_id":        claims.UserID,
+		"email_verified": user.EmailVerified,
+		"roles":          user.Roles,
 	})
 }
 
+var errNotAuthenticated = errors.New("not authenticated")
+
+// verifySession checks a token's signature and that its session is still
+// active, and loads its user. The verification status and roles are read
+// from the user so changes take effect without a new token. It serves both
+// the HTTP and gRPC verify endpoints.
+func (app *App) verifySession(token string) (*Claims, User, error) {
+	claims, err := app.keys.verifyToken(token)
+	if err != nil {
+		log.Printf("Token verification failed: %v", err)
+		return nil, User{}, errNotAuthenticated
+	}
+
+	session, err := app.sessions.Active(sessionHash(claims, token))
+	if err == errNotFound {
+		log.Printf("Token not found in sessions or expired")
+		return nil, User{}, errNotAuthenticated
+	}
+	if err != nil {
+		return nil, User{}, err
+	}
+
+	user, err := app.users.ByID(session.UserID)
+	if err == errNotFound {
+		return nil, User{}, errNotAuthenticated
+	}
+	if err != nil {
+		return nil, User{}, err
+	}
+
+	app.touchSession(session.ID)
+	return claims, user, nil
+}
+
+// bearerToken extracts the token from a "Bearer <token>" Authorization
+// header.
+func bearerToken(r *http.Request) (string, bool) {
+	parts := strings.Split(r.Header.Get("Authorization"), " ")
+	if len(parts) != 2 || strings.ToLower(parts[0]) != "bearer" || parts[1] == "" {
+		return "", false
+	}
+	return parts[1], true
+}
+
+// authenticate returns the claims of the request's bearer token after
+// checking that its session is still active.
+func (app *App) authenticate(r *http.Request) (*Claims, error) {
+	claims, _, err := app.authenticateSession(r)
+	return claims, err
+}
+
+// authenticateSession is authenticate for handlers that also need the id of
+// the caller's session.
+func (app *App) authenticateSession(r *http.Request) (*Claims, int, error) {
+	token, ok := bearerToken(r)
+	if !ok {
+		return nil, 0, errNotAuthenticated
+	}
+
+	claims, err := app.keys.verifyToken(token)
+	if err != nil {
+		return nil, 0, errNotAuthenticated
+	}
+
+	session, err := app.sessions.Active(sessionHash(claims, token))
+	if err == errNotFound {
+		return nil, 0, errNotAuthenticated
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	app.touchSession(session.ID)
+	return claims, session.ID, nil
+}
+
 func (app *App) handleLogout(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
-	// Get and clean the token
-	authHeader := r.Header.Get("Authorization")
-	if authHeader == "" {
+	token, ok := bearerToken(r)
+	if !ok {
 		w.WriteHeader(http.StatusUnauthorized)
 		json.NewEncoder(w).Encode(map[string]string{"error": "No token provided"})
 		return
 	}
 
-	// Remove "Bearer " prefix if it exists
-	token := authHeader
-	if strings.HasPrefix(authHeader, "Bearer ") {
-		token = authHeader[7:] // Remove "Bearer " prefix
-	}
-
-	// Add logging to debug
-	log.Printf("Attempting to delete session with token: %s", token)
-
-	result, err := app.db.Exec("DELETE FROM sessions WHERE token = $1", token)
+	claims, err := app.keys.verifyToken(token)
 	if err != nil {
-		log.Printf("Error deleting session: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Error processing logout"})
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid token"})
 		return
 	}
 
-	// Check if any row was actually deleted
-	rowsAffected, err := result.RowsAffected()
+	deleted, err := app.sessions.Delete(sessionHash(claims, token))
 	if err != nil {
-		log.Printf("Error getting rows affected: %v", err)
+		log.Printf("Error deleting session: %v", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(map[string]string{"error": "Error processing logout"})
 		return
 	}
 
-	if rowsAffected == 0 {
-		log.Printf("No session found for token: %s", token)
+	if !deleted {
+		log.Printf("No session found for user %d", claims.UserID)
 		w.WriteHeader(http.StatusNotFound)
 		json.NewEncoder(w).Encode(map[string]string{"error": "Session not found"})
 		return
 	}
 
-	log.Printf("Successfully deleted session. Rows affected: %d", rowsAffected)
+	log.Printf("Successfully deleted session for user %d", claims.UserID)
+	app.audit.Log(r, AuthLog{
+		EventType:   "logout",
+		UserID:      strconv.Itoa(claims.UserID),
+		Description: "User signed out",
+		Severity:    1,
+	})
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]string{"message": "Logged out successfully"})
 }
 
 func (app *App) handleRefreshToken(w http.ResponseWriter, r *http.Request) {
-	oldToken := r.Header.Get("Authorization")
-	if oldToken == "" {
+	oldToken, ok := bearerToken(r)
+	if !ok {
 		http.Error(w, "No token provided", http.StatusUnauthorized)
 		return
 	}
 
 	// Verify old token
-	claims, err := verifyToken(oldToken)
+	claims, err := app.keys.verifyToken(oldToken)
 	if err != nil {
 		http.Error(w, "Invalid token", http.StatusUnauthorized)
 		return
 	}
 
 	// Check if old token exists in sessions and is still valid
-	var exists bool
-	err = app.db.QueryRow(
-		"SELECT EXISTS(SELECT 1 FROM sessions WHERE token = $1 AND expires_at > NOW())",
-		oldToken,
-	).Scan(&exists)
+	session, err := app.sessions.Active(sessionHash(claims, oldToken))
+	if err != nil {
+		http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+		return
+	}
 
-	if err != nil || !exists {
+	user, err := app.users.ByID(session.UserID)
+	if err != nil {
 		http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
 		return
 	}
 
 	// Generate new token
-	newToken, expiresAt, err := generateToken(claims.UserID)
+	sessionID, newHash, err := generateOpaqueToken()
 	if err != nil {
 		http.Error(w, "Error generating token", http.StatusInternalServerError)
 		return
 	}
-
-	// Start transaction
-	tx, err := app.db.Begin()
+	newToken, expiresAt, err := app.keys.generateToken(user, sessionID)
 	if err != nil {
-		http.Error(w, "Database error", http.StatusInternalServerError)
+		http.Error(w, "Error generating token", http.StatusInternalServerError)
 		return
 	}
-	defer tx.Rollback()
 
-	// Delete old session
-	_, err = tx.Exec("DELETE FROM sessions WHERE token = $1", oldToken)
-	if err != nil {
-		http.Error(w, "Error updating session", http.StatusInternalServerError)
+	// Rotate the token in place so the session keeps its id, label and
+	// device details.
+	err = app.sessions.Rotate(session.Hash, newHash, expiresAt)
+	if err == errNotFound {
+		http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
 		return
 	}
-
-	// Create new session
-	_, err = tx.Exec(
-		"INSERT INTO sessions (user_id, token, expires_at) VALUES ($1, $2, $3)",
-		claims.UserID,
-		newToken,
-		expiresAt,
-	)
 	if err != nil {
-		http.Error(w, "Error creating new session", http.StatusInternalServerError)
+		http.Error(w, "Error updating session", http.StatusInternalServerError)
 		return
 	}
 
-	// Commit transaction
-	if err = tx.Commit(); err != nil {
-		http.Error(w, "Error committing transaction", http.StatusInternalServerError)
-		return
-	}
+	app.audit.Log(r, AuthLog{
+		EventType:   "token_refreshed",
+		UserID:      strconv.Itoa(user.ID),
+		Description: "Session token refreshed",
+		Severity:    1,
+		Metadata:    map[string]string{"session_id": strconv.Itoa(session.ID)},
+	})
 
 	json.NewEncoder(w).Encode(RefreshResponse{
 		Token:     newToken,
 		ExpiresAt: expiresAt.Format(time.RFC3339),
 	})
 }
+
+func (app *App) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	// Verifiers refetch on an unknown kid, so a short cache is enough.
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(jwksMaxAge.Seconds())))
+	json.NewEncoder(w).Encode(app.keys.JWKS())
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const testPassword = "correct horse battery staple"
+
+type recordingMailer struct {
+	mu   sync.Mutex
+	sent []Mail
+}
+
+func (m *recordingMailer) Send(ctx context.Context, mail Mail) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = append(m.sent, mail)
+	return nil
+}
+
+// newTestApp returns an App backed by the in-memory stores.
+func newTestApp(t *testing.T) *App {
+	t.Helper()
+
+	keys, err := newKeyManager(KeyConfig{
+		Dir:              t.TempDir(),
+		RotationInterval: 30 * 24 * time.Hour,
+		Overlap:          48 * time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users := newMemoryUserStore()
+	return &App{
+		users:                users,
+		twoFactor:            users,
+		sessions:             newMemorySessionStore(),
+		attempts:             newMemoryLoginAttemptStore(),
+		keys:                 keys,
+		mailer:               &recordingMailer{},
+		publicURL:            "http://localhost:3000",
+		allowUnverifiedLogin: true,
+		oidcStates:           newMemoryOIDCStateStore(),
+	}
+}
+
+func (app *App) createTestUser(t *testing.T, email string, verified bool) User {
+	t.Helper()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(testPassword), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := User{Email: email, PasswordHash: string(hash), Name: "Test", EmailVerified: verified}
+	if err := app.users.Create(&user); err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func call(handler http.HandlerFunc, method, token string, body interface{}) *httptest.ResponseRecorder {
+	var buf bytes.Buffer
+	if body != nil {
+		json.NewEncoder(&buf).Encode(body)
+	}
+
+	req := httptest.NewRequest(method, "/", &buf)
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	return rec
+}
+
+func (app *App) login(t *testing.T, email string) string {
+	t.Helper()
+
+	rec := call(app.handleLogin, "POST", "", LoginRequest{Email: email, Password: testPassword})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("login returned %d: %s", rec.Code, rec.Body)
+	}
+
+	var resp TokenResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp.Token
+}
+
+func TestHandleRegister(t *testing.T) {
+	tests := []struct {
+		name     string
+		req      RegisterRequest
+		wantCode int
+	}{
+		{"valid", RegisterRequest{Email: "new@example.com", Password: testPassword, Name: "New"}, http.StatusCreated},
+		{"mixed case email", RegisterRequest{Email: "New@Example.com", Password: testPassword}, http.StatusCreated},
+		{"duplicate email", RegisterRequest{Email: "taken@example.com", Password: testPassword}, http.StatusConflict},
+		{"duplicate email in another case", RegisterRequest{Email: "Taken@Example.com", Password: testPassword}, http.StatusConflict},
+		{"missing password", RegisterRequest{Email: "new@example.com"}, http.StatusBadRequest},
+		{"invalid email", RegisterRequest{Email: "Jane <jane@example.com>", Password: testPassword}, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t)
+			app.createTestUser(t, "taken@example.com", true)
+
+			rec := call(app.handleRegister, "POST", "", tt.req)
+			if rec.Code != tt.wantCode {
+				t.Fatalf("got status %d, want %d: %s", rec.Code, tt.wantCode, rec.Body)
+			}
+
+			if tt.wantCode == http.StatusCreated {
+				user, err := app.users.ByEmail(tt.req.Email)
+				if err != nil {
+					t.Fatalf("user was not stored: %v", err)
+				}
+				if user.Email != strings.ToLower(tt.req.Email) {
+					t.Errorf("stored email %q, want it in lower case", user.Email)
+				}
+				if user.EmailVerified {
+					t.Error("new user should not be verified")
+				}
+				if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(tt.req.Password)) != nil {
+					t.Error("stored password hash does not match")
+				}
+			}
+		})
+	}
+}
+
+func TestHandleLogin(t *testing.T) {
+	tests := []struct {
+		name            string
+		email           string
+		password        string
+		requireVerified bool
+		wantCode        int
+	}{
+		{"valid", "verified@example.com", testPassword, false, http.StatusOK},
+		{"wrong password", "verified@example.com", "wrong", false, http.StatusUnauthorized},
+		{"unknown email", "nobody@example.com", testPassword, false, http.StatusUnauthorized},
+		{"unverified allowed", "unverified@example.com", testPassword, false, http.StatusOK},
+		{"unverified rejected", "unverified@example.com", testPassword, true, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t)
+			app.allowUnverifiedLogin = !tt.requireVerified
+			app.createTestUser(t, "verified@example.com", true)
+			app.createTestUser(t, "unverified@example.com", false)
+
+			rec := call(app.handleLogin, "POST", "", LoginRequest{Email: tt.email, Password: tt.password})
+			if rec.Code != tt.wantCode {
+				t.Fatalf("got status %d, want %d: %s", rec.Code, tt.wantCode, rec.Body)
+			}
+
+			if tt.wantCode == http.StatusOK {
+				var resp TokenResponse
+				if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+					t.Fatal(err)
+				}
+				if resp.Token == "" || resp.Email != tt.email {
+					t.Errorf("unexpected response %+v", resp)
+				}
+			}
+		})
+	}
+}
+
+func TestHandleLoginLockout(t *testing.T) {
+	app := newTestApp(t)
+	app.createTestUser(t, "user@example.com", true)
+
+	for i := 0; i <= accountLockout.FreeAttempts; i++ {
+		call(app.handleLogin, "POST", "", LoginRequest{Email: "user@example.com", Password: "wrong"})
+	}
+
+	rec := call(app.handleLogin, "POST", "", LoginRequest{Email: "user@example.com", Password: testPassword})
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusTooManyRequests)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("missing Retry-After header")
+	}
+}
+
+func TestHandleVerifyToken(t *testing.T) {
+	app := newTestApp(t)
+	user := app.createTestUser(t, "user@example.com", true)
+	token := app.login(t, user.Email)
+
+	tests := []struct {
+		name     string
+		token    string
+		wantCode int
+	}{
+		{"valid", token, http.StatusOK},
+		{"missing", "", http.StatusUnauthorized},
+		{"malformed", "not-a-jwt", http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := call(app.handleVerifyToken, "POST", tt.token, nil)
+			if rec.Code != tt.wantCode {
+				t.Fatalf("got status %d, want %d: %s", rec.Code, tt.wantCode, rec.Body)
+			}
+
+			if tt.wantCode == http.StatusOK {
+				var resp struct {
+					Valid  bool `json:"valid"`
+					UserID int  `json:"user_id"`
+				}
+				if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+					t.Fatal(err)
+				}
+				if !resp.Valid || resp.UserID != user.ID {
+					t.Errorf("unexpected response %+v", resp)
+				}
+			}
+		})
+	}
+}
+
+func TestHandleRefreshToken(t *testing.T) {
+	app := newTestApp(t)
+	user := app.createTestUser(t, "user@example.com", true)
+	oldToken := app.login(t, user.Email)
+
+	rec := call(app.handleRefreshToken, "POST", oldToken, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("refresh returned %d: %s", rec.Code, rec.Body)
+	}
+
+	var resp RefreshResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+
+	if rec := call(app.handleVerifyToken, "POST", resp.Token, nil); rec.Code != http.StatusOK {
+		t.Errorf("refreshed token rejected with %d", rec.Code)
+	}
+	if rec := call(app.handleVerifyToken, "POST", oldToken, nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("old token still accepted after refresh: %d", rec.Code)
+	}
+
+	sessions, _ := app.sessions.List(user.ID)
+	if len(sessions) != 1 {
+		t.Errorf("refresh should rotate the session in place, found %d sessions", len(sessions))
+	}
+}
+
+func TestHandleLogout(t *testing.T) {
+	app := newTestApp(t)
+	user := app.createTestUser(t, "user@example.com", true)
+	token := app.login(t, user.Email)
+	otherToken := app.login(t, user.Email)
+
+	if rec := call(app.handleLogout, "POST", token, nil); rec.Code != http.StatusOK {
+		t.Fatalf("logout returned %d: %s", rec.Code, rec.Body)
+	}
+	if rec := call(app.handleVerifyToken, "POST", token, nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("token still accepted after logout: %d", rec.Code)
+	}
+	if rec := call(app.handleLogout, "POST", token, nil); rec.Code != http.StatusNotFound {
+		t.Errorf("second logout returned %d, want %d", rec.Code, http.StatusNotFound)
+	}
+	if rec := call(app.handleVerifyToken, "POST", otherToken, nil); rec.Code != http.StatusOK {
+		t.Errorf("logout revoked another session: %d", rec.Code)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	pb "authentication-service/logs"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// AuthLog is an audit event sent to the logger service.
+type AuthLog struct {
+	EventType   string
+	UserID      string
+	Description string
+	Severity    int32
+	Timestamp   time.Time
+	Metadata    map[string]string
+}
+
+// sensitiveMetadata lists substrings of metadata keys that are never sent,
+// as a backstop against a caller passing a credential along.
+var sensitiveMetadata = []string{"password", "token", "secret", "code"}
+
+// AuditLogger sends audit events to the logger service's LogEvent API.
+// Events are queued and sent by a background worker, so a slow or missing
+// logger never delays a request; when the queue is full, events are
+// dropped.
+type AuditLogger struct {
+	client  pb.LoggerServiceClient
+	conn    *grpc.ClientConn
+	entries chan *pb.LogRequest
+	done    chan struct{}
+	dropped atomic.Int64
+}
+
+func newAuditLogger(addr string, buffer int) (*AuditLogger, error) {
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, err
+	}
+
+	logger := newAuditLoggerWithClient(pb.NewLoggerServiceClient(conn), buffer)
+	logger.conn = conn
+	return logger, nil
+}
+
+func newAuditLoggerWithClient(client pb.LoggerServiceClient, buffer int) *AuditLogger {
+	logger := &AuditLogger{
+		client:  client,
+		entries: make(chan *pb.LogRequest, buffer),
+		done:    make(chan struct{}),
+	}
+	go logger.run()
+	return logger
+}
+
+// Log queues entry without blocking. The caller's IP and user agent are
+// added to the metadata when r is not nil.
+func (a *AuditLogger) Log(r *http.Request, entry AuthLog) {
+	if a == nil {
+		return
+	}
+
+	if entry.Timestamp.IsZero() {
+		entry.Timestamp = time.Now()
+	}
+
+	metadata := make(map[string]string, len(entry.Metadata)+2)
+	for key, value := range entry.Metadata {
+		if !isSensitiveMetadata(key) {
+			metadata[key] = value
+		}
+	}
+	if r != nil {
+		metadata["ip"] = clientIP(r)
+		metadata["user_agent"] = truncate(r.UserAgent(), maxUserAgentLength)
+	}
+
+	req := &pb.LogRequest{
+		ServiceName: "auth",
+		EventType:   entry.EventType,
+		UserId:      entry.UserID,
+		Description: entry.Description,
+		Severity:    entry.Severity,
+		Timestamp:   entry.Timestamp.Format(time.RFC3339),
+		Metadata:    metadata,
+	}
+
+	select {
+	case a.entries <- req:
+	default:
+		if a.dropped.Add(1)%100 == 1 {
+			log.Printf("Audit queue full, dropped %d events so far", a.dropped.Load())
+		}
+	}
+}
+
+func isSensitiveMetadata(key string) bool {
+	key = strings.ToLower(key)
+	for _, s := range sensitiveMetadata {
+		if strings.Contains(key, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *AuditLogger) run() {
+	defer close(a.done)
+	for req := range a.entries {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		_, err := a.client.LogEvent(ctx, req)
+		cancel()
+		if err != nil {
+			log.Printf("Failed to send %s audit event: %v", req.EventType, err)
+		}
+	}
+}
+
+// Close sends what is still queued, giving up after timeout. Log must not
+// be called after Close.
+func (a *AuditLogger) Close(timeout time.Duration) {
+	if a == nil {
+		return
+	}
+
+	close(a.entries)
+	select {
+	case <-a.done:
+	case <-time.After(timeout):
+		log.Printf("Gave up sending %d queued audit events", len(a.entries))
+	}
+	if a.conn != nil {
+		a.conn.Close()
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	pb "authentication-service/logs"
+
+	"google.golang.org/grpc"
+)
+
+type recordingLoggerClient struct {
+	requests chan *pb.LogRequest
+	block    chan struct{}
+}
+
+func (c *recordingLoggerClient) LogEvent(ctx context.Context, req *pb.LogRequest, opts ...grpc.CallOption) (*pb.LogResponse, error) {
+	if c.block != nil {
+		<-c.block
+	}
+	c.requests <- req
+	return &pb.LogResponse{Success: true}, nil
+}
+
+func TestAuditLoggerLog(t *testing.T) {
+	client := &recordingLoggerClient{requests: make(chan *pb.LogRequest, 1)}
+	audit := newAuditLoggerWithClient(client, 10)
+	defer audit.Close(time.Second)
+
+	r := httptest.NewRequest("POST", "/auth/login", nil)
+	r.Header.Set("X-Real-IP", "203.0.113.7")
+	r.Header.Set("User-Agent", "test-agent")
+
+	audit.Log(r, AuthLog{
+		EventType: "login_succeeded",
+		UserID:    "1",
+		Metadata: map[string]string{
+			"session_id":   "5",
+			"password":     testPassword,
+			"access_token": "secret",
+		},
+	})
+
+	select {
+	case req := <-client.requests:
+		if req.ServiceName != "auth" || req.EventType != "login_succeeded" || req.UserId != "1" {
+			t.Errorf("unexpected request %+v", req)
+		}
+		want := map[string]string{"session_id": "5", "ip": "203.0.113.7", "user_agent": "test-agent"}
+		if len(req.Metadata) != len(want) {
+			t.Errorf("got metadata %v, want %v", req.Metadata, want)
+		}
+		for key, value := range want {
+			if req.Metadata[key] != value {
+				t.Errorf("metadata[%q] = %q, want %q", key, req.Metadata[key], value)
+			}
+		}
+	case <-time.After(time.Second):
+		t.Fatal("event was not sent")
+	}
+}
+
+func TestAuditLoggerDoesNotBlock(t *testing.T) {
+	block := make(chan struct{})
+	client := &recordingLoggerClient{requests: make(chan *pb.LogRequest, 10), block: block}
+	audit := newAuditLoggerWithClient(client, 1)
+	defer func() {
+		close(block)
+		audit.Close(time.Second)
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 10; i++ {
+			audit.Log(nil, AuthLog{EventType: "logout"})
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Log blocked on a stalled logger")
+	}
+	if audit.dropped.Load() == 0 {
+		t.Error("expected events to be dropped")
+	}
+}
@@ -4,25 +4,55 @@ import (
 	"database/sql"
 	"fmt"
 	"os"
+	"time"
 
 	_ "github.com/lib/pq"
 )
 
 type User struct {
-	ID           int    `json:"id"`
-	Email        string `json:"email"`
-	PasswordHash string `json:"-"`
-	Name         string `json:"name"`
+	ID            int      `json:"id"`
+	Email         string   `json:"email"`
+	PasswordHash  string   `json:"-"`
+	Name          string   `json:"name"`
+	EmailVerified bool     `json:"email_verified"`
+	Roles         []string `json:"roles"`
+}
+
+type Role struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+const (
+	roleUser  = "user"
+	roleAdmin = "admin"
+)
+
+// hasRole reports whether roles contains role.
+func hasRole(roles []string, role string) bool {
+	for _, r := range roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
 }
 
 type Session struct {
-	ID        int
-	UserID    int
-	Token     string
-	ExpiresAt string
+	ID         int       `json:"id"`
+	UserID     int       `json:"-"`
+	Hash       string    `json:"-"`
+	Label      string    `json:"label"`
+	CreatedIP  string    `json:"created_ip"`
+	UserAgent  string    `json:"user_agent"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	Current    bool      `json:"current"`
 }
 
-func initDB() (*sql.DB, error) {
+// openDB connects to Postgres without touching the schema.
+func openDB() (*sql.DB, error) {
 	dbURL := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
 		os.Getenv("DB_HOST"),
 		os.Getenv("DB_PORT"),
@@ -40,6 +70,22 @@ func initDB() (*sql.DB, error) {
 		return nil, err
 	}
 
+	return db, nil
+}
+
+// initDB connects to Postgres and, unless AUTO_MIGRATE is "false", applies
+// pending migrations. Deployments that migrate separately run the migrate
+// subcommand instead.
+func initDB() (*sql.DB, error) {
+	db, err := openDB()
+	if err != nil {
+		return nil, err
+	}
+
+	if os.Getenv("AUTO_MIGRATE") == "false" {
+		return db, nil
+	}
+
 	// Run migrations
 	if err = runMigrations(db); err != nil {
 		return nil, fmt.Errorf("failed to run migrations: %v", err)
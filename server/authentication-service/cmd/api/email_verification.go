@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	emailVerificationTTL = 48 * time.Hour
+	// A new verification email is sent at most once per interval, and at
+	// most maxVerificationEmailsPerDay times in 24 hours.
+	verificationResendInterval  = time.Minute
+	maxVerificationEmailsPerDay = 5
+)
+
+type VerifyEmailRequest struct {
+	Token string `json:"token"`
+}
+
+type ResendVerificationRequest struct {
+	Email string `json:"email"`
+}
+
+// validEmail accepts a bare address such as "jane@example.com" but not
+// display-name forms like "Jane <jane@example.com>".
+func validEmail(email string) bool {
+	addr, err := mail.ParseAddress(email)
+	return err == nil && addr.Address == email
+}
+
+// normalizeEmail is how addresses are stored, so that ones differing only
+// in case belong to the same account.
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+func (app *App) sendEmailVerification(user User) {
+	token, tokenHash, err := generateOpaqueToken()
+	if err != nil {
+		log.Printf("Error generating email verification token: %v", err)
+		return
+	}
+
+	if err := app.users.CreateEmailVerification(user.ID, tokenHash, time.Now().Add(emailVerificationTTL)); err != nil {
+		log.Printf("Error storing email verification token: %v", err)
+		return
+	}
+
+	link := fmt.Sprintf("%s/verify-email?token=%s", app.publicURL, url.QueryEscape(token))
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	err = app.mailer.Send(ctx, Mail{
+		To:      user.Email,
+		Subject: "Confirm your email address",
+		Body: fmt.Sprintf(
+			"Hi %s,\n\nPlease confirm your email address by opening the link below. It expires in %s.\n\n%s",
+			user.Name, emailVerificationTTL, link,
+		),
+	})
+	if err != nil {
+		log.Printf("Error sending verification email to user %d: %v", user.ID, err)
+	}
+}
+
+func (app *App) handleVerifyEmail(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var req VerifyEmailRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Token is required"})
+		return
+	}
+
+	_, err := app.users.ConsumeEmailVerification(hashOpaqueToken(req.Token))
+	if err == errNotFound {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid or expired verification token"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error verifying email: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Error verifying email"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"message": "Email verified successfully"})
+}
+
+func (app *App) handleResendVerification(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var req ResendVerificationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Email == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Email is required"})
+		return
+	}
+
+	// Unknown, already verified and rate-limited addresses all get the same
+	// response so the endpoint does not reveal account state.
+	user, err := app.users.ByEmail(req.Email)
+	var lastSent time.Time
+	var sentToday int
+	if err == nil && !user.EmailVerified {
+		lastSent, sentToday, err = app.users.EmailVerificationsSent(user.ID, time.Now().Add(-24*time.Hour))
+	}
+
+	switch {
+	case err == errNotFound:
+	case err != nil:
+		log.Printf("Database error looking up user for verification resend: %v", err)
+	case user.EmailVerified:
+	case time.Since(lastSent) < verificationResendInterval,
+		sentToday >= maxVerificationEmailsPerDay:
+		log.Printf("Verification email for user %d rate limited", user.ID)
+	default:
+		go app.sendEmailVerification(user)
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "If this email needs verification, a new link has been sent",
+	})
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestHandleVerifyEmail(t *testing.T) {
+	app := newTestApp(t)
+	app.allowUnverifiedLogin = false
+	user := app.createTestUser(t, "user@example.com", false)
+
+	login := LoginRequest{Email: user.Email, Password: testPassword}
+	if rec := call(app.handleLogin, "POST", "", login); rec.Code != http.StatusForbidden {
+		t.Fatalf("unverified login returned %d, want %d", rec.Code, http.StatusForbidden)
+	}
+
+	app.sendEmailVerification(user)
+	req := VerifyEmailRequest{Token: app.mailedToken(t)}
+	if rec := call(app.handleVerifyEmail, "POST", "", req); rec.Code != http.StatusOK {
+		t.Fatalf("verify returned %d: %s", rec.Code, rec.Body)
+	}
+
+	stored, err := app.users.ByEmail(user.Email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stored.EmailVerified {
+		t.Error("email not marked verified")
+	}
+	if rec := call(app.handleLogin, "POST", "", login); rec.Code != http.StatusOK {
+		t.Errorf("verified login returned %d: %s", rec.Code, rec.Body)
+	}
+	if rec := call(app.handleVerifyEmail, "POST", "", req); rec.Code != http.StatusBadRequest {
+		t.Errorf("reusing the verification token returned %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestValidEmail(t *testing.T) {
+	tests := []struct {
+		email string
+		want  bool
+	}{
+		{"jane@example.com", true},
+		{"Jane <jane@example.com>", false},
+		{"jane", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		if got := validEmail(tt.email); got != tt.want {
+			t.Errorf("validEmail(%q) = %v, want %v", tt.email, got, tt.want)
+		}
+	}
+}
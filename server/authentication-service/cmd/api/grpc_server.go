@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+
+	authpb "contracts/auth"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const maxGetUsers = 100
+
+// AuthServer serves the AuthService gRPC API to other services inside the
+// cluster. It is not exposed through the gateway.
+type AuthServer struct {
+	authpb.UnimplementedAuthServiceServer
+	app *App
+}
+
+func toProtoUser(user User) *authpb.User {
+	return &authpb.User{
+		Id:            int64(user.ID),
+		Email:         user.Email,
+		Name:          user.Name,
+		EmailVerified: user.EmailVerified,
+		Roles:         user.Roles,
+	}
+}
+
+func (s *AuthServer) VerifyToken(ctx context.Context, req *authpb.VerifyTokenRequest) (*authpb.VerifyTokenResponse, error) {
+	claims, user, err := s.app.verifySession(req.Token)
+	if err == errNotAuthenticated {
+		return &authpb.VerifyTokenResponse{Valid: false}, nil
+	}
+	if err != nil {
+		log.Printf("Error verifying token: %v", err)
+		return nil, status.Error(codes.Internal, "error verifying token")
+	}
+
+	return &authpb.VerifyTokenResponse{
+		Valid:         true,
+		UserId:        int64(claims.UserID),
+		EmailVerified: user.EmailVerified,
+		Roles:         user.Roles,
+	}, nil
+}
+
+func (s *AuthServer) GetUser(ctx context.Context, req *authpb.GetUserRequest) (*authpb.User, error) {
+	user, err := s.app.users.ByID(int(req.UserId))
+	if err == errNotFound {
+		return nil, status.Error(codes.NotFound, "user not found")
+	}
+	if err != nil {
+		log.Printf("Error loading user %d: %v", req.UserId, err)
+		return nil, status.Error(codes.Internal, "error loading user")
+	}
+	return toProtoUser(user), nil
+}
+
+func (s *AuthServer) GetUsers(ctx context.Context, req *authpb.GetUsersRequest) (*authpb.GetUsersResponse, error) {
+	if len(req.UserIds) > maxGetUsers {
+		return nil, status.Errorf(codes.InvalidArgument, "at most %d users may be requested at once", maxGetUsers)
+	}
+
+	ids := make([]int, len(req.UserIds))
+	for i, id := range req.UserIds {
+		ids[i] = int(id)
+	}
+
+	users, err := s.app.users.ByIDs(ids)
+	if err != nil {
+		log.Printf("Error loading users: %v", err)
+		return nil, status.Error(codes.Internal, "error loading users")
+	}
+
+	resp := &authpb.GetUsersResponse{Users: make([]*authpb.User, len(users))}
+	for i, user := range users {
+		resp.Users[i] = toProtoUser(user)
+	}
+	return resp, nil
+}
+
+// serveGRPC starts the AuthService on addr in the background.
+func serveGRPC(app *App, addr string) (*grpc.Server, error) {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	server := grpc.NewServer()
+	authpb.RegisterAuthServiceServer(server, &AuthServer{app: app})
+
+	go func() {
+		if err := server.Serve(lis); err != nil {
+			log.Printf("gRPC server stopped: %v", err)
+		}
+	}()
+	return server, nil
+}
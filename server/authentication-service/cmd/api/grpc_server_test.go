@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	authpb "contracts/auth"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestAuthServerVerifyToken(t *testing.T) {
+	app := newTestApp(t)
+	user := app.createTestUser(t, "user@example.com", true)
+	token := app.login(t, user.Email)
+	server := &AuthServer{app: app}
+
+	tests := []struct {
+		name      string
+		token     string
+		wantValid bool
+	}{
+		{"valid", token, true},
+		{"malformed", "not-a-jwt", false},
+		{"empty", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := server.VerifyToken(context.Background(), &authpb.VerifyTokenRequest{Token: tt.token})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.Valid != tt.wantValid {
+				t.Fatalf("got valid=%v, want %v", resp.Valid, tt.wantValid)
+			}
+			if tt.wantValid && (resp.UserId != int64(user.ID) || !resp.EmailVerified) {
+				t.Errorf("unexpected response %+v", resp)
+			}
+		})
+	}
+}
+
+func TestAuthServerGetUsers(t *testing.T) {
+	app := newTestApp(t)
+	alice := app.createTestUser(t, "alice@example.com", true)
+	bob := app.createTestUser(t, "bob@example.com", true)
+	server := &AuthServer{app: app}
+
+	resp, err := server.GetUsers(context.Background(), &authpb.GetUsersRequest{
+		UserIds: []int64{int64(bob.ID), 999, int64(alice.ID), int64(bob.ID)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Users) != 2 || resp.Users[0].Email != alice.Email || resp.Users[1].Email != bob.Email {
+		t.Errorf("unexpected users %v", resp.Users)
+	}
+
+	_, err = server.GetUser(context.Background(), &authpb.GetUserRequest{UserId: 999})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("got %v, want NotFound", err)
+	}
+
+	_, err = server.GetUsers(context.Background(), &authpb.GetUsersRequest{UserIds: make([]int64, maxGetUsers+1)})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("got %v, want InvalidArgument", err)
+	}
+}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// signingKey is an RSA key pair loaded from <kid>.pem in the keys directory.
+// A kid starts with the key's activation time, e.g.
+// 20240101T000000Z-1a2b3c4d, so copying or restoring the files keeps their
+// order. A key becomes the active signing key at ActiveFrom and stays
+// published for verification until the overlap window after its successor
+// took over has passed.
+type signingKey struct {
+	ID         string
+	PrivateKey *rsa.PrivateKey
+	ActiveFrom time.Time
+}
+
+// keyIDTimeFormat is the layout of the activation time a kid starts with.
+const keyIDTimeFormat = "20060102T150405Z"
+
+// jwksMaxAge is how long verifiers may cache the JWKS. A rotated key is
+// published for this long before it starts signing, so that every verifier
+// knows it by the time it sees a token signed with it.
+const jwksMaxAge = 5 * time.Minute
+
+type KeyManager struct {
+	dir              string
+	rotationInterval time.Duration
+	overlap          time.Duration
+
+	mu   sync.RWMutex
+	keys []*signingKey // sorted by ActiveFrom, oldest first
+}
+
+type KeyConfig struct {
+	Dir              string
+	RotationInterval time.Duration
+	Overlap          time.Duration
+}
+
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+func loadKeyConfig() (KeyConfig, error) {
+	config := KeyConfig{
+		Dir:     os.Getenv("JWT_KEYS_DIR"),
+		Overlap: tokenTTL,
+	}
+	if config.Dir == "" {
+		config.Dir = "keys"
+	}
+
+	if v := os.Getenv("JWT_KEY_ROTATION_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return config, fmt.Errorf("invalid JWT_KEY_ROTATION_INTERVAL: %v", err)
+		}
+		config.RotationInterval = d
+	}
+
+	if v := os.Getenv("JWT_KEY_OVERLAP"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return config, fmt.Errorf("invalid JWT_KEY_OVERLAP: %v", err)
+		}
+		// Retired keys must outlive every token they signed.
+		if d < tokenTTL {
+			return config, fmt.Errorf("JWT_KEY_OVERLAP must be at least the token lifetime (%s)", tokenTTL)
+		}
+		config.Overlap = d
+	}
+
+	return config, nil
+}
+
+func newKeyManager(config KeyConfig) (*KeyManager, error) {
+	if err := os.MkdirAll(config.Dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create keys directory: %v", err)
+	}
+
+	km := &KeyManager{
+		dir:              config.Dir,
+		rotationInterval: config.RotationInterval,
+		overlap:          config.Overlap,
+	}
+
+	if err := km.reload(); err != nil {
+		return nil, err
+	}
+
+	// Bootstrap a first key so a fresh deployment can issue tokens.
+	if km.activeKey() == nil {
+		if err := km.bootstrap(); err != nil {
+			return nil, err
+		}
+	}
+
+	return km, nil
+}
+
+// bootstrap generates the first signing key, unless a replica starting at
+// the same time already did.
+func (km *KeyManager) bootstrap() error {
+	unlock, _, err := lockDir(km.dir, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := km.reload(); err != nil {
+		return err
+	}
+	if km.activeKey() != nil {
+		return nil
+	}
+	if _, err := km.generateKey(time.Now()); err != nil {
+		return err
+	}
+	return km.reload()
+}
+
+// Start periodically rotates the signing key (when enabled) and reloads the
+// keys directory so that keys added by an operator or another replica are
+// picked up without a restart.
+func (km *KeyManager) Start(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := km.rotateIfDue(time.Now()); err != nil {
+					log.Printf("Key rotation failed: %v", err)
+				}
+				if err := km.reload(); err != nil {
+					log.Printf("Failed to reload signing keys: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+func (km *KeyManager) reload() error {
+	entries, err := os.ReadDir(km.dir)
+	if err != nil {
+		return fmt.Errorf("failed to read keys directory: %v", err)
+	}
+
+	var keys []*signingKey
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".pem" {
+			continue
+		}
+
+		kid := strings.TrimSuffix(entry.Name(), ".pem")
+		activeFrom, err := keyActivation(kid)
+		if err != nil {
+			return err
+		}
+
+		privateKey, err := readPrivateKey(filepath.Join(km.dir, entry.Name()))
+		if err != nil {
+			return fmt.Errorf("failed to load key %s: %v", entry.Name(), err)
+		}
+
+		keys = append(keys, &signingKey{
+			ID:         kid,
+			PrivateKey: privateKey,
+			ActiveFrom: activeFrom,
+		})
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].ActiveFrom.Before(keys[j].ActiveFrom)
+	})
+
+	km.mu.Lock()
+	km.keys = keys
+	km.mu.Unlock()
+
+	return nil
+}
+
+// keyActivation reads the activation time a kid starts with.
+func keyActivation(kid string) (time.Time, error) {
+	prefix, _, _ := strings.Cut(kid, "-")
+	activeFrom, err := time.Parse(keyIDTimeFormat, prefix)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("key %s must be named <activation time>-<suffix>.pem, e.g. %s-key.pem",
+			kid, time.Now().UTC().Format(keyIDTimeFormat))
+	}
+	return activeFrom, nil
+}
+
+func readPrivateKey(path string) (*rsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		rsaKey, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, errors.New("only RSA keys are supported")
+		}
+		return rsaKey, nil
+	default:
+		return nil, fmt.Errorf("unsupported PEM block type %q", block.Type)
+	}
+}
+
+// generateKey writes a new RSA key that becomes active at activeFrom and
+// returns its kid.
+// The file is written under a temporary name and renamed so that concurrent
+// reloads never see a partially written key.
+func (km *KeyManager) generateKey(activeFrom time.Time) (string, error) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate key: %v", err)
+	}
+
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	kid := activeFrom.UTC().Format(keyIDTimeFormat) + "-" + hex.EncodeToString(suffix)
+
+	data := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(privateKey),
+	})
+
+	path := filepath.Join(km.dir, kid+".pem")
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return "", err
+	}
+
+	log.Printf("Generated signing key %s", kid)
+	return kid, nil
+}
+
+// rotateIfDue schedules a new signing key once the active key is older than
+// the rotation interval, and removes keys that are past their overlap window.
+// The new key is published jwksMaxAge before it takes over. Replicas sharing
+// the keys directory take turns through a lock file, so only one of them
+// rotates; the others pick the new key up on their next reload.
+func (km *KeyManager) rotateIfDue(now time.Time) error {
+	if km.rotationInterval <= 0 {
+		return nil
+	}
+
+	unlock, ok, err := lockDir(km.dir, false)
+	if err != nil || !ok {
+		return err
+	}
+	defer unlock()
+
+	// Another replica may have rotated since we last looked.
+	if err := km.reload(); err != nil {
+		return err
+	}
+
+	active := km.activeKey()
+	if active == nil || (now.Sub(active.ActiveFrom) >= km.rotationInterval && !km.hasPendingKey(now)) {
+		if _, err := km.generateKey(now.Add(jwksMaxAge)); err != nil {
+			return err
+		}
+	}
+
+	km.mu.RLock()
+	expired := km.expiredKeys(now)
+	km.mu.RUnlock()
+
+	for _, key := range expired {
+		if err := os.Remove(filepath.Join(km.dir, key.ID+".pem")); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		log.Printf("Removed retired signing key %s", key.ID)
+	}
+
+	return nil
+}
+
+// activeKey returns the newest key whose activation time has passed.
+func (km *KeyManager) activeKey() *signingKey {
+	km.mu.RLock()
+	defer km.mu.RUnlock()
+
+	now := time.Now()
+	for i := len(km.keys) - 1; i >= 0; i-- {
+		if !km.keys[i].ActiveFrom.After(now) {
+			return km.keys[i]
+		}
+	}
+	return nil
+}
+
+// hasPendingKey reports whether a key is scheduled to become active after
+// now.
+func (km *KeyManager) hasPendingKey(now time.Time) bool {
+	km.mu.RLock()
+	defer km.mu.RUnlock()
+	return len(km.keys) > 0 && km.keys[len(km.keys)-1].ActiveFrom.After(now)
+}
+
+// lockDir takes an exclusive lock on dir for generating keys. Unless wait
+// is set, it reports false right away if another process holds the lock.
+func lockDir(dir string, wait bool) (unlock func(), ok bool, err error) {
+	f, err := os.OpenFile(filepath.Join(dir, ".rotate.lock"), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, false, err
+	}
+	how := syscall.LOCK_EX
+	if !wait {
+		how |= syscall.LOCK_NB
+	}
+	if err := syscall.Flock(int(f.Fd()), how); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, true, nil
+}
+
+// expiredKeys returns keys that were superseded longer than the overlap
+// window ago. Callers must hold km.mu.
+func (km *KeyManager) expiredKeys(now time.Time) []*signingKey {
+	var expired []*signingKey
+	for i := 0; i < len(km.keys)-1; i++ {
+		retiredAt := km.keys[i+1].ActiveFrom
+		if !retiredAt.After(now) && now.Sub(retiredAt) > km.overlap {
+			expired = append(expired, km.keys[i])
+		}
+	}
+	return expired
+}
+
+// publicKey returns the verification key for kid, provided it is still
+// within its validity window.
+func (km *KeyManager) publicKey(kid string) (*rsa.PublicKey, error) {
+	km.mu.RLock()
+	defer km.mu.RUnlock()
+
+	now := time.Now()
+	for _, expired := range km.expiredKeys(now) {
+		if expired.ID == kid {
+			return nil, fmt.Errorf("signing key %s has been retired", kid)
+		}
+	}
+
+	for _, key := range km.keys {
+		if key.ID == kid {
+			return &key.PrivateKey.PublicKey, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unknown signing key %s", kid)
+}
+
+// JWKS returns every public key that may have signed a currently valid
+// token, plus keys scheduled to become active, so verifiers can cache them
+// ahead of a rotation.
+func (km *KeyManager) JWKS() JWKS {
+	km.mu.RLock()
+	defer km.mu.RUnlock()
+
+	expired := make(map[string]bool)
+	for _, key := range km.expiredKeys(time.Now()) {
+		expired[key.ID] = true
+	}
+
+	set := JWKS{Keys: []JWK{}}
+	for _, key := range km.keys {
+		if expired[key.ID] {
+			continue
+		}
+		pub := key.PrivateKey.PublicKey
+		set.Keys = append(set.Keys, JWK{
+			Kty: "RSA",
+			Use: "sig",
+			Alg: "RS256",
+			Kid: key.ID,
+			N:   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		})
+	}
+
+	return set
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestKeyManager(t *testing.T) *KeyManager {
+	t.Helper()
+
+	km, err := newKeyManager(KeyConfig{
+		Dir:              t.TempDir(),
+		RotationInterval: 30 * 24 * time.Hour,
+		Overlap:          48 * time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return km
+}
+
+func TestKeyOrderIgnoresModTime(t *testing.T) {
+	km := newTestKeyManager(t)
+	first := km.activeKey()
+
+	older, err := km.generateKey(time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A copy or restore gives every file a fresh modification time, here
+	// making the older key look newer.
+	for _, key := range []string{first.ID, older} {
+		path := filepath.Join(km.dir, key+".pem")
+		if err := os.Chtimes(path, time.Now(), time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := km.reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := km.activeKey().ID; got != first.ID {
+		t.Fatalf("active key is %s, want %s", got, first.ID)
+	}
+}
+
+func TestRotationPublishesBeforeSigning(t *testing.T) {
+	km := newTestKeyManager(t)
+	first := km.activeKey()
+
+	now := first.ActiveFrom.Add(km.rotationInterval)
+	if err := km.rotateIfDue(now); err != nil {
+		t.Fatal(err)
+	}
+	if err := km.reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	next := km.keys[len(km.keys)-1]
+	if len(km.keys) != 2 || !next.ActiveFrom.Equal(now.Truncate(time.Second).Add(jwksMaxAge)) {
+		t.Fatalf("got %d keys, the newest active from %s", len(km.keys), next.ActiveFrom)
+	}
+	if got := km.activeKey().ID; got != first.ID {
+		t.Fatalf("active key is %s, want %s until the new key is published", got, first.ID)
+	}
+	published := false
+	for _, key := range km.JWKS().Keys {
+		published = published || key.Kid == next.ID
+	}
+	if !published {
+		t.Fatalf("key %s is not in the JWKS", next.ID)
+	}
+
+	// A second tick before the new key takes over must not add another.
+	if err := km.rotateIfDue(now.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := km.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if len(km.keys) != 2 {
+		t.Fatalf("got %d keys after a second rotation check, want 2", len(km.keys))
+	}
+}
+
+func TestKeyActivation(t *testing.T) {
+	if _, err := keyActivation("20240101T000000Z-1a2b3c4d"); err != nil {
+		t.Fatalf("keyActivation: %v", err)
+	}
+	if _, err := keyActivation("my-key"); err == nil {
+		t.Fatal("expected an error for a kid without an activation time")
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// lockoutPolicy decides when repeated failures lock a key. The first
+// FreeAttempts failures are free; each further failure locks the key for
+// BaseDelay doubled per extra failure, up to MaxDelay. Failures older than
+// Window are forgotten.
+type lockoutPolicy struct {
+	FreeAttempts int
+	BaseDelay    time.Duration
+	MaxDelay     time.Duration
+	Window       time.Duration
+}
+
+var (
+	accountLockout = lockoutPolicy{FreeAttempts: 5, BaseDelay: time.Minute, MaxDelay: time.Hour, Window: 24 * time.Hour}
+	ipLockout      = lockoutPolicy{FreeAttempts: 20, BaseDelay: time.Minute, MaxDelay: time.Hour, Window: 24 * time.Hour}
+)
+
+func (p lockoutPolicy) lockDuration(failures int) time.Duration {
+	if failures <= p.FreeAttempts {
+		return 0
+	}
+	exp := float64(failures - p.FreeAttempts - 1)
+	delay := time.Duration(float64(p.BaseDelay) * math.Pow(2, exp))
+	if delay > p.MaxDelay || delay <= 0 {
+		return p.MaxDelay
+	}
+	return delay
+}
+
+// dummyPasswordHash is compared against when a login names an unknown
+// account, so the response takes as long as for a wrong password.
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("not-a-real-password"), bcrypt.DefaultCost)
+
+func accountKey(email string) string {
+	return "email:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
+
+func twoFactorKey(userID int) string {
+	return fmt.Sprintf("2fa:%d", userID)
+}
+
+// clientIP returns the caller's address as reported by the gateway. The
+// header is only present on requests from a trusted proxy; see
+// trustProxyHeaders.
+func clientIP(r *http.Request) string {
+	if ip := r.Header.Get("X-Real-IP"); ip != "" {
+		return ip
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// parseTrustedProxies parses a comma separated list of addresses and CIDR
+// ranges.
+func parseTrustedProxies(list string) ([]*net.IPNet, error) {
+	var trusted []*net.IPNet
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", entry)
+			}
+			entry = ip.String() + "/128"
+			if ip.To4() != nil {
+				entry = ip.String() + "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q", entry)
+		}
+		trusted = append(trusted, network)
+	}
+	return trusted, nil
+}
+
+// trustProxyHeaders drops the forwarded client address from requests that
+// did not come from one of the trusted proxies, so that callers reaching
+// the service directly cannot pick the address their failed logins count
+// against.
+func trustProxyHeaders(trusted []*net.IPNet) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !fromTrustedProxy(r, trusted) {
+				r.Header.Del("X-Real-IP")
+				r.Header.Del("X-Forwarded-For")
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func fromTrustedProxy(r *http.Request, trusted []*net.IPNet) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// lockedUntil returns the latest lock expiry among keys, or the zero time if
+// none of them is locked.
+func (app *App) lockedUntil(keys ...string) (time.Time, error) {
+	return app.attempts.LockedUntil(keys...)
+}
+
+// recordFailure counts a failed attempt against key and applies the
+// policy's lock. It returns the new lock expiry, if the key is now locked.
+func (app *App) recordFailure(key string, policy lockoutPolicy) (time.Time, error) {
+	failures, err := app.attempts.RecordFailure(key, policy.Window)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	delay := policy.lockDuration(failures)
+	if delay == 0 {
+		return time.Time{}, nil
+	}
+
+	until := time.Now().Add(delay)
+	if err := app.attempts.Lock(key, until); err != nil {
+		return time.Time{}, err
+	}
+	return until, nil
+}
+
+func (app *App) clearFailures(keys ...string) error {
+	return app.attempts.Clear(keys...)
+}
+
+// writeLocked responds to an attempt against a locked account or address.
+func writeLocked(w http.ResponseWriter, until time.Time) {
+	retryAfter := int(math.Ceil(time.Until(until).Seconds()))
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	w.Header().Set("Retry-After", fmt.Sprint(retryAfter))
+	http.Error(w, "Too many failed attempts, try again later", http.StatusTooManyRequests)
+}
+
+// auditLoginFailure records a rejected password login. userID is 0 when
+// the account does not exist.
+func (app *App) auditLoginFailure(r *http.Request, email string, userID int, reason string) {
+	entry := AuthLog{
+		EventType:   "login_failed",
+		Description: "Password login rejected",
+		Severity:    2,
+		Metadata: map[string]string{
+			"account": strings.ToLower(email),
+			"reason":  reason,
+		},
+	}
+	if userID != 0 {
+		entry.UserID = fmt.Sprint(userID)
+	}
+	app.audit.Log(r, entry)
+}
+
+// registerLoginFailure records a failed password against the account and
+// the caller's address, publishing an event when the account becomes
+// locked.
+func (app *App) registerLoginFailure(r *http.Request, email string, userID int) {
+	until, err := app.recordFailure(accountKey(email), accountLockout)
+	if err != nil {
+		log.Printf("Error recording failed login: %v", err)
+	} else if !until.IsZero() {
+		app.publishLockEvent(r, email, userID, until)
+	}
+
+	if _, err := app.recordFailure(ipKey(clientIP(r)), ipLockout); err != nil {
+		log.Printf("Error recording failed login: %v", err)
+	}
+}
+
+func (app *App) publishLockEvent(r *http.Request, email string, userID int, until time.Time) {
+	entry := AuthLog{
+		EventType:   "account_locked",
+		Description: "Account temporarily locked after repeated failed logins",
+		Severity:    2,
+		Metadata: map[string]string{
+			"account":      strings.ToLower(email),
+			"locked_until": until.Format(time.RFC3339),
+		},
+	}
+	if userID != 0 {
+		entry.UserID = fmt.Sprint(userID)
+	}
+	app.audit.Log(r, entry)
+}
+
+type UnlockRequest struct {
+	Email string `json:"email"`
+	IP    string `json:"ip"`
+}
+
+// handleUnlock clears failed attempts for an account and/or address. It is
+// restricted to admins.
+func (app *App) handleUnlock(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	admin, ok := app.requireRole(w, r, roleAdmin)
+	if !ok {
+		return
+	}
+
+	var req UnlockRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (req.Email == "" && req.IP == "") {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Email or IP is required"})
+		return
+	}
+
+	var keys []string
+	if req.Email != "" {
+		keys = append(keys, accountKey(req.Email))
+	}
+	if req.IP != "" {
+		keys = append(keys, ipKey(req.IP))
+	}
+
+	if err := app.clearFailures(keys...); err != nil {
+		log.Printf("Error unlocking: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Error unlocking"})
+		return
+	}
+
+	app.audit.Log(r, AuthLog{
+		EventType:   "account_unlocked",
+		Description: "Failed login attempts cleared by an administrator",
+		Severity:    1,
+		Metadata: map[string]string{
+			"account":     strings.ToLower(req.Email),
+			"unlocked_ip": req.IP,
+			"admin_id":    fmt.Sprint(admin.ID),
+		},
+	})
+
+	json.NewEncoder(w).Encode(map[string]string{"message": "Unlocked"})
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLockDuration(t *testing.T) {
+	policy := lockoutPolicy{FreeAttempts: 3, BaseDelay: time.Minute, MaxDelay: 10 * time.Minute}
+
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, 0},
+		{3, 0},
+		{4, time.Minute},
+		{5, 2 * time.Minute},
+		{6, 4 * time.Minute},
+		{8, 10 * time.Minute},
+		{100, 10 * time.Minute},
+	}
+
+	for _, tt := range tests {
+		if got := policy.lockDuration(tt.failures); got != tt.want {
+			t.Errorf("lockDuration(%d) = %s, want %s", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestHandleLoginLockoutThreshold(t *testing.T) {
+	app := newTestApp(t)
+	app.createTestUser(t, "user@example.com", true)
+
+	// The free attempts do not lock the account, and a correct password
+	// afterwards clears them.
+	for i := 0; i < accountLockout.FreeAttempts; i++ {
+		call(app.handleLogin, "POST", "", LoginRequest{Email: "user@example.com", Password: "wrong"})
+	}
+	app.login(t, "user@example.com")
+
+	for i := 0; i < accountLockout.FreeAttempts; i++ {
+		call(app.handleLogin, "POST", "", LoginRequest{Email: "user@example.com", Password: "wrong"})
+	}
+	app.login(t, "user@example.com")
+}
+
+func TestHandleLoginLockoutByAddress(t *testing.T) {
+	app := newTestApp(t)
+	app.createTestUser(t, "user@example.com", true)
+
+	// Failures spread across many accounts still lock the address.
+	for i := 0; i <= ipLockout.FreeAttempts; i++ {
+		email := fmt.Sprintf("nobody%d@example.com", i)
+		call(app.handleLogin, "POST", "", LoginRequest{Email: email, Password: "wrong"})
+	}
+
+	rec := call(app.handleLogin, "POST", "", LoginRequest{Email: "user@example.com", Password: testPassword})
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusTooManyRequests)
+	}
+}
+
+func TestTrustProxyHeaders(t *testing.T) {
+	trusted, err := parseTrustedProxies("10.0.0.0/8, 192.168.1.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		realIP     string
+		want       string
+	}{
+		{"trusted range", "10.1.2.3:5000", "203.0.113.7", "203.0.113.7"},
+		{"trusted address", "192.168.1.5:5000", "203.0.113.7", "203.0.113.7"},
+		{"untrusted caller", "198.51.100.1:5000", "203.0.113.7", "198.51.100.1"},
+		{"no header", "10.1.2.3:5000", "", "10.1.2.3"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			handler := trustProxyHeaders(trusted)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = clientIP(r)
+			}))
+
+			req := httptest.NewRequest("POST", "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.realIP != "" {
+				req.Header.Set("X-Real-IP", tt.realIP)
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			if got != tt.want {
+				t.Fatalf("got client address %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	for _, list := range []string{"not-an-ip", "10.0.0.0/33"} {
+		if _, err := parseTrustedProxies(list); err == nil {
+			t.Errorf("parseTrustedProxies(%q) succeeded, want an error", list)
+		}
+	}
+	if trusted, err := parseTrustedProxies(""); err != nil || len(trusted) != 0 {
+		t.Errorf("got %v, %v for an empty list, want no proxies", trusted, err)
+	}
+}
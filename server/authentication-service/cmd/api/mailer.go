@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers transactional email such as password reset links.
+type Mailer interface {
+	Send(ctx context.Context, mail Mail) error
+}
+
+type SMTPMailer struct {
+	addr string
+	auth smtp.Auth
+	from string
+}
+
+func (m *SMTPMailer) Send(ctx context.Context, mail Mail) error {
+	msg := strings.Join([]string{
+		"From: " + m.from,
+		"To: " + mail.To,
+		"Subject: " + mail.Subject,
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=UTF-8",
+		"",
+		mail.Body,
+	}, "\r\n")
+
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(m.addr, m.auth, m.from, []string{mail.To}, []byte(msg))
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// WriterMailer writes messages to a file or stdout instead of sending them,
+// for local development and tests.
+type WriterMailer struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (m *WriterMailer) Send(ctx context.Context, mail Mail) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, err := fmt.Fprintf(m.w, "----- mail %s -----\nTo: %s\nSubject: %s\n\n%s\n\n",
+		time.Now().Format(time.RFC3339), mail.To, mail.Subject, mail.Body)
+	return err
+}
+
+// newMailer builds the mailer selected by MAILER: "smtp", "file" or
+// "stdout". There is no default: the file and stdout mailers put reset
+// and verification links where anyone reading the logs can use them, so
+// they are only for development and must be asked for.
+func newMailer() (Mailer, error) {
+	switch os.Getenv("MAILER") {
+	case "smtp":
+		host := os.Getenv("SMTP_HOST")
+		from := os.Getenv("MAIL_FROM")
+		if host == "" || from == "" {
+			return nil, fmt.Errorf("SMTP_HOST and MAIL_FROM are required for the smtp mailer")
+		}
+		port := os.Getenv("SMTP_PORT")
+		if port == "" {
+			port = "587"
+		}
+
+		var auth smtp.Auth
+		if user := os.Getenv("SMTP_USERNAME"); user != "" {
+			auth = smtp.PlainAuth("", user, os.Getenv("SMTP_PASSWORD"), host)
+		}
+
+		return &SMTPMailer{addr: host + ":" + port, auth: auth, from: from}, nil
+	case "file":
+		path := os.Getenv("MAIL_FILE")
+		if path == "" {
+			path = "mail.log"
+		}
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open mail file: %v", err)
+		}
+		return &WriterMailer{w: f}, nil
+	case "stdout":
+		return &WriterMailer{w: os.Stdout}, nil
+	case "":
+		return nil, fmt.Errorf("MAILER is required")
+	default:
+		return nil, fmt.Errorf("unknown MAILER %q", os.Getenv("MAILER"))
+	}
+}
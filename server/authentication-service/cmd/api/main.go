@@ -1,9 +1,11 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
@@ -22,17 +24,100 @@ func main() {
 		}
 	}
 
+	// Subcommands run against the database and exit:
+	//   migrate status|up|down|to N
+	//   create-admin -email ADDRESS [-name NAME]
+	if len(os.Args) > 1 {
+		runCommand(os.Args[1], os.Args[2:])
+		return
+	}
+
 	db, err := initDB()
 	if err != nil {
 		log.Fatal("Database initialization failed:", err)
 	}
 	defer db.Close()
 
+	keyConfig, err := loadKeyConfig()
+	if err != nil {
+		log.Fatal("Invalid signing key configuration:", err)
+	}
+
+	keys, err := newKeyManager(keyConfig)
+	if err != nil {
+		log.Fatal("Signing key initialization failed:", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	keys.Start(ctx, time.Minute)
+
+	mailer, err := newMailer()
+	if err != nil {
+		log.Fatal("Mailer initialization failed:", err)
+	}
+
+	publicURL := os.Getenv("APP_BASE_URL")
+	if publicURL == "" {
+		publicURL = "http://localhost:3000"
+	}
+
+	oidcProviders, err := loadOIDCProviders()
+	if err != nil {
+		log.Fatal("Invalid OIDC configuration:", err)
+	}
+
+	events := newEventPublisher()
+	defer events.Close()
+	newOutboxRelay(newPostgresOutboxStore(db), events).Start(ctx, 5*time.Second)
+
+	loggerAddr := os.Getenv("LOGGER_SERVICE_ADDR")
+	if loggerAddr == "" {
+		loggerAddr = "logger-service:50001"
+	}
+	audit, err := newAuditLogger(loggerAddr, 1000)
+	if err != nil {
+		log.Printf("Warning: audit logging disabled: %v", err)
+	}
+	defer audit.Close(5 * time.Second)
+
+	users := newPostgresUserStore(db)
 	app := &App{
-		db: db,
+		users:     users,
+		twoFactor: users,
+		sessions:  newPostgresSessionStore(db),
+		attempts:  newPostgresLoginAttemptStore(db),
+		keys:      keys,
+		mailer:    mailer,
+		events:    events,
+		audit:     audit,
+		publicURL: publicURL,
+
+		allowUnverifiedLogin: os.Getenv("ALLOW_UNVERIFIED_LOGIN") == "true",
+
+		oidcProviders:   oidcProviders,
+		oidcStates:      newPostgresOIDCStateStore(db),
+		oidcRedirectURL: os.Getenv("OIDC_POST_LOGIN_REDIRECT_URL"),
+	}
+
+	grpcPort := os.Getenv("GRPC_PORT")
+	if grpcPort == "" {
+		grpcPort = "50051"
+	}
+	grpcServer, err := serveGRPC(app, ":"+grpcPort)
+	if err != nil {
+		log.Fatal("gRPC server failed to start:", err)
+	}
+	defer grpcServer.GracefulStop()
+	log.Printf("Auth gRPC service listening on port %s", grpcPort)
+
+	trustedProxies, err := parseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		log.Fatal("Invalid TRUSTED_PROXIES:", err)
 	}
 
 	router := mux.NewRouter()
+	router.Use(trustProxyHeaders(trustedProxies))
 	setupRoutes(router, app)
 
 	port := os.Getenv("PORT")
@@ -46,10 +131,61 @@ func main() {
 	}
 }
 
+func runCommand(name string, args []string) {
+	switch name {
+	case "migrate":
+		db, err := openDB()
+		if err != nil {
+			log.Fatal("Database connection failed:", err)
+		}
+		defer db.Close()
+
+		if err := runMigrateCommand(db, args); err != nil {
+			log.Fatal("Migration failed: ", err)
+		}
+	case "create-admin":
+		db, err := initDB()
+		if err != nil {
+			log.Fatal("Database initialization failed:", err)
+		}
+		defer db.Close()
+
+		if err := runCreateAdminCommand(newPostgresUserStore(db), args); err != nil {
+			log.Fatal("Creating admin failed: ", err)
+		}
+	default:
+		log.Fatalf("Unknown command %q", name)
+	}
+}
+
 func setupRoutes(router *mux.Router, app *App) {
 	router.HandleFunc("/auth/register", app.handleRegister).Methods("POST")
 	router.HandleFunc("/auth/login", app.handleLogin).Methods("POST")
+	router.HandleFunc("/auth/login/2fa", app.handleTwoFactorLogin).Methods("POST")
 	router.HandleFunc("/auth/verify", app.handleVerifyToken).Methods("POST")
 	router.HandleFunc("/auth/refresh", app.handleRefreshToken).Methods("POST")
 	router.HandleFunc("/auth/logout", app.handleLogout).Methods("POST")
+	router.HandleFunc("/auth/sessions", app.handleListSessions).Methods("GET")
+	router.HandleFunc("/auth/sessions/revoke-others", app.handleRevokeOtherSessions).Methods("POST")
+	router.HandleFunc("/auth/sessions/{id:[0-9]+}", app.handleLabelSession).Methods("PATCH")
+	router.HandleFunc("/auth/sessions/{id:[0-9]+}", app.handleRevokeSession).Methods("DELETE")
+	router.HandleFunc("/auth/me", app.handleGetProfile).Methods("GET")
+	router.HandleFunc("/auth/me", app.handleUpdateProfile).Methods("PATCH")
+	router.HandleFunc("/auth/me", app.handleDeleteAccount).Methods("DELETE")
+	router.HandleFunc("/auth/me/password", app.handleChangePassword).Methods("POST")
+	router.HandleFunc("/auth/.well-known/jwks.json", app.handleJWKS).Methods("GET")
+	router.HandleFunc("/auth/password/forgot", app.handleForgotPassword).Methods("POST")
+	router.HandleFunc("/auth/password/reset", app.handleResetPassword).Methods("POST")
+	router.HandleFunc("/auth/verify-email", app.handleVerifyEmail).Methods("POST")
+	router.HandleFunc("/auth/verify-email/resend", app.handleResendVerification).Methods("POST")
+	router.HandleFunc("/auth/oidc/{provider}/login", app.handleOIDCLogin).Methods("GET")
+	router.HandleFunc("/auth/oidc/{provider}/callback", app.handleOIDCCallback).Methods("GET")
+	router.HandleFunc("/auth/2fa/enroll", app.handleEnrollTwoFactor).Methods("POST")
+	router.HandleFunc("/auth/2fa/confirm", app.handleConfirmTwoFactor).Methods("POST")
+	router.HandleFunc("/auth/2fa/disable", app.handleDisableTwoFactor).Methods("POST")
+	router.HandleFunc("/auth/admin/unlock", app.handleUnlock).Methods("POST")
+	router.HandleFunc("/auth/admin/users", app.handleListUsers).Methods("GET")
+	router.HandleFunc("/auth/admin/users/{id:[0-9]+}/roles", app.handleSetUserRoles).Methods("PUT")
+	router.HandleFunc("/auth/admin/roles", app.handleListRoles).Methods("GET")
+	router.HandleFunc("/auth/admin/roles", app.handleCreateRole).Methods("POST")
 }
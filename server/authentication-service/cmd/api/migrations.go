@@ -1,39 +1,324 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
 	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
 )
 
-func runMigrations(db *sql.DB) error {
-	// Create users table
-	_, err := db.Exec(`
-        CREATE TABLE IF NOT EXISTS users (
-            id SERIAL PRIMARY KEY,
-            email VARCHAR(255) UNIQUE NOT NULL,
-            password_hash VARCHAR(255) NOT NULL,
-            name VARCHAR(255),
-            created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
-        );
-    `)
+// Schema changes live in migrations/ as numbered pairs of files,
+// NNNN_name.up.sql and NNNN_name.down.sql, and are embedded in the binary.
+// Never edit a migration once it has been released; add a new one instead.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLockID is the key of the Postgres advisory lock held while
+// migrating, so replicas starting together apply each migration once.
+const migrationLockID = 5_163_201_734
+
+var migrationFileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+type migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+type migrationStatus struct {
+	migration
+	AppliedAt *time.Time
+}
+
+// loadMigrations reads the embedded migrations in version order. Versions
+// must start at 1 and have no gaps, and every migration needs both files.
+func loadMigrations() ([]migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*migration)
+	for _, entry := range entries {
+		match := migrationFileName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("unexpected file in migrations: %s", entry.Name())
+		}
+
+		version, _ := strconv.Atoi(match[1])
+		m, ok := byVersion[version]
+		if !ok {
+			m = &migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		}
+		if m.Name != match[2] {
+			return nil, fmt.Errorf("migration %d has files with different names", version)
+		}
+
+		body, err := migrationFiles.ReadFile("migrations/" + entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		if match[3] == "up" {
+			m.Up = string(body)
+		} else {
+			m.Down = string(body)
+		}
+	}
+
+	migrations := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %d is missing its up or down file", m.Version)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			return nil, fmt.Errorf("migration versions must be sequential: expected %d, found %d", i+1, m.Version)
+		}
+	}
+	return migrations, nil
+}
+
+// Migrator applies and rolls back the embedded migrations, recording the
+// applied versions in schema_migrations.
+type Migrator struct {
+	db         *sql.DB
+	migrations []migration
+}
+
+func newMigrator(db *sql.DB) (*Migrator, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{db: db, migrations: migrations}, nil
+}
+
+// latest returns the newest known version.
+func (m *Migrator) latest() int {
+	return len(m.migrations)
+}
+
+// withLock runs fn on a single connection holding the migration lock, after
+// making sure schema_migrations exists.
+func (m *Migrator) withLock(ctx context.Context, fn func(conn *sql.Conn) error) error {
+	conn, err := m.db.Conn(ctx)
 	if err != nil {
 		return err
 	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLockID); err != nil {
+		return fmt.Errorf("failed to acquire migration lock: %v", err)
+	}
+	defer func() {
+		if _, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", migrationLockID); err != nil {
+			log.Printf("Error releasing migration lock: %v", err)
+		}
+	}()
 
-	// Create sessions table
-	_, err = db.Exec(`
-        CREATE TABLE IF NOT EXISTS sessions (
-            id SERIAL PRIMARY KEY,
-            user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
-            token VARCHAR(255) UNIQUE NOT NULL,
-            expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
-            created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+	_, err = conn.ExecContext(ctx, `
+        CREATE TABLE IF NOT EXISTS schema_migrations (
+            version INTEGER PRIMARY KEY,
+            name VARCHAR(255) NOT NULL,
+            applied_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
         );
     `)
 	if err != nil {
 		return err
 	}
 
+	return fn(conn)
+}
+
+func currentVersion(ctx context.Context, conn *sql.Conn) (int, error) {
+	var version int
+	err := conn.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version)
+	return version, err
+}
+
+// To migrates up or down until target is the newest applied version. Each
+// migration runs in its own transaction.
+func (m *Migrator) To(ctx context.Context, target int) error {
+	if target < 0 || target > m.latest() {
+		return fmt.Errorf("unknown migration version %d (latest is %d)", target, m.latest())
+	}
+
+	return m.withLock(ctx, func(conn *sql.Conn) error {
+		return m.migrateTo(ctx, conn, target)
+	})
+}
+
+func (m *Migrator) migrateTo(ctx context.Context, conn *sql.Conn, target int) error {
+	current, err := currentVersion(ctx, conn)
+	if err != nil {
+		return err
+	}
+	if current > m.latest() {
+		return fmt.Errorf("database is at version %d, newer than this binary (%d)", current, m.latest())
+	}
+
+	for current < target {
+		next := m.migrations[current]
+		if err := m.apply(ctx, conn, next, next.Up,
+			"INSERT INTO schema_migrations (version, name) VALUES ($1, $2)"); err != nil {
+			return fmt.Errorf("migration %d_%s failed: %v", next.Version, next.Name, err)
+		}
+		log.Printf("Applied migration %d_%s", next.Version, next.Name)
+		current++
+	}
+
+	for current > target {
+		prev := m.migrations[current-1]
+		if err := m.apply(ctx, conn, prev, prev.Down,
+			"DELETE FROM schema_migrations WHERE version = $1 AND name = $2"); err != nil {
+			return fmt.Errorf("rollback of %d_%s failed: %v", prev.Version, prev.Name, err)
+		}
+		log.Printf("Rolled back migration %d_%s", prev.Version, prev.Name)
+		current--
+	}
+
+	return nil
+}
+
+func (m *Migrator) apply(ctx context.Context, conn *sql.Conn, mig migration, script, record string) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, script); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, record, mig.Version, mig.Name); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Up applies every pending migration.
+func (m *Migrator) Up(ctx context.Context) error {
+	return m.To(ctx, m.latest())
+}
+
+// Down rolls back the newest applied migration.
+func (m *Migrator) Down(ctx context.Context) error {
+	return m.withLock(ctx, func(conn *sql.Conn) error {
+		current, err := currentVersion(ctx, conn)
+		if err != nil {
+			return err
+		}
+		if current == 0 {
+			return fmt.Errorf("no migrations to roll back")
+		}
+		return m.migrateTo(ctx, conn, current-1)
+	})
+}
+
+// Status lists every known migration and when it was applied.
+func (m *Migrator) Status(ctx context.Context) ([]migrationStatus, error) {
+	applied := make(map[int]time.Time)
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		rows, err := conn.QueryContext(ctx, "SELECT version, applied_at FROM schema_migrations")
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var version int
+			var appliedAt time.Time
+			if err := rows.Scan(&version, &appliedAt); err != nil {
+				return err
+			}
+			applied[version] = appliedAt
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]migrationStatus, 0, len(m.migrations))
+	for _, mig := range m.migrations {
+		status := migrationStatus{migration: mig}
+		if at, ok := applied[mig.Version]; ok {
+			status.AppliedAt = &at
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// runMigrations brings the schema up to date when the service starts.
+func runMigrations(db *sql.DB) error {
+	migrator, err := newMigrator(db)
+	if err != nil {
+		return err
+	}
+
+	if err := migrator.Up(context.Background()); err != nil {
+		return err
+	}
+
 	log.Println("Database migrations completed successfully")
 	return nil
 }
+
+// runMigrateCommand implements "migrate status|up|down|to N", which manages
+// the schema without starting the server.
+func runMigrateCommand(db *sql.DB, args []string) error {
+	migrator, err := newMigrator(db)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+
+	if len(args) == 0 {
+		return fmt.Errorf("usage: migrate status|up|down|to N")
+	}
+
+	switch args[0] {
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+		for _, s := range statuses {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = "applied " + s.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%04d  %-40s %s\n", s.Version, s.Name, applied)
+		}
+		return nil
+	case "up":
+		return migrator.Up(ctx)
+	case "down":
+		return migrator.Down(ctx)
+	case "to":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: migrate to N")
+		}
+		target, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Errorf("invalid version %q", args[1])
+		}
+		return migrator.To(ctx, target)
+	default:
+		return fmt.Errorf("unknown migrate command %q", args[0])
+	}
+}
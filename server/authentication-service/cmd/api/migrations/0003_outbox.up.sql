@@ -0,0 +1,9 @@
+-- Domain events written in the same transaction as the change they describe
+-- and relayed to RabbitMQ afterwards, so an event is never lost or sent for
+-- a change that was rolled back. Events are deleted once published.
+CREATE TABLE outbox_events (
+    id BIGSERIAL PRIMARY KEY,
+    routing_key VARCHAR(100) NOT NULL,
+    payload JSONB NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
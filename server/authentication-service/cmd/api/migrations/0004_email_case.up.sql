@@ -0,0 +1,15 @@
+-- Emails are unique regardless of case and stored in lower case. Where
+-- accounts differ only in case, the one logins already picked (verified
+-- first, then the oldest) keeps the address. The others could not be
+-- signed into by email anyway; they keep their data and any linked OIDC
+-- identity but get an undeliverable placeholder address.
+UPDATE users SET email = 'duplicate-' || users.id || '@invalid', email_verified = FALSE
+FROM (
+    SELECT id, row_number() OVER (PARTITION BY lower(email) ORDER BY email_verified DESC, id) AS rank
+    FROM users
+) ranked
+WHERE ranked.id = users.id AND ranked.rank > 1;
+
+UPDATE users SET email = lower(email) WHERE email <> lower(email);
+
+CREATE UNIQUE INDEX users_email_lower_key ON users (lower(email));
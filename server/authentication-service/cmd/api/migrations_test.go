@@ -0,0 +1,22 @@
+package main
+
+import "testing"
+
+func TestLoadMigrations(t *testing.T) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) == 0 {
+		t.Fatal("no migrations embedded")
+	}
+
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			t.Errorf("migration %d has version %d", i, m.Version)
+		}
+		if m.Up == "" || m.Down == "" {
+			t.Errorf("migration %d_%s is missing a script", m.Version, m.Name)
+		}
+	}
+}
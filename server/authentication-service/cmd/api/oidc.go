@@ -0,0 +1,386 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/gorilla/mux"
+	"golang.org/x/oauth2"
+)
+
+// oidcLoginTTL is how long a user has to complete the login at the identity
+// provider before the pending state expires.
+const oidcLoginTTL = 10 * time.Minute
+
+type OIDCProviderConfig struct {
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+	RedirectURL  string
+}
+
+// OIDCProvider is an external identity provider users can sign in with.
+// Discovery runs on first use so that an unreachable provider does not stop
+// the service from starting.
+type OIDCProvider struct {
+	config OIDCProviderConfig
+
+	mu       sync.Mutex
+	oauth2   *oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+// OIDCLoginState is a login waiting for the provider's redirect back to us.
+type OIDCLoginState struct {
+	State        string
+	Provider     string
+	Nonce        string
+	CodeVerifier string
+	ExpiresAt    time.Time
+}
+
+// oidcIdentity is what we take from a validated ID token.
+type oidcIdentity struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+// loadOIDCProviders reads OIDC_PROVIDERS, a comma separated list of
+// provider names, and the OIDC_<NAME>_* settings for each of them.
+func loadOIDCProviders() (map[string]*OIDCProvider, error) {
+	providers := make(map[string]*OIDCProvider)
+
+	for _, name := range strings.Split(os.Getenv("OIDC_PROVIDERS"), ",") {
+		name = strings.TrimSpace(strings.ToLower(name))
+		if name == "" {
+			continue
+		}
+
+		prefix := "OIDC_" + strings.ToUpper(name) + "_"
+		config := OIDCProviderConfig{
+			Name:         name,
+			Issuer:       os.Getenv(prefix + "ISSUER"),
+			ClientID:     os.Getenv(prefix + "CLIENT_ID"),
+			ClientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+			RedirectURL:  os.Getenv(prefix + "REDIRECT_URL"),
+			Scopes:       strings.Fields(strings.ReplaceAll(os.Getenv(prefix+"SCOPES"), ",", " ")),
+		}
+		if config.Issuer == "" || config.ClientID == "" || config.RedirectURL == "" {
+			return nil, fmt.Errorf("%sISSUER, %sCLIENT_ID and %sREDIRECT_URL are required", prefix, prefix, prefix)
+		}
+		if len(config.Scopes) == 0 {
+			config.Scopes = []string{"email", "profile"}
+		}
+
+		providers[name] = &OIDCProvider{config: config}
+	}
+
+	return providers, nil
+}
+
+func (p *OIDCProvider) discover(ctx context.Context) (*oauth2.Config, *oidc.IDTokenVerifier, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.oauth2 != nil {
+		return p.oauth2, p.verifier, nil
+	}
+
+	// The provider keeps the context for fetching signing keys later, so it
+	// must outlive the request that triggered discovery.
+	provider, err := oidc.NewProvider(context.WithoutCancel(ctx), p.config.Issuer)
+	if err != nil {
+		return nil, nil, fmt.Errorf("discovery failed for %s: %v", p.config.Name, err)
+	}
+
+	scopes := []string{oidc.ScopeOpenID}
+	for _, scope := range p.config.Scopes {
+		if scope != oidc.ScopeOpenID {
+			scopes = append(scopes, scope)
+		}
+	}
+
+	p.oauth2 = &oauth2.Config{
+		ClientID:     p.config.ClientID,
+		ClientSecret: p.config.ClientSecret,
+		Endpoint:     provider.Endpoint(),
+		RedirectURL:  p.config.RedirectURL,
+		Scopes:       scopes,
+	}
+	p.verifier = provider.Verifier(&oidc.Config{ClientID: p.config.ClientID})
+
+	return p.oauth2, p.verifier, nil
+}
+
+// authCodeURL builds the authorization request, binding it to the given
+// state, nonce and PKCE verifier.
+func (p *OIDCProvider) authCodeURL(ctx context.Context, state, nonce, verifier string) (string, error) {
+	config, _, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	return config.AuthCodeURL(state,
+		oidc.Nonce(nonce),
+		oauth2.S256ChallengeOption(verifier),
+	), nil
+}
+
+// exchange redeems an authorization code and validates the returned ID
+// token's signature, issuer, audience, expiry and nonce.
+func (p *OIDCProvider) exchange(ctx context.Context, code, verifier, nonce string) (*oidcIdentity, error) {
+	config, idVerifier, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := config.Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return nil, fmt.Errorf("code exchange failed: %v", err)
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok || rawIDToken == "" {
+		return nil, errors.New("token response has no id_token")
+	}
+
+	idToken, err := idVerifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, fmt.Errorf("invalid id_token: %v", err)
+	}
+	if idToken.Nonce != nonce {
+		return nil, errors.New("id_token nonce mismatch")
+	}
+
+	var claims struct {
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+		Name          string `json:"name"`
+	}
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, fmt.Errorf("failed to decode id_token claims: %v", err)
+	}
+
+	return &oidcIdentity{
+		Subject:       idToken.Subject,
+		Email:         claims.Email,
+		EmailVerified: claims.EmailVerified,
+		Name:          claims.Name,
+	}, nil
+}
+
+func randomString() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func (app *App) handleOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["provider"]
+	provider, ok := app.oidcProviders[name]
+	if !ok {
+		http.Error(w, "Unknown identity provider", http.StatusNotFound)
+		return
+	}
+
+	state, err := randomString()
+	if err != nil {
+		http.Error(w, "Error starting login", http.StatusInternalServerError)
+		return
+	}
+	nonce, err := randomString()
+	if err != nil {
+		http.Error(w, "Error starting login", http.StatusInternalServerError)
+		return
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	err = app.oidcStates.Create(OIDCLoginState{
+		State:        state,
+		Provider:     name,
+		Nonce:        nonce,
+		CodeVerifier: verifier,
+		ExpiresAt:    time.Now().Add(oidcLoginTTL),
+	})
+	if err != nil {
+		log.Printf("Error storing OIDC login state: %v", err)
+		http.Error(w, "Error starting login", http.StatusInternalServerError)
+		return
+	}
+
+	authURL, err := provider.authCodeURL(r.Context(), state, nonce, verifier)
+	if err != nil {
+		log.Printf("Error building OIDC authorization URL: %v", err)
+		http.Error(w, "Identity provider unavailable", http.StatusBadGateway)
+		return
+	}
+
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+func (app *App) handleOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["provider"]
+	provider, ok := app.oidcProviders[name]
+	if !ok {
+		http.Error(w, "Unknown identity provider", http.StatusNotFound)
+		return
+	}
+
+	query := r.URL.Query()
+	if errCode := query.Get("error"); errCode != "" {
+		log.Printf("OIDC provider %s returned error: %s %s", name, errCode, query.Get("error_description"))
+		http.Error(w, "Login was not completed", http.StatusUnauthorized)
+		return
+	}
+
+	login, err := app.oidcStates.Consume(query.Get("state"), name)
+	if err == errNotFound {
+		http.Error(w, "Invalid or expired login state", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading OIDC login state: %v", err)
+		http.Error(w, "Error completing login", http.StatusInternalServerError)
+		return
+	}
+
+	identity, err := provider.exchange(r.Context(), query.Get("code"), login.CodeVerifier, login.Nonce)
+	if err != nil {
+		log.Printf("OIDC login with %s failed: %v", name, err)
+		http.Error(w, "Login failed", http.StatusUnauthorized)
+		return
+	}
+
+	user, err := app.linkOIDCIdentity(name, identity)
+	if errors.Is(err, errUnverifiedOIDCEmail) {
+		http.Error(w, "The identity provider did not confirm your email address", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		log.Printf("Error linking OIDC identity: %v", err)
+		http.Error(w, "Error completing login", http.StatusInternalServerError)
+		return
+	}
+
+	// The provider stands in for the password only; a second factor is
+	// still required.
+	challenge, err := app.twoFactorChallenge(user.ID)
+	if err != nil {
+		log.Printf("Error starting 2FA challenge: %v", err)
+		http.Error(w, "Error completing login", http.StatusInternalServerError)
+		return
+	}
+	if challenge != nil {
+		if app.oidcRedirectURL != "" {
+			fragment := url.Values{
+				"two_factor_required": {"true"},
+				"challenge_token":     {challenge.ChallengeToken},
+				"expires_at":          {challenge.ExpiresAt},
+			}
+			http.Redirect(w, r, app.oidcRedirectURL+"#"+fragment.Encode(), http.StatusFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(challenge)
+		return
+	}
+
+	resp, err := app.issueSession(user, r)
+	if err != nil {
+		log.Printf("Error creating session: %v", err)
+		http.Error(w, "Error creating session", http.StatusInternalServerError)
+		return
+	}
+
+	// Browsers land here after the provider's redirect, so hand the session
+	// to the web client in the URL fragment, which is never sent to servers.
+	if app.oidcRedirectURL != "" {
+		fragment := url.Values{
+			"token":      {resp.Token},
+			"user_id":    {fmt.Sprint(resp.UserID)},
+			"name":       {resp.Name},
+			"email":      {resp.Email},
+			"expires_at": {resp.ExpiresAt},
+		}
+		http.Redirect(w, r, app.oidcRedirectURL+"#"+fragment.Encode(), http.StatusFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+var errUnverifiedOIDCEmail = errors.New("identity provider did not supply a verified email")
+
+// linkOIDCIdentity returns the user for an external identity. Identities
+// seen before map to their linked user; otherwise the identity is linked to
+// the account with the same email, or a new account is created, but only
+// when the provider vouches for the email address.
+//
+// An unverified account with that email may have been registered by someone
+// else to wait for its owner, so it is claimed for the identity instead: its
+// password, second factor and sessions are dropped before it is linked.
+func (app *App) linkOIDCIdentity(provider string, identity *oidcIdentity) (User, error) {
+	user, err := app.users.ByIdentity(provider, identity.Subject)
+	if err != errNotFound {
+		return user, err
+	}
+
+	if identity.Email == "" || !identity.EmailVerified {
+		return User{}, errUnverifiedOIDCEmail
+	}
+
+	user, err = app.users.ByEmail(identity.Email)
+	switch {
+	case err == errNotFound:
+		// Accounts created through a provider have no password; the user can
+		// set one later through the password reset flow.
+		user = User{Email: identity.Email, Name: identity.Name, EmailVerified: true}
+		err = app.users.Create(&user)
+	case err == nil && !user.EmailVerified:
+		err = app.claimUnverifiedAccount(user.ID)
+		user.EmailVerified = true
+	}
+	if err != nil {
+		return User{}, err
+	}
+
+	if err := app.users.LinkIdentity(user.ID, provider, identity.Subject, identity.Email); err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+// claimUnverifiedAccount removes every way into an unverified account
+// before marking it verified on behalf of the email's owner. Each step
+// only takes access away, so stopping half way leaves nothing exposed.
+func (app *App) claimUnverifiedAccount(userID int) error {
+	if err := app.users.SetPassword(userID, ""); err != nil {
+		return err
+	}
+	if err := app.twoFactor.DisableTOTP(userID); err != nil {
+		return err
+	}
+	if _, err := app.sessions.RevokeAll(userID); err != nil {
+		return err
+	}
+	return app.users.MarkVerified(userID)
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/mux"
+)
+
+// mockIdP is a minimal OpenID provider: discovery, JWKS and a token endpoint
+// that enforces PKCE and returns a signed ID token.
+type mockIdP struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mu       sync.Mutex
+	codes    map[string]mockAuthRequest
+	audience string // overrides the ID token audience when set
+}
+
+type mockAuthRequest struct {
+	challenge string
+	nonce     string
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idp := &mockIdP{key: key, codes: make(map[string]mockAuthRequest)}
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                idp.URL,
+			"authorization_endpoint":                idp.URL + "/authorize",
+			"token_endpoint":                        idp.URL + "/token",
+			"jwks_uri":                              idp.URL + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"alg": "RS256",
+				"use": "sig",
+				"kid": "mock",
+				"n":   base64.RawURLEncoding.EncodeToString(key.PublicKey.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.PublicKey.E)).Bytes()),
+			}},
+		})
+	})
+
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+
+		idp.mu.Lock()
+		req, ok := idp.codes[r.PostForm.Get("code")]
+		delete(idp.codes, r.PostForm.Get("code"))
+		audience := idp.audience
+		idp.mu.Unlock()
+
+		sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != req.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+
+		if audience == "" {
+			audience = r.PostForm.Get("client_id")
+			if user, _, ok := r.BasicAuth(); ok {
+				audience = user
+			}
+		}
+
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+			"iss":            idp.URL,
+			"aud":            audience,
+			"sub":            "mock-user-1",
+			"exp":            time.Now().Add(time.Hour).Unix(),
+			"iat":            time.Now().Unix(),
+			"nonce":          req.nonce,
+			"email":          "jane@example.com",
+			"email_verified": true,
+			"name":           "Jane",
+		})
+		token.Header["kid"] = "mock"
+		idToken, err := token.SignedString(key)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "mock-access-token",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     idToken,
+		})
+	})
+
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+// authorize stands in for the user approving the login at the provider and
+// returns the authorization code that would be sent to the callback.
+func (idp *mockIdP) authorize(t *testing.T, authURL string) string {
+	t.Helper()
+
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		t.Fatalf("authorization request is missing PKCE parameters: %s", authURL)
+	}
+	if !strings.Contains(q.Get("scope"), "openid") {
+		t.Fatalf("authorization request is missing the openid scope: %s", authURL)
+	}
+
+	code := "code-" + q.Get("state")
+	idp.mu.Lock()
+	idp.codes[code] = mockAuthRequest{challenge: q.Get("code_challenge"), nonce: q.Get("nonce")}
+	idp.mu.Unlock()
+	return code
+}
+
+func TestOIDCProviderExchange(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name       string
+		audience   string
+		verifier   func(v string) string
+		nonce      func(n string) string
+		wantErr    string
+		wantUserID string
+	}{
+		{
+			name:       "valid login",
+			wantUserID: "mock-user-1",
+		},
+		{
+			name:     "wrong PKCE verifier",
+			verifier: func(string) string { return "not-the-verifier-used-for-the-challenge-000000" },
+			wantErr:  "code exchange failed",
+		},
+		{
+			name:    "nonce mismatch",
+			nonce:   func(string) string { return "other-nonce" },
+			wantErr: "nonce mismatch",
+		},
+		{
+			name:     "token issued for another client",
+			audience: "someone-else",
+			wantErr:  "invalid id_token",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idp := newMockIdP(t)
+			idp.audience = tt.audience
+
+			provider := &OIDCProvider{config: OIDCProviderConfig{
+				Name:         "mock",
+				Issuer:       idp.URL,
+				ClientID:     "four-colour",
+				ClientSecret: "secret",
+				RedirectURL:  "http://localhost/api/v1/auth/oidc/mock/callback",
+				Scopes:       []string{"email", "profile"},
+			}}
+
+			state, nonce, verifier := "state-1", "nonce-1", "verifier-0123456789012345678901234567890123456789"
+			authURL, err := provider.authCodeURL(ctx, state, nonce, verifier)
+			if err != nil {
+				t.Fatalf("authCodeURL: %v", err)
+			}
+			code := idp.authorize(t, authURL)
+
+			if tt.verifier != nil {
+				verifier = tt.verifier(verifier)
+			}
+			if tt.nonce != nil {
+				nonce = tt.nonce(nonce)
+			}
+
+			identity, err := provider.exchange(ctx, code, verifier, nonce)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("exchange: %v", err)
+			}
+
+			if identity.Subject != tt.wantUserID || identity.Email != "jane@example.com" || !identity.EmailVerified {
+				t.Fatalf("unexpected identity: %+v", identity)
+			}
+		})
+	}
+}
+
+func TestLoadOIDCProviders(t *testing.T) {
+	t.Setenv("OIDC_PROVIDERS", "Company")
+	t.Setenv("OIDC_COMPANY_ISSUER", "https://idp.example.com")
+	t.Setenv("OIDC_COMPANY_CLIENT_ID", "four-colour")
+	t.Setenv("OIDC_COMPANY_REDIRECT_URL", "https://app.example.com/api/v1/auth/oidc/company/callback")
+	t.Setenv("OIDC_COMPANY_SCOPES", "email,groups")
+
+	providers, err := loadOIDCProviders()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	provider, ok := providers["company"]
+	if !ok {
+		t.Fatalf("provider not loaded: %v", providers)
+	}
+	if got := strings.Join(provider.config.Scopes, " "); got != "email groups" {
+		t.Fatalf("unexpected scopes %q", got)
+	}
+
+	t.Setenv("OIDC_COMPANY_CLIENT_ID", "")
+	if _, err := loadOIDCProviders(); err == nil {
+		t.Fatal("expected an error for a provider without a client id")
+	}
+}
+
+func TestLinkOIDCIdentity(t *testing.T) {
+	tests := []struct {
+		name         string
+		email        string
+		verified     bool
+		existing     bool // a password account exists for jane@example.com
+		existingOK   bool // and its email is verified
+		wantErr      error
+		wantExisting bool // the identity is linked to the existing account
+		wantPassword bool // which keeps its password and sessions
+	}{
+		{"new account", "jane@example.com", true, false, false, nil, false, false},
+		{"verified account", "jane@example.com", true, true, true, nil, true, true},
+		{"email differs in case", "Jane@Example.com", true, true, true, nil, true, true},
+		{"unverified account is claimed", "jane@example.com", true, true, false, nil, true, false},
+		{"email not vouched for", "jane@example.com", false, true, true, errUnverifiedOIDCEmail, false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t)
+
+			var existing User
+			var token string
+			if tt.existing {
+				existing = app.createTestUser(t, "jane@example.com", tt.existingOK)
+				token = app.login(t, existing.Email)
+			}
+
+			user, err := app.linkOIDCIdentity("mock", &oidcIdentity{
+				Subject:       "mock-user-1",
+				Email:         tt.email,
+				EmailVerified: tt.verified,
+				Name:          "Jane",
+			})
+			if tt.wantErr != nil {
+				if err != tt.wantErr {
+					t.Fatalf("got error %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if (user.ID == existing.ID) != tt.wantExisting {
+				t.Fatalf("linked to user %d, existing user is %d", user.ID, existing.ID)
+			}
+			stored, err := app.users.ByID(user.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !stored.EmailVerified {
+				t.Fatal("linked account is not verified")
+			}
+			if linked, err := app.users.ByIdentity("mock", "mock-user-1"); err != nil || linked.ID != user.ID {
+				t.Fatalf("identity maps to user %d (%v), want %d", linked.ID, err, user.ID)
+			}
+
+			if !tt.existing {
+				return
+			}
+			if hasPassword := stored.PasswordHash != ""; hasPassword != tt.wantPassword {
+				t.Fatalf("account has a password: %v, want %v", hasPassword, tt.wantPassword)
+			}
+			rec := call(app.handleVerifyToken, "POST", token, nil)
+			if signedIn := rec.Code == http.StatusOK; signedIn != tt.wantPassword {
+				t.Fatalf("earlier session still valid: %v, want %v", signedIn, tt.wantPassword)
+			}
+		})
+	}
+}
+
+// oidcLogin runs a login with the mock provider through both handlers and
+// returns the callback's response.
+func (app *App) oidcLogin(t *testing.T, idp *mockIdP) *httptest.ResponseRecorder {
+	t.Helper()
+
+	app.oidcProviders = map[string]*OIDCProvider{"mock": {config: OIDCProviderConfig{
+		Name:         "mock",
+		Issuer:       idp.URL,
+		ClientID:     "four-colour",
+		ClientSecret: "secret",
+		RedirectURL:  "http://localhost/api/v1/auth/oidc/mock/callback",
+		Scopes:       []string{"email", "profile"},
+	}}}
+	vars := map[string]string{"provider": "mock"}
+
+	rec := httptest.NewRecorder()
+	app.handleOIDCLogin(rec, mux.SetURLVars(httptest.NewRequest("GET", "/", nil), vars))
+	if rec.Code != http.StatusFound {
+		t.Fatalf("login returned %d: %s", rec.Code, rec.Body)
+	}
+	authURL, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := idp.authorize(t, authURL.String())
+
+	callback := url.Values{"state": {authURL.Query().Get("state")}, "code": {code}}
+	rec = httptest.NewRecorder()
+	app.handleOIDCCallback(rec, mux.SetURLVars(httptest.NewRequest("GET", "/?"+callback.Encode(), nil), vars))
+	return rec
+}
+
+func TestOIDCCallbackTwoFactor(t *testing.T) {
+	tests := []struct {
+		name          string
+		twoFactor     bool
+		wantChallenge bool
+	}{
+		{"without 2FA", false, false},
+		{"with 2FA", true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t)
+			user := app.createTestUser(t, "jane@example.com", true)
+			if tt.twoFactor {
+				if err := app.twoFactor.StartTOTP(user.ID, "JBSWY3DPEHPK3PXP"); err != nil {
+					t.Fatal(err)
+				}
+				if err := app.twoFactor.EnableTOTP(user.ID, nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			rec := app.oidcLogin(t, newMockIdP(t))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("got status %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+			}
+
+			var resp struct {
+				Token             string `json:"token"`
+				TwoFactorRequired bool   `json:"two_factor_required"`
+				ChallengeToken    string `json:"challenge_token"`
+			}
+			if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.TwoFactorRequired != tt.wantChallenge || (resp.ChallengeToken != "") != tt.wantChallenge {
+				t.Fatalf("got challenge %v, want %v", resp.TwoFactorRequired, tt.wantChallenge)
+			}
+			if (resp.Token != "") == tt.wantChallenge {
+				t.Fatalf("got session token %q with challenge %v", resp.Token, tt.wantChallenge)
+			}
+
+			sessions, err := app.sessions.List(user.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantSessions := 1
+			if tt.wantChallenge {
+				wantSessions = 0
+			}
+			if len(sessions) != wantSessions {
+				t.Fatalf("got %d sessions, want %d", len(sessions), wantSessions)
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+// userEventsExchange is the topic exchange domain events about accounts
+// are published to. Services that clean up after a deletion report back on
+// the same exchange with a user.deletion_completed event.
+const (
+	userEventsExchange = "user_events"
+	userDeletedKey     = "user.deleted"
+)
+
+// OutboxEvent is a domain event waiting to be relayed to RabbitMQ.
+type OutboxEvent struct {
+	ID         int64
+	RoutingKey string
+	Payload    json.RawMessage
+	CreatedAt  time.Time
+}
+
+// UserDeletedEvent is published when an account is deleted. Consumers use
+// EventID to recognise redeliveries. It names the user only by ID, so no
+// personal data is left on the bus or in the outbox.
+type UserDeletedEvent struct {
+	EventID    string    `json:"event_id"`
+	UserID     string    `json:"user_id"`
+	OccurredAt time.Time `json:"occurred_at"`
+}
+
+func newEventID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func newUserDeletedEvent(userID int) (OutboxEvent, error) {
+	id, err := newEventID()
+	if err != nil {
+		return OutboxEvent{}, err
+	}
+
+	payload, err := json.Marshal(UserDeletedEvent{
+		EventID:    id,
+		UserID:     fmt.Sprint(userID),
+		OccurredAt: time.Now().UTC(),
+	})
+	if err != nil {
+		return OutboxEvent{}, err
+	}
+	return OutboxEvent{RoutingKey: userDeletedKey, Payload: payload}, nil
+}
+
+// OutboxRelay publishes recorded events in order. An event is marked
+// published only after the broker confirms it, so delivery is at least
+// once and consumers must tolerate duplicates.
+type OutboxRelay struct {
+	outbox OutboxStore
+	events *EventPublisher
+}
+
+func newOutboxRelay(outbox OutboxStore, events *EventPublisher) *OutboxRelay {
+	return &OutboxRelay{outbox: outbox, events: events}
+}
+
+func (r *OutboxRelay) Start(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := r.relay(); err != nil {
+					log.Printf("Outbox relay failed: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// relay publishes pending events until the outbox is empty or a publish
+// fails, in which case the rest wait for the next tick.
+func (r *OutboxRelay) relay() error {
+	for {
+		events, err := r.outbox.Pending(100)
+		if err != nil {
+			return err
+		}
+		if len(events) == 0 {
+			return nil
+		}
+
+		for _, event := range events {
+			if err := r.events.PublishConfirmed(userEventsExchange, event.RoutingKey, event.Payload); err != nil {
+				return fmt.Errorf("failed to publish event %d: %v", event.ID, err)
+			}
+			if err := r.outbox.MarkPublished(event.ID); err != nil {
+				return err
+			}
+		}
+	}
+}
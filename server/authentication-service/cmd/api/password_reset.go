@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	passwordResetTTL = time.Hour
+	// A reset link is sent at most once per interval, and at most
+	// maxPasswordResetsPerDay times in 24 hours, so the endpoint can't be
+	// used to flood an inbox.
+	passwordResetInterval   = time.Minute
+	maxPasswordResetsPerDay = 5
+)
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email"`
+}
+
+type ResetPasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+func (app *App) handleForgotPassword(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var req ForgotPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Email == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Email is required"})
+		return
+	}
+
+	// The response is the same whether or not the account exists or is
+	// rate limited, so this endpoint cannot be used to discover registered
+	// emails.
+	user, err := app.users.ByEmail(req.Email)
+	var lastSent time.Time
+	var sentToday int
+	if err == nil {
+		lastSent, sentToday, err = app.users.PasswordResetsSent(user.ID, time.Now().Add(-24*time.Hour))
+	}
+
+	switch {
+	case err == errNotFound:
+	case err != nil:
+		log.Printf("Database error looking up user for password reset: %v", err)
+	case time.Since(lastSent) < passwordResetInterval,
+		sentToday >= maxPasswordResetsPerDay:
+		log.Printf("Password reset email for user %d rate limited", user.ID)
+	default:
+		go app.sendPasswordReset(user)
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "If an account exists for this email, a reset link has been sent",
+	})
+}
+
+func (app *App) sendPasswordReset(user User) {
+	token, tokenHash, err := generateOpaqueToken()
+	if err != nil {
+		log.Printf("Error generating password reset token: %v", err)
+		return
+	}
+
+	if err := app.users.CreatePasswordReset(user.ID, tokenHash, time.Now().Add(passwordResetTTL)); err != nil {
+		log.Printf("Error storing password reset token: %v", err)
+		return
+	}
+
+	link := fmt.Sprintf("%s/reset-password?token=%s", app.publicURL, url.QueryEscape(token))
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	err = app.mailer.Send(ctx, Mail{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf(
+			"Hi %s,\n\nUse the link below to choose a new password. It expires in %s.\n\n%s\n\n"+
+				"If you did not request a password reset, you can ignore this email.",
+			user.Name, passwordResetTTL, link,
+		),
+	})
+	if err != nil {
+		log.Printf("Error sending password reset email to user %d: %v", user.ID, err)
+	}
+}
+
+func (app *App) handleResetPassword(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var req ResetPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request body"})
+		return
+	}
+
+	if req.Token == "" || req.Password == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Token and password are required"})
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		log.Printf("Password hashing error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Error processing password"})
+		return
+	}
+
+	// The token is consumed as the password is set, so it works only once.
+	userID, err := app.users.ResetPassword(hashOpaqueToken(req.Token), string(hashedPassword))
+	if err == errNotFound {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid or expired reset token"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error resetting password: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Error resetting password"})
+		return
+	}
+
+	// Sign out every device, in case the reset was prompted by a compromise.
+	if _, err := app.sessions.RevokeAll(userID); err != nil {
+		log.Printf("Error revoking sessions after password reset for user %d: %v", userID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Password was reset, but signing out other devices failed"})
+		return
+	}
+
+	app.audit.Log(r, AuthLog{
+		EventType:   "password_reset",
+		UserID:      fmt.Sprint(userID),
+		Description: "Password reset with an emailed link; all sessions revoked",
+		Severity:    1,
+	})
+
+	json.NewEncoder(w).Encode(map[string]string{"message": "Password has been reset"})
+}
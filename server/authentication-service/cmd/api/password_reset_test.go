@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+)
+
+var mailedTokenPattern = regexp.MustCompile(`token=(\S+)`)
+
+// mailedToken returns the token in the link of the last mail sent.
+func (app *App) mailedToken(t *testing.T) string {
+	t.Helper()
+
+	mailer := app.mailer.(*recordingMailer)
+	mailer.mu.Lock()
+	defer mailer.mu.Unlock()
+	if len(mailer.sent) == 0 {
+		t.Fatal("no mail was sent")
+	}
+	match := mailedTokenPattern.FindStringSubmatch(mailer.sent[len(mailer.sent)-1].Body)
+	if match == nil {
+		t.Fatal("mail has no link with a token")
+	}
+	token, err := url.QueryUnescape(match[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestHandleResetPassword(t *testing.T) {
+	app := newTestApp(t)
+	user := app.createTestUser(t, "user@example.com", true)
+	session := app.login(t, user.Email)
+
+	app.sendPasswordReset(user)
+	token := app.mailedToken(t)
+
+	const newPassword = "a brand new passphrase"
+	req := ResetPasswordRequest{Token: token, Password: newPassword}
+	if rec := call(app.handleResetPassword, "POST", "", req); rec.Code != http.StatusOK {
+		t.Fatalf("reset returned %d: %s", rec.Code, rec.Body)
+	}
+
+	if rec := call(app.handleVerifyToken, "POST", session, nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("session still accepted after password reset: %d", rec.Code)
+	}
+	if rec := call(app.handleLogin, "POST", "", LoginRequest{Email: user.Email, Password: newPassword}); rec.Code != http.StatusOK {
+		t.Errorf("login with the new password returned %d: %s", rec.Code, rec.Body)
+	}
+
+	req.Password = "yet another passphrase"
+	if rec := call(app.handleResetPassword, "POST", "", req); rec.Code != http.StatusBadRequest {
+		t.Errorf("reusing the reset token returned %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+	if rec := call(app.handleResetPassword, "POST", "", ResetPasswordRequest{Token: "bogus", Password: newPassword}); rec.Code != http.StatusBadRequest {
+		t.Errorf("unknown reset token returned %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestHandleForgotPasswordUnknownEmail(t *testing.T) {
+	app := newTestApp(t)
+	app.createTestUser(t, "user@example.com", true)
+
+	known := call(app.handleForgotPassword, "POST", "", ForgotPasswordRequest{Email: "user@example.com"})
+	unknown := call(app.handleForgotPassword, "POST", "", ForgotPasswordRequest{Email: "nobody@example.com"})
+	if known.Code != http.StatusAccepted || unknown.Code != known.Code || unknown.Body.String() != known.Body.String() {
+		t.Errorf("responses differ: %d %q for a known email, %d %q for an unknown one",
+			known.Code, known.Body, unknown.Code, unknown.Body)
+	}
+}
+
+// mailCount waits briefly for mail sent in the background and returns how
+// many messages were sent.
+func (app *App) mailCount(want int) int {
+	mailer := app.mailer.(*recordingMailer)
+	deadline := time.Now().Add(time.Second)
+	for {
+		mailer.mu.Lock()
+		n := len(mailer.sent)
+		mailer.mu.Unlock()
+		if n >= want || time.Now().After(deadline) {
+			return n
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHandleForgotPasswordRateLimit(t *testing.T) {
+	tests := []struct {
+		name     string
+		sent     int
+		sentAgo  time.Duration
+		wantMail bool
+	}{
+		{"first request", 0, 0, true},
+		{"after the interval", 1, 10 * time.Minute, true},
+		{"within the interval", 1, 0, false},
+		{"daily limit reached", maxPasswordResetsPerDay, 10 * time.Minute, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t)
+			user := app.createTestUser(t, "user@example.com", true)
+			users := app.users.(*memoryUserStore)
+			for i := 0; i < tt.sent; i++ {
+				app.sendPasswordReset(user)
+			}
+			for _, token := range users.resetTokens {
+				token.createdAt = token.createdAt.Add(-tt.sentAgo)
+			}
+
+			rec := call(app.handleForgotPassword, "POST", "", ForgotPasswordRequest{Email: user.Email})
+			if rec.Code != http.StatusAccepted {
+				t.Fatalf("got status %d, want %d: %s", rec.Code, http.StatusAccepted, rec.Body)
+			}
+
+			want := tt.sent
+			if tt.wantMail {
+				want++
+			}
+			if got := app.mailCount(tt.sent + 1); got != want {
+				t.Errorf("%d mails sent, want %d", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const maxNameLength = 100
+
+type ProfileResponse struct {
+	User
+	TwoFactorEnabled bool `json:"two_factor_enabled"`
+}
+
+// UpdateProfileRequest holds the fields to change; omitted fields are left
+// alone. Changing the email requires the current password, since whoever
+// controls the address can reset the password.
+type UpdateProfileRequest struct {
+	Name            *string `json:"name"`
+	Email           *string `json:"email"`
+	CurrentPassword string  `json:"current_password"`
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+type DeleteAccountRequest struct {
+	Password string `json:"password"`
+}
+
+// currentUser authenticates the request and loads the caller's account. On
+// failure it writes the response and returns false.
+func (app *App) currentUser(w http.ResponseWriter, r *http.Request) (User, int, bool) {
+	claims, sessionID, err := app.authenticateSession(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Authentication required"})
+		return User{}, 0, false
+	}
+
+	user, err := app.users.ByID(claims.UserID)
+	if err != nil {
+		log.Printf("Error loading user %d: %v", claims.UserID, err)
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Authentication required"})
+		return User{}, 0, false
+	}
+	return user, sessionID, true
+}
+
+// confirmPassword checks password against the user's current one, counting
+// failures towards the same lockout as logins so a stolen session cannot be
+// used to guess it. Accounts created through OIDC have no password and must
+// set one with a password reset first. On failure it writes the response and
+// returns false.
+func (app *App) confirmPassword(w http.ResponseWriter, r *http.Request, user User, password string) bool {
+	ip := clientIP(r)
+	until, err := app.lockedUntil(accountKey(user.Email), ipKey(ip))
+	if err != nil {
+		log.Printf("Error checking lockout: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Internal server error"})
+		return false
+	}
+	if !until.IsZero() {
+		writeLocked(w, until)
+		return false
+	}
+
+	if user.PasswordHash == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "This account has no password; set one with a password reset first",
+		})
+		return false
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) != nil {
+		app.registerLoginFailure(r, user.Email, user.ID)
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Current password is incorrect"})
+		return false
+	}
+
+	if err := app.clearFailures(accountKey(user.Email)); err != nil {
+		log.Printf("Error clearing failed logins: %v", err)
+	}
+	return true
+}
+
+func (app *App) writeProfile(w http.ResponseWriter, user User) {
+	twoFactor, err := app.users.TwoFactorEnabled(user.ID)
+	if err != nil {
+		log.Printf("Error loading 2FA state: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Error loading profile"})
+		return
+	}
+	json.NewEncoder(w).Encode(ProfileResponse{User: user, TwoFactorEnabled: twoFactor})
+}
+
+func (app *App) handleGetProfile(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	user, _, ok := app.currentUser(w, r)
+	if !ok {
+		return
+	}
+	app.writeProfile(w, user)
+}
+
+// handleUpdateProfile changes the caller's name and/or email. A new email
+// is unverified until the link sent to it is opened.
+func (app *App) handleUpdateProfile(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	user, _, ok := app.currentUser(w, r)
+	if !ok {
+		return
+	}
+
+	var req UpdateProfileRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request body"})
+		return
+	}
+
+	if req.Name != nil {
+		name := strings.TrimSpace(*req.Name)
+		if len(name) > maxNameLength {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error": fmt.Sprintf("Name must be at most %d characters", maxNameLength),
+			})
+			return
+		}
+		user.Name = name
+	}
+
+	// Addresses are stored in lower case, so a change of case alone is none.
+	emailChanged := req.Email != nil && normalizeEmail(*req.Email) != user.Email
+	if emailChanged {
+		if !validEmail(*req.Email) {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Invalid email address"})
+			return
+		}
+		if !app.confirmPassword(w, r, user, req.CurrentPassword) {
+			return
+		}
+		user.Email = normalizeEmail(*req.Email)
+		user.EmailVerified = false
+	}
+
+	err := app.users.Update(user)
+	if err == errDuplicateEmail {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": "User with this email already exists"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error updating user %d: %v", user.ID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Error updating profile"})
+		return
+	}
+
+	if emailChanged {
+		go app.sendEmailVerification(user)
+
+		app.audit.Log(r, AuthLog{
+			EventType:   "email_changed",
+			UserID:      fmt.Sprint(user.ID),
+			Description: "User changed their email address",
+			Severity:    1,
+		})
+	}
+
+	app.writeProfile(w, user)
+}
+
+// handleChangePassword sets a new password and signs out every other
+// session, keeping the one that made the change.
+func (app *App) handleChangePassword(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	user, sessionID, ok := app.currentUser(w, r)
+	if !ok {
+		return
+	}
+
+	var req ChangePasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.NewPassword == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "New password is required"})
+		return
+	}
+
+	if !app.confirmPassword(w, r, user, req.CurrentPassword) {
+		return
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Error processing password"})
+		return
+	}
+
+	if err := app.users.SetPassword(user.ID, string(hash)); err != nil {
+		log.Printf("Error setting password for user %d: %v", user.ID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Error updating password"})
+		return
+	}
+
+	revoked, err := app.sessions.RevokeOthers(user.ID, sessionID)
+	if err != nil {
+		log.Printf("Error revoking sessions for user %d: %v", user.ID, err)
+	}
+
+	app.audit.Log(r, AuthLog{
+		EventType:   "password_changed",
+		UserID:      fmt.Sprint(user.ID),
+		Description: "User changed their password",
+		Severity:    1,
+		Metadata: map[string]string{
+			"sessions_revoked": fmt.Sprint(revoked),
+		},
+	})
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": "Password changed",
+		"revoked": revoked,
+	})
+}
+
+// handleDeleteAccount permanently removes the caller's account. Sessions,
+// tokens and linked identities are removed with it.
+func (app *App) handleDeleteAccount(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	user, _, ok := app.currentUser(w, r)
+	if !ok {
+		return
+	}
+
+	var req DeleteAccountRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Password == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Password is required"})
+		return
+	}
+
+	if !app.confirmPassword(w, r, user, req.Password) {
+		return
+	}
+
+	if err := app.users.Delete(user.ID); err != nil {
+		log.Printf("Error deleting user %d: %v", user.ID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Error deleting account"})
+		return
+	}
+
+	app.audit.Log(r, AuthLog{
+		EventType:   "account_deleted",
+		UserID:      fmt.Sprint(user.ID),
+		Description: "User deleted their account",
+		Severity:    1,
+	})
+
+	json.NewEncoder(w).Encode(map[string]string{"message": "Account deleted"})
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func strPtr(s string) *string { return &s }
+
+func TestHandleUpdateProfile(t *testing.T) {
+	tests := []struct {
+		name         string
+		req          UpdateProfileRequest
+		wantCode     int
+		wantEmail    string
+		wantVerified bool
+	}{
+		{"rename", UpdateProfileRequest{Name: strPtr("Jane")}, http.StatusOK, "user@example.com", true},
+		{"change email", UpdateProfileRequest{Email: strPtr("new@example.com"), CurrentPassword: testPassword}, http.StatusOK, "new@example.com", false},
+		{"email without password", UpdateProfileRequest{Email: strPtr("new@example.com")}, http.StatusUnauthorized, "user@example.com", true},
+		{"email taken", UpdateProfileRequest{Email: strPtr("taken@example.com"), CurrentPassword: testPassword}, http.StatusConflict, "user@example.com", true},
+		{"email taken in another case", UpdateProfileRequest{Email: strPtr("Taken@Example.com"), CurrentPassword: testPassword}, http.StatusConflict, "user@example.com", true},
+		{"change of case only", UpdateProfileRequest{Email: strPtr("User@Example.com")}, http.StatusOK, "user@example.com", true},
+		{"new email in mixed case", UpdateProfileRequest{Email: strPtr("New@Example.com"), CurrentPassword: testPassword}, http.StatusOK, "new@example.com", false},
+		{"invalid email", UpdateProfileRequest{Email: strPtr("not an email"), CurrentPassword: testPassword}, http.StatusBadRequest, "user@example.com", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t)
+			user := app.createTestUser(t, "user@example.com", true)
+			app.createTestUser(t, "taken@example.com", true)
+			token := app.login(t, user.Email)
+
+			rec := call(app.handleUpdateProfile, "PATCH", token, tt.req)
+			if rec.Code != tt.wantCode {
+				t.Fatalf("got status %d, want %d: %s", rec.Code, tt.wantCode, rec.Body)
+			}
+
+			stored, _ := app.users.ByID(user.ID)
+			if stored.Email != tt.wantEmail || stored.EmailVerified != tt.wantVerified {
+				t.Errorf("unexpected user %+v", stored)
+			}
+		})
+	}
+}
+
+func TestHandleChangePassword(t *testing.T) {
+	app := newTestApp(t)
+	user := app.createTestUser(t, "user@example.com", true)
+	token := app.login(t, user.Email)
+	otherToken := app.login(t, user.Email)
+
+	rec := call(app.handleChangePassword, "POST", token, ChangePasswordRequest{CurrentPassword: "wrong", NewPassword: "new password"})
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("wrong current password returned %d", rec.Code)
+	}
+
+	rec = call(app.handleChangePassword, "POST", token, ChangePasswordRequest{CurrentPassword: testPassword, NewPassword: "new password"})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("change password returned %d: %s", rec.Code, rec.Body)
+	}
+
+	if rec := call(app.handleVerifyToken, "POST", token, nil); rec.Code != http.StatusOK {
+		t.Errorf("current session revoked: %d", rec.Code)
+	}
+	if rec := call(app.handleVerifyToken, "POST", otherToken, nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("other session still accepted: %d", rec.Code)
+	}
+	if rec := call(app.handleLogin, "POST", "", LoginRequest{Email: user.Email, Password: "new password"}); rec.Code != http.StatusOK {
+		t.Errorf("login with new password returned %d", rec.Code)
+	}
+}
+
+func TestHandleDeleteAccount(t *testing.T) {
+	app := newTestApp(t)
+	user := app.createTestUser(t, "user@example.com", true)
+	token := app.login(t, user.Email)
+
+	if rec := call(app.handleDeleteAccount, "DELETE", token, DeleteAccountRequest{Password: "wrong"}); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("wrong password returned %d", rec.Code)
+	}
+
+	rec := call(app.handleDeleteAccount, "DELETE", token, DeleteAccountRequest{Password: testPassword})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("delete returned %d: %s", rec.Code, rec.Body)
+	}
+
+	if _, err := app.users.ByID(user.ID); err != errNotFound {
+		t.Errorf("user still exists: %v", err)
+	}
+	if rec := call(app.handleGetProfile, "GET", token, nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("profile of deleted user returned %d", rec.Code)
+	}
+	events, _ := app.users.(OutboxStore).Pending(10)
+	if len(events) != 1 || events[0].RoutingKey != userDeletedKey {
+		t.Fatalf("expected one user.deleted event, got %+v", events)
+	}
+	var event UserDeletedEvent
+	if err := json.Unmarshal(events[0].Payload, &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.UserID != strconv.Itoa(user.ID) || event.EventID == "" {
+		t.Errorf("unexpected event %+v", event)
+	}
+	if strings.Contains(string(events[0].Payload), user.Email) {
+		t.Errorf("event carries the deleted user's email: %s", events[0].Payload)
+	}
+}
+
+func TestHandleGetProfile(t *testing.T) {
+	app := newTestApp(t)
+	user := app.createTestUser(t, "user@example.com", true)
+	token := app.login(t, user.Email)
+
+	rec := call(app.handleGetProfile, "GET", token, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body)
+	}
+
+	var resp ProfileResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.ID != user.ID || resp.Email != user.Email || resp.TwoFactorEnabled {
+		t.Errorf("unexpected profile %+v", resp)
+	}
+}
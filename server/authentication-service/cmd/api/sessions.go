@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	maxUserAgentLength = 512
+	maxLabelLength     = 100
+
+	// lastSeenResolution limits how often a session's last_seen_at is
+	// written, since every authenticated request through the gateway
+	// verifies its token.
+	lastSeenResolution = time.Minute
+)
+
+type SessionLabelRequest struct {
+	Label string `json:"label"`
+}
+
+func truncate(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	return s[:max]
+}
+
+// touchSession records that a session was just used.
+func (app *App) touchSession(id int) {
+	if err := app.sessions.Touch(id, lastSeenResolution); err != nil {
+		log.Printf("Error updating session last seen time: %v", err)
+	}
+}
+
+// sessionIDParam reads the {id} route variable.
+func sessionIDParam(r *http.Request) (int, bool) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	return id, err == nil
+}
+
+// handleListSessions returns the caller's active sessions, newest first,
+// marking the one the request was made with.
+func (app *App) handleListSessions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	claims, currentID, err := app.authenticateSession(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Authentication required"})
+		return
+	}
+
+	sessions, err := app.sessions.List(claims.UserID)
+	if err != nil {
+		log.Printf("Error listing sessions: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Error listing sessions"})
+		return
+	}
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == currentID
+	}
+
+	json.NewEncoder(w).Encode(sessions)
+}
+
+// handleLabelSession lets users name a session, e.g. "Work laptop".
+func (app *App) handleLabelSession(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	claims, err := app.authenticate(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Authentication required"})
+		return
+	}
+
+	id, ok := sessionIDParam(r)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Session not found"})
+		return
+	}
+
+	var req SessionLabelRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request body"})
+		return
+	}
+	label := strings.TrimSpace(req.Label)
+	if len(label) > maxLabelLength {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Label is too long"})
+		return
+	}
+
+	found, err := app.sessions.SetLabel(claims.UserID, id, label)
+	if err != nil {
+		log.Printf("Error labelling session: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Error updating session"})
+		return
+	}
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Session not found"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"message": "Session updated"})
+}
+
+// handleRevokeSession signs out one of the caller's sessions, such as a lost
+// device. Revoking the current session is equivalent to logging out.
+func (app *App) handleRevokeSession(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	claims, err := app.authenticate(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Authentication required"})
+		return
+	}
+
+	id, ok := sessionIDParam(r)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Session not found"})
+		return
+	}
+
+	found, err := app.sessions.Revoke(claims.UserID, id)
+	if err != nil {
+		log.Printf("Error revoking session: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Error revoking session"})
+		return
+	}
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Session not found"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"message": "Session revoked"})
+}
+
+// handleRevokeOtherSessions signs out every session of the caller except the
+// one making the request.
+func (app *App) handleRevokeOtherSessions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	claims, currentID, err := app.authenticateSession(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Authentication required"})
+		return
+	}
+
+	revoked, err := app.sessions.RevokeOthers(claims.UserID, currentID)
+	if err != nil {
+		log.Printf("Error revoking sessions: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Error revoking sessions"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": "Other sessions revoked",
+		"revoked": revoked,
+	})
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestHandleRevokeOtherSessions(t *testing.T) {
+	app := newTestApp(t)
+	user := app.createTestUser(t, "user@example.com", true)
+	other := app.createTestUser(t, "other@example.com", true)
+	current := app.login(t, user.Email)
+	second := app.login(t, user.Email)
+	third := app.login(t, user.Email)
+	othersToken := app.login(t, other.Email)
+
+	rec := call(app.handleRevokeOtherSessions, "POST", current, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("revoke returned %d: %s", rec.Code, rec.Body)
+	}
+	var resp struct {
+		Revoked int64 `json:"revoked"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Revoked != 2 {
+		t.Errorf("revoked %d sessions, want 2", resp.Revoked)
+	}
+
+	for _, token := range []string{second, third} {
+		if rec := call(app.handleVerifyToken, "POST", token, nil); rec.Code != http.StatusUnauthorized {
+			t.Errorf("revoked session still accepted: %d", rec.Code)
+		}
+	}
+	for _, token := range []string{current, othersToken} {
+		if rec := call(app.handleVerifyToken, "POST", token, nil); rec.Code != http.StatusOK {
+			t.Errorf("session that should be kept was rejected: %d", rec.Code)
+		}
+	}
+
+	rec = call(app.handleListSessions, "GET", current, nil)
+	var sessions []Session
+	if err := json.NewDecoder(rec.Body).Decode(&sessions); err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 || !sessions[0].Current {
+		t.Errorf("got sessions %+v, want only the current one", sessions)
+	}
+}
+
+func TestHandleRevokeOtherSessionsUnauthenticated(t *testing.T) {
+	app := newTestApp(t)
+
+	if rec := call(app.handleRevokeOtherSessions, "POST", "", nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
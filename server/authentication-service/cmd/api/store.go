@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	errNotFound       = errors.New("not found")
+	errDuplicateEmail = errors.New("a user with this email already exists")
+	errDuplicateRole  = errors.New("a role with this name already exists")
+	errUnknownRole    = errors.New("unknown role")
+)
+
+// UserStore persists accounts, their roles and their email verification
+// state. Users are returned with their roles.
+type UserStore interface {
+	// Create inserts user with the "user" role and sets its ID and Roles. The
+	// email is stored in lower case. It returns errDuplicateEmail if the
+	// address is taken.
+	Create(user *User) error
+	ByID(id int) (User, error)
+	// ByEmail matches the address case-insensitively.
+	ByEmail(email string) (User, error)
+	List() ([]User, error)
+	// ByIDs returns the users that exist among ids, ordered by ID.
+	ByIDs(ids []int) ([]User, error)
+	// Update saves the user's name, email and email_verified. Changing the
+	// email discards outstanding verification links, which were sent to the
+	// old address. It returns errDuplicateEmail if the new address is taken.
+	Update(user User) error
+	SetPassword(userID int, passwordHash string) error
+	MarkVerified(userID int) error
+	// Delete removes the user along with everything that references them
+	// and records a user.deleted event in the outbox, atomically.
+	Delete(userID int) error
+	TwoFactorEnabled(userID int) (bool, error)
+
+	Roles() ([]Role, error)
+	// CreateRole returns errDuplicateRole if the name is taken.
+	CreateRole(role Role) error
+	// SetRoles replaces a user's roles. It returns errUnknownRole if any of
+	// them does not exist.
+	SetRoles(userID int, roles []string) error
+
+	CreateEmailVerification(userID int, tokenHash string, expiresAt time.Time) error
+	// ConsumeEmailVerification marks the token's user as verified, discards
+	// their other outstanding tokens and returns the user's ID. Unknown, used
+	// and expired tokens give errNotFound.
+	ConsumeEmailVerification(tokenHash string) (int, error)
+	// EmailVerificationsSent reports when the user was last sent a
+	// verification link and how many links were sent after since.
+	EmailVerificationsSent(userID int, since time.Time) (time.Time, int, error)
+
+	// CreatePasswordReset stores a reset token, expiring the user's other
+	// unused ones so that only the most recent link is valid.
+	CreatePasswordReset(userID int, tokenHash string, expiresAt time.Time) error
+	// PasswordResetsSent reports when the user was last sent a reset link
+	// and how many links were sent after since.
+	PasswordResetsSent(userID int, since time.Time) (time.Time, int, error)
+	// ResetPassword consumes the token and sets its user's password in one
+	// step, returning the user's ID. Unknown, used and expired tokens give
+	// errNotFound.
+	ResetPassword(tokenHash, passwordHash string) (int, error)
+
+	// ByIdentity returns the user an external identity is linked to.
+	ByIdentity(provider, subject string) (User, error)
+	LinkIdentity(userID int, provider, subject, email string) error
+}
+
+// TwoFactorStore persists TOTP secrets and recovery codes. The user stores
+// implement it, so that UserStore.TwoFactorEnabled sees its changes.
+type TwoFactorStore interface {
+	// TOTPSecret returns the user's secret, confirmed or not.
+	TOTPSecret(userID int) (string, error)
+	// StartTOTP stores an unconfirmed secret, replacing any earlier one.
+	StartTOTP(userID int, secret string) error
+	// UseTOTPStep records that a code from step was accepted. It reports
+	// false if that step or a later one was used before.
+	UseTOTPStep(userID int, step int64) (bool, error)
+	// EnableTOTP confirms the user's secret and replaces their recovery
+	// codes.
+	EnableTOTP(userID int, recoveryCodeHashes []string) error
+	// UseRecoveryCode reports whether the user had the code unused, and
+	// marks it used.
+	UseRecoveryCode(userID int, codeHash string) (bool, error)
+	// DisableTOTP removes the user's secret and recovery codes.
+	DisableTOTP(userID int) error
+}
+
+// SessionStore persists sessions, keyed by the hash of their jti.
+type SessionStore interface {
+	// Create inserts session and sets its ID.
+	Create(session *Session) error
+	// Active returns the unexpired session with the given hash.
+	Active(hash string) (Session, error)
+	// Touch updates the session's last_seen_at if it is older than
+	// resolution.
+	Touch(id int, resolution time.Duration) error
+	// Rotate moves an active session to a new hash and expiry.
+	Rotate(oldHash, newHash string, expiresAt time.Time) error
+	// Delete removes the session with the given hash, reporting whether it
+	// existed.
+	Delete(hash string) (bool, error)
+
+	// List returns a user's active sessions, newest first.
+	List(userID int) ([]Session, error)
+	SetLabel(userID, id int, label string) (bool, error)
+	Revoke(userID, id int) (bool, error)
+	// RevokeOthers removes all of a user's sessions except keepID and
+	// returns how many were removed.
+	RevokeOthers(userID, keepID int) (int64, error)
+	// RevokeAll removes all of a user's sessions and returns how many were
+	// removed.
+	RevokeAll(userID int) (int64, error)
+}
+
+// OIDCStateStore persists pending OIDC logins, so that the callback can be
+// served by any replica.
+type OIDCStateStore interface {
+	// Create stores a pending login and clears out abandoned ones.
+	Create(state OIDCLoginState) error
+	// Consume removes and returns the unexpired pending login for state, so
+	// that each authorization response is used once. Unknown and expired
+	// states give errNotFound.
+	Consume(state, provider string) (OIDCLoginState, error)
+}
+
+// OutboxStore hands domain events recorded by the other stores to the
+// relay that publishes them.
+type OutboxStore interface {
+	// Pending returns up to limit unpublished events, oldest first.
+	Pending(limit int) ([]OutboxEvent, error)
+	// MarkPublished removes a published event. Events are not kept once
+	// the broker has them.
+	MarkPublished(id int64) error
+}
+
+// LoginAttemptStore counts failed attempts per lockout key.
+type LoginAttemptStore interface {
+	// LockedUntil returns the latest lock expiry among keys, or the zero time
+	// if none of them is locked.
+	LockedUntil(keys ...string) (time.Time, error)
+	// RecordFailure counts a failure against key, restarting the count if
+	// the previous failure is older than window, and returns the count.
+	RecordFailure(key string, window time.Duration) (int, error)
+	Lock(key string, until time.Time) error
+	Clear(keys ...string) error
+}
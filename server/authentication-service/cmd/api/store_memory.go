@@ -0,0 +1,736 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The in-memory stores keep everything in maps guarded by a mutex, so
+// handlers can be tested without Postgres.
+
+// memoryToken is an emailed verification or password reset token.
+type memoryToken struct {
+	userID    int
+	expiresAt time.Time
+	createdAt time.Time
+	used      bool
+}
+
+type memoryTOTP struct {
+	secret   string
+	enabled  bool
+	lastStep int64 // 0 until a code is used
+	// recoveryCodes maps code hashes to whether they were used.
+	recoveryCodes map[string]bool
+}
+
+type memoryIdentity struct {
+	provider string
+	subject  string
+}
+
+type memoryUserStore struct {
+	mu                 sync.Mutex
+	nextID             int
+	users              map[int]User
+	roles              []Role
+	twoFactor          map[int]*memoryTOTP
+	verificationTokens map[string]*memoryToken
+	resetTokens        map[string]*memoryToken
+	identities         map[memoryIdentity]int
+	nextEventID        int64
+	outbox             []OutboxEvent
+}
+
+func newMemoryUserStore() *memoryUserStore {
+	return &memoryUserStore{
+		users:              make(map[int]User),
+		roles:              []Role{{Name: roleAdmin}, {Name: roleUser}},
+		twoFactor:          make(map[int]*memoryTOTP),
+		verificationTokens: make(map[string]*memoryToken),
+		resetTokens:        make(map[string]*memoryToken),
+		identities:         make(map[memoryIdentity]int),
+	}
+}
+
+func (s *memoryUserStore) Create(user *User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user.Email = normalizeEmail(user.Email)
+	for _, existing := range s.users {
+		if existing.Email == user.Email {
+			return errDuplicateEmail
+		}
+	}
+
+	s.nextID++
+	user.ID = s.nextID
+	user.Roles = []string{roleUser}
+	s.users[user.ID] = *user
+	return nil
+}
+
+func (s *memoryUserStore) ByID(id int) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[id]
+	if !ok {
+		return User{}, errNotFound
+	}
+	return user, nil
+}
+
+func (s *memoryUserStore) ByEmail(email string) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, user := range s.users {
+		if strings.EqualFold(user.Email, email) {
+			return user, nil
+		}
+	}
+	return User{}, errNotFound
+}
+
+func (s *memoryUserStore) List() ([]User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	users := []User{}
+	for _, user := range s.users {
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	return users, nil
+}
+
+func (s *memoryUserStore) ByIDs(ids []int) ([]User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	users := []User{}
+	seen := make(map[int]bool)
+	for _, id := range ids {
+		if user, ok := s.users[id]; ok && !seen[id] {
+			users = append(users, user)
+			seen[id] = true
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	return users, nil
+}
+
+func (s *memoryUserStore) Update(user User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, ok := s.users[user.ID]
+	if !ok {
+		return errNotFound
+	}
+	user.Email = normalizeEmail(user.Email)
+	for id, other := range s.users {
+		if id != user.ID && other.Email == user.Email {
+			return errDuplicateEmail
+		}
+	}
+
+	if existing.Email != user.Email {
+		for hash, token := range s.verificationTokens {
+			if token.userID == user.ID {
+				delete(s.verificationTokens, hash)
+			}
+		}
+	}
+
+	existing.Name = user.Name
+	existing.Email = user.Email
+	existing.EmailVerified = user.EmailVerified
+	s.users[user.ID] = existing
+	return nil
+}
+
+func (s *memoryUserStore) SetPassword(userID int, passwordHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[userID]
+	if !ok {
+		return errNotFound
+	}
+	user.PasswordHash = passwordHash
+	s.users[userID] = user
+	return nil
+}
+
+func (s *memoryUserStore) MarkVerified(userID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[userID]
+	if !ok {
+		return errNotFound
+	}
+	user.EmailVerified = true
+	s.users[userID] = user
+	return nil
+}
+
+func (s *memoryUserStore) Delete(userID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[userID]; !ok {
+		return errNotFound
+	}
+
+	event, err := newUserDeletedEvent(userID)
+	if err != nil {
+		return err
+	}
+	s.nextEventID++
+	event.ID = s.nextEventID
+	event.CreatedAt = time.Now()
+	s.outbox = append(s.outbox, event)
+
+	delete(s.users, userID)
+	delete(s.twoFactor, userID)
+	for _, tokens := range []map[string]*memoryToken{s.verificationTokens, s.resetTokens} {
+		for hash, token := range tokens {
+			if token.userID == userID {
+				delete(tokens, hash)
+			}
+		}
+	}
+	for identity, id := range s.identities {
+		if id == userID {
+			delete(s.identities, identity)
+		}
+	}
+	return nil
+}
+
+// The memory user store is also its own OutboxStore, since it is the only
+// store that records events.
+
+func (s *memoryUserStore) Pending(limit int) ([]OutboxEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.outbox) < limit {
+		limit = len(s.outbox)
+	}
+	return append([]OutboxEvent(nil), s.outbox[:limit]...), nil
+}
+
+func (s *memoryUserStore) MarkPublished(id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, event := range s.outbox {
+		if event.ID == id {
+			s.outbox = append(s.outbox[:i], s.outbox[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (s *memoryUserStore) Roles() ([]Role, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Role(nil), s.roles...), nil
+}
+
+func (s *memoryUserStore) CreateRole(role Role) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, existing := range s.roles {
+		if existing.Name == role.Name {
+			return errDuplicateRole
+		}
+	}
+	s.roles = append(s.roles, role)
+	sort.Slice(s.roles, func(i, j int) bool { return s.roles[i].Name < s.roles[j].Name })
+	return nil
+}
+
+func (s *memoryUserStore) SetRoles(userID int, roles []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[userID]
+	if !ok {
+		return errNotFound
+	}
+
+	known := make(map[string]bool)
+	for _, role := range s.roles {
+		known[role.Name] = true
+	}
+	for _, role := range roles {
+		if !known[role] {
+			return errUnknownRole
+		}
+	}
+
+	user.Roles = uniqueStrings(roles)
+	sort.Strings(user.Roles)
+	s.users[userID] = user
+	return nil
+}
+
+func (s *memoryUserStore) TwoFactorEnabled(userID int) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	totp := s.twoFactor[userID]
+	return totp != nil && totp.enabled, nil
+}
+
+func (s *memoryUserStore) CreateEmailVerification(userID int, tokenHash string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.verificationTokens[tokenHash] = &memoryToken{
+		userID:    userID,
+		expiresAt: expiresAt,
+		createdAt: time.Now(),
+	}
+	return nil
+}
+
+func (s *memoryUserStore) ConsumeEmailVerification(tokenHash string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token, ok := s.verificationTokens[tokenHash]
+	if !ok || token.used || !token.expiresAt.After(time.Now()) {
+		return 0, errNotFound
+	}
+	token.used = true
+
+	user := s.users[token.userID]
+	user.EmailVerified = true
+	s.users[token.userID] = user
+
+	for hash, other := range s.verificationTokens {
+		if other.userID == token.userID && !other.used {
+			delete(s.verificationTokens, hash)
+		}
+	}
+	return token.userID, nil
+}
+
+func (s *memoryUserStore) EmailVerificationsSent(userID int, since time.Time) (time.Time, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var last time.Time
+	var count int
+	for _, token := range s.verificationTokens {
+		if token.userID != userID {
+			continue
+		}
+		if token.createdAt.After(last) {
+			last = token.createdAt
+		}
+		if token.createdAt.After(since) {
+			count++
+		}
+	}
+	return last, count, nil
+}
+
+func (s *memoryUserStore) CreatePasswordReset(userID int, tokenHash string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for _, token := range s.resetTokens {
+		if token.userID == userID && !token.used && token.expiresAt.After(now) {
+			token.expiresAt = now
+		}
+	}
+	s.resetTokens[tokenHash] = &memoryToken{
+		userID:    userID,
+		expiresAt: expiresAt,
+		createdAt: time.Now(),
+	}
+	return nil
+}
+
+func (s *memoryUserStore) PasswordResetsSent(userID int, since time.Time) (time.Time, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var last time.Time
+	var count int
+	for _, token := range s.resetTokens {
+		if token.userID != userID {
+			continue
+		}
+		if token.createdAt.After(last) {
+			last = token.createdAt
+		}
+		if token.createdAt.After(since) {
+			count++
+		}
+	}
+	return last, count, nil
+}
+
+func (s *memoryUserStore) ResetPassword(tokenHash, passwordHash string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token, ok := s.resetTokens[tokenHash]
+	if !ok || token.used || !token.expiresAt.After(time.Now()) {
+		return 0, errNotFound
+	}
+	token.used = true
+
+	user := s.users[token.userID]
+	user.PasswordHash = passwordHash
+	s.users[token.userID] = user
+	return token.userID, nil
+}
+
+func (s *memoryUserStore) ByIdentity(provider, subject string) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[s.identities[memoryIdentity{provider, subject}]]
+	if !ok {
+		return User{}, errNotFound
+	}
+	return user, nil
+}
+
+func (s *memoryUserStore) LinkIdentity(userID int, provider, subject, email string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[userID]; !ok {
+		return errNotFound
+	}
+	s.identities[memoryIdentity{provider, subject}] = userID
+	return nil
+}
+
+// The memory user store is also its own TwoFactorStore.
+
+func (s *memoryUserStore) TOTPSecret(userID int) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	totp, ok := s.twoFactor[userID]
+	if !ok {
+		return "", errNotFound
+	}
+	return totp.secret, nil
+}
+
+func (s *memoryUserStore) StartTOTP(userID int, secret string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if totp, ok := s.twoFactor[userID]; ok {
+		totp.secret = secret
+		totp.lastStep = 0
+		return nil
+	}
+	s.twoFactor[userID] = &memoryTOTP{secret: secret}
+	return nil
+}
+
+func (s *memoryUserStore) UseTOTPStep(userID int, step int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	totp, ok := s.twoFactor[userID]
+	if !ok || totp.lastStep >= step {
+		return false, nil
+	}
+	totp.lastStep = step
+	return true, nil
+}
+
+func (s *memoryUserStore) EnableTOTP(userID int, recoveryCodeHashes []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	totp, ok := s.twoFactor[userID]
+	if !ok {
+		return errNotFound
+	}
+	totp.enabled = true
+	totp.recoveryCodes = make(map[string]bool)
+	for _, hash := range recoveryCodeHashes {
+		totp.recoveryCodes[hash] = false
+	}
+	return nil
+}
+
+func (s *memoryUserStore) UseRecoveryCode(userID int, codeHash string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	totp, ok := s.twoFactor[userID]
+	if !ok {
+		return false, nil
+	}
+	used, exists := totp.recoveryCodes[codeHash]
+	if !exists || used {
+		return false, nil
+	}
+	totp.recoveryCodes[codeHash] = true
+	return true, nil
+}
+
+func (s *memoryUserStore) DisableTOTP(userID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.twoFactor, userID)
+	return nil
+}
+
+type memorySessionStore struct {
+	mu       sync.Mutex
+	nextID   int
+	sessions map[int]*Session
+}
+
+func newMemorySessionStore() *memorySessionStore {
+	return &memorySessionStore{sessions: make(map[int]*Session)}
+}
+
+func (s *memorySessionStore) Create(session *Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextID++
+	session.ID = s.nextID
+	session.CreatedAt = time.Now()
+	session.LastSeenAt = session.CreatedAt
+	stored := *session
+	s.sessions[session.ID] = &stored
+	return nil
+}
+
+// active returns the unexpired session with hash. s.mu must be held.
+func (s *memorySessionStore) active(hash string) *Session {
+	for _, session := range s.sessions {
+		if session.Hash == hash && session.ExpiresAt.After(time.Now()) {
+			return session
+		}
+	}
+	return nil
+}
+
+func (s *memorySessionStore) Active(hash string) (Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session := s.active(hash)
+	if session == nil {
+		return Session{}, errNotFound
+	}
+	return *session, nil
+}
+
+func (s *memorySessionStore) Touch(id int, resolution time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if session, ok := s.sessions[id]; ok && time.Since(session.LastSeenAt) >= resolution {
+		session.LastSeenAt = time.Now()
+	}
+	return nil
+}
+
+func (s *memorySessionStore) Rotate(oldHash, newHash string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session := s.active(oldHash)
+	if session == nil {
+		return errNotFound
+	}
+	session.Hash = newHash
+	session.ExpiresAt = expiresAt
+	session.LastSeenAt = time.Now()
+	return nil
+}
+
+func (s *memorySessionStore) Delete(hash string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, session := range s.sessions {
+		if session.Hash == hash {
+			delete(s.sessions, id)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *memorySessionStore) List(userID int) ([]Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sessions := []Session{}
+	for _, session := range s.sessions {
+		if session.UserID == userID && session.ExpiresAt.After(time.Now()) {
+			sessions = append(sessions, *session)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].ID > sessions[j].ID })
+	return sessions, nil
+}
+
+func (s *memorySessionStore) SetLabel(userID, id int, label string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, ok := s.sessions[id]
+	if !ok || session.UserID != userID || !session.ExpiresAt.After(time.Now()) {
+		return false, nil
+	}
+	session.Label = label
+	return true, nil
+}
+
+func (s *memorySessionStore) Revoke(userID, id int) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, ok := s.sessions[id]
+	if !ok || session.UserID != userID {
+		return false, nil
+	}
+	delete(s.sessions, id)
+	return true, nil
+}
+
+func (s *memorySessionStore) RevokeOthers(userID, keepID int) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var revoked int64
+	for id, session := range s.sessions {
+		if session.UserID == userID && id != keepID {
+			delete(s.sessions, id)
+			revoked++
+		}
+	}
+	return revoked, nil
+}
+
+func (s *memorySessionStore) RevokeAll(userID int) (int64, error) {
+	return s.RevokeOthers(userID, 0)
+}
+
+type memoryOIDCStateStore struct {
+	mu     sync.Mutex
+	states map[string]OIDCLoginState
+}
+
+func newMemoryOIDCStateStore() *memoryOIDCStateStore {
+	return &memoryOIDCStateStore{states: make(map[string]OIDCLoginState)}
+}
+
+func (s *memoryOIDCStateStore) Create(state OIDCLoginState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, other := range s.states {
+		if other.ExpiresAt.Before(time.Now()) {
+			delete(s.states, key)
+		}
+	}
+	s.states[state.State] = state
+	return nil
+}
+
+func (s *memoryOIDCStateStore) Consume(state, provider string) (OIDCLoginState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	login, ok := s.states[state]
+	if !ok || login.Provider != provider || !login.ExpiresAt.After(time.Now()) {
+		return OIDCLoginState{}, errNotFound
+	}
+	delete(s.states, state)
+	return login, nil
+}
+
+type memoryLoginAttempt struct {
+	failures      int
+	lockedUntil   time.Time
+	lastFailureAt time.Time
+}
+
+type memoryLoginAttemptStore struct {
+	mu       sync.Mutex
+	attempts map[string]*memoryLoginAttempt
+}
+
+func newMemoryLoginAttemptStore() *memoryLoginAttemptStore {
+	return &memoryLoginAttemptStore{attempts: make(map[string]*memoryLoginAttempt)}
+}
+
+func (s *memoryLoginAttemptStore) LockedUntil(keys ...string) (time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var until time.Time
+	for _, key := range keys {
+		if a, ok := s.attempts[key]; ok && a.lockedUntil.After(time.Now()) && a.lockedUntil.After(until) {
+			until = a.lockedUntil
+		}
+	}
+	return until, nil
+}
+
+func (s *memoryLoginAttemptStore) RecordFailure(key string, window time.Duration) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a, ok := s.attempts[key]
+	if !ok {
+		a = &memoryLoginAttempt{}
+		s.attempts[key] = a
+	} else if time.Since(a.lastFailureAt) > window {
+		a.failures = 0
+	}
+	a.failures++
+	a.lastFailureAt = time.Now()
+	return a.failures, nil
+}
+
+func (s *memoryLoginAttemptStore) Lock(key string, until time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if a, ok := s.attempts[key]; ok {
+		a.lockedUntil = until
+	}
+	return nil
+}
+
+func (s *memoryLoginAttemptStore) Clear(keys ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, key := range keys {
+		delete(s.attempts, key)
+	}
+	return nil
+}
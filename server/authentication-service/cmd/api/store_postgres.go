@@ -0,0 +1,770 @@
+package main
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+type postgresUserStore struct {
+	db *sql.DB
+}
+
+func newPostgresUserStore(db *sql.DB) *postgresUserStore {
+	return &postgresUserStore{db: db}
+}
+
+func isUniqueViolation(err error) bool {
+	return err != nil && (strings.Contains(err.Error(), "unique constraint") ||
+		strings.Contains(err.Error(), "duplicate key"))
+}
+
+// insertUserSQL creates a user with the "user" role. Its parameters are
+// email, password hash, name and email_verified.
+const insertUserSQL = `
+    WITH new_user AS (
+        INSERT INTO users (email, password_hash, name, email_verified)
+        VALUES ($1, $2, $3, $4)
+        RETURNING id
+    )
+    INSERT INTO user_roles (user_id, role_id)
+    SELECT new_user.id, roles.id FROM new_user, roles WHERE roles.name = 'user'
+    RETURNING user_id`
+
+func (s *postgresUserStore) Create(user *User) error {
+	user.Email = normalizeEmail(user.Email)
+	err := s.db.QueryRow(
+		insertUserSQL,
+		user.Email,
+		user.PasswordHash,
+		user.Name,
+		user.EmailVerified,
+	).Scan(&user.ID)
+
+	if isUniqueViolation(err) {
+		return errDuplicateEmail
+	}
+	if err != nil {
+		return err
+	}
+	user.Roles = []string{roleUser}
+	return nil
+}
+
+const userColumns = `id, email, password_hash, name, email_verified,
+        ARRAY(SELECT r.name FROM user_roles ur JOIN roles r ON r.id = ur.role_id
+              WHERE ur.user_id = users.id ORDER BY r.name)`
+
+func (s *postgresUserStore) ByID(id int) (User, error) {
+	return scanUser(s.db.QueryRow("SELECT "+userColumns+" FROM users WHERE id = $1", id))
+}
+
+func (s *postgresUserStore) ByEmail(email string) (User, error) {
+	return scanUser(s.db.QueryRow(
+		"SELECT "+userColumns+" FROM users WHERE lower(email) = lower($1)",
+		email,
+	))
+}
+
+func (s *postgresUserStore) List() ([]User, error) {
+	return s.query("SELECT " + userColumns + " FROM users ORDER BY id")
+}
+
+func (s *postgresUserStore) ByIDs(ids []int) ([]User, error) {
+	return s.query("SELECT "+userColumns+" FROM users WHERE id = ANY($1) ORDER BY id", pq.Array(ids))
+}
+
+func (s *postgresUserStore) query(query string, args ...interface{}) ([]User, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+func (s *postgresUserStore) Update(user User) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	user.Email = normalizeEmail(user.Email)
+	var oldEmail string
+	err = tx.QueryRow("SELECT email FROM users WHERE id = $1 FOR UPDATE", user.ID).Scan(&oldEmail)
+	if err == sql.ErrNoRows {
+		return errNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		"UPDATE users SET name = $2, email = $3, email_verified = $4 WHERE id = $1",
+		user.ID,
+		user.Name,
+		user.Email,
+		user.EmailVerified,
+	)
+	if isUniqueViolation(err) {
+		return errDuplicateEmail
+	}
+	if err != nil {
+		return err
+	}
+
+	if oldEmail != user.Email {
+		if _, err := tx.Exec("DELETE FROM email_verification_tokens WHERE user_id = $1", user.ID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *postgresUserStore) SetPassword(userID int, passwordHash string) error {
+	return s.exec("UPDATE users SET password_hash = $2 WHERE id = $1", userID, passwordHash)
+}
+
+func (s *postgresUserStore) MarkVerified(userID int) error {
+	return s.exec("UPDATE users SET email_verified = TRUE WHERE id = $1", userID)
+}
+
+func (s *postgresUserStore) Delete(userID int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	found, err := affected(tx.Exec("DELETE FROM users WHERE id = $1", userID))
+	if err != nil {
+		return err
+	}
+	if !found {
+		return errNotFound
+	}
+
+	event, err := newUserDeletedEvent(userID)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(
+		"INSERT INTO outbox_events (routing_key, payload) VALUES ($1, $2)",
+		event.RoutingKey,
+		[]byte(event.Payload),
+	); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// exec runs a statement against a single user, mapping "no rows" to
+// errNotFound.
+func (s *postgresUserStore) exec(query string, args ...interface{}) error {
+	found, err := affected(s.db.Exec(query, args...))
+	if err != nil {
+		return err
+	}
+	if !found {
+		return errNotFound
+	}
+	return nil
+}
+
+func scanUser(row scanner) (User, error) {
+	var user User
+	var name sql.NullString
+	err := row.Scan(&user.ID, &user.Email, &user.PasswordHash, &name, &user.EmailVerified, pq.Array(&user.Roles))
+	if err == sql.ErrNoRows {
+		return User{}, errNotFound
+	}
+	user.Name = name.String
+	return user, err
+}
+
+func (s *postgresUserStore) Roles() ([]Role, error) {
+	rows, err := s.db.Query("SELECT name, description FROM roles ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := []Role{}
+	for rows.Next() {
+		var role Role
+		if err := rows.Scan(&role.Name, &role.Description); err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+	return roles, rows.Err()
+}
+
+func (s *postgresUserStore) CreateRole(role Role) error {
+	_, err := s.db.Exec(
+		"INSERT INTO roles (name, description) VALUES ($1, $2)",
+		role.Name,
+		role.Description,
+	)
+	if isUniqueViolation(err) {
+		return errDuplicateRole
+	}
+	return err
+}
+
+func (s *postgresUserStore) SetRoles(userID int, roles []string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE id = $1)", userID).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return errNotFound
+	}
+
+	var known int
+	if err := tx.QueryRow(
+		"SELECT COUNT(*) FROM roles WHERE name = ANY($1)",
+		pq.Array(roles),
+	).Scan(&known); err != nil {
+		return err
+	}
+	if known != len(uniqueStrings(roles)) {
+		return errUnknownRole
+	}
+
+	if _, err := tx.Exec("DELETE FROM user_roles WHERE user_id = $1", userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(
+		"INSERT INTO user_roles (user_id, role_id) SELECT $1, id FROM roles WHERE name = ANY($2)",
+		userID,
+		pq.Array(roles),
+	); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func uniqueStrings(values []string) []string {
+	seen := make(map[string]bool)
+	var unique []string
+	for _, v := range values {
+		if !seen[v] {
+			seen[v] = true
+			unique = append(unique, v)
+		}
+	}
+	return unique
+}
+
+func (s *postgresUserStore) TwoFactorEnabled(userID int) (bool, error) {
+	var enabled bool
+	err := s.db.QueryRow(
+		"SELECT enabled FROM user_totp WHERE user_id = $1",
+		userID,
+	).Scan(&enabled)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return enabled, err
+}
+
+func (s *postgresUserStore) CreateEmailVerification(userID int, tokenHash string, expiresAt time.Time) error {
+	_, err := s.db.Exec(
+		"INSERT INTO email_verification_tokens (user_id, token_hash, expires_at) VALUES ($1, $2, $3)",
+		userID,
+		tokenHash,
+		expiresAt,
+	)
+	return err
+}
+
+func (s *postgresUserStore) ConsumeEmailVerification(tokenHash string) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var userID int
+	err = tx.QueryRow(
+		`UPDATE email_verification_tokens SET used_at = NOW()
+         WHERE token_hash = $1 AND used_at IS NULL AND expires_at > NOW()
+         RETURNING user_id`,
+		tokenHash,
+	).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return 0, errNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := tx.Exec("UPDATE users SET email_verified = TRUE WHERE id = $1", userID); err != nil {
+		return 0, err
+	}
+
+	// Links from earlier resends are no longer needed.
+	if _, err := tx.Exec(
+		"DELETE FROM email_verification_tokens WHERE user_id = $1 AND used_at IS NULL",
+		userID,
+	); err != nil {
+		return 0, err
+	}
+
+	return userID, tx.Commit()
+}
+
+func (s *postgresUserStore) EmailVerificationsSent(userID int, since time.Time) (time.Time, int, error) {
+	var last sql.NullTime
+	var count int
+	err := s.db.QueryRow(
+		`SELECT MAX(created_at), COUNT(*) FILTER (WHERE created_at > $2)
+         FROM email_verification_tokens WHERE user_id = $1`,
+		userID,
+		since,
+	).Scan(&last, &count)
+	return last.Time, count, err
+}
+
+func (s *postgresUserStore) CreatePasswordReset(userID int, tokenHash string, expiresAt time.Time) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Old tokens are expired rather than deleted, so that they still count
+	// towards PasswordResetsSent.
+	if _, err := tx.Exec(
+		"UPDATE password_reset_tokens SET expires_at = NOW() WHERE user_id = $1 AND used_at IS NULL AND expires_at > NOW()",
+		userID,
+	); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(
+		"INSERT INTO password_reset_tokens (user_id, token_hash, expires_at) VALUES ($1, $2, $3)",
+		userID,
+		tokenHash,
+		expiresAt,
+	); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *postgresUserStore) PasswordResetsSent(userID int, since time.Time) (time.Time, int, error) {
+	var last sql.NullTime
+	var count int
+	err := s.db.QueryRow(
+		`SELECT MAX(created_at), COUNT(*) FILTER (WHERE created_at > $2)
+         FROM password_reset_tokens WHERE user_id = $1`,
+		userID,
+		since,
+	).Scan(&last, &count)
+	return last.Time, count, err
+}
+
+func (s *postgresUserStore) ResetPassword(tokenHash, passwordHash string) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var userID int
+	err = tx.QueryRow(
+		`UPDATE password_reset_tokens SET used_at = NOW()
+         WHERE token_hash = $1 AND used_at IS NULL AND expires_at > NOW()
+         RETURNING user_id`,
+		tokenHash,
+	).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return 0, errNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := tx.Exec("UPDATE users SET password_hash = $2 WHERE id = $1", userID, passwordHash); err != nil {
+		return 0, err
+	}
+	return userID, tx.Commit()
+}
+
+func (s *postgresUserStore) ByIdentity(provider, subject string) (User, error) {
+	return scanUser(s.db.QueryRow(
+		"SELECT "+userColumns+` FROM users
+         WHERE id = (SELECT user_id FROM user_identities WHERE provider = $1 AND subject = $2)`,
+		provider,
+		subject,
+	))
+}
+
+func (s *postgresUserStore) LinkIdentity(userID int, provider, subject, email string) error {
+	_, err := s.db.Exec(
+		"INSERT INTO user_identities (user_id, provider, subject, email) VALUES ($1, $2, $3, $4)",
+		userID,
+		provider,
+		subject,
+		email,
+	)
+	return err
+}
+
+func (s *postgresUserStore) TOTPSecret(userID int) (string, error) {
+	var secret string
+	err := s.db.QueryRow("SELECT secret FROM user_totp WHERE user_id = $1", userID).Scan(&secret)
+	if err == sql.ErrNoRows {
+		return "", errNotFound
+	}
+	return secret, err
+}
+
+func (s *postgresUserStore) StartTOTP(userID int, secret string) error {
+	_, err := s.db.Exec(
+		`INSERT INTO user_totp (user_id, secret, enabled) VALUES ($1, $2, FALSE)
+         ON CONFLICT (user_id) DO UPDATE SET secret = EXCLUDED.secret, last_used_step = NULL`,
+		userID,
+		secret,
+	)
+	return err
+}
+
+func (s *postgresUserStore) UseTOTPStep(userID int, step int64) (bool, error) {
+	return affected(s.db.Exec(
+		`UPDATE user_totp SET last_used_step = $2
+         WHERE user_id = $1 AND (last_used_step IS NULL OR last_used_step < $2)`,
+		userID,
+		step,
+	))
+}
+
+func (s *postgresUserStore) EnableTOTP(userID int, recoveryCodeHashes []string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	found, err := affected(tx.Exec(
+		"UPDATE user_totp SET enabled = TRUE, confirmed_at = NOW() WHERE user_id = $1",
+		userID,
+	))
+	if err != nil {
+		return err
+	}
+	if !found {
+		return errNotFound
+	}
+
+	if _, err := tx.Exec("DELETE FROM user_recovery_codes WHERE user_id = $1", userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(
+		"INSERT INTO user_recovery_codes (user_id, code_hash) SELECT $1, unnest($2::text[])",
+		userID,
+		pq.Array(recoveryCodeHashes),
+	); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *postgresUserStore) UseRecoveryCode(userID int, codeHash string) (bool, error) {
+	return affected(s.db.Exec(
+		`UPDATE user_recovery_codes SET used_at = NOW()
+         WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL`,
+		userID,
+		codeHash,
+	))
+}
+
+func (s *postgresUserStore) DisableTOTP(userID int) error {
+	// Recovery codes go with the secret through the foreign key cascade.
+	_, err := s.db.Exec("DELETE FROM user_totp WHERE user_id = $1", userID)
+	return err
+}
+
+type postgresSessionStore struct {
+	db *sql.DB
+}
+
+func newPostgresSessionStore(db *sql.DB) *postgresSessionStore {
+	return &postgresSessionStore{db: db}
+}
+
+func (s *postgresSessionStore) Create(session *Session) error {
+	return s.db.QueryRow(
+		`INSERT INTO sessions (user_id, session_hash, expires_at, created_ip, user_agent)
+         VALUES ($1, $2, $3, $4, $5)
+         RETURNING id, created_at, last_seen_at`,
+		session.UserID,
+		session.Hash,
+		session.ExpiresAt,
+		session.CreatedIP,
+		session.UserAgent,
+	).Scan(&session.ID, &session.CreatedAt, &session.LastSeenAt)
+}
+
+const sessionColumns = `id, user_id, session_hash, COALESCE(label, ''), COALESCE(created_ip, ''),
+        COALESCE(user_agent, ''), created_at, COALESCE(last_seen_at, created_at), expires_at`
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanSession(row scanner) (Session, error) {
+	var session Session
+	err := row.Scan(
+		&session.ID,
+		&session.UserID,
+		&session.Hash,
+		&session.Label,
+		&session.CreatedIP,
+		&session.UserAgent,
+		&session.CreatedAt,
+		&session.LastSeenAt,
+		&session.ExpiresAt,
+	)
+	if err == sql.ErrNoRows {
+		return Session{}, errNotFound
+	}
+	return session, err
+}
+
+func (s *postgresSessionStore) Active(hash string) (Session, error) {
+	return scanSession(s.db.QueryRow(
+		"SELECT "+sessionColumns+" FROM sessions WHERE session_hash = $1 AND expires_at > NOW()",
+		hash,
+	))
+}
+
+func (s *postgresSessionStore) Touch(id int, resolution time.Duration) error {
+	_, err := s.db.Exec(
+		`UPDATE sessions SET last_seen_at = NOW()
+         WHERE id = $1 AND (last_seen_at IS NULL OR last_seen_at < NOW() - $2 * INTERVAL '1 second')`,
+		id,
+		int64(resolution.Seconds()),
+	)
+	return err
+}
+
+func (s *postgresSessionStore) Rotate(oldHash, newHash string, expiresAt time.Time) error {
+	result, err := s.db.Exec(
+		`UPDATE sessions SET session_hash = $2, expires_at = $3, last_seen_at = NOW()
+         WHERE session_hash = $1 AND expires_at > NOW()`,
+		oldHash,
+		newHash,
+		expiresAt,
+	)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+func (s *postgresSessionStore) Delete(hash string) (bool, error) {
+	return affected(s.db.Exec("DELETE FROM sessions WHERE session_hash = $1", hash))
+}
+
+func (s *postgresSessionStore) List(userID int) ([]Session, error) {
+	rows, err := s.db.Query(
+		"SELECT "+sessionColumns+" FROM sessions WHERE user_id = $1 AND expires_at > NOW() ORDER BY created_at DESC",
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+func (s *postgresSessionStore) SetLabel(userID, id int, label string) (bool, error) {
+	return affected(s.db.Exec(
+		"UPDATE sessions SET label = NULLIF($3, '') WHERE id = $1 AND user_id = $2 AND expires_at > NOW()",
+		id,
+		userID,
+		label,
+	))
+}
+
+func (s *postgresSessionStore) Revoke(userID, id int) (bool, error) {
+	return affected(s.db.Exec("DELETE FROM sessions WHERE id = $1 AND user_id = $2", id, userID))
+}
+
+func (s *postgresSessionStore) RevokeOthers(userID, keepID int) (int64, error) {
+	result, err := s.db.Exec("DELETE FROM sessions WHERE user_id = $1 AND id <> $2", userID, keepID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (s *postgresSessionStore) RevokeAll(userID int) (int64, error) {
+	result, err := s.db.Exec("DELETE FROM sessions WHERE user_id = $1", userID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// affected reports whether a statement changed any rows.
+func affected(result sql.Result, err error) (bool, error) {
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+type postgresLoginAttemptStore struct {
+	db *sql.DB
+}
+
+func newPostgresLoginAttemptStore(db *sql.DB) *postgresLoginAttemptStore {
+	return &postgresLoginAttemptStore{db: db}
+}
+
+func (s *postgresLoginAttemptStore) LockedUntil(keys ...string) (time.Time, error) {
+	var until sql.NullTime
+	err := s.db.QueryRow(
+		"SELECT MAX(locked_until) FROM login_attempts WHERE key = ANY($1) AND locked_until > NOW()",
+		pq.Array(keys),
+	).Scan(&until)
+	return until.Time, err
+}
+
+func (s *postgresLoginAttemptStore) RecordFailure(key string, window time.Duration) (int, error) {
+	var failures int
+	err := s.db.QueryRow(
+		`INSERT INTO login_attempts (key, failures, last_failure_at) VALUES ($1, 1, NOW())
+         ON CONFLICT (key) DO UPDATE SET
+             failures = CASE WHEN login_attempts.last_failure_at < NOW() - $2 * INTERVAL '1 second'
+                             THEN 1 ELSE login_attempts.failures + 1 END,
+             last_failure_at = NOW()
+         RETURNING failures`,
+		key,
+		int64(window.Seconds()),
+	).Scan(&failures)
+	return failures, err
+}
+
+func (s *postgresLoginAttemptStore) Lock(key string, until time.Time) error {
+	_, err := s.db.Exec("UPDATE login_attempts SET locked_until = $2 WHERE key = $1", key, until)
+	return err
+}
+
+func (s *postgresLoginAttemptStore) Clear(keys ...string) error {
+	_, err := s.db.Exec("DELETE FROM login_attempts WHERE key = ANY($1)", pq.Array(keys))
+	return err
+}
+
+type postgresOIDCStateStore struct {
+	db *sql.DB
+}
+
+func newPostgresOIDCStateStore(db *sql.DB) *postgresOIDCStateStore {
+	return &postgresOIDCStateStore{db: db}
+}
+
+func (s *postgresOIDCStateStore) Create(state OIDCLoginState) error {
+	_, err := s.db.Exec(
+		`WITH expired AS (DELETE FROM oidc_login_states WHERE expires_at < NOW())
+         INSERT INTO oidc_login_states (state, provider, nonce, code_verifier, expires_at)
+         VALUES ($1, $2, $3, $4, $5)`,
+		state.State,
+		state.Provider,
+		state.Nonce,
+		state.CodeVerifier,
+		state.ExpiresAt,
+	)
+	return err
+}
+
+func (s *postgresOIDCStateStore) Consume(state, provider string) (OIDCLoginState, error) {
+	login := OIDCLoginState{State: state, Provider: provider}
+	err := s.db.QueryRow(
+		`DELETE FROM oidc_login_states
+         WHERE state = $1 AND provider = $2 AND expires_at > NOW()
+         RETURNING nonce, code_verifier, expires_at`,
+		state,
+		provider,
+	).Scan(&login.Nonce, &login.CodeVerifier, &login.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return OIDCLoginState{}, errNotFound
+	}
+	return login, err
+}
+
+type postgresOutboxStore struct {
+	db *sql.DB
+}
+
+func newPostgresOutboxStore(db *sql.DB) *postgresOutboxStore {
+	return &postgresOutboxStore{db: db}
+}
+
+func (s *postgresOutboxStore) Pending(limit int) ([]OutboxEvent, error) {
+	rows, err := s.db.Query(`
+		SELECT id, routing_key, payload, created_at
+		FROM outbox_events
+		ORDER BY id
+		LIMIT $1`,
+		limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []OutboxEvent
+	for rows.Next() {
+		var event OutboxEvent
+		var payload []byte
+		if err := rows.Scan(&event.ID, &event.RoutingKey, &payload, &event.CreatedAt); err != nil {
+			return nil, err
+		}
+		event.Payload = payload
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+func (s *postgresOutboxStore) MarkPublished(id int64) error {
+	_, err := s.db.Exec("DELETE FROM outbox_events WHERE id = $1", id)
+	return err
+}
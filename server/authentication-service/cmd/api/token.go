@@ -1,42 +1,148 @@
 package main
 
 import (
-	"os"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
 )
 
+const (
+	tokenTTL = 24 * time.Hour
+	// challengeTTL is how long a user has to enter their second factor
+	// after a correct password.
+	challengeTTL = 5 * time.Minute
+
+	purposeTwoFactorChallenge = "2fa_challenge"
+)
+
 type Claims struct {
-	UserID int `json:"user_id"`
+	UserID        int      `json:"user_id"`
+	EmailVerified bool     `json:"email_verified"`
+	Roles         []string `json:"roles,omitempty"`
+	// Purpose is set on restricted tokens, such as login challenges, that
+	// must not be accepted as a session.
+	Purpose string `json:"purpose,omitempty"`
 	jwt.StandardClaims
 }
 
-func generateToken(userID int) (string, time.Time, error) {
-	expirationTime := time.Now().Add(24 * time.Hour)
-	claims := &Claims{
-		UserID: userID,
+// generateToken issues a session token for user. sessionID becomes the
+// token's jti; only its hash is stored, in sessions.session_hash.
+func (km *KeyManager) generateToken(user User, sessionID string) (string, time.Time, error) {
+	expirationTime := time.Now().Add(tokenTTL)
+	tokenString, err := km.sign(&Claims{
+		UserID:        user.ID,
+		EmailVerified: user.EmailVerified,
+		Roles:         user.Roles,
 		StandardClaims: jwt.StandardClaims{
+			Id:        sessionID,
 			ExpiresAt: expirationTime.Unix(),
 			IssuedAt:  time.Now().Unix(),
 		},
-	}
+	})
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString([]byte(os.Getenv("JWT_SECRET")))
+	return tokenString, expirationTime, err
+}
+
+// generateChallengeToken issues a short-lived token proving that userID
+// passed the password step of a two-factor login.
+func (km *KeyManager) generateChallengeToken(userID int) (string, time.Time, error) {
+	expirationTime := time.Now().Add(challengeTTL)
+	tokenString, err := km.sign(&Claims{
+		UserID:  userID,
+		Purpose: purposeTwoFactorChallenge,
+		StandardClaims: jwt.StandardClaims{
+			ExpiresAt: expirationTime.Unix(),
+			IssuedAt:  time.Now().Unix(),
+		},
+	})
 
 	return tokenString, expirationTime, err
 }
 
-func verifyToken(tokenString string) (*Claims, error) {
+func (km *KeyManager) sign(claims *Claims) (string, error) {
+	key := km.activeKey()
+	if key == nil {
+		return "", errors.New("no active signing key")
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.PrivateKey)
+}
+
+func (km *KeyManager) verifyToken(tokenString string) (*Claims, error) {
+	claims, err := km.parse(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Purpose != "" {
+		return nil, fmt.Errorf("%s token cannot be used as a session", claims.Purpose)
+	}
+	return claims, nil
+}
+
+func (km *KeyManager) verifyChallengeToken(tokenString string) (*Claims, error) {
+	claims, err := km.parse(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Purpose != purposeTwoFactorChallenge {
+		return nil, errors.New("not a two-factor challenge token")
+	}
+	return claims, nil
+}
+
+func (km *KeyManager) parse(tokenString string) (*Claims, error) {
 	claims := &Claims{}
 	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-		return []byte(os.Getenv("JWT_SECRET")), nil
+		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		kid, _ := token.Header["kid"].(string)
+		if kid == "" {
+			return nil, errors.New("token has no kid header")
+		}
+		return km.publicKey(kid)
 	})
 
-	if err != nil || !token.Valid {
+	if err != nil {
 		return nil, err
 	}
+	if !token.Valid {
+		return nil, errors.New("invalid token")
+	}
 
 	return claims, nil
 }
+
+// generateOpaqueToken returns a random URL-safe token for links sent by
+// email, together with the hash that is stored in place of the token.
+func generateOpaqueToken() (string, string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	return token, hashOpaqueToken(token), nil
+}
+
+func hashOpaqueToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// sessionHash returns the key a verified session token is stored under.
+// Tokens issued before sessions had a jti were stored by the hash of the
+// whole token, which is what the migration backfilled.
+func sessionHash(claims *Claims, token string) string {
+	if claims.Id == "" {
+		return hashOpaqueToken(token)
+	}
+	return hashOpaqueToken(claims.Id)
+}
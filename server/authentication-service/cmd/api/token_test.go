@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestSessionStoredByJTIHash(t *testing.T) {
+	app := newTestApp(t)
+	user := app.createTestUser(t, "user@example.com", true)
+	token := app.login(t, user.Email)
+
+	claims, err := app.keys.verifyToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Id == "" {
+		t.Fatal("session token has no jti")
+	}
+	if _, err := app.sessions.Active(hashOpaqueToken(claims.Id)); err != nil {
+		t.Errorf("session not found by the hash of its jti: %v", err)
+	}
+	for _, key := range []string{claims.Id, token, hashOpaqueToken(token)} {
+		if _, err := app.sessions.Active(key); err != errNotFound {
+			t.Errorf("session found by %q: %v", key, err)
+		}
+	}
+}
+
+func TestSessionHashLegacyToken(t *testing.T) {
+	app := newTestApp(t)
+	user := app.createTestUser(t, "user@example.com", true)
+
+	// Tokens issued before sessions had a jti are stored by the hash of the
+	// whole token.
+	token, expiresAt, err := app.keys.generateToken(user, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := Session{UserID: user.ID, Hash: hashOpaqueToken(token), ExpiresAt: expiresAt}
+	if err := app.sessions.Create(&session); err != nil {
+		t.Fatal(err)
+	}
+
+	if rec := call(app.handleVerifyToken, "POST", token, nil); rec.Code != http.StatusOK {
+		t.Errorf("legacy token rejected with %d: %s", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"image/png"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+)
+
+const (
+	totpIssuer        = "Four Colour Map Solver"
+	totpPeriod        = 30
+	recoveryCodeCount = 10
+)
+
+type TwoFactorEnrollResponse struct {
+	Secret     string `json:"secret"`
+	OTPAuthURL string `json:"otpauth_url"`
+	QRCode     string `json:"qr_code"` // PNG as a data URL
+}
+
+type TwoFactorCodeRequest struct {
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code,omitempty"`
+}
+
+// DisableTwoFactorRequest needs the password as well as a code, so that a
+// stolen session alone is not enough to remove the second factor.
+type DisableTwoFactorRequest struct {
+	Password     string `json:"password"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+type TwoFactorLoginRequest struct {
+	ChallengeToken string `json:"challenge_token"`
+	Code           string `json:"code"`
+	RecoveryCode   string `json:"recovery_code"`
+}
+
+type TwoFactorChallengeResponse struct {
+	TwoFactorRequired bool   `json:"two_factor_required"`
+	ChallengeToken    string `json:"challenge_token"`
+	ExpiresAt         string `json:"expires_at"`
+}
+
+// matchTOTP checks code against the current time step and one step either
+// side to allow for clock drift, returning the step that matched.
+func matchTOTP(secret, code string, now time.Time) (int64, bool) {
+	for _, skew := range []int64{0, -1, 1} {
+		step := now.Unix()/totpPeriod + skew
+		expected, err := totp.GenerateCodeCustom(secret, time.Unix(step*totpPeriod, 0), totp.ValidateOpts{
+			Period:    totpPeriod,
+			Digits:    otp.DigitsSix,
+			Algorithm: otp.AlgorithmSHA1,
+		})
+		if err == nil && subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// checkSecondFactor accepts either a TOTP code or an unused recovery code.
+// A TOTP code is rejected if its time step was already used, so an observed
+// code cannot be replayed.
+func (app *App) checkSecondFactor(userID int, code, recoveryCode string) (bool, error) {
+	if recoveryCode != "" {
+		normalized := strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(recoveryCode))
+		return app.twoFactor.UseRecoveryCode(userID, hashOpaqueToken(normalized))
+	}
+
+	secret, err := app.twoFactor.TOTPSecret(userID)
+	if err == errNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	step, ok := matchTOTP(secret, strings.TrimSpace(code), time.Now())
+	if !ok {
+		return false, nil
+	}
+	return app.twoFactor.UseTOTPStep(userID, step)
+}
+
+// recordTwoFactorFailure counts a wrong code against the user's two-factor
+// lockout, auditing it when the lock kicks in.
+func (app *App) recordTwoFactorFailure(r *http.Request, userID int) {
+	until, err := app.recordFailure(twoFactorKey(userID), accountLockout)
+	if err != nil {
+		log.Printf("Error recording failed 2FA attempt: %v", err)
+	} else if !until.IsZero() {
+		app.audit.Log(r, AuthLog{
+			EventType:   "two_factor_locked",
+			UserID:      fmt.Sprint(userID),
+			Description: "Two-factor authentication temporarily locked after repeated invalid codes",
+			Severity:    2,
+			Metadata: map[string]string{
+				"locked_until": until.Format(time.RFC3339),
+			},
+		})
+	}
+}
+
+// confirmSecondFactor checks a code before a change to the user's 2FA
+// settings. Wrong codes count towards the same lockout as two-factor
+// logins, so that a stolen session cannot be used to guess them. On
+// failure it writes the response and returns false.
+func (app *App) confirmSecondFactor(w http.ResponseWriter, r *http.Request, userID int, code, recoveryCode string) bool {
+	until, err := app.lockedUntil(twoFactorKey(userID))
+	if err != nil {
+		log.Printf("Error checking 2FA lockout: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Internal server error"})
+		return false
+	}
+	if !until.IsZero() {
+		writeLocked(w, until)
+		return false
+	}
+
+	ok, err := app.checkSecondFactor(userID, code, recoveryCode)
+	if err != nil {
+		log.Printf("Error checking second factor: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Internal server error"})
+		return false
+	}
+	if !ok {
+		app.recordTwoFactorFailure(r, userID)
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid code"})
+		return false
+	}
+
+	if err := app.clearFailures(twoFactorKey(userID)); err != nil {
+		log.Printf("Error clearing failed 2FA attempts: %v", err)
+	}
+	return true
+}
+
+// twoFactorChallenge returns a challenge to complete at /auth/login/2fa if
+// the user has 2FA enabled, or nil if they can be signed in right away.
+// Every login method checks it before issuing a session.
+func (app *App) twoFactorChallenge(userID int) (*TwoFactorChallengeResponse, error) {
+	enabled, err := app.users.TwoFactorEnabled(userID)
+	if err != nil || !enabled {
+		return nil, err
+	}
+
+	challenge, expiresAt, err := app.keys.generateChallengeToken(userID)
+	if err != nil {
+		return nil, err
+	}
+	return &TwoFactorChallengeResponse{
+		TwoFactorRequired: true,
+		ChallengeToken:    challenge,
+		ExpiresAt:         expiresAt.Format(time.RFC3339),
+	}, nil
+}
+
+// generateRecoveryCodes returns codes formatted for display, e.g.
+// "ABCD-EFGH-IJKL", and the hashes of their normalized form.
+func generateRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+
+	for i := range codes {
+		b := make([]byte, 8)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		raw := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b)[:12]
+		codes[i] = raw[0:4] + "-" + raw[4:8] + "-" + raw[8:12]
+		hashes[i] = hashOpaqueToken(raw)
+	}
+
+	return codes, hashes, nil
+}
+
+func (app *App) handleEnrollTwoFactor(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	claims, err := app.authenticate(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Authentication required"})
+		return
+	}
+
+	user, err := app.users.ByID(claims.UserID)
+	if err != nil {
+		log.Printf("Error loading user for 2FA enrollment: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Error starting enrollment"})
+		return
+	}
+	enabled, err := app.users.TwoFactorEnabled(user.ID)
+	if err != nil {
+		log.Printf("Error loading 2FA state: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Error starting enrollment"})
+		return
+	}
+
+	if enabled {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Two-factor authentication is already enabled"})
+		return
+	}
+
+	key, err := totp.Generate(totp.GenerateOpts{
+		Issuer:      totpIssuer,
+		AccountName: user.Email,
+		Period:      totpPeriod,
+	})
+	if err != nil {
+		log.Printf("Error generating TOTP secret: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Error starting enrollment"})
+		return
+	}
+
+	img, err := key.Image(256, 256)
+	if err != nil {
+		log.Printf("Error rendering TOTP QR code: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Error starting enrollment"})
+		return
+	}
+	var qr bytes.Buffer
+	if err := png.Encode(&qr, img); err != nil {
+		log.Printf("Error encoding TOTP QR code: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Error starting enrollment"})
+		return
+	}
+
+	// Restarting enrollment replaces any secret that was never confirmed.
+	if err := app.twoFactor.StartTOTP(user.ID, key.Secret()); err != nil {
+		log.Printf("Error storing TOTP secret: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Error starting enrollment"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(TwoFactorEnrollResponse{
+		Secret:     key.Secret(),
+		OTPAuthURL: key.URL(),
+		QRCode:     "data:image/png;base64," + base64.StdEncoding.EncodeToString(qr.Bytes()),
+	})
+}
+
+func (app *App) handleConfirmTwoFactor(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	claims, err := app.authenticate(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Authentication required"})
+		return
+	}
+
+	var req TwoFactorCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Code is required"})
+		return
+	}
+
+	enabled, err := app.users.TwoFactorEnabled(claims.UserID)
+	if err != nil {
+		log.Printf("Error loading 2FA state: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Error confirming two-factor authentication"})
+		return
+	}
+	if enabled {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Two-factor authentication is already enabled"})
+		return
+	}
+
+	if !app.confirmSecondFactor(w, r, claims.UserID, req.Code, "") {
+		return
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		log.Printf("Error generating recovery codes: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Error confirming two-factor authentication"})
+		return
+	}
+
+	if err := app.twoFactor.EnableTOTP(claims.UserID, hashes); err != nil {
+		log.Printf("Error enabling 2FA: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Error confirming two-factor authentication"})
+		return
+	}
+
+	// Recovery codes are only ever shown here; we keep just their hashes.
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":        "Two-factor authentication enabled",
+		"recovery_codes": codes,
+	})
+}
+
+func (app *App) handleDisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	user, _, ok := app.currentUser(w, r)
+	if !ok {
+		return
+	}
+
+	var req DisableTwoFactorRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Password == "" || (req.Code == "" && req.RecoveryCode == "") {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Password and a code or recovery code are required"})
+		return
+	}
+
+	if !app.confirmPassword(w, r, user, req.Password) {
+		return
+	}
+	if !app.confirmSecondFactor(w, r, user.ID, req.Code, req.RecoveryCode) {
+		return
+	}
+
+	if err := app.twoFactor.DisableTOTP(user.ID); err != nil {
+		log.Printf("Error disabling 2FA: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Error disabling two-factor authentication"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"message": "Two-factor authentication disabled"})
+}
+
+func (app *App) handleTwoFactorLogin(w http.ResponseWriter, r *http.Request) {
+	var req TwoFactorLoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	claims, err := app.keys.verifyChallengeToken(req.ChallengeToken)
+	if err != nil {
+		http.Error(w, "Invalid or expired challenge", http.StatusUnauthorized)
+		return
+	}
+
+	// Six-digit codes are easy to guess without a limit on attempts.
+	until, err := app.lockedUntil(twoFactorKey(claims.UserID))
+	if err != nil {
+		log.Printf("Error checking 2FA lockout: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if !until.IsZero() {
+		writeLocked(w, until)
+		return
+	}
+
+	ok, err := app.checkSecondFactor(claims.UserID, req.Code, req.RecoveryCode)
+	if err != nil {
+		log.Printf("Error checking second factor: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		app.audit.Log(r, AuthLog{
+			EventType:   "login_failed",
+			UserID:      fmt.Sprint(claims.UserID),
+			Description: "Two-factor login rejected",
+			Severity:    2,
+			Metadata:    map[string]string{"reason": "invalid_second_factor"},
+		})
+
+		app.recordTwoFactorFailure(r, claims.UserID)
+		http.Error(w, "Invalid code", http.StatusUnauthorized)
+		return
+	}
+
+	if err := app.clearFailures(twoFactorKey(claims.UserID)); err != nil {
+		log.Printf("Error clearing failed 2FA attempts: %v", err)
+	}
+
+	user, err := app.users.ByID(claims.UserID)
+	if err != nil {
+		http.Error(w, "Invalid or expired challenge", http.StatusUnauthorized)
+		return
+	}
+
+	resp, err := app.issueSession(user, r)
+	if err != nil {
+		log.Printf("Error creating session: %v", err)
+		http.Error(w, "Error creating session", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/pquerna/otp/totp"
+)
+
+func TestMatchTOTP(t *testing.T) {
+	key, err := totp.Generate(totp.GenerateOpts{Issuer: totpIssuer, AccountName: "jane@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1700000000, 0)
+
+	tests := []struct {
+		name   string
+		codeAt time.Time
+		wantOK bool
+	}{
+		{"current step", now, true},
+		{"previous step", now.Add(-totpPeriod * time.Second), true},
+		{"next step", now.Add(totpPeriod * time.Second), true},
+		{"too old", now.Add(-3 * totpPeriod * time.Second), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, err := totp.GenerateCode(key.Secret(), tt.codeAt)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			step, ok := matchTOTP(key.Secret(), code, now)
+			if ok != tt.wantOK {
+				t.Fatalf("matchTOTP() ok = %v, want %v", ok, tt.wantOK)
+			}
+			if ok && step != tt.codeAt.Unix()/totpPeriod {
+				t.Fatalf("matchTOTP() step = %d, want %d", step, tt.codeAt.Unix()/totpPeriod)
+			}
+		})
+	}
+}
+
+func TestGenerateRecoveryCodes(t *testing.T) {
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(codes) != recoveryCodeCount || len(hashes) != recoveryCodeCount {
+		t.Fatalf("got %d codes and %d hashes, want %d", len(codes), len(hashes), recoveryCodeCount)
+	}
+
+	format := regexp.MustCompile(`^[A-Z2-7]{4}-[A-Z2-7]{4}-[A-Z2-7]{4}$`)
+	seen := make(map[string]bool)
+	for i, code := range codes {
+		if !format.MatchString(code) {
+			t.Errorf("code %q has unexpected format", code)
+		}
+		if seen[code] {
+			t.Errorf("duplicate code %q", code)
+		}
+		seen[code] = true
+
+		normalized := code[0:4] + code[5:9] + code[10:14]
+		if hashes[i] != hashOpaqueToken(normalized) {
+			t.Errorf("hash for %q does not match its normalized form", code)
+		}
+	}
+}
+
+// enableTestTwoFactor turns on 2FA for user and returns the TOTP secret.
+func (app *App) enableTestTwoFactor(t *testing.T, user User) string {
+	t.Helper()
+
+	const secret = "JBSWY3DPEHPK3PXP"
+	if err := app.twoFactor.StartTOTP(user.ID, secret); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.twoFactor.EnableTOTP(user.ID, nil); err != nil {
+		t.Fatal(err)
+	}
+	return secret
+}
+
+func TestHandleDisableTwoFactor(t *testing.T) {
+	tests := []struct {
+		name         string
+		password     string
+		recoveryCode string
+		wantCode     int
+	}{
+		{"valid", testPassword, "", http.StatusOK},
+		{"missing password", "", "", http.StatusBadRequest},
+		{"wrong password", "wrong", "", http.StatusUnauthorized},
+		{"wrong code", testPassword, "AAAA-BBBB-CCCC", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t)
+			user := app.createTestUser(t, "user@example.com", true)
+			token := app.login(t, user.Email)
+			secret := app.enableTestTwoFactor(t, user)
+
+			code, err := totp.GenerateCode(secret, time.Now())
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := DisableTwoFactorRequest{Password: tt.password, Code: code, RecoveryCode: tt.recoveryCode}
+			rec := call(app.handleDisableTwoFactor, "POST", token, req)
+			if rec.Code != tt.wantCode {
+				t.Fatalf("got status %d, want %d: %s", rec.Code, tt.wantCode, rec.Body)
+			}
+
+			enabled, err := app.users.TwoFactorEnabled(user.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if enabled != (tt.wantCode != http.StatusOK) {
+				t.Errorf("2FA enabled = %v after status %d", enabled, rec.Code)
+			}
+		})
+	}
+}
+
+func TestHandleDisableTwoFactorLockout(t *testing.T) {
+	app := newTestApp(t)
+	user := app.createTestUser(t, "user@example.com", true)
+	token := app.login(t, user.Email)
+	secret := app.enableTestTwoFactor(t, user)
+
+	wrong := DisableTwoFactorRequest{Password: testPassword, RecoveryCode: "AAAA-BBBB-CCCC"}
+	for i := 0; i <= accountLockout.FreeAttempts; i++ {
+		if rec := call(app.handleDisableTwoFactor, "POST", token, wrong); rec.Code != http.StatusBadRequest {
+			t.Fatalf("attempt %d got status %d, want %d", i+1, rec.Code, http.StatusBadRequest)
+		}
+	}
+
+	// Once locked, even a valid code is refused.
+	code, err := totp.GenerateCode(secret, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := call(app.handleDisableTwoFactor, "POST", token, DisableTwoFactorRequest{Password: testPassword, Code: code})
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusTooManyRequests)
+	}
+	if enabled, _ := app.users.TwoFactorEnabled(user.ID); !enabled {
+		t.Error("2FA was disabled while locked")
+	}
+}
@@ -38,8 +38,9 @@ type LoggerServer struct {
 }
 
 type Config struct {
-	rabbitmq *amqp.Connection
-	mongo    *mongo.Client
+	rabbitmq     *amqp.Connection
+	mongo        *mongo.Client
+	pseudonymKey []byte
 }
 
 func (app *Config) setupRabbitMQ() error {
@@ -93,7 +94,7 @@ func (app *Config) setupRabbitMQ() error {
 		log.Printf("Declared and bound queue: %s to exchange: %s", queue, exchanges[i])
 	}
 
-	return nil
+	return app.setupUserEvents(ch)
 }
 
 func (app *Config) consumeMessages(ctx context.Context) {
@@ -175,6 +176,12 @@ func (app *Config) consumeMessages(ctx context.Context) {
 
 							log.Printf("Processing message from queue %s: %+v", queueName, logData)
 
+							if err := app.scrubDeletedUser(ctx, &logData); err != nil {
+								log.Printf("Error checking deleted users for queue %s: %v", queueName, err)
+								msg.Nack(false, true)
+								continue
+							}
+
 							_, err := app.mongo.Database("logs").Collection("logs").InsertOne(ctx, logData)
 							if err != nil {
 								log.Printf("Error saving to MongoDB from queue %s: %v", queueName, err)
@@ -294,9 +301,15 @@ func main() {
 	defer rabbitConn.Close()
 	log.Println("Connected to RabbitMQ")
 
+	pseudonymKey := os.Getenv("LOG_PSEUDONYM_KEY")
+	if pseudonymKey == "" {
+		log.Println("Warning: LOG_PSEUDONYM_KEY is not set; pseudonyms of deleted users can be reversed")
+	}
+
 	app := Config{
-		rabbitmq: rabbitConn,
-		mongo:    mongoClient,
+		rabbitmq:     rabbitConn,
+		mongo:        mongoClient,
+		pseudonymKey: []byte(pseudonymKey),
 	}
 
 	// Setup RabbitMQ exchanges and queues
@@ -352,6 +365,7 @@ func main() {
 
 	// Start initial consumer
 	app.consumeMessages(ctx)
+	go app.consumeUserEvents(ctx)
 
 	// Initialize gRPC server
 	lis, err := net.Listen("tcp", ":50001")
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/streadway/amqp"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	userEventsExchange       = "user_events"
+	userEventsQueue          = "logger_user_events"
+	userDeletedKey           = "user.deleted"
+	userDeletionCompletedKey = "user.deletion_completed"
+)
+
+// UserDeletedEvent is published by the authentication service when an
+// account is deleted.
+type UserDeletedEvent struct {
+	EventID    string    `json:"event_id"`
+	UserID     string    `json:"user_id"`
+	OccurredAt time.Time `json:"occurred_at"`
+}
+
+// UserDeletionCompleted is reported by each service that cleans up after a
+// deletion, including this one.
+type UserDeletionCompleted struct {
+	EventID     string    `json:"event_id"`
+	UserID      string    `json:"user_id"`
+	Service     string    `json:"service"`
+	Affected    int64     `json:"affected"`
+	CompletedAt time.Time `json:"completed_at"`
+}
+
+// userDigest identifies a user without revealing their ID. It is keyed
+// with LOG_PSEUDONYM_KEY so small numeric IDs cannot be recovered by
+// hashing every candidate.
+func (app *Config) userDigest(userID string) string {
+	mac := hmac.New(sha256.New, app.pseudonymKey)
+	mac.Write([]byte(userID))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// pseudonym replaces a deleted user's ID in stored logs. The same user
+// always gets the same pseudonym, so their entries can still be correlated.
+func (app *Config) pseudonym(userID string) string {
+	return "deleted-" + app.userDigest(userID)[:16]
+}
+
+// deletedUserFields are the metadata fields that identify a user. They are
+// dropped from the logs of deleted users along with the user ID.
+var deletedUserFields = []string{"account", "ip"}
+
+// scrubDeletedUser pseudonymizes an entry about a user that was deleted
+// before the entry arrived, the same way handleUserDeleted treats the
+// entries stored before the deletion.
+func (app *Config) scrubDeletedUser(ctx context.Context, entry *Log) error {
+	if entry.UserID == "" {
+		return nil
+	}
+
+	err := app.mongo.Database("logs").Collection("deleted_users").
+		FindOne(ctx, bson.M{"_id": app.userDigest(entry.UserID)}).Err()
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	entry.UserID = app.pseudonym(entry.UserID)
+	for _, field := range deletedUserFields {
+		delete(entry.Metadata, field)
+	}
+	return nil
+}
+
+func (app *Config) setupUserEvents(ch *amqp.Channel) error {
+	if err := ch.ExchangeDeclare(userEventsExchange, "topic", true, false, false, false, nil); err != nil {
+		return fmt.Errorf("failed to declare exchange %s: %v", userEventsExchange, err)
+	}
+	if _, err := ch.QueueDeclare(userEventsQueue, true, false, false, false, nil); err != nil {
+		return fmt.Errorf("failed to declare queue %s: %v", userEventsQueue, err)
+	}
+	for _, key := range []string{userDeletedKey, userDeletionCompletedKey} {
+		if err := ch.QueueBind(userEventsQueue, key, userEventsExchange, false, nil); err != nil {
+			return fmt.Errorf("failed to bind queue %s to %s: %v", userEventsQueue, key, err)
+		}
+	}
+	log.Printf("Declared and bound queue: %s to exchange: %s", userEventsQueue, userEventsExchange)
+	return nil
+}
+
+// consumeUserEvents pseudonymizes the logs of deleted users and records
+// each service's completion report. Like consumeMessages, it opens a new
+// channel on the current connection whenever the old one closes.
+func (app *Config) consumeUserEvents(ctx context.Context) {
+	for {
+		if err := app.consumeUserEventsOnce(ctx); err != nil {
+			log.Printf("User event consumer stopped: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			log.Printf("Shutting down consumer for queue: %s", userEventsQueue)
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+func (app *Config) consumeUserEventsOnce(ctx context.Context) error {
+	ch, err := app.rabbitmq.Channel()
+	if err != nil {
+		return fmt.Errorf("failed to create channel: %v", err)
+	}
+	defer ch.Close()
+
+	if err := ch.Qos(1, 0, false); err != nil {
+		return fmt.Errorf("failed to set QoS: %v", err)
+	}
+
+	msgs, err := ch.Consume(userEventsQueue, "", false, false, false, false, nil)
+	if err != nil {
+		return fmt.Errorf("failed to consume from queue %s: %v", userEventsQueue, err)
+	}
+	log.Printf("Started consuming from queue: %s", userEventsQueue)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case msg, ok := <-msgs:
+			if !ok {
+				return fmt.Errorf("message channel closed")
+			}
+
+			switch msg.RoutingKey {
+			case userDeletedKey:
+				err = app.handleUserDeleted(ctx, ch, msg.Body)
+			case userDeletionCompletedKey:
+				err = app.handleDeletionCompleted(ctx, msg.Body)
+			default:
+				log.Printf("Ignoring user event with routing key %s", msg.RoutingKey)
+				err = nil
+			}
+
+			if err == errMalformedEvent {
+				log.Printf("Discarding malformed %s event: %s", msg.RoutingKey, msg.Body)
+				msg.Nack(false, false)
+				continue
+			}
+			if err != nil {
+				log.Printf("Error handling %s event: %v", msg.RoutingKey, err)
+				time.Sleep(time.Second)
+				msg.Nack(false, true)
+				continue
+			}
+			msg.Ack(false)
+		}
+	}
+}
+
+var errMalformedEvent = errors.New("malformed event")
+
+// metadataUnset builds an $unset document for the given metadata fields.
+func metadataUnset(fields []string) bson.M {
+	unset := bson.M{}
+	for _, field := range fields {
+		unset["metadata."+field] = ""
+	}
+	return unset
+}
+
+// handleUserDeleted pseudonymizes the user's existing logs. The user is
+// recorded in deleted_users first, so entries that arrive while or after
+// this runs are pseudonymized on insert; updating by user ID is safe to
+// repeat when the event is redelivered.
+func (app *Config) handleUserDeleted(ctx context.Context, ch *amqp.Channel, body []byte) error {
+	var event UserDeletedEvent
+	if err := json.Unmarshal(body, &event); err != nil || event.EventID == "" || event.UserID == "" {
+		return errMalformedEvent
+	}
+
+	logsDB := app.mongo.Database("logs")
+	_, err := logsDB.Collection("deleted_users").UpdateOne(ctx,
+		bson.M{"_id": app.userDigest(event.UserID)},
+		bson.M{"$setOnInsert": bson.M{"deleted_at": event.OccurredAt}},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		return err
+	}
+
+	result, err := logsDB.Collection("logs").UpdateMany(ctx, bson.M{"user_id": event.UserID}, bson.M{
+		"$set":   bson.M{"user_id": app.pseudonym(event.UserID)},
+		"$unset": metadataUnset(deletedUserFields),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to pseudonymize logs: %v", err)
+	}
+	log.Printf("Pseudonymized %d log entries of deleted user", result.ModifiedCount)
+
+	completion, err := json.Marshal(UserDeletionCompleted{
+		EventID:     event.EventID,
+		UserID:      event.UserID,
+		Service:     "logger",
+		Affected:    result.ModifiedCount,
+		CompletedAt: time.Now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+	return ch.Publish(userEventsExchange, userDeletionCompletedKey, false, false, amqp.Publishing{
+		ContentType:  "application/json",
+		DeliveryMode: amqp.Persistent,
+		Body:         completion,
+	})
+}
+
+// handleDeletionCompleted stores a service's completion report as a log
+// entry under the user's pseudonym. Reports are keyed by event and service,
+// so a redelivered report is stored once.
+func (app *Config) handleDeletionCompleted(ctx context.Context, body []byte) error {
+	var completion UserDeletionCompleted
+	if err := json.Unmarshal(body, &completion); err != nil || completion.EventID == "" || completion.Service == "" {
+		return errMalformedEvent
+	}
+
+	// The filter fields are copied into the inserted document, so only the
+	// rest are set here.
+	_, err := app.mongo.Database("logs").Collection("logs").UpdateOne(ctx,
+		bson.M{
+			"service_name":      completion.Service,
+			"event_type":        "user_deletion_completed",
+			"metadata.event_id": completion.EventID,
+		},
+		bson.M{"$setOnInsert": bson.M{
+			"user_id":           app.pseudonym(completion.UserID),
+			"description":       "Service finished cleaning up after an account deletion",
+			"severity":          int32(1),
+			"timestamp":         completion.CompletedAt,
+			"metadata.affected": fmt.Sprint(completion.Affected),
+		}},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// access is what a caller may do with a map. Each level includes the ones
+// below it.
+type access int
+
+const (
+	accessNone access = iota
+	accessViewer
+	accessEditor
+	accessOwner
+)
+
+func (a access) String() string {
+	switch a {
+	case accessViewer:
+		return "viewer"
+	case accessEditor:
+		return "editor"
+	case accessOwner:
+		return "owner"
+	default:
+		return ""
+	}
+}
+
+var (
+	errNoAccess  = errors.New("no access to map")
+	errForbidden = errors.New("insufficient access to map")
+)
+
+// principal is who is making a request: a signed-in user, whose ID the
+// gateway passes in X-User-ID, or an anonymous holder of a share link.
+type principal struct {
+	UserID     string
+	ShareToken string
+}
+
+func principalFrom(r *http.Request) principal {
+	return principal{
+		UserID:     r.Header.Get("X-User-ID"),
+		ShareToken: mux.Vars(r)["token"],
+	}
+}
+
+// hashShareToken is how share tokens are stored, so that the database alone
+// does not give access to shared maps.
+func hashShareToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// accessTo works out p's access to m. Maps in the trash are only visible to
+// their owner.
+func accessTo(p principal, m Map) access {
+	if p.UserID != "" && p.UserID == m.UserID {
+		return accessOwner
+	}
+	if m.DeletedAt != nil {
+		return accessNone
+	}
+
+	if p.UserID != "" {
+		for _, grant := range m.Grants {
+			if grant.UserID == p.UserID {
+				return grant.access()
+			}
+		}
+	}
+
+	if p.ShareToken != "" {
+		hash := hashShareToken(p.ShareToken)
+		for _, link := range m.ShareLinks {
+			if subtle.ConstantTimeCompare([]byte(link.TokenHash), []byte(hash)) == 1 &&
+				(link.ExpiresAt == nil || time.Now().Before(*link.ExpiresAt)) {
+				return accessViewer
+			}
+		}
+	}
+	return accessNone
+}
+
+// authorize checks that p has at least the needed access to m. It is the
+// one place map access is decided; listing or creating a user's maps is
+// checked as owner access to a map of that user. A caller without any
+// access gets errNoAccess, so that responses don't reveal whether a map
+// exists.
+func authorize(p principal, m Map, need access) error {
+	got := accessTo(p, m)
+	switch {
+	case got >= need:
+		return nil
+	case got == accessNone:
+		return errNoAccess
+	default:
+		return errForbidden
+	}
+}
+
+// writeAccessError responds to a failed authorize.
+func writeAccessError(w http.ResponseWriter, err error) {
+	if err == errForbidden {
+		http.Error(w, "You don't have permission to do this", http.StatusForbidden)
+		return
+	}
+	http.Error(w, "Map not found", http.StatusNotFound)
+}
+
+// mapScope is which maps a lookup by ID may find.
+type mapScope int
+
+const (
+	activeMaps mapScope = iota
+	trashedMaps
+	allMaps
+)
+
+func (sc mapScope) contains(m Map) bool {
+	switch sc {
+	case activeMaps:
+		return m.DeletedAt == nil
+	case trashedMaps:
+		return m.DeletedAt != nil
+	default:
+		return true
+	}
+}
+
+// checkMap finishes loading a map: it writes the error response if the
+// lookup failed, the map is out of scope or the caller lacks the needed
+// access. The caller's access is returned in the map's Access field.
+func checkMap(w http.ResponseWriter, r *http.Request, m Map, err error, scope mapScope, need access) (Map, bool) {
+	if err == errNotFound || (err == nil && !scope.contains(m)) {
+		http.Error(w, "Map not found", http.StatusNotFound)
+		return m, false
+	}
+	if err != nil {
+		log.Printf("Error finding map: %v", err)
+		http.Error(w, "Failed to retrieve map", http.StatusInternalServerError)
+		return m, false
+	}
+
+	p := principalFrom(r)
+	if err := authorize(p, m, need); err != nil {
+		writeAccessError(w, err)
+		return m, false
+	}
+	m.Access = accessTo(p, m).String()
+	return m, true
+}
+
+// mapID parses the {id} route variable, writing a 400 if it is invalid.
+func mapID(w http.ResponseWriter, r *http.Request) (primitive.ObjectID, bool) {
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid map ID", http.StatusBadRequest)
+		return id, false
+	}
+	return id, true
+}
+
+// loadMap loads the map named by the {id} route variable without its
+// matrix, and checks that it is in scope and that the caller has the
+// needed access to it.
+func (s *Server) loadMap(w http.ResponseWriter, r *http.Request, scope mapScope, need access) (Map, bool) {
+	id, ok := mapID(w, r)
+	if !ok {
+		return Map{}, false
+	}
+	m, err := s.maps.Info(context.Background(), id)
+	return checkMap(w, r, m, err, scope, need)
+}
+
+// loadReadableMap loads the map a read-only route refers to, with all of
+// its content: by share token on public routes, by ID on the others.
+func (s *Server) loadReadableMap(w http.ResponseWriter, r *http.Request) (Map, bool) {
+	return s.loadViewableMap(w, r, activeMaps, s.maps.ByID)
+}
+
+// loadMapMedia is loadReadableMap for a map's image and thumbnails, which
+// stay available to the owner while the map is in the trash so that the
+// trash can show previews. The matrix is left out.
+func (s *Server) loadMapMedia(w http.ResponseWriter, r *http.Request) (Map, bool) {
+	return s.loadViewableMap(w, r, allMaps, s.maps.Info)
+}
+
+func (s *Server) loadViewableMap(w http.ResponseWriter, r *http.Request, scope mapScope, byID func(context.Context, primitive.ObjectID) (Map, error)) (Map, bool) {
+	if token, ok := mux.Vars(r)["token"]; ok {
+		m, err := s.maps.ByShareToken(context.Background(), hashShareToken(token))
+		return checkMap(w, r, m, err, activeMaps, accessViewer)
+	}
+	id, ok := mapID(w, r)
+	if !ok {
+		return Map{}, false
+	}
+	m, err := byID(context.Background(), id)
+	return checkMap(w, r, m, err, scope, accessViewer)
+}
+
+// authorizeUser checks that the caller may act on behalf of userID, i.e.
+// list or create that user's maps, writing the error response if not.
+func authorizeUser(w http.ResponseWriter, r *http.Request, userID string) bool {
+	if err := authorize(principalFrom(r), Map{UserID: userID}, accessOwner); err != nil {
+		http.Error(w, "You can only access your own maps", http.StatusForbidden)
+		return false
+	}
+	return true
+}
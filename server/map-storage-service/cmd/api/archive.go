@@ -0,0 +1,607 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Archives are zip files laid out as
+//
+//	manifest.json           ArchiveManifest
+//	maps/<id>/map.json      ArchiveMap, the map's metadata
+//	maps/<id>/matrix.json   the map's matrix, i.e. its coloring
+//	maps/<id>/image.<ext>   the map's image, if it has one
+//
+// where <id> is the map's ID in the exporting environment.
+const (
+	archiveFormat  = "map-archive"
+	archiveVersion = 1
+
+	maxMetadataBytes = 1 << 20
+	maxMatrixBytes   = 64 << 20
+	// maxImportMaps limits how many maps one archive may hold.
+	maxImportMaps = 1000
+)
+
+// ArchiveManifest lists the contents of an archive.
+type ArchiveManifest struct {
+	Format     string          `json:"format"`
+	Version    int             `json:"version"`
+	ExportedAt time.Time       `json:"exportedAt"`
+	Folders    []ArchiveFolder `json:"folders"`
+	Maps       []ArchiveEntry  `json:"maps"`
+}
+
+// ArchiveFolder is a folder in an archive. IDs are those of the exporting
+// environment and only used to link folders and maps within the archive.
+type ArchiveFolder struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	ParentID string `json:"parentId,omitempty"`
+}
+
+// ArchiveEntry points to the files of one map.
+type ArchiveEntry struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Metadata string `json:"metadata"`
+	Matrix   string `json:"matrix"`
+	Image    string `json:"image,omitempty"`
+	// ImageSHA256 is the hex SHA-256 of the image file, checked on import.
+	ImageSHA256 string `json:"imageSha256,omitempty"`
+}
+
+// ArchiveMap is a map's metadata in an archive.
+type ArchiveMap struct {
+	Name      string    `json:"name"`
+	Width     int       `json:"width"`
+	Height    int       `json:"height"`
+	ImageType string    `json:"imageType,omitempty"`
+	FolderID  string    `json:"folderId,omitempty"`
+	Tags      []string  `json:"tags,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// ImportReport is the response to an import. Every map in the archive has
+// an entry in Maps, in archive order.
+type ImportReport struct {
+	Imported int            `json:"imported"`
+	Failed   int            `json:"failed"`
+	Folders  []ImportedItem `json:"folders"`
+	Maps     []ImportedItem `json:"maps"`
+}
+
+// ImportedItem is the outcome of importing one folder or map. ID is the
+// new ID of an imported item; Error says why an item failed.
+type ImportedItem struct {
+	SourceID string `json:"sourceId"`
+	ID       string `json:"id,omitempty"`
+	Name     string `json:"name"`
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+}
+
+// handleExportMaps streams the caller's maps and folders as a zip archive.
+// Maps in the trash and maps shared with the caller are left out. Once the
+// archive is under way errors can only be logged, so the manifest is
+// written last and a cut-off archive is recognizably incomplete.
+func (s *Server) handleExportMaps(w http.ResponseWriter, r *http.Request) {
+	userID, ok := callerID(w, r)
+	if !ok {
+		return
+	}
+	ctx := r.Context()
+
+	folders, err := s.exportFolders(ctx, userID)
+	if err != nil {
+		log.Printf("Error fetching folders for export: %v", err)
+		http.Error(w, "Failed to export maps", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf(`attachment; filename="maps-%s.zip"`, time.Now().UTC().Format("2006-01-02")))
+
+	zw := zip.NewWriter(w)
+	manifest := ArchiveManifest{
+		Format:     archiveFormat,
+		Version:    archiveVersion,
+		ExportedAt: time.Now().UTC(),
+		Folders:    folders,
+		Maps:       []ArchiveEntry{},
+	}
+	err = s.maps.Each(ctx, userID, func(m Map) error {
+		entry, err := s.exportMap(ctx, zw, m)
+		if err != nil {
+			return fmt.Errorf("map %s: %v", m.ID.Hex(), err)
+		}
+		manifest.Maps = append(manifest.Maps, entry)
+		return nil
+	})
+	if err != nil {
+		log.Printf("Error exporting maps: %v", err)
+		return
+	}
+
+	if err := writeZipJSON(zw, "manifest.json", manifest); err != nil {
+		log.Printf("Error writing export manifest: %v", err)
+		return
+	}
+	if err := zw.Close(); err != nil {
+		log.Printf("Error finishing export: %v", err)
+		return
+	}
+
+	if s.logger != nil {
+		metadata := map[string]string{
+			"maps":    strconv.Itoa(len(manifest.Maps)),
+			"folders": strconv.Itoa(len(manifest.Folders)),
+		}
+
+		if err := s.logger.LogEvent(
+			"maps_exported",
+			userID,
+			fmt.Sprintf("Exported %d maps", len(manifest.Maps)),
+			metadata,
+		); err != nil {
+			log.Printf("Failed to log map export: %v", err)
+		}
+	}
+}
+
+func (s *Server) exportFolders(ctx context.Context, userID string) ([]ArchiveFolder, error) {
+	folders, err := s.folders.List(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	archived := make([]ArchiveFolder, len(folders))
+	for i, folder := range folders {
+		archived[i] = ArchiveFolder{ID: folder.ID.Hex(), Name: folder.Name}
+		if folder.ParentID != nil {
+			archived[i].ParentID = folder.ParentID.Hex()
+		}
+	}
+	return archived, nil
+}
+
+// exportMap writes the files of m to zw.
+func (s *Server) exportMap(ctx context.Context, zw *zip.Writer, m Map) (ArchiveEntry, error) {
+	dir := "maps/" + m.ID.Hex() + "/"
+	entry := ArchiveEntry{
+		ID:       m.ID.Hex(),
+		Name:     m.Name,
+		Metadata: dir + "map.json",
+		Matrix:   dir + "matrix.json",
+	}
+
+	metadata := ArchiveMap{
+		Name:      m.Name,
+		Width:     m.Width,
+		Height:    m.Height,
+		ImageType: m.ImageType,
+		Tags:      m.Tags,
+		CreatedAt: m.CreatedAt,
+		UpdatedAt: m.UpdatedAt,
+	}
+	if m.FolderID != nil {
+		metadata.FolderID = m.FolderID.Hex()
+	}
+
+	var image io.ReadCloser
+	switch {
+	case m.ImageKey != "":
+		blob, err := s.blobs.Get(ctx, m.ImageKey)
+		if err != nil {
+			return entry, err
+		}
+		image = blob
+		entry.ImageSHA256 = m.ImageKey
+	case m.ImageData != "":
+		// Not migrated to the blob store yet; export it all the same.
+		data, contentType, err := decodeImageData(m.ImageData, s.limits.MaxImageBytes)
+		if err != nil {
+			return entry, err
+		}
+		sum := sha256.Sum256(data)
+		image = io.NopCloser(bytes.NewReader(data))
+		metadata.ImageType = contentType
+		entry.ImageSHA256 = hex.EncodeToString(sum[:])
+	}
+	if image != nil {
+		defer image.Close()
+		ext, ok := imageExtensions[metadata.ImageType]
+		if !ok {
+			ext = ".bin"
+		}
+		entry.Image = dir + "image" + ext
+
+		// Images are compressed already.
+		fw, err := zw.CreateHeader(&zip.FileHeader{Name: entry.Image, Method: zip.Store, Modified: m.UpdatedAt})
+		if err != nil {
+			return entry, err
+		}
+		if _, err := io.Copy(fw, image); err != nil {
+			return entry, err
+		}
+	}
+
+	if err := writeZipJSON(zw, entry.Metadata, metadata); err != nil {
+		return entry, err
+	}
+	matrix := m.Matrix
+	if matrix == nil {
+		matrix = [][]int{}
+	}
+	if err := writeZipJSON(zw, entry.Matrix, matrix); err != nil {
+		return entry, err
+	}
+	return entry, nil
+}
+
+func writeZipJSON(zw *zip.Writer, name string, v interface{}) error {
+	fw, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(fw).Encode(v)
+}
+
+// handleImportMaps recreates the maps and folders of an archive under the
+// caller. Every map and folder gets a new ID, and references between them
+// are remapped. The archive as a whole must be valid, but a map that fails
+// doesn't stop the others from being imported: the report says what
+// happened to each.
+func (s *Server) handleImportMaps(w http.ResponseWriter, r *http.Request) {
+	userID, ok := callerID(w, r)
+	if !ok {
+		return
+	}
+	ctx := r.Context()
+
+	// zip needs random access, so the upload is spooled to disk first.
+	tmp, err := os.CreateTemp("", "map-import-*.zip")
+	if err != nil {
+		log.Printf("Error creating temporary file: %v", err)
+		http.Error(w, "Failed to import maps", http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	size, err := io.Copy(tmp, http.MaxBytesReader(w, r.Body, s.limits.MaxArchiveBytes))
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			http.Error(w, fmt.Sprintf("Archive must not be larger than %d bytes", s.limits.MaxArchiveBytes), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "Failed to read archive", http.StatusBadRequest)
+		return
+	}
+
+	archive, err := zip.NewReader(tmp, size)
+	if err != nil {
+		http.Error(w, "Body is not a zip archive", http.StatusBadRequest)
+		return
+	}
+	files := make(map[string]*zip.File, len(archive.File))
+	for _, f := range archive.File {
+		files[f.Name] = f
+	}
+
+	var manifest ArchiveManifest
+	if err := readZipJSON(files, "manifest.json", maxMetadataBytes, &manifest); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid manifest: %v", err), http.StatusBadRequest)
+		return
+	}
+	if manifest.Format != archiveFormat || manifest.Version != archiveVersion {
+		http.Error(w, fmt.Sprintf("Unsupported archive: expected %s version %d", archiveFormat, archiveVersion), http.StatusBadRequest)
+		return
+	}
+
+	if len(manifest.Maps) > maxImportMaps {
+		http.Error(w, fmt.Sprintf("An archive must not hold more than %d maps", maxImportMaps), http.StatusBadRequest)
+		return
+	}
+	if err := checkArchiveFiles(manifest.Maps); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid manifest: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	report := ImportReport{Folders: []ImportedItem{}, Maps: []ImportedItem{}}
+	folderIDs := s.importFolders(ctx, userID, manifest.Folders, &report)
+
+	for _, entry := range manifest.Maps {
+		item := ImportedItem{SourceID: entry.ID, Name: entry.Name}
+		m, err := s.importMap(ctx, r, userID, files, entry, folderIDs)
+		if err != nil {
+			item.Status = "failed"
+			item.Error = err.Error()
+			report.Failed++
+		} else {
+			item.Status = "imported"
+			item.ID = m.ID.Hex()
+			report.Imported++
+		}
+		report.Maps = append(report.Maps, item)
+	}
+
+	if s.logger != nil {
+		metadata := map[string]string{
+			"imported": strconv.Itoa(report.Imported),
+			"failed":   strconv.Itoa(report.Failed),
+			"folders":  strconv.Itoa(len(folderIDs)),
+		}
+
+		if err := s.logger.LogEvent(
+			"maps_imported",
+			userID,
+			fmt.Sprintf("Imported %d maps, %d failed", report.Imported, report.Failed),
+			metadata,
+		); err != nil {
+			log.Printf("Failed to log map import: %v", err)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// checkArchiveFiles checks that no file of an archive belongs to more than
+// one map, so that each file is read at most once however the manifest
+// points into the archive.
+func checkArchiveFiles(entries []ArchiveEntry) error {
+	seen := make(map[string]bool, 3*len(entries))
+	for _, entry := range entries {
+		for _, name := range []string{entry.Metadata, entry.Matrix, entry.Image} {
+			if name == "" {
+				continue
+			}
+			if seen[name] {
+				return fmt.Errorf("%s is referenced more than once", name)
+			}
+			seen[name] = true
+		}
+	}
+	return nil
+}
+
+// limitedReader reads at most n bytes from r, and fails with err if r has
+// more. Unlike io.LimitReader it doesn't pass off a truncated file as the
+// whole one.
+type limitedReader struct {
+	r   io.Reader
+	n   int64
+	err error
+}
+
+func newLimitedReader(r io.Reader, n int64, err error) *limitedReader {
+	return &limitedReader{r: io.LimitReader(r, n+1), n: n, err: err}
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return n, l.err
+	}
+	return n, err
+}
+
+// readZipJSON decodes the named file of an archive into v, reading at most
+// limit bytes.
+func readZipJSON(files map[string]*zip.File, name string, limit int64, v interface{}) error {
+	f, ok := files[name]
+	if !ok {
+		return fmt.Errorf("%s is missing", name)
+	}
+	if f.UncompressedSize64 > uint64(limit) {
+		return fmt.Errorf("%s is too large", name)
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	defer rc.Close()
+	if err := json.NewDecoder(io.LimitReader(rc, limit)).Decode(v); err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	return nil
+}
+
+// importFolders creates the archive's folders under userID, parents before
+// children, and returns their new IDs by archive ID. A folder whose name is
+// taken at its place in the tree is merged into the existing one, so that
+// importing the same archive twice doesn't duplicate the tree. Folders
+// whose parent failed end up at the top level.
+func (s *Server) importFolders(ctx context.Context, userID string, folders []ArchiveFolder, report *ImportReport) map[string]primitive.ObjectID {
+	ids := make(map[string]primitive.ObjectID, len(folders))
+	pending := folders
+	for len(pending) > 0 {
+		var next []ArchiveFolder
+		for _, folder := range pending {
+			if _, ok := ids[folder.ParentID]; folder.ParentID != "" && !ok && containsFolder(pending, folder.ParentID) {
+				// Wait for the parent.
+				next = append(next, folder)
+				continue
+			}
+
+			item := ImportedItem{SourceID: folder.ID, Name: folder.Name}
+			id, err := s.importFolder(ctx, userID, folder, ids)
+			if err != nil {
+				item.Status = "failed"
+				item.Error = err.Error()
+			} else {
+				item.Status = "imported"
+				item.ID = id.Hex()
+				ids[folder.ID] = id
+			}
+			report.Folders = append(report.Folders, item)
+		}
+		if len(next) == len(pending) {
+			// The rest form a cycle; break it by importing one at the top.
+			next[0].ParentID = ""
+		}
+		pending = next
+	}
+	return ids
+}
+
+func containsFolder(folders []ArchiveFolder, id string) bool {
+	for _, folder := range folders {
+		if folder.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) importFolder(ctx context.Context, userID string, folder ArchiveFolder, ids map[string]primitive.ObjectID) (primitive.ObjectID, error) {
+	if folder.Name == "" {
+		return primitive.NilObjectID, errors.New("name is required")
+	}
+
+	doc := Folder{UserID: userID, Name: folder.Name, CreatedAt: time.Now(), UpdatedAt: time.Now()}
+	if parentID, ok := ids[folder.ParentID]; ok {
+		doc.ParentID = &parentID
+	}
+
+	existing, err := s.folders.ByName(ctx, userID, doc.Name, doc.ParentID)
+	if err == nil {
+		return existing.ID, nil
+	}
+	if err != errNotFound {
+		return primitive.NilObjectID, err
+	}
+
+	if err := s.folders.Create(ctx, &doc); err != nil {
+		return primitive.NilObjectID, err
+	}
+	return doc.ID, nil
+}
+
+// importMap validates one archive entry and creates its map under userID.
+func (s *Server) importMap(ctx context.Context, r *http.Request, userID string, files map[string]*zip.File, entry ArchiveEntry, folderIDs map[string]primitive.ObjectID) (Map, error) {
+	var metadata ArchiveMap
+	if err := readZipJSON(files, entry.Metadata, maxMetadataBytes, &metadata); err != nil {
+		return Map{}, err
+	}
+	var matrix [][]int
+	if err := readZipJSON(files, entry.Matrix, maxMatrixBytes, &matrix); err != nil {
+		return Map{}, err
+	}
+	if metadata.Width < 0 || metadata.Height < 0 {
+		return Map{}, errors.New("width and height must not be negative")
+	}
+	tags, err := normalizeTags(metadata.Tags)
+	if err != nil {
+		return Map{}, err
+	}
+
+	var image ImageRef
+	if entry.Image != "" {
+		image, err = s.importImage(ctx, files, entry, metadata.ImageType)
+		if err != nil {
+			return Map{}, err
+		}
+	}
+
+	now := time.Now()
+	m := Map{
+		UserID:    userID,
+		Name:      metadata.Name,
+		Width:     metadata.Width,
+		Height:    metadata.Height,
+		ImageRef:  image,
+		Matrix:    matrix,
+		Tags:      tags,
+		CreatedAt: metadata.CreatedAt,
+		UpdatedAt: metadata.UpdatedAt,
+		Version:   1,
+	}
+	if len(m.Tags) == 0 {
+		m.Tags = nil
+	}
+	if m.CreatedAt.IsZero() {
+		m.CreatedAt = now
+	}
+	if m.UpdatedAt.IsZero() {
+		m.UpdatedAt = m.CreatedAt
+	}
+	if folderID, ok := folderIDs[metadata.FolderID]; ok {
+		m.FolderID = &folderID
+	}
+
+	if err := s.maps.Create(ctx, &m); err != nil {
+		s.releaseBlobs(context.Background(), image.ImageKey)
+		log.Printf("Error saving imported map: %v", err)
+		return Map{}, errors.New("failed to save map")
+	}
+	s.recordRevision(m, revisionAuthor(r), "Imported")
+	s.refreshThumbnails(m)
+	return m, nil
+}
+
+// importImage stores the image of an archive entry in the blob store,
+// checking it against the checksum in the manifest.
+func (s *Server) importImage(ctx context.Context, files map[string]*zip.File, entry ArchiveEntry, contentType string) (ImageRef, error) {
+	f, ok := files[entry.Image]
+	if !ok {
+		return ImageRef{}, fmt.Errorf("%s is missing", entry.Image)
+	}
+	if f.UncompressedSize64 > uint64(s.limits.MaxImageBytes) {
+		return ImageRef{}, fmt.Errorf("image must not be larger than %d bytes", s.limits.MaxImageBytes)
+	}
+	if contentType == "" {
+		for ct, ext := range imageExtensions {
+			if path.Ext(entry.Image) == ext {
+				contentType = ct
+			}
+		}
+	}
+	if _, ok := imageExtensions[contentType]; !ok {
+		return ImageRef{}, errors.New("unsupported image type")
+	}
+
+	rc, err := f.Open()
+	if err != nil {
+		return ImageRef{}, fmt.Errorf("%s: %v", entry.Image, err)
+	}
+	defer rc.Close()
+
+	// The size in the zip header is not to be trusted.
+	ref, err := s.storeImage(ctx, newLimitedReader(rc, s.limits.MaxImageBytes, errImageTooLarge))
+	if errors.Is(err, errImageTooLarge) {
+		return ImageRef{}, fmt.Errorf("image must not be larger than %d bytes", s.limits.MaxImageBytes)
+	}
+	if err == errUnsupportedImage {
+		return ImageRef{}, err
+	}
+	if err != nil {
+		log.Printf("Error storing imported image: %v", err)
+		return ImageRef{}, errors.New("failed to store image")
+	}
+	if entry.ImageSHA256 != "" && ref.ImageKey != entry.ImageSHA256 {
+		s.releaseBlobs(context.Background(), ref.ImageKey)
+		return ImageRef{}, errors.New("image checksum does not match the manifest")
+	}
+	return ref, nil
+}
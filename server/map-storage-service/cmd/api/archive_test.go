@@ -0,0 +1,121 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// testArchive zips manifest together with files, by name.
+func testArchive(t *testing.T, manifest ArchiveManifest, files map[string][]byte) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	if err := writeZipJSON(zw, "manifest.json", manifest); err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range files {
+		fw, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fw.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestImportMaps(t *testing.T) {
+	files := map[string][]byte{
+		"maps/a/map.json":    []byte(`{"name":"A","width":2,"height":2}`),
+		"maps/a/matrix.json": []byte(`[[0,1],[1,0]]`),
+		"maps/b/map.json":    []byte(`{"name":"B","width":2,"height":2}`),
+		"maps/b/matrix.json": []byte(`[[1,1],[1,1]]`),
+	}
+	entry := func(id, image string) ArchiveEntry {
+		return ArchiveEntry{
+			ID:       id,
+			Metadata: "maps/" + id + "/map.json",
+			Matrix:   "maps/" + id + "/matrix.json",
+			Image:    image,
+		}
+	}
+	tooMany := make([]ArchiveEntry, maxImportMaps+1)
+	for i := range tooMany {
+		tooMany[i] = entry(fmt.Sprint(i), "")
+	}
+
+	tests := []struct {
+		name     string
+		maps     []ArchiveEntry
+		wantCode int
+		wantMaps int
+	}{
+		{"valid", []ArchiveEntry{entry("a", ""), entry("b", "")}, http.StatusOK, 2},
+		{"shared image", []ArchiveEntry{entry("a", "image.png"), entry("b", "image.png")}, http.StatusBadRequest, 0},
+		{"shared matrix", []ArchiveEntry{entry("a", ""), {ID: "b", Metadata: "maps/b/map.json", Matrix: "maps/a/matrix.json"}}, http.StatusBadRequest, 0},
+		{"too many maps", tooMany, http.StatusBadRequest, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			manifest := ArchiveManifest{Format: archiveFormat, Version: archiveVersion, Maps: tt.maps}
+			body := testArchive(t, manifest, files)
+
+			req := httptest.NewRequest("POST", "/", bytes.NewReader(body))
+			req.Header.Set("X-User-ID", "1")
+			rec := httptest.NewRecorder()
+			s.handleImportMaps(rec, req)
+			if rec.Code != tt.wantCode {
+				t.Fatalf("got status %d, want %d: %s", rec.Code, tt.wantCode, rec.Body)
+			}
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+
+			var report ImportReport
+			if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+				t.Fatal(err)
+			}
+			if report.Imported != tt.wantMaps {
+				t.Fatalf("imported %d maps, want %d: %+v", report.Imported, tt.wantMaps, report)
+			}
+		})
+	}
+}
+
+func TestLimitedReader(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantErr error
+	}{
+		{"under the limit", "abc", nil},
+		{"at the limit", "abcd", nil},
+		{"over the limit", "abcde", errImageTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := io.ReadAll(newLimitedReader(strings.NewReader(tt.data), 4, errImageTooLarge))
+			if err != tt.wantErr {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && string(got) != tt.data {
+				t.Fatalf("read %q, want %q", got, tt.data)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"time"
+
+	authpb "contracts/auth"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// maxGetUsers is the most users the auth service returns per GetUsers call.
+const maxGetUsers = 100
+
+type AuthClient struct {
+	client authpb.AuthServiceClient
+	conn   *grpc.ClientConn
+}
+
+func connectToAuth(addr string) (*AuthClient, error) {
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, err
+	}
+
+	return &AuthClient{
+		client: authpb.NewAuthServiceClient(conn),
+		conn:   conn,
+	}, nil
+}
+
+func (a *AuthClient) Close() {
+	if a != nil && a.conn != nil {
+		a.conn.Close()
+	}
+}
+
+// OwnerNames looks up the display names of the given users. Names are
+// decoration, so on failure it logs and returns what it has; unknown and
+// deleted users are simply missing from the result.
+func (a *AuthClient) OwnerNames(userIDs []string) map[string]string {
+	names := make(map[string]string)
+	if a == nil {
+		return names
+	}
+
+	seen := make(map[int64]bool)
+	var ids []int64
+	for _, userID := range userIDs {
+		id, err := strconv.ParseInt(userID, 10, 64)
+		if err != nil || seen[id] {
+			continue
+		}
+		seen[id] = true
+		ids = append(ids, id)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for start := 0; start < len(ids); start += maxGetUsers {
+		end := min(start+maxGetUsers, len(ids))
+		resp, err := a.client.GetUsers(ctx, &authpb.GetUsersRequest{UserIds: ids[start:end]})
+		if err != nil {
+			log.Printf("Failed to look up map owners: %v", err)
+			return names
+		}
+		for _, user := range resp.Users {
+			names[strconv.FormatInt(user.Id, 10)] = user.Name
+		}
+	}
+	return names
+}
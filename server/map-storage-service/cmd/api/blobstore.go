@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+)
+
+var errBlobNotFound = errors.New("blob not found")
+
+// pendingPrefix starts the names of uploads whose key is not known yet.
+// Put renames them once it is, so any left over belong to puts that failed
+// or were interrupted.
+const pendingPrefix = "pending-"
+
+// blobKeyPattern matches the keys handed out by Put: the hex SHA-256 of the
+// content. Checking it keeps arbitrary strings out of file paths.
+var blobKeyPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// BlobStore stores immutable blobs under a key derived from their content,
+// so that storing the same bytes twice yields the same key and one copy.
+// Each blob remembers when it was last stored, so that one that is about
+// to be referenced is not mistaken for garbage.
+type BlobStore interface {
+	// Put reads r to the end and returns the blob's key and size. Putting
+	// bytes that are already stored counts as storing them again.
+	Put(ctx context.Context, r io.Reader) (key string, size int64, err error)
+	// Get opens the blob for reading. It returns errBlobNotFound if there
+	// is no blob with that key.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete removes the blob if it was last stored before storedBefore,
+	// even when a Put of the same bytes runs at the same time. Deleting a
+	// missing blob is not an error.
+	Delete(ctx context.Context, key string, storedBefore time.Time) error
+	// Each calls fn with the key of every blob last stored before
+	// storedBefore.
+	Each(ctx context.Context, storedBefore time.Time, fn func(key string) error) error
+	// DeletePending removes uploads that were started before startedBefore
+	// but never became blobs.
+	DeletePending(ctx context.Context, startedBefore time.Time) error
+}
+
+// newBlobStore returns the store selected by kind, "gridfs" or "filesystem".
+// db is only used by GridFS.
+func newBlobStore(kind, dir string, db *mongo.Database) (BlobStore, error) {
+	switch kind {
+	case "gridfs":
+		return newGridFSBlobStore(db)
+	case "filesystem":
+		return newFileBlobStore(dir)
+	default:
+		return nil, fmt.Errorf("unknown blob store %q", kind)
+	}
+}
+
+// hashingReader hashes and counts what is read through it.
+type hashingReader struct {
+	r    io.Reader
+	h    hash.Hash
+	size int64
+}
+
+func newHashingReader(r io.Reader) *hashingReader {
+	return &hashingReader{r: r, h: sha256.New()}
+}
+
+func (h *hashingReader) Read(p []byte) (int, error) {
+	n, err := h.r.Read(p)
+	h.h.Write(p[:n])
+	h.size += int64(n)
+	return n, err
+}
+
+func (h *hashingReader) key() string {
+	return hex.EncodeToString(h.h.Sum(nil))
+}
+
+// GridFSBlobStore keeps blobs in the database's default GridFS bucket,
+// using the key as the file name.
+type GridFSBlobStore struct {
+	bucket *gridfs.Bucket
+}
+
+func newGridFSBlobStore(db *mongo.Database) (*GridFSBlobStore, error) {
+	bucket, err := gridfs.NewBucket(db)
+	if err != nil {
+		return nil, err
+	}
+	return &GridFSBlobStore{bucket: bucket}, nil
+}
+
+func (s *GridFSBlobStore) Put(ctx context.Context, r io.Reader) (string, int64, error) {
+	// The key is only known once everything has been read, so upload under
+	// a temporary name and rename afterwards.
+	id := primitive.NewObjectID()
+	stream, err := s.bucket.OpenUploadStreamWithID(id, pendingPrefix+id.Hex())
+	if err != nil {
+		return "", 0, err
+	}
+	hr := newHashingReader(r)
+	if _, err := io.Copy(stream, hr); err != nil {
+		stream.Abort()
+		return "", 0, err
+	}
+	if err := stream.Close(); err != nil {
+		return "", 0, err
+	}
+
+	// Keep the new upload and drop earlier copies, so that the upload date
+	// says when the blob was last stored. Only copies with a lower ID are
+	// dropped, so concurrent puts of the same bytes leave the newest one
+	// rather than deleting each other's.
+	key := hr.key()
+	if err := s.bucket.RenameContext(ctx, id, key); err != nil {
+		return "", 0, err
+	}
+	if err := s.deleteFiles(ctx, bson.M{"filename": key, "_id": bson.M{"$lt": id}}); err != nil {
+		return "", 0, err
+	}
+	return key, hr.size, nil
+}
+
+func (s *GridFSBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	if !blobKeyPattern.MatchString(key) {
+		return nil, errBlobNotFound
+	}
+	stream, err := s.bucket.OpenDownloadStreamByName(key)
+	if err == gridfs.ErrFileNotFound {
+		return nil, errBlobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// Delete only removes copies uploaded before storedBefore. A concurrent Put
+// uploads a new copy, which is left alone.
+func (s *GridFSBlobStore) Delete(ctx context.Context, key string, storedBefore time.Time) error {
+	return s.deleteFiles(ctx, bson.M{"filename": key, "uploadDate": bson.M{"$lt": storedBefore}})
+}
+
+func (s *GridFSBlobStore) deleteFiles(ctx context.Context, filter bson.M) error {
+	cursor, err := s.bucket.FindContext(ctx, filter)
+	if err != nil {
+		return err
+	}
+	var files []struct {
+		ID primitive.ObjectID `bson:"_id"`
+	}
+	if err := cursor.All(ctx, &files); err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err := s.bucket.DeleteContext(ctx, file.ID); err != nil && err != gridfs.ErrFileNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *GridFSBlobStore) Each(ctx context.Context, storedBefore time.Time, fn func(key string) error) error {
+	cursor, err := s.bucket.FindContext(ctx, bson.M{
+		"filename":   bson.M{"$regex": blobKeyPattern.String()},
+		"uploadDate": bson.M{"$lt": storedBefore},
+	})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var file struct {
+			Filename string `bson:"filename"`
+		}
+		if err := cursor.Decode(&file); err != nil {
+			return err
+		}
+		if err := fn(file.Filename); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+func (s *GridFSBlobStore) DeletePending(ctx context.Context, startedBefore time.Time) error {
+	return s.deleteFiles(ctx, bson.M{
+		"filename":   bson.M{"$regex": "^" + pendingPrefix},
+		"uploadDate": bson.M{"$lt": startedBefore},
+	})
+}
+
+// FileBlobStore keeps blobs as files below a directory, fanned out by the
+// first two characters of the key.
+type FileBlobStore struct {
+	dir string
+}
+
+func newFileBlobStore(dir string) (*FileBlobStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &FileBlobStore{dir: dir}, nil
+}
+
+func (s *FileBlobStore) path(key string) string {
+	return filepath.Join(s.dir, key[:2], key)
+}
+
+func (s *FileBlobStore) Put(ctx context.Context, r io.Reader) (string, int64, error) {
+	tmp, err := os.CreateTemp(s.dir, pendingPrefix+"*")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	hr := newHashingReader(r)
+	if _, err := io.Copy(tmp, hr); err != nil {
+		tmp.Close()
+		return "", 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", 0, err
+	}
+
+	// Renaming is atomic, and a blob that already exists has the same
+	// content, so concurrent puts of the same bytes are harmless. The new
+	// file's modification time records that the blob was stored again.
+	key := hr.key()
+	if err := os.MkdirAll(filepath.Dir(s.path(key)), 0o755); err != nil {
+		return "", 0, err
+	}
+	if err := os.Rename(tmp.Name(), s.path(key)); err != nil {
+		return "", 0, err
+	}
+	return key, hr.size, nil
+}
+
+func (s *FileBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	if !blobKeyPattern.MatchString(key) {
+		return nil, errBlobNotFound
+	}
+	f, err := os.Open(s.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errBlobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Delete moves the blob aside before looking at its age, so that a Put of
+// the same bytes either lands afterwards and is kept, or landed first and
+// is moved back.
+func (s *FileBlobStore) Delete(ctx context.Context, key string, storedBefore time.Time) error {
+	if !blobKeyPattern.MatchString(key) {
+		return nil
+	}
+	tmp, err := os.CreateTemp(s.dir, "deleting-*")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	err = os.Rename(s.path(key), tmp.Name())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(tmp.Name())
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Before(storedBefore) {
+		return nil
+	}
+	// Anything put since has the same bytes, so overwriting it is harmless.
+	return os.Rename(tmp.Name(), s.path(key))
+}
+
+func (s *FileBlobStore) Each(ctx context.Context, storedBefore time.Time, fn func(key string) error) error {
+	return filepath.WalkDir(s.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !blobKeyPattern.MatchString(d.Name()) {
+			return nil
+		}
+		info, err := d.Info()
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.ModTime().Before(storedBefore) {
+			return fn(d.Name())
+		}
+		return nil
+	})
+}
+
+// DeletePending only looks at the top directory, where Put creates its
+// temporary files.
+func (s *FileBlobStore) DeletePending(ctx context.Context, startedBefore time.Time) error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasPrefix(entry.Name(), pendingPrefix) {
+			continue
+		}
+		info, err := entry.Info()
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !info.ModTime().Before(startedBefore) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(s.dir, entry.Name())); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,490 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// maxFolderDepth bounds how deeply folders nest.
+	maxFolderDepth = 16
+	maxTags        = 20
+	maxTagLength   = 50
+)
+
+// Folder groups a user's maps. Folders nest through ParentID; folders
+// without one are at the top level. Folders are private to their owner:
+// maps shared with others don't bring their folder along.
+type Folder struct {
+	ID        primitive.ObjectID  `json:"id" bson:"_id,omitempty"`
+	UserID    string              `json:"userId" bson:"userId"`
+	Name      string              `json:"name" bson:"name"`
+	ParentID  *primitive.ObjectID `json:"parentId,omitempty" bson:"parentId,omitempty"`
+	CreatedAt time.Time           `json:"createdAt" bson:"createdAt"`
+	UpdatedAt time.Time           `json:"updatedAt" bson:"updatedAt"`
+}
+
+// FolderRequest is the body of POST /api/v1/folders.
+type FolderRequest struct {
+	Name     string              `json:"name"`
+	ParentID *primitive.ObjectID `json:"parentId"`
+}
+
+// UpdateFolderRequest is the body of PATCH /api/v1/folders/{id}. A parentId
+// of null moves the folder to the top level; omitting it leaves it where it
+// is.
+type UpdateFolderRequest struct {
+	Name     *string         `json:"name"`
+	ParentID json.RawMessage `json:"parentId"`
+}
+
+// MoveMapRequest is the body of PUT /api/v1/maps/{id}/folder. A null
+// folderId takes the map out of its folder.
+type MoveMapRequest struct {
+	FolderID *primitive.ObjectID `json:"folderId"`
+}
+
+// TagsRequest is the body of PUT /api/v1/maps/{id}/tags.
+type TagsRequest struct {
+	Tags []string `json:"tags"`
+}
+
+// TagCount is an entry of GET /api/v1/tags.
+type TagCount struct {
+	Tag   string `json:"tag" bson:"_id"`
+	Count int64  `json:"count" bson:"count"`
+}
+
+// callerID returns the signed-in caller, writing a 401 if there is none.
+func callerID(w http.ResponseWriter, r *http.Request) (string, bool) {
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		http.Error(w, "Authentication required", http.StatusUnauthorized)
+		return "", false
+	}
+	return userID, true
+}
+
+// normalizeTags trims and lower-cases tags, dropping empty ones and
+// duplicates, so that filtering by tag is not thrown off by spelling.
+func normalizeTags(tags []string) ([]string, error) {
+	seen := make(map[string]bool, len(tags))
+	normalized := []string{}
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || seen[tag] {
+			continue
+		}
+		if len(tag) > maxTagLength {
+			return nil, fmt.Errorf("tags must be at most %d characters", maxTagLength)
+		}
+		seen[tag] = true
+		normalized = append(normalized, tag)
+	}
+	if len(normalized) > maxTags {
+		return nil, fmt.Errorf("a map can have at most %d tags", maxTags)
+	}
+	return normalized, nil
+}
+
+// findFolder loads one of userID's folders, writing the error response if
+// it doesn't exist.
+func (s *Server) findFolder(w http.ResponseWriter, userID string, id primitive.ObjectID) (Folder, bool) {
+	folder, err := s.folders.ByID(context.Background(), userID, id)
+	if err == errNotFound {
+		http.Error(w, "Folder not found", http.StatusNotFound)
+		return folder, false
+	}
+	if err != nil {
+		log.Printf("Error finding folder: %v", err)
+		http.Error(w, "Failed to retrieve folder", http.StatusInternalServerError)
+		return folder, false
+	}
+	return folder, true
+}
+
+// checkFolderParent checks that parentID is one of userID's folders, that
+// putting folder id under it keeps the tree acyclic and that the folder and
+// its subfolders end up nested at most maxFolderDepth deep. id is nil for a
+// new folder.
+func (s *Server) checkFolderParent(w http.ResponseWriter, userID string, id *primitive.ObjectID, parentID primitive.ObjectID) bool {
+	height := 1
+	if id != nil {
+		folders, ok := s.listFolders(w, userID)
+		if !ok {
+			return false
+		}
+		height = subtreeHeight(folders, *id)
+	}
+
+	depth := height
+	for next := &parentID; next != nil; depth++ {
+		if id != nil && *next == *id {
+			http.Error(w, "A folder can't be moved into itself", http.StatusBadRequest)
+			return false
+		}
+		if depth >= maxFolderDepth {
+			http.Error(w, fmt.Sprintf("Folders can be nested at most %d deep", maxFolderDepth), http.StatusBadRequest)
+			return false
+		}
+		parent, ok := s.findFolder(w, userID, *next)
+		if !ok {
+			return false
+		}
+		next = parent.ParentID
+	}
+	return true
+}
+
+// listFolders loads all of userID's folders, writing the error response if
+// that fails.
+func (s *Server) listFolders(w http.ResponseWriter, userID string) ([]Folder, bool) {
+	folders, err := s.folders.List(context.Background(), userID)
+	if err != nil {
+		log.Printf("Error fetching folders: %v", err)
+		http.Error(w, "Failed to retrieve folder", http.StatusInternalServerError)
+		return nil, false
+	}
+	return folders, true
+}
+
+// subtreeHeight counts the levels of the tree below folder id, the folder
+// itself included.
+func subtreeHeight(folders []Folder, id primitive.ObjectID) int {
+	children := make(map[primitive.ObjectID][]primitive.ObjectID)
+	for _, f := range folders {
+		if f.ParentID != nil {
+			children[*f.ParentID] = append(children[*f.ParentID], f.ID)
+		}
+	}
+	var height func(id primitive.ObjectID, depth int) int
+	height = func(id primitive.ObjectID, depth int) int {
+		h := 1
+		// The tree is acyclic; the bound only guards against bad data.
+		if depth > maxFolderDepth {
+			return h
+		}
+		for _, child := range children[id] {
+			if ch := 1 + height(child, depth+1); ch > h {
+				h = ch
+			}
+		}
+		return h
+	}
+	return height(id, 1)
+}
+
+// subfolderNameTaken reports whether one of folder's subfolders has the name
+// of a folder next to it, which would clash once deleting folder moves the
+// subfolders up. folder itself still counts, as it is only deleted after
+// its subfolders have moved.
+func subfolderNameTaken(folders []Folder, folder Folder) bool {
+	siblings := make(map[string]bool)
+	for _, f := range folders {
+		if sameParent(f.ParentID, folder.ParentID) {
+			siblings[f.Name] = true
+		}
+	}
+	for _, f := range folders {
+		if f.ParentID != nil && *f.ParentID == folder.ID && siblings[f.Name] {
+			return true
+		}
+	}
+	return false
+}
+
+// writeFolderError responds to a failed folder write.
+func writeFolderError(w http.ResponseWriter, err error) {
+	if err == errDuplicateFolder {
+		http.Error(w, "A folder with that name already exists here", http.StatusConflict)
+		return
+	}
+	log.Printf("Error saving folder: %v", err)
+	http.Error(w, "Failed to save folder", http.StatusInternalServerError)
+}
+
+// logFolderEvent logs a change to userID's folders or to where their maps
+// are filed.
+func (s *Server) logFolderEvent(event, userID, description string, metadata map[string]string) {
+	if s.logger == nil {
+		return
+	}
+	if err := s.logger.LogEvent(event, userID, description, metadata); err != nil {
+		log.Printf("Failed to log %s: %v", event, err)
+	}
+}
+
+// handleGetFolders lists all of the caller's folders, sorted by name. They
+// come as a flat list; clients build the tree from parentId.
+func (s *Server) handleGetFolders(w http.ResponseWriter, r *http.Request) {
+	userID, ok := callerID(w, r)
+	if !ok {
+		return
+	}
+
+	folders, err := s.folders.List(context.Background(), userID)
+	if err != nil {
+		log.Printf("Error fetching folders: %v", err)
+		http.Error(w, "Failed to fetch folders", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(folders)
+}
+
+func (s *Server) handleCreateFolder(w http.ResponseWriter, r *http.Request) {
+	userID, ok := callerID(w, r)
+	if !ok {
+		return
+	}
+
+	var req FolderRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		http.Error(w, "Name is required", http.StatusBadRequest)
+		return
+	}
+	if req.ParentID != nil && !s.checkFolderParent(w, userID, nil, *req.ParentID) {
+		return
+	}
+
+	now := time.Now()
+	folder := Folder{
+		UserID:    userID,
+		Name:      req.Name,
+		ParentID:  req.ParentID,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if err := s.folders.Create(context.Background(), &folder); err != nil {
+		writeFolderError(w, err)
+		return
+	}
+
+	s.logFolderEvent("folder_created", userID, fmt.Sprintf("Folder created: %s", folder.Name),
+		map[string]string{"folder_id": folder.ID.Hex(), "folder_name": folder.Name})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(folder)
+}
+
+// handleUpdateFolder renames a folder and/or moves it under another one.
+func (s *Server) handleUpdateFolder(w http.ResponseWriter, r *http.Request) {
+	userID, ok := callerID(w, r)
+	if !ok {
+		return
+	}
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid folder ID", http.StatusBadRequest)
+		return
+	}
+
+	var req UpdateFolderRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	folder, ok := s.findFolder(w, userID, id)
+	if !ok {
+		return
+	}
+
+	if req.Name != nil {
+		folder.Name = strings.TrimSpace(*req.Name)
+		if folder.Name == "" {
+			http.Error(w, "Name must not be empty", http.StatusBadRequest)
+			return
+		}
+	}
+	if req.ParentID != nil {
+		var parentID *primitive.ObjectID
+		if err := json.Unmarshal(req.ParentID, &parentID); err != nil {
+			http.Error(w, "Invalid parentId", http.StatusBadRequest)
+			return
+		}
+		if parentID != nil && !s.checkFolderParent(w, userID, &id, *parentID) {
+			return
+		}
+		folder.ParentID = parentID
+	}
+	folder.UpdatedAt = time.Now()
+
+	if err := s.folders.Update(context.Background(), folder); err != nil {
+		writeFolderError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(folder)
+}
+
+// handleDeleteFolder deletes a folder. Its maps and subfolders move up to
+// its parent rather than being deleted with it.
+func (s *Server) handleDeleteFolder(w http.ResponseWriter, r *http.Request) {
+	userID, ok := callerID(w, r)
+	if !ok {
+		return
+	}
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid folder ID", http.StatusBadRequest)
+		return
+	}
+
+	folder, ok := s.findFolder(w, userID, id)
+	if !ok {
+		return
+	}
+
+	// Check for clashing names up front: the maps are moved first, and
+	// there is no undoing that if the folder then can't be deleted.
+	folders, ok := s.listFolders(w, userID)
+	if !ok {
+		return
+	}
+	if subfolderNameTaken(folders, folder) {
+		writeFolderError(w, errDuplicateFolder)
+		return
+	}
+
+	ctx := context.Background()
+	// Maps in the trash are moved too, so they don't come back into a
+	// folder that no longer exists.
+	if err := s.maps.MoveFolder(ctx, userID, id, folder.ParentID); err != nil {
+		log.Printf("Error moving maps out of folder: %v", err)
+		http.Error(w, "Failed to delete folder", http.StatusInternalServerError)
+		return
+	}
+	if err := s.folders.Delete(ctx, folder); err != nil {
+		// A subfolder created since the check may clash after all.
+		writeFolderError(w, err)
+		return
+	}
+
+	s.logFolderEvent("folder_deleted", userID, fmt.Sprintf("Folder deleted: %s", folder.Name),
+		map[string]string{"folder_id": id.Hex(), "folder_name": folder.Name})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleMoveMap files a map in one of its owner's folders, or takes it out
+// of its folder. Like tags, where a map is filed is not part of its content:
+// it neither bumps the version nor records a revision.
+func (s *Server) handleMoveMap(w http.ResponseWriter, r *http.Request) {
+	var req MoveMapRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	m, ok := s.loadMap(w, r, activeMaps, accessOwner)
+	if !ok {
+		return
+	}
+
+	if req.FolderID != nil {
+		if _, ok := s.findFolder(w, m.UserID, *req.FolderID); !ok {
+			return
+		}
+	}
+
+	mapData, err := s.maps.SetFolder(context.Background(), m.ID, req.FolderID)
+	if err == errNotFound {
+		http.Error(w, "Map not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error moving map: %v", err)
+		http.Error(w, "Failed to move map", http.StatusInternalServerError)
+		return
+	}
+
+	metadata := map[string]string{"map_id": mapData.ID.Hex(), "map_name": mapData.Name}
+	if mapData.FolderID != nil {
+		metadata["folder_id"] = mapData.FolderID.Hex()
+	}
+	s.logFolderEvent("map_moved", mapData.UserID, fmt.Sprintf("Map moved: %s", mapData.Name), metadata)
+
+	mapData.Access = m.Access
+	s.setURLs(&mapData)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(mapData)
+}
+
+// handleSetTags replaces a map's tags. Editors may tag maps shared with
+// them; the tags are visible to everyone who can see the map.
+func (s *Server) handleSetTags(w http.ResponseWriter, r *http.Request) {
+	var req TagsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	tags, err := normalizeTags(req.Tags)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	m, ok := s.loadMap(w, r, activeMaps, accessEditor)
+	if !ok {
+		return
+	}
+
+	mapData, err := s.maps.SetTags(context.Background(), m.ID, tags)
+	if err == errNotFound {
+		http.Error(w, "Map not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error tagging map: %v", err)
+		http.Error(w, "Failed to tag map", http.StatusInternalServerError)
+		return
+	}
+
+	s.logFolderEvent("map_tagged", mapData.UserID, fmt.Sprintf("Map tags set: %s", mapData.Name),
+		map[string]string{
+			"map_id":   mapData.ID.Hex(),
+			"map_name": mapData.Name,
+			"tags":     strings.Join(tags, ","),
+		})
+
+	mapData.Access = m.Access
+	s.setURLs(&mapData)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(mapData)
+}
+
+// handleGetTags lists the tags on the caller's maps with how many maps
+// carry each, most used first, e.g. to offer as filters.
+func (s *Server) handleGetTags(w http.ResponseWriter, r *http.Request) {
+	userID, ok := callerID(w, r)
+	if !ok {
+		return
+	}
+
+	tags, err := s.maps.Tags(context.Background(), userID)
+	if err != nil {
+		log.Printf("Error aggregating tags: %v", err)
+		http.Error(w, "Failed to fetch tags", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tags)
+}
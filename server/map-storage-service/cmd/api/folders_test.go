@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func (s *Server) createTestFolder(t *testing.T, userID, name string, parentID *primitive.ObjectID) Folder {
+	t.Helper()
+	now := time.Now()
+	folder := Folder{UserID: userID, Name: name, ParentID: parentID, CreatedAt: now, UpdatedAt: now}
+	if err := s.folders.Create(context.Background(), &folder); err != nil {
+		t.Fatal(err)
+	}
+	return folder
+}
+
+func TestDeleteFolder(t *testing.T) {
+	tests := []struct {
+		name     string
+		subName  string
+		wantCode int
+	}{
+		{"subfolder moves up", "Drafts", http.StatusNoContent},
+		{"subfolder name taken", "Archive", http.StatusConflict},
+		{"subfolder named like the folder", "Dungeons", http.StatusConflict},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			ctx := context.Background()
+			s.createTestFolder(t, "1", "Archive", nil)
+			folder := s.createTestFolder(t, "1", "Dungeons", nil)
+			sub := s.createTestFolder(t, "1", tt.subName, &folder.ID)
+			m := s.createTestMap(t, "1", "Level 1")
+			if _, err := s.maps.SetFolder(ctx, m.ID, &folder.ID); err != nil {
+				t.Fatal(err)
+			}
+
+			rec := call(s.handleDeleteFolder, "DELETE", "/", "1", map[string]string{"id": folder.ID.Hex()}, nil)
+			if rec.Code != tt.wantCode {
+				t.Fatalf("got status %d, want %d: %s", rec.Code, tt.wantCode, rec.Body)
+			}
+
+			stored, err := s.maps.ByID(ctx, m.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			movedSub, err := s.folders.ByID(ctx, "1", sub.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = s.folders.ByID(ctx, "1", folder.ID)
+			if tt.wantCode != http.StatusNoContent {
+				if err != nil || stored.FolderID == nil || *stored.FolderID != folder.ID || movedSub.ParentID == nil {
+					t.Fatalf("failed delete changed folders: map in %v, subfolder under %v, folder lookup %v",
+						stored.FolderID, movedSub.ParentID, err)
+				}
+				return
+			}
+			if err != errNotFound || stored.FolderID != nil || movedSub.ParentID != nil {
+				t.Fatalf("map in %v and subfolder under %v after delete, folder lookup %v",
+					stored.FolderID, movedSub.ParentID, err)
+			}
+		})
+	}
+}
+
+func TestUpdateFolderDepth(t *testing.T) {
+	tests := []struct {
+		name      string
+		subLevels int
+		wantCode  int
+	}{
+		{"fits", maxFolderDepth - 1, http.StatusOK},
+		{"subfolders too deep", maxFolderDepth, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			target := s.createTestFolder(t, "1", "Target", nil)
+			moved := s.createTestFolder(t, "1", "Moved", nil)
+			parent := moved
+			for i := 1; i < tt.subLevels; i++ {
+				parentID := parent.ID
+				parent = s.createTestFolder(t, "1", "Sub", &parentID)
+			}
+
+			body := map[string]string{"parentId": target.ID.Hex()}
+			rec := call(s.handleUpdateFolder, "PATCH", "/", "1", map[string]string{"id": moved.ID.Hex()}, body)
+			if rec.Code != tt.wantCode {
+				t.Fatalf("got status %d, want %d: %s", rec.Code, tt.wantCode, rec.Body)
+			}
+		})
+	}
+}
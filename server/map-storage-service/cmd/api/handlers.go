@@ -8,15 +8,15 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
-	"github.com/gorilla/mux"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
 )
 
-func handleSaveMap(w http.ResponseWriter, r *http.Request) {
+func (s *Server) handleSaveMap(w http.ResponseWriter, r *http.Request) {
 	// Read and log the raw request body
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
@@ -62,6 +62,19 @@ func handleSaveMap(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "UserID is required", http.StatusBadRequest)
 		return
 	}
+	if !authorizeUser(w, r, mapData.UserID) {
+		return
+	}
+
+	// Move the image to the blob store
+	var image ImageRef
+	if mapData.ImageData != "" {
+		image, err = s.storeImageData(r.Context(), mapData.ImageData)
+		if err != nil {
+			s.writeImageError(w, err)
+			return
+		}
+	}
 
 	// Create new map
 	newMap := Map{
@@ -69,25 +82,26 @@ func handleSaveMap(w http.ResponseWriter, r *http.Request) {
 		Name:      mapData.Name,
 		Width:     mapData.Width,
 		Height:    mapData.Height,
-		ImageData: mapData.ImageData,
+		ImageRef:  image,
 		Matrix:    mapData.Matrix,
 		CreatedAt: time.Now(),
 		UpdatedAt: time.Now(),
+		Version:   1,
 	}
 
 	// Insert into database
-	result, err := db.Collection("maps").InsertOne(context.Background(), newMap)
-	if err != nil {
+	if err := s.maps.Create(context.Background(), &newMap); err != nil {
 		log.Printf("Error saving map: %v", err)
 		http.Error(w, "Failed to save map", http.StatusInternalServerError)
 		return
 	}
 
-	// Get the inserted ID
-	newMap.ID = result.InsertedID.(primitive.ObjectID)
+	s.recordRevision(newMap, revisionAuthor(r), "Created")
+	s.refreshThumbnails(newMap)
+	s.setURLs(&newMap)
 
 	// Log the successful map creation
-	if loggerClient != nil {
+	if s.logger != nil {
 		metadata := map[string]string{
 			"map_id":   newMap.ID.Hex(),
 			"map_name": newMap.Name,
@@ -95,7 +109,7 @@ func handleSaveMap(w http.ResponseWriter, r *http.Request) {
 			"height":   fmt.Sprintf("%d", newMap.Height),
 		}
 
-		if err := loggerClient.LogEvent(
+		if err := s.logger.LogEvent(
 			"map_created",
 			newMap.UserID,
 			fmt.Sprintf("Map created: %s", newMap.Name),
@@ -107,122 +121,298 @@ func handleSaveMap(w http.ResponseWriter, r *http.Request) {
 
 	// Return the saved map
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", mapETag(newMap.Version))
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(newMap)
 }
 
-func handleGetMaps(w http.ResponseWriter, r *http.Request) {
-	// Get userID from query parameter
-	userID := r.URL.Query().Get("userId")
-	if userID == "" {
-		log.Printf("No userID provided in query parameters")
-		http.Error(w, "UserID is required", http.StatusBadRequest)
+func (s *Server) handleGetMaps(w http.ResponseWriter, r *http.Request) {
+	query, ok := parseOwnListQuery(w, r, r.URL.Query())
+	if !ok {
+		return
+	}
+	if query.Sort == "deleted" {
+		http.Error(w, "sort=deleted is only available for the trash", http.StatusBadRequest)
 		return
 	}
 
-	cursor, err := db.Collection("maps").Find(context.Background(), bson.M{"userId": userID})
+	s.writeMapPage(w, r, query)
+}
+
+// parseOwnListQuery parses a listing of the caller's maps. userId defaults
+// to the caller and may not name anyone else.
+func parseOwnListQuery(w http.ResponseWriter, r *http.Request, values url.Values) (listQuery, bool) {
+	if values.Get("userId") == "" {
+		values.Set("userId", r.Header.Get("X-User-ID"))
+	}
+	query, err := parseListQuery(values)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return query, false
+	}
+	return query, authorizeUser(w, r, query.UserID)
+}
+
+// writeMapPage responds with the page of maps selected by query.
+func (s *Server) writeMapPage(w http.ResponseWriter, r *http.Request, query listQuery) {
+	maps, total, err := s.maps.List(context.Background(), query)
 	if err != nil {
 		log.Printf("Error fetching maps: %v", err)
 		http.Error(w, "Failed to fetch maps", http.StatusInternalServerError)
 		return
 	}
-	defer cursor.Close(context.Background())
 
-	var maps []Map
-	if err = cursor.All(context.Background(), &maps); err != nil {
-		log.Printf("Error decoding maps: %v", err)
-		http.Error(w, "Failed to decode maps", http.StatusInternalServerError)
+	page := MapPage{Total: total}
+	if len(maps) > query.Limit {
+		maps = maps[:query.Limit]
+		page.NextCursor = cursorAfter(query, maps[len(maps)-1])
+	}
+
+	userIDs := make([]string, len(maps))
+	for i := range maps {
+		userIDs[i] = maps[i].UserID
+	}
+	names := s.auth.OwnerNames(userIDs)
+	p := principalFrom(r)
+	for i := range maps {
+		maps[i].OwnerName = names[maps[i].UserID]
+		maps[i].Access = accessTo(p, maps[i]).String()
+		s.setURLs(&maps[i])
+	}
+	page.Items = maps
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+// handleGetMap serves a map to any signed-in user who can view it. Holders
+// of a share link get the public view from handleGetPublicMap instead.
+func (s *Server) handleGetMap(w http.ResponseWriter, r *http.Request) {
+	mapData, ok := s.loadReadableMap(w, r)
+	if !ok {
 		return
 	}
 
+	mapData.OwnerName = s.auth.OwnerNames([]string{mapData.UserID})[mapData.UserID]
+	s.setURLs(&mapData)
+
+	// Return the map data
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(maps)
+	w.Header().Set("ETag", mapETag(mapData.Version))
+	json.NewEncoder(w).Encode(mapData)
 }
 
-func handleGetMap(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	mapID := vars["id"]
+// handleDeleteMap moves a map to the trash, from which it can be restored
+// until the purge job removes it. With ?permanent=true, a map that is
+// already in the trash is purged right away.
+func (s *Server) handleDeleteMap(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("permanent") == "true" {
+		mapData, ok := s.loadMap(w, r, allMaps, accessOwner)
+		if !ok {
+			return
+		}
+		if mapData.DeletedAt == nil {
+			http.Error(w, "Only maps in the trash can be deleted permanently", http.StatusConflict)
+			return
+		}
 
-	// Convert string ID to ObjectID
-	objectID, err := primitive.ObjectIDFromHex(mapID)
-	if err != nil {
-		log.Printf("Invalid map ID format: %v", err)
-		http.Error(w, "Invalid map ID", http.StatusBadRequest)
+		// The map may have been restored since it was loaded, in which
+		// case it is kept.
+		deleted, err := s.purgeMap(context.Background(), mapData, time.Now())
+		if err != nil {
+			log.Printf("Error deleting map: %v", err)
+			http.Error(w, "Failed to delete map", http.StatusInternalServerError)
+			return
+		}
+		if !deleted {
+			http.Error(w, "Only maps in the trash can be deleted permanently", http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
 		return
 	}
 
-	// Find the map in the database
-	var mapData Map
-	err = db.Collection("maps").FindOne(context.Background(), bson.M{"_id": objectID}).Decode(&mapData)
+	m, ok := s.loadMap(w, r, activeMaps, accessOwner)
+	if !ok {
+		return
+	}
+
+	mapData, err := s.maps.Trash(context.Background(), m.ID, time.Now())
+	if err == errNotFound {
+		http.Error(w, "Map not found", http.StatusNotFound)
+		return
+	}
 	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			http.Error(w, "Map not found", http.StatusNotFound)
-			return
-		}
-		log.Printf("Error finding map: %v", err)
-		http.Error(w, "Failed to retrieve map", http.StatusInternalServerError)
+		log.Printf("Error deleting map: %v", err)
+		http.Error(w, "Failed to delete map", http.StatusInternalServerError)
 		return
 	}
 
-	// Return the map data
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(mapData)
+	s.logMapDeleted(mapData, "trashed")
+
+	w.WriteHeader(http.StatusNoContent)
 }
 
-func handleDeleteMap(w http.ResponseWriter, r *http.Request) {
-	params := mux.Vars(r)
-	id, err := primitive.ObjectIDFromHex(params["id"])
+// mapETag formats a map version as a strong entity tag.
+func mapETag(version int64) string {
+	return fmt.Sprintf("%q", strconv.FormatInt(version, 10))
+}
+
+// parseIfMatch returns the version named by an If-Match header, or nil
+// for "*", which matches every version.
+func parseIfMatch(header string) (*int64, error) {
+	header = strings.TrimSpace(header)
+	if header == "*" {
+		return nil, nil
+	}
+	tag := strings.Trim(strings.TrimPrefix(header, "W/"), `"`)
+	version, err := strconv.ParseInt(tag, 10, 64)
 	if err != nil {
-		log.Printf("Invalid map ID: %v", err)
-		http.Error(w, "Invalid map ID", http.StatusBadRequest)
+		return nil, err
+	}
+	return &version, nil
+}
+
+// handleUpdateMap serves PUT, which replaces the map's content, and PATCH,
+// which changes only the fields present in the body. Both require an
+// If-Match header naming the current version, so that an edit based on a
+// stale copy fails with 412 instead of overwriting newer changes.
+func (s *Server) handleUpdateMap(w http.ResponseWriter, r *http.Request) {
+	id, ok := mapID(w, r)
+	if !ok {
 		return
 	}
 
-	// Get map details before deletion for logging
-	var mapData Map
-	err = db.Collection("maps").FindOne(context.Background(), bson.M{"_id": id}).Decode(&mapData)
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch == "" {
+		http.Error(w, "If-Match header is required", http.StatusPreconditionRequired)
+		return
+	}
+	version, err := parseIfMatch(ifMatch)
 	if err != nil {
-		log.Printf("Error finding map before deletion: %v", err)
-		if err == mongo.ErrNoDocuments {
-			http.Error(w, "Map not found", http.StatusNotFound)
-			return
-		}
-		http.Error(w, "Failed to retrieve map", http.StatusInternalServerError)
+		http.Error(w, "Invalid If-Match header", http.StatusPreconditionFailed)
+		return
+	}
+	if _, ok := s.loadMap(w, r, activeMaps, accessEditor); !ok {
 		return
 	}
 
-	result, err := db.Collection("maps").DeleteOne(context.Background(), bson.M{
-		"_id": id,
-	})
+	var change MapChange
+	// imageData is the new inline image, if the request changes it.
+	var imageData *string
+	if r.Method == http.MethodPut {
+		var update MapRequest
+		if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+			return
+		}
+		change = MapChange{
+			Name:   &update.Name,
+			Width:  &update.Width,
+			Height: &update.Height,
+			Matrix: &update.Matrix,
+		}
+		imageData = &update.ImageData
+	} else {
+		var patch UpdateMapRequest
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+			return
+		}
+		change = MapChange{
+			Name:   patch.Name,
+			Width:  patch.Width,
+			Height: patch.Height,
+			Matrix: patch.Matrix,
+		}
+		imageData = patch.ImageData
+		if change == (MapChange{}) && imageData == nil {
+			http.Error(w, "No fields to update", http.StatusBadRequest)
+			return
+		}
+	}
+	for field, size := range map[string]*int{"width": change.Width, "height": change.Height} {
+		if size != nil && *size < 0 {
+			http.Error(w, fmt.Sprintf("%s must not be negative", field), http.StatusBadRequest)
+			return
+		}
+	}
+	change.UpdatedAt = time.Now()
+
+	var image ImageRef
+	if imageData != nil {
+		if *imageData != "" {
+			image, err = s.storeImageData(r.Context(), *imageData)
+			if err != nil {
+				s.writeImageError(w, err)
+				return
+			}
+		}
+		change.Image = &image
+	}
 
+	// The repository returns the map as it was before the update, so the
+	// revision summary can say what changed.
+	previous, err := s.maps.Update(context.Background(), id, version, change)
+	if err == errNotFound {
+		s.releaseBlobs(context.Background(), image.ImageKey)
+		s.writeUpdateConflict(w, id)
+		return
+	}
 	if err != nil {
-		log.Printf("Error deleting map: %v", err)
-		http.Error(w, "Failed to delete map", http.StatusInternalServerError)
+		log.Printf("Error updating map: %v", err)
+		s.releaseBlobs(context.Background(), image.ImageKey)
+		http.Error(w, "Failed to update map", http.StatusInternalServerError)
 		return
 	}
 
-	if result.DeletedCount == 0 {
-		log.Printf("Map not found for deletion")
-		http.Error(w, "Map not found", http.StatusNotFound)
-		return
+	mapData := previous
+	change.apply(&mapData)
+	s.recordRevision(mapData, revisionAuthor(r), summarizeChanges(previous, mapData))
+	s.refreshThumbnails(mapData)
+	if imageData != nil {
+		s.releaseBlobs(context.Background(), previous.ImageKey)
 	}
 
-	// Log the successful map deletion
-	if loggerClient != nil {
+	// Log the successful map update
+	if s.logger != nil {
 		metadata := map[string]string{
 			"map_id":   id.Hex(),
 			"map_name": mapData.Name,
+			"version":  strconv.FormatInt(mapData.Version, 10),
 		}
 
-		if err := loggerClient.LogEvent(
-			"map_deleted",
+		if err := s.logger.LogEvent(
+			"map_updated",
 			mapData.UserID,
-			fmt.Sprintf("Map deleted: %s", mapData.Name),
+			fmt.Sprintf("Map updated: %s", mapData.Name),
 			metadata,
 		); err != nil {
-			log.Printf("Failed to log map deletion: %v", err)
+			log.Printf("Failed to log map update: %v", err)
 		}
 	}
 
-	w.WriteHeader(http.StatusNoContent)
+	mapData.OwnerName = s.auth.OwnerNames([]string{mapData.UserID})[mapData.UserID]
+	s.setURLs(&mapData)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", mapETag(mapData.Version))
+	json.NewEncoder(w).Encode(mapData)
+}
+
+// writeUpdateConflict responds to a conditional update that matched no
+// map: either the map is gone or someone else updated it first.
+func (s *Server) writeUpdateConflict(w http.ResponseWriter, id primitive.ObjectID) {
+	current, err := s.maps.Info(context.Background(), id)
+	if err == errNotFound || (err == nil && current.DeletedAt != nil) {
+		http.Error(w, "Map not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error finding map: %v", err)
+		http.Error(w, "Failed to retrieve map", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("ETag", mapETag(current.Version))
+	http.Error(w, "Map was modified by another request", http.StatusPreconditionFailed)
 }
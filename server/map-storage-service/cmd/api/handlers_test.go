@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// newTestServer returns a Server backed by the in-memory repositories and
+// a blob store in a temporary directory.
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+
+	blobs, err := newBlobStore("filesystem", t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &Server{
+		maps:           newMemoryMapRepository(),
+		revisions:      newMemoryRevisionRepository(),
+		folders:        newMemoryFolderRepository(),
+		events:         newMemoryEventRepository(),
+		blobs:          blobs,
+		limits:         defaultLimits(),
+		thumbnailQueue: make(chan primitive.ObjectID, 100),
+	}
+}
+
+func (s *Server) createTestMap(t *testing.T, userID, name string) Map {
+	t.Helper()
+
+	now := time.Now()
+	m := Map{
+		UserID:    userID,
+		Name:      name,
+		Matrix:    [][]int{{0, 1}, {1, 0}},
+		Width:     2,
+		Height:    2,
+		Version:   1,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if err := s.maps.Create(context.Background(), &m); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// testPNG encodes a width×width PNG whose pixels are all set to shade, so
+// that different shades give different blobs.
+func testPNG(t *testing.T, width, shade int) []byte {
+	t.Helper()
+
+	img := image.NewGray(image.Rect(0, 0, width, width))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(shade)
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// call runs handler on a request to target made by userID, with the route
+// variables a router would have set.
+func call(handler http.HandlerFunc, method, target, userID string, vars map[string]string, body interface{}) *httptest.ResponseRecorder {
+	var buf bytes.Buffer
+	if body != nil {
+		json.NewEncoder(&buf).Encode(body)
+	}
+
+	req := httptest.NewRequest(method, target, &buf)
+	req.Header.Set("Content-Type", "application/json")
+	if userID != "" {
+		req.Header.Set("X-User-ID", userID)
+	}
+	if vars != nil {
+		req = mux.SetURLVars(req, vars)
+	}
+
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	return rec
+}
+
+func TestSaveMap(t *testing.T) {
+	tests := []struct {
+		name     string
+		userID   string
+		req      MapRequest
+		wantCode int
+	}{
+		{"valid", "1", MapRequest{UserID: "1", Name: "Level 1", Matrix: [][]int{{1}}, Width: 1, Height: 1}, http.StatusCreated},
+		{"missing user ID", "1", MapRequest{Name: "Level 1"}, http.StatusBadRequest},
+		{"another user", "2", MapRequest{UserID: "1", Name: "Level 1"}, http.StatusForbidden},
+		{"not signed in", "", MapRequest{UserID: "1", Name: "Level 1"}, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+
+			rec := call(s.handleSaveMap, "POST", "/api/v1/maps", tt.userID, nil, tt.req)
+			if rec.Code != tt.wantCode {
+				t.Fatalf("got status %d, want %d: %s", rec.Code, tt.wantCode, rec.Body)
+			}
+			if tt.wantCode != http.StatusCreated {
+				return
+			}
+
+			var saved Map
+			if err := json.NewDecoder(rec.Body).Decode(&saved); err != nil {
+				t.Fatal(err)
+			}
+			stored, err := s.maps.ByID(context.Background(), saved.ID)
+			if err != nil {
+				t.Fatalf("map was not stored: %v", err)
+			}
+			if stored.Name != tt.req.Name || stored.Version != 1 {
+				t.Fatalf("stored %q at version %d, want %q at version 1", stored.Name, stored.Version, tt.req.Name)
+			}
+			revs, err := s.revisions.List(context.Background(), saved.ID)
+			if err != nil || len(revs) != 1 {
+				t.Fatalf("got %d revisions (%v), want 1", len(revs), err)
+			}
+		})
+	}
+}
+
+func TestGetMap(t *testing.T) {
+	tests := []struct {
+		name     string
+		userID   string
+		id       func(m Map) string
+		wantCode int
+	}{
+		{"owner", "1", func(m Map) string { return m.ID.Hex() }, http.StatusOK},
+		{"another user", "2", func(m Map) string { return m.ID.Hex() }, http.StatusNotFound},
+		{"not found", "1", func(Map) string { return primitive.NewObjectID().Hex() }, http.StatusNotFound},
+		{"invalid ID", "1", func(Map) string { return "not-an-id" }, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			m := s.createTestMap(t, "1", "Level 1")
+
+			rec := call(s.handleGetMap, "GET", "/", tt.userID, map[string]string{"id": tt.id(m)}, nil)
+			if rec.Code != tt.wantCode {
+				t.Fatalf("got status %d, want %d: %s", rec.Code, tt.wantCode, rec.Body)
+			}
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+
+			var got Map
+			if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			if got.ID != m.ID || len(got.Matrix) != len(m.Matrix) {
+				t.Fatalf("got map %s with %d rows, want %s with %d", got.ID.Hex(), len(got.Matrix), m.ID.Hex(), len(m.Matrix))
+			}
+		})
+	}
+}
+
+func TestGetMapInTrash(t *testing.T) {
+	s := newTestServer(t)
+	m := s.createTestMap(t, "1", "Level 1")
+	if _, err := s.maps.Trash(context.Background(), m.ID, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := call(s.handleGetMap, "GET", "/", "1", map[string]string{"id": m.ID.Hex()}, nil)
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("got status %d, want %d: %s", rec.Code, http.StatusNotFound, rec.Body)
+	}
+}
+
+func TestGetMaps(t *testing.T) {
+	tests := []struct {
+		name      string
+		userID    string
+		target    string
+		wantCode  int
+		wantItems int
+		wantTotal int64
+		wantNext  bool
+	}{
+		{"own maps", "1", "/api/v1/maps?userId=1", http.StatusOK, 3, 3, false},
+		{"first page", "1", "/api/v1/maps?userId=1&limit=2", http.StatusOK, 2, 3, true},
+		{"name prefix", "1", "/api/v1/maps?userId=1&q=Cave", http.StatusOK, 1, 1, false},
+		{"no maps", "3", "/api/v1/maps?userId=3", http.StatusOK, 0, 0, false},
+		{"another user", "2", "/api/v1/maps?userId=1", http.StatusForbidden, 0, 0, false},
+		{"invalid limit", "1", "/api/v1/maps?userId=1&limit=0", http.StatusBadRequest, 0, 0, false},
+		{"invalid cursor", "1", "/api/v1/maps?userId=1&cursor=nope", http.StatusBadRequest, 0, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			s.createTestMap(t, "1", "Level 1")
+			s.createTestMap(t, "1", "Level 2")
+			s.createTestMap(t, "1", "Cave")
+			s.createTestMap(t, "2", "Elsewhere")
+
+			rec := call(s.handleGetMaps, "GET", tt.target, tt.userID, nil, nil)
+			if rec.Code != tt.wantCode {
+				t.Fatalf("got status %d, want %d: %s", rec.Code, tt.wantCode, rec.Body)
+			}
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+
+			var page MapPage
+			if err := json.NewDecoder(rec.Body).Decode(&page); err != nil {
+				t.Fatal(err)
+			}
+			if len(page.Items) != tt.wantItems || page.Total != tt.wantTotal {
+				t.Fatalf("got %d items of %d, want %d of %d", len(page.Items), page.Total, tt.wantItems, tt.wantTotal)
+			}
+			if (page.NextCursor != "") != tt.wantNext {
+				t.Fatalf("got next cursor %q, want one: %v", page.NextCursor, tt.wantNext)
+			}
+			for _, m := range page.Items {
+				if m.Matrix != nil {
+					t.Fatalf("map %s was listed with its matrix", m.ID.Hex())
+				}
+			}
+		})
+	}
+}
+
+func TestGetMapsPages(t *testing.T) {
+	s := newTestServer(t)
+	for _, name := range []string{"A", "B", "C", "D", "E"} {
+		s.createTestMap(t, "1", name)
+	}
+
+	var names []string
+	target := "/api/v1/maps?userId=1&sort=name&limit=2"
+	for {
+		rec := call(s.handleGetMaps, "GET", target, "1", nil, nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("got status %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+		}
+		var page MapPage
+		if err := json.NewDecoder(rec.Body).Decode(&page); err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range page.Items {
+			names = append(names, m.Name)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		target = "/api/v1/maps?userId=1&sort=name&limit=2&cursor=" + page.NextCursor
+	}
+
+	if got := fmt.Sprint(names); got != "[A B C D E]" {
+		t.Fatalf("got %s, want [A B C D E]", got)
+	}
+}
+
+func TestDeleteMap(t *testing.T) {
+	tests := []struct {
+		name     string
+		userID   string
+		id       func(m Map) string
+		query    string
+		trashed  bool
+		wantCode int
+	}{
+		{"to trash", "1", func(m Map) string { return m.ID.Hex() }, "", false, http.StatusNoContent},
+		{"already in trash", "1", func(m Map) string { return m.ID.Hex() }, "", true, http.StatusNotFound},
+		{"permanent", "1", func(m Map) string { return m.ID.Hex() }, "?permanent=true", true, http.StatusNoContent},
+		{"permanent while active", "1", func(m Map) string { return m.ID.Hex() }, "?permanent=true", false, http.StatusConflict},
+		{"another user", "2", func(m Map) string { return m.ID.Hex() }, "", false, http.StatusNotFound},
+		{"not found", "1", func(Map) string { return primitive.NewObjectID().Hex() }, "", false, http.StatusNotFound},
+		{"invalid ID", "1", func(Map) string { return "not-an-id" }, "", false, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			m := s.createTestMap(t, "1", "Level 1")
+			if tt.trashed {
+				if _, err := s.maps.Trash(context.Background(), m.ID, time.Now()); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			rec := call(s.handleDeleteMap, "DELETE", "/"+tt.query, tt.userID, map[string]string{"id": tt.id(m)}, nil)
+			if rec.Code != tt.wantCode {
+				t.Fatalf("got status %d, want %d: %s", rec.Code, tt.wantCode, rec.Body)
+			}
+
+			stored, err := s.maps.ByID(context.Background(), m.ID)
+			switch {
+			case tt.wantCode != http.StatusNoContent:
+				if err != nil || (stored.DeletedAt != nil) != tt.trashed {
+					t.Fatalf("map changed by a failed delete: %v", err)
+				}
+			case tt.query != "":
+				if err != errNotFound {
+					t.Fatalf("got %v looking up a purged map, want errNotFound", err)
+				}
+			default:
+				if err != nil || stored.DeletedAt == nil {
+					t.Fatalf("map was not moved to the trash: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestUpdateMap(t *testing.T) {
+	tests := []struct {
+		name     string
+		userID   string
+		method   string
+		ifMatch  string
+		body     interface{}
+		wantCode int
+	}{
+		{"owner put", "1", "PUT", `"1"`, MapRequest{Name: "Renamed", Matrix: [][]int{{1}}, Width: 1, Height: 1}, http.StatusOK},
+		{"owner patch", "1", "PATCH", `"1"`, map[string]string{"name": "Renamed"}, http.StatusOK},
+		{"any version", "1", "PATCH", "*", map[string]string{"name": "Renamed"}, http.StatusOK},
+		{"editor", "2", "PATCH", `"1"`, map[string]string{"name": "Renamed"}, http.StatusOK},
+		{"viewer", "3", "PATCH", `"1"`, map[string]string{"name": "Renamed"}, http.StatusForbidden},
+		{"another user", "4", "PATCH", `"1"`, map[string]string{"name": "Renamed"}, http.StatusNotFound},
+		{"not signed in", "", "PATCH", `"1"`, map[string]string{"name": "Renamed"}, http.StatusNotFound},
+		{"stale version", "1", "PATCH", `"0"`, map[string]string{"name": "Renamed"}, http.StatusPreconditionFailed},
+		{"missing If-Match", "1", "PATCH", "", map[string]string{"name": "Renamed"}, http.StatusPreconditionRequired},
+		{"empty patch", "1", "PATCH", `"1"`, map[string]string{}, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			m := s.createTestMap(t, "1", "Level 1")
+			ctx := context.Background()
+			for userID, role := range map[string]string{"2": "editor", "3": "viewer"} {
+				if err := s.maps.PutGrant(ctx, m.ID, Grant{UserID: userID, Role: role, GrantedAt: time.Now()}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var buf bytes.Buffer
+			json.NewEncoder(&buf).Encode(tt.body)
+			req := httptest.NewRequest(tt.method, "/", &buf)
+			if tt.userID != "" {
+				req.Header.Set("X-User-ID", tt.userID)
+			}
+			if tt.ifMatch != "" {
+				req.Header.Set("If-Match", tt.ifMatch)
+			}
+			req = mux.SetURLVars(req, map[string]string{"id": m.ID.Hex()})
+			rec := httptest.NewRecorder()
+			s.handleUpdateMap(rec, req)
+
+			if rec.Code != tt.wantCode {
+				t.Fatalf("got status %d, want %d: %s", rec.Code, tt.wantCode, rec.Body)
+			}
+
+			stored, err := s.maps.ByID(ctx, m.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch tt.wantCode {
+			case http.StatusOK:
+				if stored.Name != "Renamed" || stored.Version != 2 {
+					t.Fatalf("stored %q at version %d, want \"Renamed\" at version 2", stored.Name, stored.Version)
+				}
+				if got := rec.Header().Get("ETag"); got != `"2"` {
+					t.Fatalf("got ETag %s, want \"2\"", got)
+				}
+			case http.StatusPreconditionFailed:
+				if got := rec.Header().Get("ETag"); got != `"1"` {
+					t.Fatalf("got ETag %s on a conflict, want the current version \"1\"", got)
+				}
+				fallthrough
+			default:
+				if stored.Name != m.Name || stored.Version != 1 {
+					t.Fatalf("map changed by a failed update: %q at version %d", stored.Name, stored.Version)
+				}
+			}
+		})
+	}
+}
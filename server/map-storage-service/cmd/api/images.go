@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// imageExtensions are the image types maps may have, with the extension
+// files of that type are named with, e.g. in archives. Other types, SVG in
+// particular, could carry scripts and are refused.
+var imageExtensions = map[string]string{
+	"image/png":  ".png",
+	"image/jpeg": ".jpg",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+var (
+	errImageTooLarge    = errors.New("image is too large")
+	errInvalidImage     = errors.New("invalid image data")
+	errUnsupportedImage = errors.New("unsupported image type")
+)
+
+// decodeImageData decodes an image sent inline as a data URL
+// ("data:image/png;base64,...") or as bare base64, which is taken as PNG.
+// Images larger than limit bytes are refused.
+func decodeImageData(s string, limit int64) ([]byte, string, error) {
+	contentType := "image/png"
+	if rest, ok := strings.CutPrefix(s, "data:"); ok {
+		header, data, ok := strings.Cut(rest, ",")
+		mediaType, isBase64 := strings.CutSuffix(header, ";base64")
+		if !ok || !isBase64 || !strings.HasPrefix(mediaType, "image/") {
+			return nil, "", errInvalidImage
+		}
+		contentType, s = mediaType, data
+	}
+
+	if int64(base64.StdEncoding.DecodedLen(len(s))) > limit+2 {
+		return nil, "", errImageTooLarge
+	}
+	data, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, "", errInvalidImage
+	}
+	if int64(len(data)) > limit {
+		return nil, "", errImageTooLarge
+	}
+	return data, contentType, nil
+}
+
+// storeImageData moves an inline image into the blob store.
+func (s *Server) storeImageData(ctx context.Context, data string) (ImageRef, error) {
+	image, contentType, err := decodeImageData(data, s.limits.MaxImageBytes)
+	if err != nil {
+		return ImageRef{}, err
+	}
+	if _, ok := imageExtensions[contentType]; !ok {
+		return ImageRef{}, errUnsupportedImage
+	}
+	return s.storeImage(ctx, bytes.NewReader(image))
+}
+
+// storeImage streams an image into the blob store. Its type is taken from
+// its content rather than from what the client claimed, and must be one of
+// imageExtensions.
+func (s *Server) storeImage(ctx context.Context, r io.Reader) (ImageRef, error) {
+	br := bufio.NewReader(r)
+	head, err := br.Peek(512)
+	if err != nil && err != io.EOF {
+		return ImageRef{}, err
+	}
+	contentType := http.DetectContentType(head)
+	if _, ok := imageExtensions[contentType]; !ok {
+		return ImageRef{}, errUnsupportedImage
+	}
+
+	key, size, err := s.blobs.Put(ctx, br)
+	if err != nil {
+		return ImageRef{}, err
+	}
+	return ImageRef{ImageKey: key, ImageSize: size, ImageType: contentType}, nil
+}
+
+// writeImageError responds to a failed storeImageData.
+func (s *Server) writeImageError(w http.ResponseWriter, err error) {
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.Is(err, errImageTooLarge), errors.As(err, &maxBytesErr):
+		http.Error(w, fmt.Sprintf("Image must not be larger than %d bytes", s.limits.MaxImageBytes), http.StatusRequestEntityTooLarge)
+	case errors.Is(err, errInvalidImage):
+		http.Error(w, "Invalid image data", http.StatusBadRequest)
+	case errors.Is(err, errUnsupportedImage):
+		http.Error(w, "Image must be a PNG, JPEG, GIF or WebP file", http.StatusUnsupportedMediaType)
+	default:
+		log.Printf("Error storing image: %v", err)
+		http.Error(w, "Failed to store image", http.StatusInternalServerError)
+	}
+}
+
+// setURL points ImageURL at path if there is an image to download.
+func (ref *ImageRef) setURL(path string) {
+	if ref.ImageKey != "" || ref.ImageData != "" {
+		ref.ImageURL = path
+	}
+}
+
+// setURLs fills in the download URLs of m's image and thumbnails.
+func (s *Server) setURLs(m *Map) {
+	s.setURLsAt(m, "/api/v1/maps/"+m.ID.Hex())
+}
+
+// setURLsAt is setURLs for a map served under prefix rather than its usual
+// path, e.g. through a share link.
+func (s *Server) setURLsAt(m *Map, prefix string) {
+	m.ImageRef.setURL(prefix + "/image")
+	s.setThumbnailURLs(m, prefix)
+}
+
+func revisionImagePath(id primitive.ObjectID, revision int64) string {
+	return fmt.Sprintf("/api/v1/maps/%s/revisions/%d/image", id.Hex(), revision)
+}
+
+// releaseBlobs deletes the given blobs unless a map or revision still
+// refers to them. Blobs are shared because keys are content-addressed, so
+// this is the only safe way to delete one. Blobs stored within the grace
+// period are kept, since another request may have just stored the same
+// bytes and not yet saved its reference; runBlobSweeper deletes them later
+// if they stay unused. Failures are logged; at worst a blob is left behind.
+func (s *Server) releaseBlobs(ctx context.Context, keys ...string) {
+	storedBefore := time.Now().Add(-s.blobGracePeriod)
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		if key == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		referenced := false
+		for _, refs := range []blobReferences{s.maps, s.revisions} {
+			found, err := refs.ReferencesBlob(ctx, key)
+			if err != nil {
+				log.Printf("Error checking references to blob %s: %v", key, err)
+				found = true
+			}
+			referenced = referenced || found
+		}
+		if referenced {
+			continue
+		}
+		if err := s.blobs.Delete(ctx, key, storedBefore); err != nil {
+			log.Printf("Error deleting blob %s: %v", key, err)
+		}
+	}
+}
+
+// runBlobSweeper releases blobs that are past the grace period, every
+// interval until ctx is cancelled. It catches the blobs releaseBlobs kept
+// because they were new, and any left behind by failures, along with
+// uploads that never finished.
+func (s *Server) runBlobSweeper(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.sweepBlobs(ctx)
+		}
+	}
+}
+
+func (s *Server) sweepBlobs(ctx context.Context) {
+	cutoff := time.Now().Add(-s.blobGracePeriod)
+	if err := s.blobs.DeletePending(ctx, cutoff); err != nil {
+		log.Printf("Error deleting abandoned uploads: %v", err)
+	}
+
+	var keys []string
+	err := s.blobs.Each(ctx, cutoff, func(key string) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		log.Printf("Error listing blobs: %v", err)
+		return
+	}
+	s.releaseBlobs(ctx, keys...)
+}
+
+// blobKeys returns the blobs a map and its revisions refer to.
+func (s *Server) blobKeys(ctx context.Context, mapID primitive.ObjectID) ([]string, error) {
+	var keys []string
+	for _, refs := range []blobReferences{s.maps, s.revisions} {
+		values, err := refs.BlobKeys(ctx, mapID)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, values...)
+	}
+	return keys, nil
+}
+
+// setImageHeaders sets the type of an image response. Browsers are told not
+// to guess a type, and images saved before uploads were checked whose type
+// is not one of imageExtensions are only offered as a download, so that no
+// image is ever rendered as a document.
+func setImageHeaders(w http.ResponseWriter, contentType string) {
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if ext, ok := imageExtensions[contentType]; ok {
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`inline; filename="image%s"`, ext))
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="image"`)
+}
+
+// serveImage writes the image ref points to. Blobs never change, so the key
+// doubles as the ETag.
+func (s *Server) serveImage(w http.ResponseWriter, r *http.Request, ref ImageRef) {
+	if ref.ImageKey == "" {
+		if ref.ImageData == "" {
+			http.Error(w, "Map has no image", http.StatusNotFound)
+			return
+		}
+		data, contentType, err := decodeImageData(ref.ImageData, s.limits.MaxImageBytes)
+		if err != nil {
+			log.Printf("Error decoding inline image: %v", err)
+			http.Error(w, "Failed to read image", http.StatusInternalServerError)
+			return
+		}
+		setImageHeaders(w, contentType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Write(data)
+		return
+	}
+
+	etag := `"` + ref.ImageKey + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "private, no-cache")
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	blob, err := s.blobs.Get(r.Context(), ref.ImageKey)
+	if err != nil {
+		log.Printf("Error opening blob %s: %v", ref.ImageKey, err)
+		http.Error(w, "Failed to read image", http.StatusInternalServerError)
+		return
+	}
+	defer blob.Close()
+
+	setImageHeaders(w, ref.ImageType)
+	w.Header().Set("Content-Length", strconv.FormatInt(ref.ImageSize, 10))
+	if _, err := io.Copy(w, blob); err != nil {
+		log.Printf("Error sending blob %s: %v", ref.ImageKey, err)
+	}
+}
+
+func (s *Server) handleGetMapImage(w http.ResponseWriter, r *http.Request) {
+	mapData, ok := s.loadMapMedia(w, r)
+	if !ok {
+		return
+	}
+
+	s.serveImage(w, r, mapData.ImageRef)
+}
+
+func (s *Server) handleGetRevisionImage(w http.ResponseWriter, r *http.Request) {
+	mapID, revision, ok := s.revisionVars(w, r, accessViewer)
+	if !ok {
+		return
+	}
+	rev, ok := s.findRevision(w, mapID, revision)
+	if !ok {
+		return
+	}
+	s.serveImage(w, r, rev.ImageRef)
+}
+
+// handlePutMapImage replaces a map's image with the raw request body, which
+// is streamed to the blob store. Like other updates it requires If-Match.
+func (s *Server) handlePutMapImage(w http.ResponseWriter, r *http.Request) {
+	id, ok := mapID(w, r)
+	if !ok {
+		return
+	}
+
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch == "" {
+		http.Error(w, "If-Match header is required", http.StatusPreconditionRequired)
+		return
+	}
+	version, err := parseIfMatch(ifMatch)
+	if err != nil {
+		http.Error(w, "Invalid If-Match header", http.StatusPreconditionFailed)
+		return
+	}
+
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if _, ok := imageExtensions[contentType]; !ok {
+		http.Error(w, "Content-Type must be image/png, image/jpeg, image/gif or image/webp", http.StatusUnsupportedMediaType)
+		return
+	}
+	if _, ok := s.loadMap(w, r, activeMaps, accessEditor); !ok {
+		return
+	}
+
+	ref, err := s.storeImage(r.Context(), http.MaxBytesReader(w, r.Body, s.limits.MaxImageBytes))
+	if err != nil {
+		s.writeImageError(w, err)
+		return
+	}
+
+	change := MapChange{Image: &ref, UpdatedAt: time.Now()}
+	previous, err := s.maps.Update(context.Background(), id, version, change)
+	if err == errNotFound {
+		s.releaseBlobs(context.Background(), ref.ImageKey)
+		s.writeUpdateConflict(w, id)
+		return
+	}
+	if err != nil {
+		log.Printf("Error updating map image: %v", err)
+		s.releaseBlobs(context.Background(), ref.ImageKey)
+		http.Error(w, "Failed to update map", http.StatusInternalServerError)
+		return
+	}
+
+	mapData := previous
+	change.apply(&mapData)
+	s.recordRevision(mapData, revisionAuthor(r), summarizeChanges(previous, mapData))
+	s.refreshThumbnails(mapData)
+	s.releaseBlobs(context.Background(), previous.ImageKey)
+
+	if s.logger != nil {
+		metadata := map[string]string{
+			"map_id":     id.Hex(),
+			"map_name":   mapData.Name,
+			"image_size": strconv.FormatInt(ref.ImageSize, 10),
+			"version":    strconv.FormatInt(mapData.Version, 10),
+		}
+
+		if err := s.logger.LogEvent(
+			"map_image_updated",
+			mapData.UserID,
+			fmt.Sprintf("Map image updated: %s", mapData.Name),
+			metadata,
+		); err != nil {
+			log.Printf("Failed to log map image update: %v", err)
+		}
+	}
+
+	s.setURLs(&mapData)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", mapETag(mapData.Version))
+	json.NewEncoder(w).Encode(mapData)
+}
+
+// migrateInlineImages moves the inline images of maps and revisions saved
+// before the blob store into it. It changes neither versions nor
+// timestamps, and can be rerun safely after an interruption.
+func (s *Server) migrateInlineImages(ctx context.Context) error {
+	for _, source := range []struct {
+		name  string
+		store inlineImageStore
+	}{
+		{"maps", s.maps},
+		{"map_revisions", s.revisions},
+	} {
+		migrated, failed := 0, 0
+		err := source.store.EachInlineImage(ctx, func(id primitive.ObjectID, data string) error {
+			var ref ImageRef
+			if data != "" {
+				var err error
+				ref, err = s.storeImageData(ctx, data)
+				if err != nil {
+					log.Printf("Skipping %s %s: %v", source.name, id.Hex(), err)
+					failed++
+					return nil
+				}
+			}
+
+			// Only touch the document if the inline image is unchanged,
+			// in case it was updated while migrating.
+			if err := source.store.MoveInlineImage(ctx, id, data, ref); err != nil {
+				return err
+			}
+			migrated++
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		log.Printf("Migrated %d inline images in %s, %d failed", migrated, source.name, failed)
+	}
+	return nil
+}
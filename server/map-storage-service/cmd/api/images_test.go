@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestPutMapImage(t *testing.T) {
+	svg := []byte(`<svg xmlns="http://www.w3.org/2000/svg"><script>alert(1)</script></svg>`)
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        []byte
+		wantCode    int
+		wantType    string
+	}{
+		{"png", "image/png", testPNG(t, 2, 1), http.StatusOK, "image/png"},
+		{"declared with parameters", "image/png; charset=binary", testPNG(t, 2, 1), http.StatusOK, "image/png"},
+		{"type taken from content", "image/jpeg", testPNG(t, 2, 1), http.StatusOK, "image/png"},
+		{"svg", "image/svg+xml", svg, http.StatusUnsupportedMediaType, ""},
+		{"svg declared as png", "image/png", svg, http.StatusUnsupportedMediaType, ""},
+		{"not an image", "text/html", []byte("<html></html>"), http.StatusUnsupportedMediaType, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			m := s.createTestMap(t, "1", "Level 1")
+
+			req := httptest.NewRequest("PUT", "/", bytes.NewReader(tt.body))
+			req.Header.Set("Content-Type", tt.contentType)
+			req.Header.Set("X-User-ID", "1")
+			req.Header.Set("If-Match", "*")
+			req = mux.SetURLVars(req, map[string]string{"id": m.ID.Hex()})
+			rec := httptest.NewRecorder()
+			s.handlePutMapImage(rec, req)
+
+			if rec.Code != tt.wantCode {
+				t.Fatalf("got status %d, want %d: %s", rec.Code, tt.wantCode, rec.Body)
+			}
+			stored, err := s.maps.ByID(context.Background(), m.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored.ImageType != tt.wantType {
+				t.Fatalf("stored image type %q, want %q", stored.ImageType, tt.wantType)
+			}
+		})
+	}
+}
+
+func TestServeImageHeaders(t *testing.T) {
+	tests := []struct {
+		name            string
+		imageType       string
+		wantType        string
+		wantDisposition string
+	}{
+		{"allowed type", "image/png", "image/png", `inline; filename="image.png"`},
+		{"legacy svg", "image/svg+xml", "application/octet-stream", `attachment; filename="image"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			data := testPNG(t, 2, 1)
+			ref, err := s.storeImage(context.Background(), bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			ref.ImageType = tt.imageType
+
+			rec := httptest.NewRecorder()
+			s.serveImage(rec, httptest.NewRequest("GET", "/", nil), ref)
+
+			if got := rec.Header().Get("Content-Type"); got != tt.wantType {
+				t.Errorf("got Content-Type %q, want %q", got, tt.wantType)
+			}
+			if got := rec.Header().Get("Content-Disposition"); got != tt.wantDisposition {
+				t.Errorf("got Content-Disposition %q, want %q", got, tt.wantDisposition)
+			}
+			if got := rec.Header().Get("X-Content-Type-Options"); got != "nosniff" {
+				t.Errorf("got X-Content-Type-Options %q, want nosniff", got)
+			}
+		})
+	}
+}
+
+func TestStoreImageData(t *testing.T) {
+	s := newTestServer(t)
+	svg := base64.StdEncoding.EncodeToString([]byte(`<svg xmlns="http://www.w3.org/2000/svg"></svg>`))
+
+	for _, data := range []string{"data:image/svg+xml;base64," + svg, svg} {
+		if _, err := s.storeImageData(context.Background(), data); err != errUnsupportedImage {
+			t.Errorf("got %v storing an SVG, want errUnsupportedImage", err)
+		}
+	}
+	png := "data:image/png;base64," + base64.StdEncoding.EncodeToString(testPNG(t, 2, 1))
+	if ref, err := s.storeImageData(context.Background(), png); err != nil || ref.ImageType != "image/png" {
+		t.Errorf("got %+v, %v storing a PNG", ref, err)
+	}
+}
+
+func TestReleaseBlobsGracePeriod(t *testing.T) {
+	s := newTestServer(t)
+	s.blobGracePeriod = time.Hour
+	ctx := context.Background()
+	blobs := s.blobs.(*FileBlobStore)
+
+	ref, err := s.storeImage(ctx, bytes.NewReader(testPNG(t, 2, 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A blob stored just now may be about to be referenced.
+	s.releaseBlobs(ctx, ref.ImageKey)
+	if _, err := os.Stat(blobs.path(ref.ImageKey)); err != nil {
+		t.Fatalf("new blob was deleted: %v", err)
+	}
+
+	// Once it is past the grace period, the sweep deletes it if nothing
+	// refers to it.
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(blobs.path(ref.ImageKey), old, old); err != nil {
+		t.Fatal(err)
+	}
+	m := s.createTestMap(t, "1", "Level 1")
+	if _, err := s.maps.Update(ctx, m.ID, nil, MapChange{Image: &ref, UpdatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	s.sweepBlobs(ctx)
+	if _, err := os.Stat(blobs.path(ref.ImageKey)); err != nil {
+		t.Fatalf("referenced blob was deleted: %v", err)
+	}
+
+	if _, err := s.maps.Trash(ctx, m.ID, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.maps.Delete(ctx, m.ID, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	s.sweepBlobs(ctx)
+	if _, err := os.Stat(blobs.path(ref.ImageKey)); !os.IsNotExist(err) {
+		t.Fatalf("unreferenced blob was kept: %v", err)
+	}
+}
+
+func TestFileBlobStoreDeleteKeepsNewPut(t *testing.T) {
+	blobs, err := newFileBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	key, _, err := blobs.Put(ctx, bytes.NewReader([]byte("blob")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(blobs.path(key), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	// Storing the same bytes again makes the blob new.
+	cutoff := time.Now().Add(-time.Minute)
+	if _, _, err := blobs.Put(ctx, bytes.NewReader([]byte("blob"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := blobs.Delete(ctx, key, cutoff); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(blobs.path(key)); err != nil {
+		t.Fatalf("blob stored again was deleted: %v", err)
+	}
+
+	if err := blobs.Delete(ctx, key, time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := blobs.Get(ctx, key); err != errBlobNotFound {
+		t.Fatalf("got %v reading a deleted blob, want errBlobNotFound", err)
+	}
+}
+
+func TestSweepBlobsDeletesPendingUploads(t *testing.T) {
+	s := newTestServer(t)
+	s.blobGracePeriod = time.Hour
+	blobs := s.blobs.(*FileBlobStore)
+
+	abandoned := filepath.Join(blobs.dir, pendingPrefix+"abandoned")
+	inProgress := filepath.Join(blobs.dir, pendingPrefix+"in-progress")
+	for _, path := range []string{abandoned, inProgress} {
+		if err := os.WriteFile(path, []byte("partial"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(abandoned, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	s.sweepBlobs(context.Background())
+	if _, err := os.Stat(abandoned); !os.IsNotExist(err) {
+		t.Errorf("abandoned upload was kept: %v", err)
+	}
+	if _, err := os.Stat(inProgress); err != nil {
+		t.Errorf("upload in progress was deleted: %v", err)
+	}
+}
@@ -16,25 +16,21 @@ type LoggerClient struct {
 	conn   *grpc.ClientConn
 }
 
-var loggerClient *LoggerClient
-
-func connectToLogger() error {
+func connectToLogger() (*LoggerClient, error) {
 	conn, err := grpc.Dial("logger-service:50001", grpc.WithInsecure())
 	if err != nil {
-		return fmt.Errorf("failed to connect to logger service: %v", err)
+		return nil, fmt.Errorf("failed to connect to logger service: %v", err)
 	}
 
 	client := pb.NewLoggerServiceClient(conn)
-	loggerClient = &LoggerClient{
+	return &LoggerClient{
 		client: client,
 		conn:   conn,
-	}
-
-	return nil
+	}, nil
 }
 
 func (l *LoggerClient) Close() {
-	if l.conn != nil {
+	if l != nil && l.conn != nil {
 		l.conn.Close()
 	}
 }
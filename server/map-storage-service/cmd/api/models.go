@@ -18,11 +18,61 @@ type MapRequest struct {
 type Map struct {
 	ID        primitive.ObjectID `json:"id" bson:"_id,omitempty"`
 	UserID    string             `json:"userId" bson:"userId"`
+	OwnerName string             `json:"ownerName,omitempty" bson:"-"`
 	Name      string             `json:"name" bson:"name"`
 	Width     int                `json:"width" bson:"width"`
 	Height    int                `json:"height" bson:"height"`
-	ImageData string             `json:"imageData" bson:"imageData"`
-	Matrix    [][]int            `json:"matrix,omitempty" bson:"matrix,omitempty"` // Changed back to [][]int
-	CreatedAt time.Time          `json:"createdAt" bson:"createdAt"`
-	UpdatedAt time.Time          `json:"updatedAt" bson:"updatedAt"`
+	ImageRef  `bson:",inline"`
+	Matrix    [][]int   `json:"matrix,omitempty" bson:"matrix,omitempty"` // Changed back to [][]int
+	CreatedAt time.Time `json:"createdAt" bson:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt" bson:"updatedAt"`
+	// FolderID is the owner's folder the map is filed in, if any.
+	FolderID *primitive.ObjectID `json:"folderId,omitempty" bson:"folderId,omitempty"`
+	Tags     []string            `json:"tags,omitempty" bson:"tags,omitempty"`
+	// Thumbnails are rendered in the background from the image whose key
+	// is ThumbnailSource; they are stale when that differs from ImageKey.
+	Thumbnails       []Thumbnail       `json:"-" bson:"thumbnails,omitempty"`
+	ThumbnailSource  string            `json:"-" bson:"thumbnailSource,omitempty"`
+	ThumbnailsFailed bool              `json:"-" bson:"thumbnailsFailed,omitempty"`
+	ThumbnailURLs    map[string]string `json:"thumbnailUrls,omitempty" bson:"-"`
+	// DeletedAt is set while the map is in the trash.
+	DeletedAt *time.Time `json:"deletedAt,omitempty" bson:"deletedAt,omitempty"`
+	// Grants and ShareLinks say who else may open the map. Only the owner
+	// sees them, through the sharing endpoints.
+	Grants     []Grant     `json:"-" bson:"grants,omitempty"`
+	ShareLinks []ShareLink `json:"-" bson:"shareLinks,omitempty"`
+	// Access is the caller's access to the map: owner, editor or viewer.
+	Access string `json:"access,omitempty" bson:"-"`
+	// Version is incremented by every update and served as the ETag. Maps
+	// saved before versioning have none and read as version 0.
+	Version int64 `json:"version" bson:"version"`
+}
+
+// ImageRef points to a map's image in the blob store. ImageData only holds
+// the inline base64 image of maps saved before images moved there, until
+// they are migrated; it is never sent to clients, which download the image
+// from ImageURL instead.
+type ImageRef struct {
+	ImageKey  string `json:"imageKey,omitempty" bson:"imageKey,omitempty"`
+	ImageSize int64  `json:"imageSize,omitempty" bson:"imageSize,omitempty"`
+	ImageType string `json:"imageType,omitempty" bson:"imageType,omitempty"`
+	ImageURL  string `json:"imageUrl,omitempty" bson:"-"`
+	ImageData string `json:"-" bson:"imageData,omitempty"`
+}
+
+// MapPage is a page of GET /api/v1/maps. NextCursor is empty on the last
+// page; Total counts every map matching the filters.
+type MapPage struct {
+	Items      []Map  `json:"items"`
+	NextCursor string `json:"nextCursor,omitempty"`
+	Total      int64  `json:"total"`
+}
+
+// UpdateMapRequest is the body of a PATCH; omitted fields are unchanged.
+type UpdateMapRequest struct {
+	Name      *string  `json:"name"`
+	ImageData *string  `json:"imageData"`
+	Matrix    *[][]int `json:"matrix"`
+	Width     *int     `json:"width"`
+	Height    *int     `json:"height"`
 }
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+// sortFields maps the values accepted by the sort parameter to document fields.
+var sortFields = map[string]string{
+	"created": "createdAt",
+	"updated": "updatedAt",
+	"name":    "name",
+	"deleted": "deletedAt",
+}
+
+// listQuery is a parsed GET /api/v1/maps request.
+type listQuery struct {
+	UserID        string
+	Limit         int
+	Sort          string
+	Descending    bool
+	NamePrefix    string
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	UpdatedAfter  time.Time
+	UpdatedBefore time.Time
+	Full          bool
+	After         *mapCursor
+	// Trash selects maps in the trash instead of the others.
+	Trash bool
+	// SharedWith selects the maps UserID has been granted access to
+	// instead of the ones they own.
+	SharedWith bool
+	// Folder limits the listing to one folder; InRoot to maps in none.
+	Folder *primitive.ObjectID
+	InRoot bool
+	// Tags limits the listing to maps carrying every one of them.
+	Tags []string
+}
+
+// mapCursor is the position after the last map of a page. It is handed to
+// clients as an opaque base64 string and only valid for the same sort.
+type mapCursor struct {
+	Sort  string    `json:"s"`
+	Desc  bool      `json:"d"`
+	ID    string    `json:"id"`
+	Name  string    `json:"n,omitempty"`
+	Time  time.Time `json:"t,omitempty"`
+	objID primitive.ObjectID
+}
+
+func (c mapCursor) encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(s string) (*mapCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	var c mapCursor
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, err
+	}
+	if c.objID, err = primitive.ObjectIDFromHex(c.ID); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// cursorAfter returns the cursor pointing past m in q's sort order.
+func cursorAfter(q listQuery, m Map) string {
+	c := mapCursor{Sort: q.Sort, Desc: q.Descending, ID: m.ID.Hex()}
+	switch q.Sort {
+	case "name":
+		c.Name = m.Name
+	case "updated":
+		c.Time = m.UpdatedAt
+	case "deleted":
+		c.Time = *m.DeletedAt
+	default:
+		c.Time = m.CreatedAt
+	}
+	return c.encode()
+}
+
+func parseListQuery(values url.Values) (listQuery, error) {
+	q := listQuery{
+		UserID:     values.Get("userId"),
+		Limit:      defaultPageSize,
+		Sort:       "created",
+		Descending: true,
+		NamePrefix: values.Get("q"),
+		Full:       values.Get("fields") == "full",
+	}
+	if q.UserID == "" {
+		return q, errors.New("UserID is required")
+	}
+
+	if limit := values.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > maxPageSize {
+			return q, fmt.Errorf("limit must be between 1 and %d", maxPageSize)
+		}
+		q.Limit = n
+	}
+
+	if sort := values.Get("sort"); sort != "" {
+		if _, ok := sortFields[sort]; !ok {
+			return q, errors.New("sort must be one of created, updated, name or deleted")
+		}
+		q.Sort = sort
+		// Names read naturally A to Z; dates newest first.
+		q.Descending = sort != "name"
+	}
+	switch values.Get("order") {
+	case "":
+	case "asc":
+		q.Descending = false
+	case "desc":
+		q.Descending = true
+	default:
+		return q, errors.New("order must be asc or desc")
+	}
+
+	for param, dst := range map[string]*time.Time{
+		"createdAfter":  &q.CreatedAfter,
+		"createdBefore": &q.CreatedBefore,
+		"updatedAfter":  &q.UpdatedAfter,
+		"updatedBefore": &q.UpdatedBefore,
+	} {
+		if value := values.Get(param); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return q, fmt.Errorf("%s must be an RFC 3339 timestamp", param)
+			}
+			*dst = t
+		}
+	}
+
+	switch folder := values.Get("folder"); folder {
+	case "":
+	case "root":
+		q.InRoot = true
+	default:
+		id, err := primitive.ObjectIDFromHex(folder)
+		if err != nil {
+			return q, errors.New("folder must be a folder ID or root")
+		}
+		q.Folder = &id
+	}
+	if tags := values["tag"]; len(tags) > 0 {
+		normalized, err := normalizeTags(tags)
+		if err != nil {
+			return q, err
+		}
+		q.Tags = normalized
+	}
+
+	if cursor := values.Get("cursor"); cursor != "" {
+		c, err := decodeCursor(cursor)
+		if err != nil || c.Sort != q.Sort || c.Desc != q.Descending {
+			return q, errors.New("invalid cursor")
+		}
+		q.After = c
+	}
+	return q, nil
+}
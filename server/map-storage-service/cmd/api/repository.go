@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var (
+	errNotFound        = errors.New("not found")
+	errDuplicateFolder = errors.New("a folder with that name already exists here")
+)
+
+// MapRepository persists maps. Maps are active until they are moved to the
+// trash. Lookups of missing maps return errNotFound.
+type MapRepository interface {
+	blobReferences
+	inlineImageStore
+
+	// Create inserts m and sets its ID.
+	Create(ctx context.Context, m *Map) error
+	// ByID returns a map, active or in the trash, with all of its content.
+	ByID(ctx context.Context, id primitive.ObjectID) (Map, error)
+	// Info is ByID without the matrix, for access checks and for routes
+	// that only need the map's metadata or image.
+	Info(ctx context.Context, id primitive.ObjectID) (Map, error)
+	// ByShareToken returns the active map with a share link whose token
+	// hashes to tokenHash. Whether the link has expired is left to
+	// authorize.
+	ByShareToken(ctx context.Context, tokenHash string) (Map, error)
+	// List returns the maps q selects, in its order and starting after its
+	// cursor, plus one more if there is a next page, and the number of maps
+	// matching its filters. Unless q.Full, the maps come without their
+	// matrix and inline image.
+	List(ctx context.Context, q listQuery) ([]Map, int64, error)
+	// Each calls fn with each of the user's active maps, oldest first.
+	Each(ctx context.Context, userID string, fn func(Map) error) error
+
+	// Update applies change to an active map and returns the map as it was
+	// before. If version is not nil, the map must be at that version. It
+	// returns errNotFound if no map matched.
+	Update(ctx context.Context, id primitive.ObjectID, version *int64, change MapChange) (Map, error)
+	// Trash moves an active map to the trash and returns it without its
+	// matrix and inline image.
+	Trash(ctx context.Context, id primitive.ObjectID, at time.Time) (Map, error)
+	// Restore takes a map out of the trash and returns it.
+	Restore(ctx context.Context, id primitive.ObjectID) (Map, error)
+	// Delete removes a map for good if it was moved to the trash at or
+	// before trashedBefore, reporting whether it did. A map that is active,
+	// because it was never trashed or was restored meanwhile, is kept.
+	Delete(ctx context.Context, id primitive.ObjectID, trashedBefore time.Time) (bool, error)
+	// TrashedBefore returns the maps moved to the trash before t, without
+	// their matrix and inline image.
+	TrashedBefore(ctx context.Context, t time.Time) ([]Map, error)
+	// DeleteUser removes all of a user's maps and returns how many.
+	DeleteUser(ctx context.Context, userID string) (int64, error)
+
+	// AddShareLink adds link to an active map.
+	AddShareLink(ctx context.Context, id primitive.ObjectID, link ShareLink) error
+	// RemoveShareLink reports whether the map had the link.
+	RemoveShareLink(ctx context.Context, id, linkID primitive.ObjectID) (bool, error)
+	// PutGrant adds grant to a map, replacing any grant to the same user.
+	PutGrant(ctx context.Context, id primitive.ObjectID, grant Grant) error
+	// RemoveGrant reports whether the map had a grant to the user.
+	RemoveGrant(ctx context.Context, id primitive.ObjectID, userID string) (bool, error)
+	// RemoveGrantsTo removes the grants to a user from every map.
+	RemoveGrantsTo(ctx context.Context, userID string) error
+
+	// SetFolder files an active map in a folder, or in none if folderID is
+	// nil, and returns it without its matrix and inline image.
+	SetFolder(ctx context.Context, id primitive.ObjectID, folderID *primitive.ObjectID) (Map, error)
+	// MoveFolder moves the user's maps, including those in the trash, from
+	// one folder to another, or to none if to is nil.
+	MoveFolder(ctx context.Context, userID string, from primitive.ObjectID, to *primitive.ObjectID) error
+	// SetTags replaces an active map's tags and returns it without its
+	// matrix and inline image.
+	SetTags(ctx context.Context, id primitive.ObjectID, tags []string) (Map, error)
+	// Tags counts the tags on the user's active maps, most used first.
+	Tags(ctx context.Context, userID string) ([]TagCount, error)
+
+	// StaleThumbnails returns up to limit maps whose thumbnails were not
+	// rendered from their current image.
+	StaleThumbnails(ctx context.Context, limit int) ([]primitive.ObjectID, error)
+	// SetThumbnails stores the thumbnails rendered from image source,
+	// unless the map's image has changed since. It reports whether the map
+	// was updated.
+	SetThumbnails(ctx context.Context, id primitive.ObjectID, source string, thumbnails []Thumbnail) (bool, error)
+	// SetThumbnailsFailed marks image source as impossible to render,
+	// unless the map's image has changed since.
+	SetThumbnailsFailed(ctx context.Context, id primitive.ObjectID, source string) error
+}
+
+// RevisionRepository persists the revision history of maps.
+type RevisionRepository interface {
+	blobReferences
+	inlineImageStore
+
+	// Add inserts rev and deletes the map's oldest revisions beyond keep.
+	// It returns the blobs the deleted revisions referred to, for the
+	// caller to release.
+	Add(ctx context.Context, rev MapRevision, keep int) ([]string, error)
+	// List returns a map's revisions, newest first, without their matrix
+	// and inline image.
+	List(ctx context.Context, mapID primitive.ObjectID) ([]MapRevision, error)
+	Get(ctx context.Context, mapID primitive.ObjectID, revision int64) (MapRevision, error)
+	DeleteMap(ctx context.Context, mapID primitive.ObjectID) error
+	DeleteUser(ctx context.Context, userID string) error
+}
+
+// FolderRepository persists folders. Lookups are scoped to the folder's
+// owner, so another user's folder is as good as missing. Writes that would
+// give two sibling folders the same name return errDuplicateFolder.
+type FolderRepository interface {
+	// Create inserts f and sets its ID.
+	Create(ctx context.Context, f *Folder) error
+	ByID(ctx context.Context, userID string, id primitive.ObjectID) (Folder, error)
+	// ByName returns the user's folder with the given name and parent, or
+	// at the top level if parentID is nil.
+	ByName(ctx context.Context, userID, name string, parentID *primitive.ObjectID) (Folder, error)
+	// List returns the user's folders sorted by name.
+	List(ctx context.Context, userID string) ([]Folder, error)
+	// Update saves f's name, parent and UpdatedAt.
+	Update(ctx context.Context, f Folder) error
+	// Delete removes f, moving its subfolders up to its parent.
+	Delete(ctx context.Context, f Folder) error
+	DeleteUser(ctx context.Context, userID string) error
+}
+
+// EventRepository remembers which user events have been handled, so that
+// redelivered ones can be acknowledged without handling them twice.
+type EventRepository interface {
+	Processed(ctx context.Context, eventID string) (bool, error)
+	MarkProcessed(ctx context.Context, eventID string) error
+}
+
+// blobReferences is implemented by the repositories of documents that
+// refer to blobs, so that a blob is only deleted once nothing does.
+type blobReferences interface {
+	// BlobKeys returns the blobs a map, or its revisions, refer to.
+	BlobKeys(ctx context.Context, mapID primitive.ObjectID) ([]string, error)
+	// UserBlobKeys returns the blobs the user's documents refer to.
+	UserBlobKeys(ctx context.Context, userID string) ([]string, error)
+	ReferencesBlob(ctx context.Context, key string) (bool, error)
+}
+
+// inlineImageStore is implemented by the repositories of documents that
+// may still hold an inline image from before the blob store.
+type inlineImageStore interface {
+	// EachInlineImage calls fn with the ID and inline image of every
+	// document that has one.
+	EachInlineImage(ctx context.Context, fn func(id primitive.ObjectID, data string) error) error
+	// MoveInlineImage replaces a document's inline image with ref, unless
+	// the inline image is no longer data.
+	MoveInlineImage(ctx context.Context, id primitive.ObjectID, data string, ref ImageRef) error
+}
+
+// MapChange is an update to a map's content. Nil fields are left as they
+// are. A new Image replaces the map's image, inline or not.
+type MapChange struct {
+	Name      *string
+	Width     *int
+	Height    *int
+	Matrix    *[][]int
+	Image     *ImageRef
+	UpdatedAt time.Time
+}
+
+// apply makes the change to m the way the repositories save it, bumping
+// the version.
+func (c MapChange) apply(m *Map) {
+	if c.Name != nil {
+		m.Name = *c.Name
+	}
+	if c.Width != nil {
+		m.Width = *c.Width
+	}
+	if c.Height != nil {
+		m.Height = *c.Height
+	}
+	if c.Matrix != nil {
+		m.Matrix = *c.Matrix
+	}
+	if c.Image != nil {
+		m.ImageRef = ImageRef{ImageKey: c.Image.ImageKey, ImageSize: c.Image.ImageSize, ImageType: c.Image.ImageType}
+	}
+	m.UpdatedAt = c.UpdatedAt
+	m.Version++
+}
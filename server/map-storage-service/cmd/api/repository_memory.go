@@ -0,0 +1,824 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// The in-memory repositories keep everything in maps guarded by a mutex,
+// so handlers can be tested without MongoDB. They hand out copies, so that
+// callers can't change what is stored behind their back.
+
+type memoryMapRepository struct {
+	mu   sync.Mutex
+	maps map[primitive.ObjectID]Map
+}
+
+func newMemoryMapRepository() *memoryMapRepository {
+	return &memoryMapRepository{maps: make(map[primitive.ObjectID]Map)}
+}
+
+// cloneMap copies m deeply enough that nothing is shared with the copy.
+func cloneMap(m Map) Map {
+	m.Matrix = cloneMatrix(m.Matrix)
+	m.Tags = slices.Clone(m.Tags)
+	m.Thumbnails = slices.Clone(m.Thumbnails)
+	m.Grants = slices.Clone(m.Grants)
+	m.ShareLinks = slices.Clone(m.ShareLinks)
+	if m.FolderID != nil {
+		id := *m.FolderID
+		m.FolderID = &id
+	}
+	if m.DeletedAt != nil {
+		t := *m.DeletedAt
+		m.DeletedAt = &t
+	}
+	return m
+}
+
+func cloneMatrix(matrix [][]int) [][]int {
+	if matrix == nil {
+		return nil
+	}
+	clone := make([][]int, len(matrix))
+	for i, row := range matrix {
+		clone[i] = slices.Clone(row)
+	}
+	return clone
+}
+
+// summary leaves out the heavy fields of a map, like the Mongo projection.
+func summary(m Map) Map {
+	m.Matrix = nil
+	m.ImageData = ""
+	return m
+}
+
+func (s *memoryMapRepository) Create(ctx context.Context, m *Map) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m.ID = primitive.NewObjectID()
+	s.maps[m.ID] = cloneMap(*m)
+	return nil
+}
+
+func (s *memoryMapRepository) ByID(ctx context.Context, id primitive.ObjectID) (Map, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m, ok := s.maps[id]
+	if !ok {
+		return Map{}, errNotFound
+	}
+	return cloneMap(m), nil
+}
+
+func (s *memoryMapRepository) Info(ctx context.Context, id primitive.ObjectID) (Map, error) {
+	m, err := s.ByID(ctx, id)
+	m.Matrix = nil
+	return m, err
+}
+
+func (s *memoryMapRepository) ByShareToken(ctx context.Context, tokenHash string) (Map, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, m := range s.maps {
+		if m.DeletedAt != nil {
+			continue
+		}
+		for _, link := range m.ShareLinks {
+			if link.TokenHash == tokenHash {
+				return cloneMap(m), nil
+			}
+		}
+	}
+	return Map{}, errNotFound
+}
+
+func (s *memoryMapRepository) List(ctx context.Context, q listQuery) ([]Map, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var matching []Map
+	for _, m := range s.maps {
+		if matchesQuery(q, m) {
+			matching = append(matching, m)
+		}
+	}
+	sort.Slice(matching, func(i, j int) bool {
+		return compareInOrder(q, matching[i], matching[j]) < 0
+	})
+
+	maps := []Map{}
+	for _, m := range matching {
+		if len(maps) > q.Limit {
+			break
+		}
+		if q.After != nil && compareInOrder(q, cursorMap(*q.After), m) >= 0 {
+			continue
+		}
+		if !q.Full {
+			m = summary(m)
+		}
+		maps = append(maps, cloneMap(m))
+	}
+	return maps, int64(len(matching)), nil
+}
+
+// matchesQuery reports whether m is in q's result set, ignoring the cursor.
+func matchesQuery(q listQuery, m Map) bool {
+	if q.SharedWith {
+		if !slices.ContainsFunc(m.Grants, func(g Grant) bool { return g.UserID == q.UserID }) {
+			return false
+		}
+	} else if m.UserID != q.UserID {
+		return false
+	}
+	if (m.DeletedAt != nil) != q.Trash {
+		return false
+	}
+	if q.Folder != nil && (m.FolderID == nil || *m.FolderID != *q.Folder) {
+		return false
+	}
+	if q.InRoot && m.FolderID != nil {
+		return false
+	}
+	for _, tag := range q.Tags {
+		if !slices.Contains(m.Tags, tag) {
+			return false
+		}
+	}
+	if !strings.HasPrefix(strings.ToLower(m.Name), strings.ToLower(q.NamePrefix)) {
+		return false
+	}
+	return inRange(m.CreatedAt, q.CreatedAfter, q.CreatedBefore) &&
+		inRange(m.UpdatedAt, q.UpdatedAfter, q.UpdatedBefore)
+}
+
+func inRange(t, after, before time.Time) bool {
+	return (after.IsZero() || !t.Before(after)) && (before.IsZero() || t.Before(before))
+}
+
+// compareInOrder compares two maps by q's sort, breaking ties by ID.
+func compareInOrder(q listQuery, a, b Map) int {
+	var c int
+	switch q.Sort {
+	case "name":
+		c = strings.Compare(a.Name, b.Name)
+	case "updated":
+		c = a.UpdatedAt.Compare(b.UpdatedAt)
+	case "deleted":
+		c = a.DeletedAt.Compare(*b.DeletedAt)
+	default:
+		c = a.CreatedAt.Compare(b.CreatedAt)
+	}
+	if c == 0 {
+		c = bytes.Compare(a.ID[:], b.ID[:])
+	}
+	if q.Descending {
+		c = -c
+	}
+	return c
+}
+
+// cursorMap is a stand-in for the map a cursor points past, carrying just
+// the fields compareInOrder looks at.
+func cursorMap(c mapCursor) Map {
+	t := c.Time
+	return Map{ID: c.objID, Name: c.Name, CreatedAt: t, UpdatedAt: t, DeletedAt: &t}
+}
+
+func (s *memoryMapRepository) Each(ctx context.Context, userID string, fn func(Map) error) error {
+	s.mu.Lock()
+	var maps []Map
+	for _, m := range s.maps {
+		if m.UserID == userID && m.DeletedAt == nil {
+			maps = append(maps, cloneMap(m))
+		}
+	}
+	s.mu.Unlock()
+
+	oldestFirst := listQuery{Sort: "created"}
+	sort.Slice(maps, func(i, j int) bool {
+		return compareInOrder(oldestFirst, maps[i], maps[j]) < 0
+	})
+	for _, m := range maps {
+		if err := fn(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// update applies fn to the map with the given ID if it is active, and
+// returns the map as updated.
+func (s *memoryMapRepository) update(id primitive.ObjectID, fn func(*Map)) (Map, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m, ok := s.maps[id]
+	if !ok || m.DeletedAt != nil {
+		return Map{}, errNotFound
+	}
+	fn(&m)
+	s.maps[id] = cloneMap(m)
+	return cloneMap(m), nil
+}
+
+func (s *memoryMapRepository) Update(ctx context.Context, id primitive.ObjectID, version *int64, change MapChange) (Map, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m, ok := s.maps[id]
+	if !ok || m.DeletedAt != nil || (version != nil && m.Version != *version) {
+		return Map{}, errNotFound
+	}
+	previous := cloneMap(m)
+	change.apply(&m)
+	s.maps[id] = cloneMap(m)
+	return previous, nil
+}
+
+func (s *memoryMapRepository) Trash(ctx context.Context, id primitive.ObjectID, at time.Time) (Map, error) {
+	m, err := s.update(id, func(m *Map) { m.DeletedAt = &at })
+	return summary(m), err
+}
+
+func (s *memoryMapRepository) Restore(ctx context.Context, id primitive.ObjectID) (Map, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m, ok := s.maps[id]
+	if !ok || m.DeletedAt == nil {
+		return Map{}, errNotFound
+	}
+	m.DeletedAt = nil
+	s.maps[id] = m
+	return cloneMap(m), nil
+}
+
+func (s *memoryMapRepository) Delete(ctx context.Context, id primitive.ObjectID, trashedBefore time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m, ok := s.maps[id]
+	if !ok || m.DeletedAt == nil || m.DeletedAt.After(trashedBefore) {
+		return false, nil
+	}
+	delete(s.maps, id)
+	return true, nil
+}
+
+func (s *memoryMapRepository) TrashedBefore(ctx context.Context, t time.Time) ([]Map, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var maps []Map
+	for _, m := range s.maps {
+		if m.DeletedAt != nil && m.DeletedAt.Before(t) {
+			maps = append(maps, summary(cloneMap(m)))
+		}
+	}
+	return maps, nil
+}
+
+func (s *memoryMapRepository) DeleteUser(ctx context.Context, userID string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var deleted int64
+	for id, m := range s.maps {
+		if m.UserID == userID {
+			delete(s.maps, id)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (s *memoryMapRepository) AddShareLink(ctx context.Context, id primitive.ObjectID, link ShareLink) error {
+	_, err := s.update(id, func(m *Map) { m.ShareLinks = append(m.ShareLinks, link) })
+	return err
+}
+
+func (s *memoryMapRepository) RemoveShareLink(ctx context.Context, id, linkID primitive.ObjectID) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m, ok := s.maps[id]
+	if !ok {
+		return false, nil
+	}
+	n := len(m.ShareLinks)
+	m.ShareLinks = slices.DeleteFunc(m.ShareLinks, func(link ShareLink) bool { return link.ID == linkID })
+	s.maps[id] = m
+	return len(m.ShareLinks) < n, nil
+}
+
+func (s *memoryMapRepository) PutGrant(ctx context.Context, id primitive.ObjectID, grant Grant) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m, ok := s.maps[id]
+	if !ok {
+		return nil
+	}
+	i := slices.IndexFunc(m.Grants, func(g Grant) bool { return g.UserID == grant.UserID })
+	if i >= 0 {
+		m.Grants[i] = grant
+	} else {
+		m.Grants = append(m.Grants, grant)
+	}
+	s.maps[id] = m
+	return nil
+}
+
+func (s *memoryMapRepository) RemoveGrant(ctx context.Context, id primitive.ObjectID, userID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m, ok := s.maps[id]
+	if !ok {
+		return false, nil
+	}
+	n := len(m.Grants)
+	m.Grants = slices.DeleteFunc(m.Grants, func(g Grant) bool { return g.UserID == userID })
+	s.maps[id] = m
+	return len(m.Grants) < n, nil
+}
+
+func (s *memoryMapRepository) RemoveGrantsTo(ctx context.Context, userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, m := range s.maps {
+		m.Grants = slices.DeleteFunc(m.Grants, func(g Grant) bool { return g.UserID == userID })
+		s.maps[id] = m
+	}
+	return nil
+}
+
+func (s *memoryMapRepository) SetFolder(ctx context.Context, id primitive.ObjectID, folderID *primitive.ObjectID) (Map, error) {
+	m, err := s.update(id, func(m *Map) { m.FolderID = folderID })
+	return summary(m), err
+}
+
+func (s *memoryMapRepository) MoveFolder(ctx context.Context, userID string, from primitive.ObjectID, to *primitive.ObjectID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, m := range s.maps {
+		if m.UserID == userID && m.FolderID != nil && *m.FolderID == from {
+			m.FolderID = to
+			s.maps[id] = m
+		}
+	}
+	return nil
+}
+
+func (s *memoryMapRepository) SetTags(ctx context.Context, id primitive.ObjectID, tags []string) (Map, error) {
+	if len(tags) == 0 {
+		tags = nil
+	}
+	m, err := s.update(id, func(m *Map) { m.Tags = tags })
+	return summary(m), err
+}
+
+func (s *memoryMapRepository) Tags(ctx context.Context, userID string) ([]TagCount, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counts := make(map[string]int64)
+	for _, m := range s.maps {
+		if m.UserID == userID && m.DeletedAt == nil {
+			for _, tag := range m.Tags {
+				counts[tag]++
+			}
+		}
+	}
+	tags := []TagCount{}
+	for tag, count := range counts {
+		tags = append(tags, TagCount{Tag: tag, Count: count})
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		if tags[i].Count != tags[j].Count {
+			return tags[i].Count > tags[j].Count
+		}
+		return tags[i].Tag < tags[j].Tag
+	})
+	return tags, nil
+}
+
+func (s *memoryMapRepository) StaleThumbnails(ctx context.Context, limit int) ([]primitive.ObjectID, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var ids []primitive.ObjectID
+	for id, m := range s.maps {
+		if len(ids) == limit {
+			break
+		}
+		if m.ImageKey != "" && m.ThumbnailSource != m.ImageKey {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+func (s *memoryMapRepository) SetThumbnails(ctx context.Context, id primitive.ObjectID, source string, thumbnails []Thumbnail) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m, ok := s.maps[id]
+	if !ok || m.ImageKey != source {
+		return false, nil
+	}
+	m.Thumbnails = slices.Clone(thumbnails)
+	m.ThumbnailSource = source
+	m.ThumbnailsFailed = false
+	s.maps[id] = m
+	return true, nil
+}
+
+func (s *memoryMapRepository) SetThumbnailsFailed(ctx context.Context, id primitive.ObjectID, source string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if m, ok := s.maps[id]; ok && m.ImageKey == source {
+		m.ThumbnailSource = source
+		m.ThumbnailsFailed = true
+		s.maps[id] = m
+	}
+	return nil
+}
+
+func (s *memoryMapRepository) BlobKeys(ctx context.Context, mapID primitive.ObjectID) ([]string, error) {
+	return s.blobKeys(func(m Map) bool { return m.ID == mapID }), nil
+}
+
+func (s *memoryMapRepository) UserBlobKeys(ctx context.Context, userID string) ([]string, error) {
+	return s.blobKeys(func(m Map) bool { return m.UserID == userID }), nil
+}
+
+func (s *memoryMapRepository) blobKeys(match func(Map) bool) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var keys []string
+	for _, m := range s.maps {
+		if !match(m) {
+			continue
+		}
+		if m.ImageKey != "" {
+			keys = append(keys, m.ImageKey)
+		}
+		for _, t := range m.Thumbnails {
+			keys = append(keys, t.Key)
+		}
+	}
+	return keys
+}
+
+func (s *memoryMapRepository) ReferencesBlob(ctx context.Context, key string) (bool, error) {
+	for _, k := range s.blobKeys(func(Map) bool { return true }) {
+		if k == key {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *memoryMapRepository) EachInlineImage(ctx context.Context, fn func(primitive.ObjectID, string) error) error {
+	s.mu.Lock()
+	images := make(map[primitive.ObjectID]string)
+	for id, m := range s.maps {
+		if m.ImageData != "" {
+			images[id] = m.ImageData
+		}
+	}
+	s.mu.Unlock()
+
+	for id, data := range images {
+		if err := fn(id, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *memoryMapRepository) MoveInlineImage(ctx context.Context, id primitive.ObjectID, data string, ref ImageRef) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if m, ok := s.maps[id]; ok && m.ImageData == data {
+		m.ImageRef = ref
+		s.maps[id] = m
+	}
+	return nil
+}
+
+type memoryRevisionRepository struct {
+	mu        sync.Mutex
+	revisions []MapRevision
+}
+
+func newMemoryRevisionRepository() *memoryRevisionRepository {
+	return &memoryRevisionRepository{}
+}
+
+func cloneRevision(rev MapRevision) MapRevision {
+	rev.Matrix = cloneMatrix(rev.Matrix)
+	return rev
+}
+
+func (s *memoryRevisionRepository) Add(ctx context.Context, rev MapRevision, keep int) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rev.ID = primitive.NewObjectID()
+	s.revisions = append(s.revisions, cloneRevision(rev))
+
+	var numbers []int64
+	for _, r := range s.revisions {
+		if r.MapID == rev.MapID {
+			numbers = append(numbers, r.Revision)
+		}
+	}
+	if len(numbers) <= keep {
+		return nil, nil
+	}
+	slices.Sort(numbers)
+	oldest := numbers[len(numbers)-keep-1]
+	var keys []string
+	s.revisions = slices.DeleteFunc(s.revisions, func(r MapRevision) bool {
+		pruned := r.MapID == rev.MapID && r.Revision <= oldest
+		if pruned && r.ImageKey != "" {
+			keys = append(keys, r.ImageKey)
+		}
+		return pruned
+	})
+	return keys, nil
+}
+
+func (s *memoryRevisionRepository) List(ctx context.Context, mapID primitive.ObjectID) ([]MapRevision, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	revisions := []MapRevision{}
+	for _, rev := range s.revisions {
+		if rev.MapID == mapID {
+			rev.Matrix = nil
+			rev.ImageData = ""
+			revisions = append(revisions, rev)
+		}
+	}
+	sort.Slice(revisions, func(i, j int) bool {
+		return revisions[i].Revision > revisions[j].Revision
+	})
+	return revisions, nil
+}
+
+func (s *memoryRevisionRepository) Get(ctx context.Context, mapID primitive.ObjectID, revision int64) (MapRevision, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, rev := range s.revisions {
+		if rev.MapID == mapID && rev.Revision == revision {
+			return cloneRevision(rev), nil
+		}
+	}
+	return MapRevision{}, errNotFound
+}
+
+func (s *memoryRevisionRepository) DeleteMap(ctx context.Context, mapID primitive.ObjectID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.revisions = slices.DeleteFunc(s.revisions, func(r MapRevision) bool { return r.MapID == mapID })
+	return nil
+}
+
+func (s *memoryRevisionRepository) DeleteUser(ctx context.Context, userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.revisions = slices.DeleteFunc(s.revisions, func(r MapRevision) bool { return r.UserID == userID })
+	return nil
+}
+
+func (s *memoryRevisionRepository) BlobKeys(ctx context.Context, mapID primitive.ObjectID) ([]string, error) {
+	return s.blobKeys(func(r MapRevision) bool { return r.MapID == mapID }), nil
+}
+
+func (s *memoryRevisionRepository) UserBlobKeys(ctx context.Context, userID string) ([]string, error) {
+	return s.blobKeys(func(r MapRevision) bool { return r.UserID == userID }), nil
+}
+
+func (s *memoryRevisionRepository) blobKeys(match func(MapRevision) bool) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var keys []string
+	for _, rev := range s.revisions {
+		if match(rev) && rev.ImageKey != "" {
+			keys = append(keys, rev.ImageKey)
+		}
+	}
+	return keys
+}
+
+func (s *memoryRevisionRepository) ReferencesBlob(ctx context.Context, key string) (bool, error) {
+	return len(s.blobKeys(func(r MapRevision) bool { return r.ImageKey == key })) > 0, nil
+}
+
+func (s *memoryRevisionRepository) EachInlineImage(ctx context.Context, fn func(primitive.ObjectID, string) error) error {
+	s.mu.Lock()
+	var revisions []MapRevision
+	for _, rev := range s.revisions {
+		if rev.ImageData != "" {
+			revisions = append(revisions, rev)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, rev := range revisions {
+		if err := fn(rev.ID, rev.ImageData); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *memoryRevisionRepository) MoveInlineImage(ctx context.Context, id primitive.ObjectID, data string, ref ImageRef) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, rev := range s.revisions {
+		if rev.ID == id && rev.ImageData == data {
+			s.revisions[i].ImageRef = ref
+		}
+	}
+	return nil
+}
+
+type memoryFolderRepository struct {
+	mu      sync.Mutex
+	folders map[primitive.ObjectID]Folder
+}
+
+func newMemoryFolderRepository() *memoryFolderRepository {
+	return &memoryFolderRepository{folders: make(map[primitive.ObjectID]Folder)}
+}
+
+func sameParent(a, b *primitive.ObjectID) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// nameTaken reports whether f's siblings include another folder named like
+// it. The caller must hold s.mu.
+func (s *memoryFolderRepository) nameTaken(f Folder) bool {
+	for id, other := range s.folders {
+		if id != f.ID && other.UserID == f.UserID && other.Name == f.Name && sameParent(other.ParentID, f.ParentID) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *memoryFolderRepository) Create(ctx context.Context, f *Folder) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.nameTaken(*f) {
+		return errDuplicateFolder
+	}
+	f.ID = primitive.NewObjectID()
+	s.folders[f.ID] = *f
+	return nil
+}
+
+func (s *memoryFolderRepository) ByID(ctx context.Context, userID string, id primitive.ObjectID) (Folder, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, ok := s.folders[id]
+	if !ok || f.UserID != userID {
+		return Folder{}, errNotFound
+	}
+	return f, nil
+}
+
+func (s *memoryFolderRepository) ByName(ctx context.Context, userID, name string, parentID *primitive.ObjectID) (Folder, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, f := range s.folders {
+		if f.UserID == userID && f.Name == name && sameParent(f.ParentID, parentID) {
+			return f, nil
+		}
+	}
+	return Folder{}, errNotFound
+}
+
+func (s *memoryFolderRepository) List(ctx context.Context, userID string) ([]Folder, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	folders := []Folder{}
+	for _, f := range s.folders {
+		if f.UserID == userID {
+			folders = append(folders, f)
+		}
+	}
+	sort.Slice(folders, func(i, j int) bool {
+		return folders[i].Name < folders[j].Name
+	})
+	return folders, nil
+}
+
+func (s *memoryFolderRepository) Update(ctx context.Context, f Folder) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, ok := s.folders[f.ID]
+	if !ok || existing.UserID != f.UserID {
+		return nil
+	}
+	if s.nameTaken(f) {
+		return errDuplicateFolder
+	}
+	existing.Name = f.Name
+	existing.ParentID = f.ParentID
+	existing.UpdatedAt = f.UpdatedAt
+	s.folders[f.ID] = existing
+	return nil
+}
+
+func (s *memoryFolderRepository) Delete(ctx context.Context, f Folder) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var children []Folder
+	for _, child := range s.folders {
+		if child.UserID == f.UserID && child.ParentID != nil && *child.ParentID == f.ID {
+			child.ParentID = f.ParentID
+			children = append(children, child)
+		}
+	}
+	for _, child := range children {
+		if s.nameTaken(child) {
+			return errDuplicateFolder
+		}
+	}
+	for _, child := range children {
+		s.folders[child.ID] = child
+	}
+	delete(s.folders, f.ID)
+	return nil
+}
+
+func (s *memoryFolderRepository) DeleteUser(ctx context.Context, userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, f := range s.folders {
+		if f.UserID == userID {
+			delete(s.folders, id)
+		}
+	}
+	return nil
+}
+
+type memoryEventRepository struct {
+	mu        sync.Mutex
+	processed map[string]bool
+}
+
+func newMemoryEventRepository() *memoryEventRepository {
+	return &memoryEventRepository{processed: make(map[string]bool)}
+}
+
+func (s *memoryEventRepository) Processed(ctx context.Context, eventID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.processed[eventID], nil
+}
+
+func (s *memoryEventRepository) MarkProcessed(ctx context.Context, eventID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.processed[eventID] = true
+	return nil
+}
@@ -0,0 +1,787 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// summaryProjection leaves out the heavy fields of a map.
+var summaryProjection = bson.M{"imageData": 0, "matrix": 0}
+
+// activeMap matches the map with the given ID unless it is in the trash.
+func activeMap(id primitive.ObjectID) bson.M {
+	return bson.M{"_id": id, "deletedAt": nil}
+}
+
+// versionFilter matches maps at version. Maps saved before versioning have
+// no version field and match version 0.
+func versionFilter(version int64) interface{} {
+	if version == 0 {
+		return bson.M{"$in": bson.A{0, nil}}
+	}
+	return version
+}
+
+// addImageUpdate adds to update, which must have a $set document, the
+// changes that replace a document's image with ref. Any inline image left
+// from before the blob store is removed.
+func addImageUpdate(update bson.M, ref ImageRef) {
+	set := update["$set"].(bson.M)
+	unset := bson.M{"imageData": ""}
+	if ref.ImageKey == "" {
+		unset["imageKey"] = ""
+		unset["imageSize"] = ""
+		unset["imageType"] = ""
+	} else {
+		set["imageKey"] = ref.ImageKey
+		set["imageSize"] = ref.ImageSize
+		set["imageType"] = ref.ImageType
+	}
+	update["$unset"] = unset
+	if len(set) == 0 {
+		delete(update, "$set")
+	}
+}
+
+// distinctKeys returns the non-empty values of a string field among the
+// documents matching filter.
+func distinctKeys(ctx context.Context, collection *mongo.Collection, field string, filter bson.M) ([]string, error) {
+	values, err := collection.Distinct(ctx, field, filter)
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, value := range values {
+		if key, ok := value.(string); ok && key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+func exists(ctx context.Context, collection *mongo.Collection, filter bson.M) (bool, error) {
+	count, err := collection.CountDocuments(ctx, filter, options.Count().SetLimit(1))
+	return count > 0, err
+}
+
+// eachInlineImage implements EachInlineImage for either collection.
+func eachInlineImage(ctx context.Context, collection *mongo.Collection, fn func(primitive.ObjectID, string) error) error {
+	cursor, err := collection.Find(ctx,
+		bson.M{"imageData": bson.M{"$exists": true}},
+		options.Find().SetProjection(bson.M{"imageData": 1}),
+	)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var doc struct {
+			ID        primitive.ObjectID `bson:"_id"`
+			ImageData string             `bson:"imageData"`
+		}
+		if err := cursor.Decode(&doc); err != nil {
+			return err
+		}
+		if err := fn(doc.ID, doc.ImageData); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+func moveInlineImage(ctx context.Context, collection *mongo.Collection, id primitive.ObjectID, data string, ref ImageRef) error {
+	update := bson.M{"$set": bson.M{}}
+	addImageUpdate(update, ref)
+	_, err := collection.UpdateOne(ctx, bson.M{"_id": id, "imageData": data}, update)
+	return err
+}
+
+type mongoMapRepository struct {
+	maps *mongo.Collection
+}
+
+func newMongoMapRepository(db *mongo.Database) *mongoMapRepository {
+	return &mongoMapRepository{maps: db.Collection("maps")}
+}
+
+// findOne decodes the map matching filter, translating a miss into
+// errNotFound.
+func (s *mongoMapRepository) findOne(ctx context.Context, filter bson.M, opts ...*options.FindOneOptions) (Map, error) {
+	var m Map
+	err := s.maps.FindOne(ctx, filter, opts...).Decode(&m)
+	if err == mongo.ErrNoDocuments {
+		return m, errNotFound
+	}
+	return m, err
+}
+
+// findOneAndUpdate applies update to the map matching filter and decodes
+// it as returned by opts.
+func (s *mongoMapRepository) findOneAndUpdate(ctx context.Context, filter, update bson.M, opts *options.FindOneAndUpdateOptions) (Map, error) {
+	var m Map
+	err := s.maps.FindOneAndUpdate(ctx, filter, update, opts).Decode(&m)
+	if err == mongo.ErrNoDocuments {
+		return m, errNotFound
+	}
+	return m, err
+}
+
+func (s *mongoMapRepository) Create(ctx context.Context, m *Map) error {
+	result, err := s.maps.InsertOne(ctx, m)
+	if err != nil {
+		return err
+	}
+	m.ID = result.InsertedID.(primitive.ObjectID)
+	return nil
+}
+
+func (s *mongoMapRepository) ByID(ctx context.Context, id primitive.ObjectID) (Map, error) {
+	return s.findOne(ctx, bson.M{"_id": id})
+}
+
+func (s *mongoMapRepository) Info(ctx context.Context, id primitive.ObjectID) (Map, error) {
+	return s.findOne(ctx, bson.M{"_id": id}, options.FindOne().SetProjection(bson.M{"matrix": 0}))
+}
+
+func (s *mongoMapRepository) ByShareToken(ctx context.Context, tokenHash string) (Map, error) {
+	return s.findOne(ctx, bson.M{"shareLinks.tokenHash": tokenHash, "deletedAt": nil})
+}
+
+func (s *mongoMapRepository) List(ctx context.Context, q listQuery) ([]Map, int64, error) {
+	total, err := s.maps.CountDocuments(ctx, listFilter(q))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	cursor, err := s.maps.Find(ctx, pageFilter(q), listFindOptions(q))
+	if err != nil {
+		return nil, 0, err
+	}
+	maps := []Map{}
+	if err := cursor.All(ctx, &maps); err != nil {
+		return nil, 0, err
+	}
+	return maps, total, nil
+}
+
+// listFilter returns the query matching every map in q's result set,
+// ignoring the cursor, so that it can also be used for the total count.
+func listFilter(q listQuery) bson.M {
+	filter := bson.M{"userId": q.UserID, "deletedAt": nil}
+	if q.SharedWith {
+		filter = bson.M{"grants.userId": q.UserID, "deletedAt": nil}
+	}
+	if q.Trash {
+		filter["deletedAt"] = bson.M{"$ne": nil}
+	}
+	if q.Folder != nil {
+		filter["folderId"] = *q.Folder
+	} else if q.InRoot {
+		filter["folderId"] = nil
+	}
+	if len(q.Tags) > 0 {
+		filter["tags"] = bson.M{"$all": q.Tags}
+	}
+	if q.NamePrefix != "" {
+		filter["name"] = primitive.Regex{Pattern: "^" + regexp.QuoteMeta(q.NamePrefix), Options: "i"}
+	}
+	addRange(filter, "createdAt", q.CreatedAfter, q.CreatedBefore)
+	addRange(filter, "updatedAt", q.UpdatedAfter, q.UpdatedBefore)
+	return filter
+}
+
+func addRange(filter bson.M, field string, after, before time.Time) {
+	r := bson.M{}
+	if !after.IsZero() {
+		r["$gte"] = after
+	}
+	if !before.IsZero() {
+		r["$lt"] = before
+	}
+	if len(r) > 0 {
+		filter[field] = r
+	}
+}
+
+// pageFilter restricts listFilter to the maps after the cursor. Ties on the
+// sort field are broken by _id, so every map appears on exactly one page.
+func pageFilter(q listQuery) bson.M {
+	filter := listFilter(q)
+	if q.After == nil {
+		return filter
+	}
+
+	op := "$gt"
+	if q.Descending {
+		op = "$lt"
+	}
+	field := sortFields[q.Sort]
+	var value interface{} = q.After.Time
+	if q.Sort == "name" {
+		value = q.After.Name
+	}
+
+	return bson.M{"$and": bson.A{
+		filter,
+		bson.M{"$or": bson.A{
+			bson.M{field: bson.M{op: value}},
+			bson.M{field: value, "_id": bson.M{op: q.After.objID}},
+		}},
+	}}
+}
+
+// listFindOptions sorts the page, fetches one extra map to tell whether
+// there is a next page and leaves out the heavy fields unless asked for.
+func listFindOptions(q listQuery) *options.FindOptions {
+	dir := 1
+	if q.Descending {
+		dir = -1
+	}
+	opts := options.Find().
+		SetSort(bson.D{{Key: sortFields[q.Sort], Value: dir}, {Key: "_id", Value: dir}}).
+		SetLimit(int64(q.Limit + 1))
+	if !q.Full {
+		opts.SetProjection(summaryProjection)
+	}
+	return opts
+}
+
+func (s *mongoMapRepository) Each(ctx context.Context, userID string, fn func(Map) error) error {
+	cursor, err := s.maps.Find(ctx,
+		bson.M{"userId": userID, "deletedAt": nil},
+		options.Find().SetSort(bson.D{{Key: "createdAt", Value: 1}, {Key: "_id", Value: 1}}),
+	)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var m Map
+		if err := cursor.Decode(&m); err != nil {
+			return err
+		}
+		if err := fn(m); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+func (s *mongoMapRepository) Update(ctx context.Context, id primitive.ObjectID, version *int64, change MapChange) (Map, error) {
+	set := bson.M{"updatedAt": change.UpdatedAt}
+	if change.Name != nil {
+		set["name"] = *change.Name
+	}
+	if change.Width != nil {
+		set["width"] = *change.Width
+	}
+	if change.Height != nil {
+		set["height"] = *change.Height
+	}
+	if change.Matrix != nil {
+		set["matrix"] = *change.Matrix
+	}
+	update := bson.M{"$set": set, "$inc": bson.M{"version": 1}}
+	if change.Image != nil {
+		addImageUpdate(update, *change.Image)
+	}
+
+	filter := activeMap(id)
+	if version != nil {
+		filter["version"] = versionFilter(*version)
+	}
+	return s.findOneAndUpdate(ctx, filter, update,
+		options.FindOneAndUpdate().SetReturnDocument(options.Before))
+}
+
+func (s *mongoMapRepository) Trash(ctx context.Context, id primitive.ObjectID, at time.Time) (Map, error) {
+	return s.findOneAndUpdate(ctx, activeMap(id),
+		bson.M{"$set": bson.M{"deletedAt": at}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After).SetProjection(summaryProjection),
+	)
+}
+
+func (s *mongoMapRepository) Restore(ctx context.Context, id primitive.ObjectID) (Map, error) {
+	return s.findOneAndUpdate(ctx,
+		bson.M{"_id": id, "deletedAt": bson.M{"$ne": nil}},
+		bson.M{"$unset": bson.M{"deletedAt": ""}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	)
+}
+
+func (s *mongoMapRepository) Delete(ctx context.Context, id primitive.ObjectID, trashedBefore time.Time) (bool, error) {
+	result, err := s.maps.DeleteOne(ctx, bson.M{
+		"_id":       id,
+		"deletedAt": bson.M{"$ne": nil, "$lte": trashedBefore},
+	})
+	if err != nil {
+		return false, err
+	}
+	return result.DeletedCount > 0, nil
+}
+
+func (s *mongoMapRepository) TrashedBefore(ctx context.Context, t time.Time) ([]Map, error) {
+	cursor, err := s.maps.Find(ctx,
+		bson.M{"deletedAt": bson.M{"$lt": t}},
+		options.Find().SetProjection(summaryProjection),
+	)
+	if err != nil {
+		return nil, err
+	}
+	var maps []Map
+	if err := cursor.All(ctx, &maps); err != nil {
+		return nil, err
+	}
+	return maps, nil
+}
+
+func (s *mongoMapRepository) DeleteUser(ctx context.Context, userID string) (int64, error) {
+	result, err := s.maps.DeleteMany(ctx, bson.M{"userId": userID})
+	if err != nil {
+		return 0, err
+	}
+	return result.DeletedCount, nil
+}
+
+func (s *mongoMapRepository) AddShareLink(ctx context.Context, id primitive.ObjectID, link ShareLink) error {
+	result, err := s.maps.UpdateOne(ctx, activeMap(id),
+		bson.M{"$push": bson.M{"shareLinks": link}},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+func (s *mongoMapRepository) RemoveShareLink(ctx context.Context, id, linkID primitive.ObjectID) (bool, error) {
+	result, err := s.maps.UpdateOne(ctx,
+		bson.M{"_id": id, "shareLinks.id": linkID},
+		bson.M{"$pull": bson.M{"shareLinks": bson.M{"id": linkID}}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return result.MatchedCount > 0, nil
+}
+
+func (s *mongoMapRepository) PutGrant(ctx context.Context, id primitive.ObjectID, grant Grant) error {
+	result, err := s.maps.UpdateOne(ctx,
+		bson.M{"_id": id, "grants.userId": grant.UserID},
+		bson.M{"$set": bson.M{"grants.$": grant}},
+	)
+	if err == nil && result.MatchedCount == 0 {
+		_, err = s.maps.UpdateOne(ctx,
+			bson.M{"_id": id, "grants.userId": bson.M{"$ne": grant.UserID}},
+			bson.M{"$push": bson.M{"grants": grant}},
+		)
+	}
+	return err
+}
+
+func (s *mongoMapRepository) RemoveGrant(ctx context.Context, id primitive.ObjectID, userID string) (bool, error) {
+	result, err := s.maps.UpdateOne(ctx,
+		bson.M{"_id": id, "grants.userId": userID},
+		bson.M{"$pull": bson.M{"grants": bson.M{"userId": userID}}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return result.MatchedCount > 0, nil
+}
+
+func (s *mongoMapRepository) RemoveGrantsTo(ctx context.Context, userID string) error {
+	_, err := s.maps.UpdateMany(ctx,
+		bson.M{"grants.userId": userID},
+		bson.M{"$pull": bson.M{"grants": bson.M{"userId": userID}}},
+	)
+	return err
+}
+
+func (s *mongoMapRepository) SetFolder(ctx context.Context, id primitive.ObjectID, folderID *primitive.ObjectID) (Map, error) {
+	update := bson.M{"$unset": bson.M{"folderId": ""}}
+	if folderID != nil {
+		update = bson.M{"$set": bson.M{"folderId": *folderID}}
+	}
+	return s.findOneAndUpdate(ctx, activeMap(id), update,
+		options.FindOneAndUpdate().SetReturnDocument(options.After).SetProjection(summaryProjection))
+}
+
+func (s *mongoMapRepository) MoveFolder(ctx context.Context, userID string, from primitive.ObjectID, to *primitive.ObjectID) error {
+	update := bson.M{"$unset": bson.M{"folderId": ""}}
+	if to != nil {
+		update = bson.M{"$set": bson.M{"folderId": *to}}
+	}
+	_, err := s.maps.UpdateMany(ctx, bson.M{"userId": userID, "folderId": from}, update)
+	return err
+}
+
+func (s *mongoMapRepository) SetTags(ctx context.Context, id primitive.ObjectID, tags []string) (Map, error) {
+	update := bson.M{"$set": bson.M{"tags": tags}}
+	if len(tags) == 0 {
+		update = bson.M{"$unset": bson.M{"tags": ""}}
+	}
+	return s.findOneAndUpdate(ctx, activeMap(id), update,
+		options.FindOneAndUpdate().SetReturnDocument(options.After).SetProjection(summaryProjection))
+}
+
+func (s *mongoMapRepository) Tags(ctx context.Context, userID string) ([]TagCount, error) {
+	cursor, err := s.maps.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"userId": userID, "deletedAt": nil, "tags": bson.M{"$exists": true}}}},
+		{{Key: "$unwind", Value: "$tags"}},
+		{{Key: "$group", Value: bson.M{"_id": "$tags", "count": bson.M{"$sum": 1}}}},
+		{{Key: "$sort", Value: bson.D{{Key: "count", Value: -1}, {Key: "_id", Value: 1}}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	tags := []TagCount{}
+	if err := cursor.All(ctx, &tags); err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
+
+func (s *mongoMapRepository) StaleThumbnails(ctx context.Context, limit int) ([]primitive.ObjectID, error) {
+	cursor, err := s.maps.Find(ctx,
+		bson.M{
+			"imageKey": bson.M{"$exists": true},
+			"$expr":    bson.M{"$ne": bson.A{"$thumbnailSource", "$imageKey"}},
+		},
+		options.Find().SetProjection(bson.M{"_id": 1}).SetLimit(int64(limit)),
+	)
+	if err != nil {
+		return nil, err
+	}
+	var docs []struct {
+		ID primitive.ObjectID `bson:"_id"`
+	}
+	if err := cursor.All(ctx, &docs); err != nil {
+		return nil, err
+	}
+	ids := make([]primitive.ObjectID, len(docs))
+	for i, doc := range docs {
+		ids[i] = doc.ID
+	}
+	return ids, nil
+}
+
+func (s *mongoMapRepository) SetThumbnails(ctx context.Context, id primitive.ObjectID, source string, thumbnails []Thumbnail) (bool, error) {
+	result, err := s.maps.UpdateOne(ctx,
+		bson.M{"_id": id, "imageKey": source},
+		bson.M{
+			"$set":   bson.M{"thumbnails": thumbnails, "thumbnailSource": source},
+			"$unset": bson.M{"thumbnailsFailed": ""},
+		},
+	)
+	if err != nil {
+		return false, err
+	}
+	return result.MatchedCount > 0, nil
+}
+
+func (s *mongoMapRepository) SetThumbnailsFailed(ctx context.Context, id primitive.ObjectID, source string) error {
+	_, err := s.maps.UpdateOne(ctx,
+		bson.M{"_id": id, "imageKey": source},
+		bson.M{"$set": bson.M{"thumbnailSource": source, "thumbnailsFailed": true}},
+	)
+	return err
+}
+
+func (s *mongoMapRepository) BlobKeys(ctx context.Context, mapID primitive.ObjectID) ([]string, error) {
+	return s.blobKeys(ctx, bson.M{"_id": mapID})
+}
+
+func (s *mongoMapRepository) UserBlobKeys(ctx context.Context, userID string) ([]string, error) {
+	return s.blobKeys(ctx, bson.M{"userId": userID})
+}
+
+// blobKeys returns the images and thumbnails of the maps matching filter.
+func (s *mongoMapRepository) blobKeys(ctx context.Context, filter bson.M) ([]string, error) {
+	var keys []string
+	for _, field := range []string{"imageKey", "thumbnails.key"} {
+		values, err := distinctKeys(ctx, s.maps, field, filter)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, values...)
+	}
+	return keys, nil
+}
+
+func (s *mongoMapRepository) ReferencesBlob(ctx context.Context, key string) (bool, error) {
+	return exists(ctx, s.maps, bson.M{"$or": bson.A{bson.M{"imageKey": key}, bson.M{"thumbnails.key": key}}})
+}
+
+func (s *mongoMapRepository) EachInlineImage(ctx context.Context, fn func(primitive.ObjectID, string) error) error {
+	return eachInlineImage(ctx, s.maps, fn)
+}
+
+func (s *mongoMapRepository) MoveInlineImage(ctx context.Context, id primitive.ObjectID, data string, ref ImageRef) error {
+	return moveInlineImage(ctx, s.maps, id, data, ref)
+}
+
+type mongoRevisionRepository struct {
+	revisions *mongo.Collection
+}
+
+func newMongoRevisionRepository(db *mongo.Database) *mongoRevisionRepository {
+	return &mongoRevisionRepository{revisions: db.Collection("map_revisions")}
+}
+
+func (s *mongoRevisionRepository) Add(ctx context.Context, rev MapRevision, keep int) ([]string, error) {
+	if _, err := s.revisions.InsertOne(ctx, rev); err != nil {
+		return nil, err
+	}
+
+	// Find the newest revision that falls outside the limit and delete it
+	// along with everything older.
+	var oldest MapRevision
+	err := s.revisions.FindOne(ctx, bson.M{"mapId": rev.MapID}, options.FindOne().
+		SetSort(bson.D{{Key: "revision", Value: -1}}).
+		SetSkip(int64(keep)).
+		SetProjection(bson.M{"revision": 1}),
+	).Decode(&oldest)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	pruned := bson.M{"mapId": rev.MapID, "revision": bson.M{"$lte": oldest.Revision}}
+	keys, err := distinctKeys(ctx, s.revisions, "imageKey", pruned)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.revisions.DeleteMany(ctx, pruned); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (s *mongoRevisionRepository) List(ctx context.Context, mapID primitive.ObjectID) ([]MapRevision, error) {
+	cursor, err := s.revisions.Find(ctx, bson.M{"mapId": mapID}, options.Find().
+		SetSort(bson.D{{Key: "revision", Value: -1}}).
+		SetProjection(summaryProjection),
+	)
+	if err != nil {
+		return nil, err
+	}
+	revisions := []MapRevision{}
+	if err := cursor.All(ctx, &revisions); err != nil {
+		return nil, err
+	}
+	return revisions, nil
+}
+
+func (s *mongoRevisionRepository) Get(ctx context.Context, mapID primitive.ObjectID, revision int64) (MapRevision, error) {
+	var rev MapRevision
+	err := s.revisions.FindOne(ctx, bson.M{"mapId": mapID, "revision": revision}).Decode(&rev)
+	if err == mongo.ErrNoDocuments {
+		return rev, errNotFound
+	}
+	return rev, err
+}
+
+func (s *mongoRevisionRepository) DeleteMap(ctx context.Context, mapID primitive.ObjectID) error {
+	_, err := s.revisions.DeleteMany(ctx, bson.M{"mapId": mapID})
+	return err
+}
+
+func (s *mongoRevisionRepository) DeleteUser(ctx context.Context, userID string) error {
+	_, err := s.revisions.DeleteMany(ctx, bson.M{"userId": userID})
+	return err
+}
+
+func (s *mongoRevisionRepository) BlobKeys(ctx context.Context, mapID primitive.ObjectID) ([]string, error) {
+	return distinctKeys(ctx, s.revisions, "imageKey", bson.M{"mapId": mapID})
+}
+
+func (s *mongoRevisionRepository) UserBlobKeys(ctx context.Context, userID string) ([]string, error) {
+	return distinctKeys(ctx, s.revisions, "imageKey", bson.M{"userId": userID})
+}
+
+func (s *mongoRevisionRepository) ReferencesBlob(ctx context.Context, key string) (bool, error) {
+	return exists(ctx, s.revisions, bson.M{"imageKey": key})
+}
+
+func (s *mongoRevisionRepository) EachInlineImage(ctx context.Context, fn func(primitive.ObjectID, string) error) error {
+	return eachInlineImage(ctx, s.revisions, fn)
+}
+
+func (s *mongoRevisionRepository) MoveInlineImage(ctx context.Context, id primitive.ObjectID, data string, ref ImageRef) error {
+	return moveInlineImage(ctx, s.revisions, id, data, ref)
+}
+
+type mongoFolderRepository struct {
+	folders *mongo.Collection
+}
+
+func newMongoFolderRepository(db *mongo.Database) *mongoFolderRepository {
+	return &mongoFolderRepository{folders: db.Collection("map_folders")}
+}
+
+// folderError translates a violation of the unique sibling name index.
+func folderError(err error) error {
+	if mongo.IsDuplicateKeyError(err) {
+		return errDuplicateFolder
+	}
+	return err
+}
+
+func (s *mongoFolderRepository) findOne(ctx context.Context, filter bson.M) (Folder, error) {
+	var f Folder
+	err := s.folders.FindOne(ctx, filter).Decode(&f)
+	if err == mongo.ErrNoDocuments {
+		return f, errNotFound
+	}
+	return f, err
+}
+
+func (s *mongoFolderRepository) Create(ctx context.Context, f *Folder) error {
+	result, err := s.folders.InsertOne(ctx, f)
+	if err != nil {
+		return folderError(err)
+	}
+	f.ID = result.InsertedID.(primitive.ObjectID)
+	return nil
+}
+
+func (s *mongoFolderRepository) ByID(ctx context.Context, userID string, id primitive.ObjectID) (Folder, error) {
+	return s.findOne(ctx, bson.M{"_id": id, "userId": userID})
+}
+
+func (s *mongoFolderRepository) ByName(ctx context.Context, userID, name string, parentID *primitive.ObjectID) (Folder, error) {
+	filter := bson.M{"userId": userID, "name": name, "parentId": nil}
+	if parentID != nil {
+		filter["parentId"] = *parentID
+	}
+	return s.findOne(ctx, filter)
+}
+
+func (s *mongoFolderRepository) List(ctx context.Context, userID string) ([]Folder, error) {
+	cursor, err := s.folders.Find(ctx,
+		bson.M{"userId": userID},
+		options.Find().SetSort(bson.D{{Key: "name", Value: 1}}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	folders := []Folder{}
+	if err := cursor.All(ctx, &folders); err != nil {
+		return nil, err
+	}
+	return folders, nil
+}
+
+func (s *mongoFolderRepository) Update(ctx context.Context, f Folder) error {
+	update := bson.M{"$set": bson.M{"name": f.Name, "updatedAt": f.UpdatedAt}}
+	if f.ParentID != nil {
+		update["$set"].(bson.M)["parentId"] = *f.ParentID
+	} else {
+		update["$unset"] = bson.M{"parentId": ""}
+	}
+	_, err := s.folders.UpdateOne(ctx, bson.M{"_id": f.ID, "userId": f.UserID}, update)
+	return folderError(err)
+}
+
+func (s *mongoFolderRepository) Delete(ctx context.Context, f Folder) error {
+	up := bson.M{"$unset": bson.M{"parentId": ""}}
+	if f.ParentID != nil {
+		up = bson.M{"$set": bson.M{"parentId": *f.ParentID}}
+	}
+	if _, err := s.folders.UpdateMany(ctx, bson.M{"userId": f.UserID, "parentId": f.ID}, up); err != nil {
+		return folderError(err)
+	}
+	_, err := s.folders.DeleteOne(ctx, bson.M{"_id": f.ID, "userId": f.UserID})
+	return err
+}
+
+func (s *mongoFolderRepository) DeleteUser(ctx context.Context, userID string) error {
+	_, err := s.folders.DeleteMany(ctx, bson.M{"userId": userID})
+	return err
+}
+
+type mongoEventRepository struct {
+	processed *mongo.Collection
+}
+
+func newMongoEventRepository(db *mongo.Database) *mongoEventRepository {
+	return &mongoEventRepository{processed: db.Collection("processed_events")}
+}
+
+func (s *mongoEventRepository) Processed(ctx context.Context, eventID string) (bool, error) {
+	err := s.processed.FindOne(ctx, bson.M{"_id": eventID}).Err()
+	if err == mongo.ErrNoDocuments {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *mongoEventRepository) MarkProcessed(ctx context.Context, eventID string) error {
+	_, err := s.processed.InsertOne(ctx, bson.M{"_id": eventID, "processedAt": time.Now()})
+	if err != nil && !mongo.IsDuplicateKeyError(err) {
+		return err
+	}
+	return nil
+}
+
+// ensureIndexes creates the indexes backing the map listing, one per sort
+// order, and those of the revision history. Creating an index that already
+// exists is a no-op.
+func ensureIndexes(db *mongo.Database) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	var models []mongo.IndexModel
+	for _, field := range []string{"createdAt", "updatedAt", "name"} {
+		models = append(models, mongo.IndexModel{
+			Keys: bson.D{{Key: "userId", Value: 1}, {Key: field, Value: 1}, {Key: "_id", Value: 1}},
+		})
+	}
+	if _, err := db.Collection("maps").Indexes().CreateMany(ctx, models); err != nil {
+		return err
+	}
+
+	_, err := db.Collection("map_revisions").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "mapId", Value: 1}, {Key: "revision", Value: -1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{Keys: bson.D{{Key: "userId", Value: 1}}},
+		{Keys: bson.D{{Key: "imageKey", Value: 1}}, Options: options.Index().SetSparse(true)},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Collection("maps").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "imageKey", Value: 1}}, Options: options.Index().SetSparse(true)},
+		{Keys: bson.D{{Key: "thumbnails.key", Value: 1}}, Options: options.Index().SetSparse(true)},
+		{Keys: bson.D{{Key: "deletedAt", Value: 1}}, Options: options.Index().SetSparse(true)},
+		{Keys: bson.D{{Key: "grants.userId", Value: 1}, {Key: "updatedAt", Value: 1}}, Options: options.Index().SetSparse(true)},
+		{Keys: bson.D{{Key: "shareLinks.tokenHash", Value: 1}}, Options: options.Index().SetSparse(true)},
+		{Keys: bson.D{{Key: "userId", Value: 1}, {Key: "folderId", Value: 1}, {Key: "updatedAt", Value: 1}}},
+		{Keys: bson.D{{Key: "userId", Value: 1}, {Key: "tags", Value: 1}}},
+	})
+	if err != nil {
+		return err
+	}
+
+	// Folder names are unique among their siblings.
+	_, err = db.Collection("map_folders").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "userId", Value: 1}, {Key: "parentId", Value: 1}, {Key: "name", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	return err
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// maxDiffCells caps the cell changes listed in a diff response.
+const maxDiffCells = 1000
+
+// MapRevision is an immutable copy of a map's content after a change.
+// Revision equals the map's version at that point.
+type MapRevision struct {
+	ID        primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	MapID     primitive.ObjectID `json:"mapId" bson:"mapId"`
+	UserID    string             `json:"userId" bson:"userId"`
+	Revision  int64              `json:"revision" bson:"revision"`
+	AuthorID  string             `json:"authorId" bson:"authorId"`
+	Summary   string             `json:"summary" bson:"summary"`
+	Name      string             `json:"name" bson:"name"`
+	Width     int                `json:"width" bson:"width"`
+	Height    int                `json:"height" bson:"height"`
+	ImageRef  `bson:",inline"`
+	Matrix    [][]int   `json:"matrix,omitempty" bson:"matrix,omitempty"`
+	CreatedAt time.Time `json:"createdAt" bson:"createdAt"`
+}
+
+// CellChange is a matrix cell whose color differs between two revisions.
+type CellChange struct {
+	Row  int `json:"row"`
+	Col  int `json:"col"`
+	From int `json:"from"`
+	To   int `json:"to"`
+}
+
+// RevisionDiff compares the content of two revisions of a map.
+type RevisionDiff struct {
+	From          int64        `json:"from"`
+	To            int64        `json:"to"`
+	ChangedFields []string     `json:"changedFields"`
+	NameFrom      string       `json:"nameFrom,omitempty"`
+	NameTo        string       `json:"nameTo,omitempty"`
+	CellsChanged  int          `json:"cellsChanged"`
+	Cells         []CellChange `json:"cells"`
+	Truncated     bool         `json:"truncated,omitempty"`
+}
+
+// revisionAuthor is the user making a change. Changes need editor access,
+// so by the time one is recorded the caller has been authorized as a
+// signed-in user whose X-User-ID the gateway set from their token.
+func revisionAuthor(r *http.Request) string {
+	return principalFrom(r).UserID
+}
+
+// changedFields names the parts of a map that differ between a and b.
+func changedFields(a, b Map) []string {
+	fields := []string{}
+	if a.Name != b.Name {
+		fields = append(fields, "name")
+	}
+	if a.Width != b.Width || a.Height != b.Height {
+		fields = append(fields, "size")
+	}
+	if a.ImageKey != b.ImageKey || a.ImageData != b.ImageData {
+		fields = append(fields, "drawing")
+	}
+	if !equalMatrix(a.Matrix, b.Matrix) {
+		fields = append(fields, "coloring")
+	}
+	return fields
+}
+
+func equalMatrix(a, b [][]int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if len(a[i]) != len(b[i]) {
+			return false
+		}
+		for j := range a[i] {
+			if a[i][j] != b[i][j] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func summarizeChanges(before, after Map) string {
+	fields := changedFields(before, after)
+	if len(fields) == 0 {
+		return "No changes"
+	}
+	return "Changed " + strings.Join(fields, ", ")
+}
+
+// recordRevision stores m's current content as a revision and prunes the
+// oldest revisions beyond MaxRevisions, releasing their images. Failures
+// are logged rather than returned, since the map itself has already been
+// saved.
+func (s *Server) recordRevision(m Map, authorID, summary string) {
+	pruned, err := s.revisions.Add(context.Background(), MapRevision{
+		MapID:     m.ID,
+		UserID:    m.UserID,
+		Revision:  m.Version,
+		AuthorID:  authorID,
+		Summary:   summary,
+		Name:      m.Name,
+		Width:     m.Width,
+		Height:    m.Height,
+		ImageRef:  m.ImageRef,
+		Matrix:    m.Matrix,
+		CreatedAt: m.UpdatedAt,
+	}, s.limits.MaxRevisions)
+	if err != nil {
+		log.Printf("Error recording revision %d of map %s: %v", m.Version, m.ID.Hex(), err)
+		return
+	}
+	s.releaseBlobs(context.Background(), pruned...)
+}
+
+// findRevision loads one revision, writing the error response if it fails.
+func (s *Server) findRevision(w http.ResponseWriter, mapID primitive.ObjectID, revision int64) (MapRevision, bool) {
+	rev, err := s.revisions.Get(context.Background(), mapID, revision)
+	if err == errNotFound {
+		http.Error(w, "Revision not found", http.StatusNotFound)
+		return rev, false
+	}
+	if err != nil {
+		log.Printf("Error finding revision: %v", err)
+		http.Error(w, "Failed to retrieve revision", http.StatusInternalServerError)
+		return rev, false
+	}
+	return rev, true
+}
+
+// revisionVars parses the {id} and {rev} route variables and checks that
+// the caller has the needed access to the map.
+func (s *Server) revisionVars(w http.ResponseWriter, r *http.Request, need access) (primitive.ObjectID, int64, bool) {
+	mapID, ok := mapID(w, r)
+	if !ok {
+		return mapID, 0, false
+	}
+	revision, err := strconv.ParseInt(mux.Vars(r)["rev"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid revision", http.StatusBadRequest)
+		return mapID, 0, false
+	}
+
+	// Like its image, a map's history stays readable while it is in the
+	// trash; changes need it out of the trash.
+	scope := allMaps
+	if need > accessViewer {
+		scope = activeMaps
+	}
+	if _, ok := s.loadMap(w, r, scope, need); !ok {
+		return mapID, 0, false
+	}
+	return mapID, revision, true
+}
+
+func (s *Server) handleListRevisions(w http.ResponseWriter, r *http.Request) {
+	m, ok := s.loadMap(w, r, allMaps, accessViewer)
+	if !ok {
+		return
+	}
+
+	revisions, err := s.revisions.List(context.Background(), m.ID)
+	if err != nil {
+		log.Printf("Error fetching revisions: %v", err)
+		http.Error(w, "Failed to fetch revisions", http.StatusInternalServerError)
+		return
+	}
+	for i := range revisions {
+		revisions[i].ImageRef.setURL(revisionImagePath(m.ID, revisions[i].Revision))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(revisions)
+}
+
+func (s *Server) handleGetRevision(w http.ResponseWriter, r *http.Request) {
+	mapID, revision, ok := s.revisionVars(w, r, accessViewer)
+	if !ok {
+		return
+	}
+	rev, ok := s.findRevision(w, mapID, revision)
+	if !ok {
+		return
+	}
+	rev.ImageRef.setURL(revisionImagePath(mapID, revision))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rev)
+}
+
+// handleDiffRevision compares revision {rev} with the one named by the
+// against parameter, which defaults to the revision before it.
+func (s *Server) handleDiffRevision(w http.ResponseWriter, r *http.Request) {
+	mapID, revision, ok := s.revisionVars(w, r, accessViewer)
+	if !ok {
+		return
+	}
+	against := revision - 1
+	if value := r.URL.Query().Get("against"); value != "" {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid against revision", http.StatusBadRequest)
+			return
+		}
+		against = n
+	}
+
+	from, ok := s.findRevision(w, mapID, against)
+	if !ok {
+		return
+	}
+	to, ok := s.findRevision(w, mapID, revision)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(diffRevisions(from, to))
+}
+
+func diffRevisions(from, to MapRevision) RevisionDiff {
+	diff := RevisionDiff{
+		From:          from.Revision,
+		To:            to.Revision,
+		ChangedFields: changedFields(revisionContent(from), revisionContent(to)),
+		Cells:         []CellChange{},
+	}
+	if from.Name != to.Name {
+		diff.NameFrom, diff.NameTo = from.Name, to.Name
+	}
+
+	// Cells outside one of the matrices count as color 0 there.
+	rows := max(len(from.Matrix), len(to.Matrix))
+	for i := 0; i < rows; i++ {
+		cols := max(rowLen(from.Matrix, i), rowLen(to.Matrix, i))
+		for j := 0; j < cols; j++ {
+			a, b := cell(from.Matrix, i, j), cell(to.Matrix, i, j)
+			if a == b {
+				continue
+			}
+			diff.CellsChanged++
+			if len(diff.Cells) < maxDiffCells {
+				diff.Cells = append(diff.Cells, CellChange{Row: i, Col: j, From: a, To: b})
+			} else {
+				diff.Truncated = true
+			}
+		}
+	}
+	return diff
+}
+
+func revisionContent(rev MapRevision) Map {
+	return Map{Name: rev.Name, Width: rev.Width, Height: rev.Height, ImageRef: rev.ImageRef, Matrix: rev.Matrix}
+}
+
+func rowLen(matrix [][]int, i int) int {
+	if i < len(matrix) {
+		return len(matrix[i])
+	}
+	return 0
+}
+
+func cell(matrix [][]int, i, j int) int {
+	if i < len(matrix) && j < len(matrix[i]) {
+		return matrix[i][j]
+	}
+	return 0
+}
+
+// handleRestoreRevision makes revision {rev} the map's current content.
+// The restore is itself recorded as a new revision, so it can be undone.
+// An If-Match header is optional here but honoured when present.
+func (s *Server) handleRestoreRevision(w http.ResponseWriter, r *http.Request) {
+	mapID, revision, ok := s.revisionVars(w, r, accessEditor)
+	if !ok {
+		return
+	}
+	rev, ok := s.findRevision(w, mapID, revision)
+	if !ok {
+		return
+	}
+
+	var version *int64
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+		var err error
+		version, err = parseIfMatch(ifMatch)
+		if err != nil {
+			http.Error(w, "Invalid If-Match header", http.StatusPreconditionFailed)
+			return
+		}
+	}
+
+	// Revisions recorded before the blob store may still hold their image
+	// inline; the restored map should not.
+	image := rev.ImageRef
+	if image.ImageKey == "" && image.ImageData != "" {
+		var err error
+		image, err = s.storeImageData(r.Context(), image.ImageData)
+		if err != nil {
+			s.writeImageError(w, err)
+			return
+		}
+	}
+
+	change := MapChange{
+		Name:      &rev.Name,
+		Width:     &rev.Width,
+		Height:    &rev.Height,
+		Matrix:    &rev.Matrix,
+		Image:     &image,
+		UpdatedAt: time.Now(),
+	}
+	previous, err := s.maps.Update(context.Background(), mapID, version, change)
+	if err == errNotFound {
+		s.releaseBlobs(context.Background(), image.ImageKey)
+		s.writeUpdateConflict(w, mapID)
+		return
+	}
+	if err != nil {
+		log.Printf("Error restoring map: %v", err)
+		s.releaseBlobs(context.Background(), image.ImageKey)
+		http.Error(w, "Failed to restore map", http.StatusInternalServerError)
+		return
+	}
+
+	mapData := previous
+	change.apply(&mapData)
+	s.recordRevision(mapData, revisionAuthor(r), fmt.Sprintf("Restored revision %d", revision))
+	s.refreshThumbnails(mapData)
+	s.releaseBlobs(context.Background(), previous.ImageKey)
+
+	if s.logger != nil {
+		metadata := map[string]string{
+			"map_id":   mapID.Hex(),
+			"map_name": mapData.Name,
+			"revision": strconv.FormatInt(revision, 10),
+			"version":  strconv.FormatInt(mapData.Version, 10),
+		}
+
+		if err := s.logger.LogEvent(
+			"map_restored",
+			mapData.UserID,
+			fmt.Sprintf("Map %s restored to revision %d", mapData.Name, revision),
+			metadata,
+		); err != nil {
+			log.Printf("Failed to log map restore: %v", err)
+		}
+	}
+
+	s.setURLs(&mapData)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", mapETag(mapData.Version))
+	json.NewEncoder(w).Encode(mapData)
+}
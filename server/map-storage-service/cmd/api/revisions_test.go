@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRestoreRevision(t *testing.T) {
+	tests := []struct {
+		name     string
+		userID   string
+		rev      string
+		wantCode int
+	}{
+		{"owner", "1", "1", http.StatusOK},
+		{"editor", "2", "1", http.StatusOK},
+		{"viewer", "3", "1", http.StatusForbidden},
+		{"not signed in", "", "1", http.StatusNotFound},
+		{"unknown revision", "1", "9", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			ctx := context.Background()
+			m := s.createTestMap(t, "1", "Level 1")
+			s.recordRevision(m, m.UserID, "Created")
+
+			renamed := "Renamed"
+			previous, err := s.maps.Update(ctx, m.ID, nil, MapChange{Name: &renamed, UpdatedAt: time.Now()})
+			if err != nil {
+				t.Fatal(err)
+			}
+			change := MapChange{Name: &renamed}
+			change.apply(&previous)
+			s.recordRevision(previous, m.UserID, "Changed name")
+
+			for userID, role := range map[string]string{"2": "editor", "3": "viewer"} {
+				if err := s.maps.PutGrant(ctx, m.ID, Grant{UserID: userID, Role: role, GrantedAt: time.Now()}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			rec := call(s.handleRestoreRevision, "POST", "/", tt.userID, map[string]string{"id": m.ID.Hex(), "rev": tt.rev}, nil)
+			if rec.Code != tt.wantCode {
+				t.Fatalf("got status %d, want %d: %s", rec.Code, tt.wantCode, rec.Body)
+			}
+
+			stored, err := s.maps.ByID(ctx, m.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantCode != http.StatusOK {
+				if stored.Name != renamed || stored.Version != 2 {
+					t.Fatalf("map changed by a failed restore: %q at version %d", stored.Name, stored.Version)
+				}
+				return
+			}
+
+			var got Map
+			if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			if got.Name != m.Name || stored.Name != m.Name || stored.Version != 3 {
+				t.Fatalf("stored %q at version %d, want %q at version 3", stored.Name, stored.Version, m.Name)
+			}
+			revs, err := s.revisions.List(ctx, m.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var latest MapRevision
+			for _, rev := range revs {
+				if rev.Revision > latest.Revision {
+					latest = rev
+				}
+			}
+			if latest.Revision != 3 || latest.AuthorID != tt.userID {
+				t.Fatalf("latest revision is %d by %q, want 3 by %q", latest.Revision, latest.AuthorID, tt.userID)
+			}
+		})
+	}
+}
+
+func TestRecordRevisionReleasesPrunedImages(t *testing.T) {
+	s := newTestServer(t)
+	s.limits.MaxRevisions = 2
+	ctx := context.Background()
+	m := s.createTestMap(t, "1", "Level 1")
+
+	var keys []string
+	for i := 1; i <= 3; i++ {
+		ref, err := s.storeImage(ctx, bytes.NewReader(testPNG(t, 1, i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, ref.ImageKey)
+		m.Version = int64(i)
+		m.ImageRef = ref
+		s.recordRevision(m, m.UserID, "Changed drawing")
+	}
+
+	if _, err := s.blobs.Get(ctx, keys[0]); err != errBlobNotFound {
+		t.Fatalf("image of the pruned revision was kept: %v", err)
+	}
+	for _, key := range keys[1:] {
+		blob, err := s.blobs.Get(ctx, key)
+		if err != nil {
+			t.Fatalf("image of a kept revision was deleted: %v", err)
+		}
+		blob.Close()
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Limits are the service's tunables. main sets them from the environment,
+// starting from defaultLimits.
+type Limits struct {
+	// MaxRevisions is how many revisions are kept per map; older ones are
+	// pruned whenever a new one is recorded.
+	MaxRevisions int
+	// MaxImageBytes limits the size of a single image.
+	MaxImageBytes int64
+	// MaxImagePixels limits the width times height of the images thumbnails
+	// are rendered from. Decoding needs memory for every pixel, and a small
+	// file can declare a huge image.
+	MaxImagePixels int
+	// ThumbnailSizes are the bounding boxes, in pixels, thumbnails are
+	// rendered at. The first one is served when no size is requested.
+	ThumbnailSizes []int
+	// TrashRetention is how long a map stays in the trash before it is
+	// purged.
+	TrashRetention time.Duration
+	// MaxArchiveBytes limits the size of an uploaded archive.
+	MaxArchiveBytes int64
+}
+
+func defaultLimits() Limits {
+	return Limits{
+		MaxRevisions:    50,
+		MaxImageBytes:   20 << 20,
+		MaxImagePixels:  40_000_000,
+		ThumbnailSizes:  []int{128, 256},
+		TrashRetention:  30 * 24 * time.Hour,
+		MaxArchiveBytes: 1 << 30,
+	}
+}
+
+// Server holds what the handlers and background jobs work with. main wires
+// it to MongoDB; tests use the in-memory repositories.
+type Server struct {
+	maps      MapRepository
+	revisions RevisionRepository
+	folders   FolderRepository
+	events    EventRepository
+	blobs     BlobStore
+	// blobGracePeriod is how long a newly stored blob is kept even though
+	// nothing refers to it yet, giving the request that stored it time to
+	// save the map or revision that will.
+	blobGracePeriod time.Duration
+	limits          Limits
+	// auth and logger may be nil when the services are unavailable.
+	auth   *AuthClient
+	logger *LoggerClient
+
+	// thumbnailQueue holds maps whose thumbnails need rendering. It is
+	// drained by runThumbnailWorker; anything that doesn't fit is picked up
+	// by the worker's periodic sweep instead.
+	thumbnailQueue chan primitive.ObjectID
+}
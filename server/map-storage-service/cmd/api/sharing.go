@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Grant gives another user access to a map.
+type Grant struct {
+	UserID    string    `json:"userId" bson:"userId"`
+	UserName  string    `json:"userName,omitempty" bson:"-"`
+	Role      string    `json:"role" bson:"role"`
+	GrantedAt time.Time `json:"grantedAt" bson:"grantedAt"`
+}
+
+// grantRoles maps the roles a grant can give to the access they mean.
+var grantRoles = map[string]access{
+	"viewer": accessViewer,
+	"editor": accessEditor,
+}
+
+func (g Grant) access() access {
+	return grantRoles[g.Role]
+}
+
+// ShareLink gives anyone holding its token read-only access to a map until
+// it expires or is revoked. Only a hash of the token is stored; the token
+// itself is returned once, when the link is created.
+type ShareLink struct {
+	ID        primitive.ObjectID `json:"id" bson:"id"`
+	TokenHash string             `json:"-" bson:"tokenHash"`
+	CreatedAt time.Time          `json:"createdAt" bson:"createdAt"`
+	ExpiresAt *time.Time         `json:"expiresAt,omitempty" bson:"expiresAt,omitempty"`
+}
+
+// CreateShareLinkRequest is the body of POST /api/v1/maps/{id}/share-links.
+// Links without an expiry last until they are revoked.
+type CreateShareLinkRequest struct {
+	ExpiresAt *time.Time `json:"expiresAt"`
+}
+
+// NewShareLink is a created share link, with its token and the public path
+// that serves the map.
+type NewShareLink struct {
+	ShareLink
+	Token string `json:"token"`
+	Path  string `json:"path"`
+}
+
+// PublicMap is what a share link shows of a map: its content, but not who
+// owns it or how it is filed, tagged and shared.
+type PublicMap struct {
+	Name          string            `json:"name"`
+	Width         int               `json:"width"`
+	Height        int               `json:"height"`
+	Matrix        [][]int           `json:"matrix"`
+	ImageURL      string            `json:"imageUrl,omitempty"`
+	ThumbnailURLs map[string]string `json:"thumbnailUrls,omitempty"`
+}
+
+// GrantRequest is the body of PUT /api/v1/maps/{id}/grants/{userId}.
+type GrantRequest struct {
+	Role string `json:"role"`
+}
+
+// newShareToken returns a random, URL-safe token.
+func newShareToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// logShareChange logs a map_shared or map_unshared event for m.
+func (s *Server) logShareChange(event string, m Map, description string, metadata map[string]string) {
+	if s.logger == nil {
+		return
+	}
+
+	metadata["map_id"] = m.ID.Hex()
+	metadata["map_name"] = m.Name
+
+	if err := s.logger.LogEvent(event, m.UserID, description, metadata); err != nil {
+		log.Printf("Failed to log sharing change: %v", err)
+	}
+}
+
+// handleGetSharedWithMe lists the maps other users have granted the caller
+// access to. It takes the same parameters as the normal listing, except
+// userId.
+func (s *Server) handleGetSharedWithMe(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	values.Set("userId", r.Header.Get("X-User-ID"))
+	query, err := parseListQuery(values)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if query.Sort == "deleted" {
+		http.Error(w, "sort=deleted is only available for the trash", http.StatusBadRequest)
+		return
+	}
+	query.SharedWith = true
+
+	s.writeMapPage(w, r, query)
+}
+
+// handleGetPublicMap serves a map to anyone holding one of its share links.
+func (s *Server) handleGetPublicMap(w http.ResponseWriter, r *http.Request) {
+	m, ok := s.loadReadableMap(w, r)
+	if !ok {
+		return
+	}
+	s.setURLsAt(&m, "/api/v1/public/maps/"+mux.Vars(r)["token"])
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", mapETag(m.Version))
+	json.NewEncoder(w).Encode(PublicMap{
+		Name:          m.Name,
+		Width:         m.Width,
+		Height:        m.Height,
+		Matrix:        m.Matrix,
+		ImageURL:      m.ImageURL,
+		ThumbnailURLs: m.ThumbnailURLs,
+	})
+}
+
+func (s *Server) handleListShareLinks(w http.ResponseWriter, r *http.Request) {
+	m, ok := s.loadMap(w, r, activeMaps, accessOwner)
+	if !ok {
+		return
+	}
+
+	links := m.ShareLinks
+	if links == nil {
+		links = []ShareLink{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(links)
+}
+
+func (s *Server) handleCreateShareLink(w http.ResponseWriter, r *http.Request) {
+	var req CreateShareLinkRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		http.Error(w, "expiresAt must be in the future", http.StatusBadRequest)
+		return
+	}
+
+	m, ok := s.loadMap(w, r, activeMaps, accessOwner)
+	if !ok {
+		return
+	}
+
+	token, err := newShareToken()
+	if err != nil {
+		log.Printf("Error generating share token: %v", err)
+		http.Error(w, "Failed to create share link", http.StatusInternalServerError)
+		return
+	}
+	link := ShareLink{
+		ID:        primitive.NewObjectID(),
+		TokenHash: hashShareToken(token),
+		CreatedAt: time.Now(),
+		ExpiresAt: req.ExpiresAt,
+	}
+
+	err = s.maps.AddShareLink(context.Background(), m.ID, link)
+	if err == errNotFound {
+		http.Error(w, "Map not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error saving share link: %v", err)
+		http.Error(w, "Failed to create share link", http.StatusInternalServerError)
+		return
+	}
+
+	metadata := map[string]string{"share": "link", "link_id": link.ID.Hex()}
+	if link.ExpiresAt != nil {
+		metadata["expires_at"] = link.ExpiresAt.Format(time.RFC3339)
+	}
+	s.logShareChange("map_shared", m, fmt.Sprintf("Share link created for map %s", m.ID.Hex()), metadata)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(NewShareLink{
+		ShareLink: link,
+		Token:     token,
+		Path:      "/api/v1/public/maps/" + token,
+	})
+}
+
+func (s *Server) handleDeleteShareLink(w http.ResponseWriter, r *http.Request) {
+	linkID, err := primitive.ObjectIDFromHex(mux.Vars(r)["linkId"])
+	if err != nil {
+		http.Error(w, "Invalid share link ID", http.StatusBadRequest)
+		return
+	}
+
+	m, ok := s.loadMap(w, r, activeMaps, accessOwner)
+	if !ok {
+		return
+	}
+
+	removed, err := s.maps.RemoveShareLink(context.Background(), m.ID, linkID)
+	if err != nil {
+		log.Printf("Error revoking share link: %v", err)
+		http.Error(w, "Failed to revoke share link", http.StatusInternalServerError)
+		return
+	}
+	if !removed {
+		http.Error(w, "Share link not found", http.StatusNotFound)
+		return
+	}
+
+	s.logShareChange("map_unshared", m, fmt.Sprintf("Share link revoked for map %s", m.ID.Hex()),
+		map[string]string{"share": "link", "link_id": linkID.Hex()})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleListGrants(w http.ResponseWriter, r *http.Request) {
+	m, ok := s.loadMap(w, r, activeMaps, accessOwner)
+	if !ok {
+		return
+	}
+
+	grants := m.Grants
+	if grants == nil {
+		grants = []Grant{}
+	}
+	userIDs := make([]string, len(grants))
+	for i := range grants {
+		userIDs[i] = grants[i].UserID
+	}
+	names := s.auth.OwnerNames(userIDs)
+	for i := range grants {
+		grants[i].UserName = names[grants[i].UserID]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(grants)
+}
+
+// handlePutGrant gives a user viewer or editor access to a map, replacing
+// any role they had before.
+func (s *Server) handlePutGrant(w http.ResponseWriter, r *http.Request) {
+	userID := mux.Vars(r)["userId"]
+	if n, err := strconv.Atoi(userID); err != nil || n < 1 {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	var req GrantRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	if _, ok := grantRoles[req.Role]; !ok {
+		http.Error(w, "role must be viewer or editor", http.StatusBadRequest)
+		return
+	}
+
+	m, ok := s.loadMap(w, r, activeMaps, accessOwner)
+	if !ok {
+		return
+	}
+	if userID == m.UserID {
+		http.Error(w, "The owner of a map can't be given a grant on it", http.StatusBadRequest)
+		return
+	}
+
+	grant := Grant{UserID: userID, Role: req.Role, GrantedAt: time.Now()}
+	if err := s.maps.PutGrant(context.Background(), m.ID, grant); err != nil {
+		log.Printf("Error saving grant: %v", err)
+		http.Error(w, "Failed to save grant", http.StatusInternalServerError)
+		return
+	}
+
+	s.logShareChange("map_shared", m, fmt.Sprintf("Map %s shared with user %s as %s", m.ID.Hex(), userID, req.Role),
+		map[string]string{"share": "grant", "grantee_id": userID, "role": req.Role})
+
+	grant.UserName = s.auth.OwnerNames([]string{userID})[userID]
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(grant)
+}
+
+func (s *Server) handleDeleteGrant(w http.ResponseWriter, r *http.Request) {
+	userID := mux.Vars(r)["userId"]
+
+	m, ok := s.loadMap(w, r, activeMaps, accessOwner)
+	if !ok {
+		return
+	}
+
+	removed, err := s.maps.RemoveGrant(context.Background(), m.ID, userID)
+	if err != nil {
+		log.Printf("Error revoking grant: %v", err)
+		http.Error(w, "Failed to revoke grant", http.StatusInternalServerError)
+		return
+	}
+	if !removed {
+		http.Error(w, "Grant not found", http.StatusNotFound)
+		return
+	}
+
+	s.logShareChange("map_unshared", m, fmt.Sprintf("Map %s no longer shared with user %s", m.ID.Hex(), userID),
+		map[string]string{"share": "grant", "grantee_id": userID})
+
+	w.WriteHeader(http.StatusNoContent)
+}
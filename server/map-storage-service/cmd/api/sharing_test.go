@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestGetPublicMap(t *testing.T) {
+	expired := time.Now().Add(-time.Hour)
+
+	tests := []struct {
+		name      string
+		token     string
+		expiresAt *time.Time
+		wantCode  int
+	}{
+		{"valid link", "secret", nil, http.StatusOK},
+		{"expired link", "secret", &expired, http.StatusNotFound},
+		{"unknown token", "guess", nil, http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			ctx := context.Background()
+			m := s.createTestMap(t, "1", "Level 1")
+			folderID := primitive.NewObjectID()
+			if _, err := s.maps.SetFolder(ctx, m.ID, &folderID); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.maps.SetTags(ctx, m.ID, []string{"private"}); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.maps.PutGrant(ctx, m.ID, Grant{UserID: "2", Role: "editor", GrantedAt: time.Now()}); err != nil {
+				t.Fatal(err)
+			}
+			link := ShareLink{ID: primitive.NewObjectID(), TokenHash: hashShareToken("secret"), CreatedAt: time.Now(), ExpiresAt: tt.expiresAt}
+			if err := s.maps.AddShareLink(ctx, m.ID, link); err != nil {
+				t.Fatal(err)
+			}
+
+			rec := call(s.handleGetPublicMap, "GET", "/", "", map[string]string{"token": tt.token}, nil)
+			if rec.Code != tt.wantCode {
+				t.Fatalf("got status %d, want %d: %s", rec.Code, tt.wantCode, rec.Body)
+			}
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+
+			var got map[string]json.RawMessage
+			if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			for _, field := range []string{"id", "userId", "ownerName", "folderId", "tags", "grants", "shareLinks", "access"} {
+				if _, ok := got[field]; ok {
+					t.Errorf("public map includes %s", field)
+				}
+			}
+			var name string
+			json.Unmarshal(got["name"], &name)
+			if name != m.Name || got["matrix"] == nil {
+				t.Fatalf("got %v, want the map's name and matrix", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/HugoSmits86/nativewebp"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// thumbnailFormats maps the formats thumbnails are rendered in to their
+// content types.
+var thumbnailFormats = map[string]string{
+	"png":  "image/png",
+	"webp": "image/webp",
+}
+
+// Thumbnail is a scaled-down copy of a map's image, stored in the blob store.
+type Thumbnail struct {
+	Size   int    `json:"size" bson:"size"`
+	Format string `json:"format" bson:"format"`
+	Key    string `json:"-" bson:"key"`
+	Bytes  int64  `json:"bytes" bson:"bytes"`
+}
+
+// parseThumbnailSizes parses a comma-separated list of sizes.
+func parseThumbnailSizes(value string) ([]int, error) {
+	var sizes []int
+	for _, field := range strings.Split(value, ",") {
+		size, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || size < 1 {
+			return nil, fmt.Errorf("invalid thumbnail size %q", field)
+		}
+		sizes = append(sizes, size)
+	}
+	return sizes, nil
+}
+
+// refreshThumbnails queues m if its thumbnails are missing or stale.
+func (s *Server) refreshThumbnails(m Map) {
+	if m.ImageKey != "" && !s.thumbnailsCurrent(m) {
+		s.queueThumbnails(m.ID)
+	}
+}
+
+// queueThumbnails asks the worker to render the thumbnails of a map.
+func (s *Server) queueThumbnails(id primitive.ObjectID) {
+	select {
+	case s.thumbnailQueue <- id:
+	default:
+		log.Printf("Thumbnail queue full, map %s will be picked up by the next sweep", id.Hex())
+	}
+}
+
+// thumbnailsCurrent reports whether m has every configured thumbnail
+// rendered from its current image.
+func (s *Server) thumbnailsCurrent(m Map) bool {
+	if m.ThumbnailSource != m.ImageKey {
+		return false
+	}
+	if m.ThumbnailsFailed {
+		return true
+	}
+	for _, size := range s.limits.ThumbnailSizes {
+		for format := range thumbnailFormats {
+			if findThumbnail(m.Thumbnails, size, format) == nil {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func findThumbnail(thumbnails []Thumbnail, size int, format string) *Thumbnail {
+	for i := range thumbnails {
+		if thumbnails[i].Size == size && thumbnails[i].Format == format {
+			return &thumbnails[i]
+		}
+	}
+	return nil
+}
+
+// setThumbnailURLs fills in m.ThumbnailURLs if its thumbnails are current.
+// The URLs carry the source image key, so they change whenever the image
+// does and can be cached for a long time.
+func (s *Server) setThumbnailURLs(m *Map, prefix string) {
+	if m.ImageKey == "" || m.ThumbnailsFailed || !s.thumbnailsCurrent(*m) {
+		return
+	}
+	m.ThumbnailURLs = make(map[string]string, len(s.limits.ThumbnailSizes))
+	for _, size := range s.limits.ThumbnailSizes {
+		m.ThumbnailURLs[strconv.Itoa(size)] = fmt.Sprintf("%s/thumbnail?size=%d&v=%s", prefix, size, m.ImageKey[:12])
+	}
+}
+
+// runThumbnailWorker renders queued thumbnails until ctx is cancelled. Every
+// interval, and once at start, it also sweeps for maps whose thumbnails are
+// missing or stale, e.g. because the queue was full or the service stopped
+// before getting to them.
+func (s *Server) runThumbnailWorker(ctx context.Context, interval time.Duration) {
+	s.sweepThumbnails(ctx)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case id := <-s.thumbnailQueue:
+			if err := s.renderThumbnails(ctx, id); err != nil {
+				log.Printf("Error rendering thumbnails of map %s: %v", id.Hex(), err)
+			}
+		case <-ticker.C:
+			s.sweepThumbnails(ctx)
+		}
+	}
+}
+
+func (s *Server) sweepThumbnails(ctx context.Context) {
+	ids, err := s.maps.StaleThumbnails(ctx, 100)
+	if err != nil {
+		log.Printf("Error finding maps without thumbnails: %v", err)
+		return
+	}
+
+	for _, id := range ids {
+		if err := s.renderThumbnails(ctx, id); err != nil {
+			log.Printf("Error rendering thumbnails of map %s: %v", id.Hex(), err)
+		}
+	}
+}
+
+// renderThumbnails renders every configured size and format from the map's
+// current image and stores them, unless they are already current.
+func (s *Server) renderThumbnails(ctx context.Context, id primitive.ObjectID) error {
+	m, err := s.maps.Info(ctx, id)
+	if err == errNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if m.ImageKey == "" || s.thumbnailsCurrent(m) {
+		return nil
+	}
+
+	blob, err := s.blobs.Get(ctx, m.ImageKey)
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(blob)
+	blob.Close()
+	if err != nil {
+		return err
+	}
+	src, err := decodeImage(data, s.limits.MaxImagePixels)
+	if err != nil {
+		// Retrying won't help, so mark the image as done to keep the
+		// sweep from picking it up again.
+		if err := s.maps.SetThumbnailsFailed(ctx, id, m.ImageKey); err != nil {
+			log.Printf("Error marking thumbnails of map %s as failed: %v", id.Hex(), err)
+		}
+		return fmt.Errorf("failed to decode image: %v", err)
+	}
+
+	var thumbnails []Thumbnail
+	var keys []string
+	for _, size := range s.limits.ThumbnailSizes {
+		scaled := scaleToFit(src, size)
+		for format := range thumbnailFormats {
+			var buf bytes.Buffer
+			if format == "webp" {
+				err = nativewebp.Encode(&buf, scaled, nil)
+			} else {
+				err = png.Encode(&buf, scaled)
+			}
+			if err != nil {
+				s.releaseBlobs(ctx, keys...)
+				return fmt.Errorf("failed to encode %s thumbnail: %v", format, err)
+			}
+
+			key, n, err := s.blobs.Put(ctx, &buf)
+			if err != nil {
+				s.releaseBlobs(ctx, keys...)
+				return err
+			}
+			keys = append(keys, key)
+			thumbnails = append(thumbnails, Thumbnail{Size: size, Format: format, Key: key, Bytes: n})
+		}
+	}
+
+	// Only store the thumbnails if the image hasn't changed meanwhile; if
+	// it has, the newer image is queued and will be rendered next.
+	updated, err := s.maps.SetThumbnails(ctx, id, m.ImageKey, thumbnails)
+	if err != nil || !updated {
+		s.releaseBlobs(ctx, keys...)
+		return err
+	}
+
+	var old []string
+	for _, t := range m.Thumbnails {
+		old = append(old, t.Key)
+	}
+	s.releaseBlobs(ctx, old...)
+	return nil
+}
+
+// decodeImage decodes data, after checking from its header that the image
+// is no larger than maxPixels.
+func decodeImage(data []byte, maxPixels int) (image.Image, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if config.Width*config.Height > maxPixels {
+		return nil, fmt.Errorf("image is %dx%d, more than %d pixels", config.Width, config.Height, maxPixels)
+	}
+	src, _, err := image.Decode(bytes.NewReader(data))
+	return src, err
+}
+
+// scaleToFit scales src down to fit in a size by size box, keeping its
+// aspect ratio. Images that already fit are not enlarged.
+func scaleToFit(src image.Image, size int) image.Image {
+	bounds := src.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w <= size && h <= size {
+		return src
+	}
+	if w >= h {
+		w, h = size, max(1, h*size/w)
+	} else {
+		w, h = max(1, w*size/h), size
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, bounds, draw.Over, nil)
+	return dst
+}
+
+// handleGetThumbnail serves a map thumbnail. The format is taken from the
+// format parameter, or else WebP if the client accepts it and PNG if not.
+func (s *Server) handleGetThumbnail(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	size := s.limits.ThumbnailSizes[0]
+	if value := query.Get("size"); value != "" {
+		var err error
+		size, err = strconv.Atoi(value)
+		if err != nil || !slices.Contains(s.limits.ThumbnailSizes, size) {
+			http.Error(w, fmt.Sprintf("size must be one of %v", s.limits.ThumbnailSizes), http.StatusBadRequest)
+			return
+		}
+	}
+
+	format := query.Get("format")
+	if format == "" {
+		format = "png"
+		if strings.Contains(r.Header.Get("Accept"), "image/webp") {
+			format = "webp"
+		}
+	}
+	contentType, ok := thumbnailFormats[format]
+	if !ok {
+		http.Error(w, "format must be png or webp", http.StatusBadRequest)
+		return
+	}
+
+	m, ok := s.loadMapMedia(w, r)
+	if !ok {
+		return
+	}
+
+	var thumbnail *Thumbnail
+	if m.ImageKey != "" && m.ThumbnailSource == m.ImageKey {
+		thumbnail = findThumbnail(m.Thumbnails, size, format)
+	}
+	if thumbnail == nil {
+		if m.ImageKey != "" && !m.ThumbnailsFailed {
+			s.queueThumbnails(m.ID)
+		}
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, "Thumbnail not available", http.StatusNotFound)
+		return
+	}
+
+	etag := `"` + thumbnail.Key + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Vary", "Accept")
+	// A URL carrying the current version never changes content.
+	if v := query.Get("v"); v != "" && strings.HasPrefix(m.ImageKey, v) {
+		w.Header().Set("Cache-Control", "private, max-age=31536000, immutable")
+	} else {
+		w.Header().Set("Cache-Control", "private, max-age=60")
+	}
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	blob, err := s.blobs.Get(r.Context(), thumbnail.Key)
+	if err != nil {
+		log.Printf("Error opening thumbnail %s: %v", thumbnail.Key, err)
+		http.Error(w, "Failed to read thumbnail", http.StatusInternalServerError)
+		return
+	}
+	defer blob.Close()
+
+	setImageHeaders(w, contentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(thumbnail.Bytes, 10))
+	if _, err := io.Copy(w, blob); err != nil {
+		log.Printf("Error sending thumbnail %s: %v", thumbnail.Key, err)
+	}
+}
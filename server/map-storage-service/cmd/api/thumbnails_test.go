@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestDecodeImagePixelLimit(t *testing.T) {
+	if _, err := decodeImage(testPNG(t, 10, 1), 100); err != nil {
+		t.Fatalf("got %v decoding an image at the limit", err)
+	}
+	if _, err := decodeImage(testPNG(t, 11, 1), 100); err == nil {
+		t.Fatal("decoded an image over the limit")
+	}
+}
+
+// setTestImage stores a width by width image of the given shade as the
+// map's image and returns the updated map.
+func (s *Server) setTestImage(t *testing.T, id primitive.ObjectID, width, shade int) Map {
+	t.Helper()
+
+	ref, err := s.storeImage(context.Background(), bytes.NewReader(testPNG(t, width, shade)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.maps.Update(context.Background(), id, nil, MapChange{Image: &ref, UpdatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	m, err := s.maps.Info(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestScaleToFit(t *testing.T) {
+	tests := []struct {
+		name          string
+		width, height int
+		wantW, wantH  int
+	}{
+		{"landscape", 200, 100, 50, 25},
+		{"portrait", 100, 200, 25, 50},
+		{"square", 80, 80, 50, 50},
+		{"thin", 1000, 10, 50, 1},
+		{"already fits", 40, 20, 40, 20},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := image.NewGray(image.Rect(0, 0, tt.width, tt.height))
+			bounds := scaleToFit(src, 50).Bounds()
+			if bounds.Dx() != tt.wantW || bounds.Dy() != tt.wantH {
+				t.Errorf("scaled %dx%d to %dx%d, want %dx%d",
+					tt.width, tt.height, bounds.Dx(), bounds.Dy(), tt.wantW, tt.wantH)
+			}
+		})
+	}
+}
+
+func TestThumbnailsCurrent(t *testing.T) {
+	s := newTestServer(t)
+	s.limits.ThumbnailSizes = []int{16, 32}
+
+	var complete []Thumbnail
+	for _, size := range s.limits.ThumbnailSizes {
+		for format := range thumbnailFormats {
+			complete = append(complete, Thumbnail{Size: size, Format: format})
+		}
+	}
+
+	tests := []struct {
+		name       string
+		image      string
+		source     string
+		failed     bool
+		thumbnails []Thumbnail
+		want       bool
+	}{
+		{"complete", "a", "a", false, complete, true},
+		{"stale source", "b", "a", false, complete, false},
+		{"missing a size", "a", "a", false, complete[:2], false},
+		{"never rendered", "a", "", false, nil, false},
+		{"failed", "a", "a", true, nil, true},
+		{"failed for an older image", "b", "a", true, nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := Map{ThumbnailSource: tt.source, ThumbnailsFailed: tt.failed, Thumbnails: tt.thumbnails}
+			m.ImageKey = tt.image
+			if got := s.thumbnailsCurrent(m); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRenderThumbnails(t *testing.T) {
+	s := newTestServer(t)
+	s.limits.ThumbnailSizes = []int{16, 32}
+	ctx := context.Background()
+	m := s.createTestMap(t, "1", "Level 1")
+	s.setTestImage(t, m.ID, 64, 1)
+
+	if err := s.renderThumbnails(ctx, m.ID); err != nil {
+		t.Fatal(err)
+	}
+	first, err := s.maps.Info(ctx, m.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.thumbnailsCurrent(first) || len(first.Thumbnails) != 4 {
+		t.Fatalf("got thumbnails %+v from %s, want 4 from %s", first.Thumbnails, first.ThumbnailSource, first.ImageKey)
+	}
+
+	// Replacing the image makes the thumbnails stale until they are
+	// rendered again, and the old ones are deleted once they are.
+	replaced := s.setTestImage(t, m.ID, 64, 2)
+	if s.thumbnailsCurrent(replaced) {
+		t.Fatal("thumbnails of the old image are current")
+	}
+	if err := s.renderThumbnails(ctx, m.ID); err != nil {
+		t.Fatal(err)
+	}
+	second, err := s.maps.Info(ctx, m.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.thumbnailsCurrent(second) || second.ThumbnailSource != replaced.ImageKey {
+		t.Fatalf("thumbnails rendered from %s, want %s", second.ThumbnailSource, replaced.ImageKey)
+	}
+	for _, thumbnail := range first.Thumbnails {
+		if _, err := s.blobs.Get(ctx, thumbnail.Key); err != errBlobNotFound {
+			t.Errorf("got %v reading a thumbnail of the old image, want errBlobNotFound", err)
+		}
+	}
+}
+
+// replacingMapRepository replaces a map's image just before thumbnails are
+// stored, as a save racing the thumbnail worker would.
+type replacingMapRepository struct {
+	MapRepository
+	replace func()
+}
+
+func (r replacingMapRepository) SetThumbnails(ctx context.Context, id primitive.ObjectID, source string, thumbnails []Thumbnail) (bool, error) {
+	r.replace()
+	return r.MapRepository.SetThumbnails(ctx, id, source, thumbnails)
+}
+
+func TestRenderThumbnailsImageReplaced(t *testing.T) {
+	s := newTestServer(t)
+	s.limits.ThumbnailSizes = []int{16}
+	ctx := context.Background()
+	m := s.createTestMap(t, "1", "Level 1")
+	s.setTestImage(t, m.ID, 64, 1)
+
+	var replaced Map
+	s.maps = replacingMapRepository{
+		MapRepository: s.maps,
+		replace:       func() { replaced = s.setTestImage(t, m.ID, 64, 2) },
+	}
+	if err := s.renderThumbnails(ctx, m.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := s.maps.Info(ctx, m.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Thumbnails) != 0 || got.ThumbnailSource == replaced.ImageKey {
+		t.Fatalf("stored thumbnails %+v of the replaced image", got.Thumbnails)
+	}
+
+	// Only the two images are left; the discarded renders were released.
+	var keys []string
+	err = s.blobs.Each(ctx, time.Now().Add(time.Minute), func(key string) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 {
+		t.Errorf("got %d blobs, want the 2 images", len(keys))
+	}
+}
+
+func TestHandleGetThumbnail(t *testing.T) {
+	s := newTestServer(t)
+	s.limits.ThumbnailSizes = []int{16}
+	m := s.createTestMap(t, "1", "Level 1")
+	m = s.setTestImage(t, m.ID, 64, 1)
+
+	get := func(query, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/maps/"+m.ID.Hex()+"/thumbnail"+query, nil)
+		req.Header.Set("X-User-ID", "1")
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		req = mux.SetURLVars(req, map[string]string{"id": m.ID.Hex()})
+		rec := httptest.NewRecorder()
+		s.handleGetThumbnail(rec, req)
+		return rec
+	}
+
+	rec := get("", "")
+	if rec.Code != http.StatusNotFound || rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("got status %d with Retry-After %q before rendering, want 404 with Retry-After",
+			rec.Code, rec.Header().Get("Retry-After"))
+	}
+	if len(s.thumbnailQueue) != 1 {
+		t.Errorf("missing thumbnail queued %d times, want once", len(s.thumbnailQueue))
+	}
+
+	if err := s.renderThumbnails(context.Background(), m.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		query         string
+		accept        string
+		wantType      string
+		wantImmutable bool
+	}{
+		{"png by default", "", "", "image/png", false},
+		{"webp when accepted", "", "image/webp,image/*", "image/webp", false},
+		{"format parameter wins", "?format=png", "image/webp", "image/png", false},
+		{"current version", "?v=" + m.ImageKey[:12], "", "image/png", true},
+		{"old version", "?v=0123456789ab", "", "image/png", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := get(tt.query, tt.accept)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("got status %d: %s", rec.Code, rec.Body)
+			}
+			if got := rec.Header().Get("Content-Type"); got != tt.wantType {
+				t.Errorf("got Content-Type %q, want %q", got, tt.wantType)
+			}
+			cacheControl := rec.Header().Get("Cache-Control")
+			if got := strings.Contains(cacheControl, "immutable"); got != tt.wantImmutable {
+				t.Errorf("got Cache-Control %q, want immutable %v", cacheControl, tt.wantImmutable)
+			}
+			if _, _, err := image.Decode(rec.Body); err != nil {
+				t.Errorf("response is not an image: %v", err)
+			}
+		})
+	}
+}
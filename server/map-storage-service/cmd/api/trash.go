@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// logMapDeleted logs a map_deleted event. deletion is "trashed" when the
+// map was moved to the trash and "purged" when it was removed for good.
+func (s *Server) logMapDeleted(m Map, deletion string) {
+	if s.logger == nil {
+		return
+	}
+
+	metadata := map[string]string{
+		"map_id":   m.ID.Hex(),
+		"map_name": m.Name,
+		"deletion": deletion,
+	}
+
+	if err := s.logger.LogEvent(
+		"map_deleted",
+		m.UserID,
+		fmt.Sprintf("Map %s: %s", deletion, m.Name),
+		metadata,
+	); err != nil {
+		log.Printf("Failed to log map deletion: %v", err)
+	}
+}
+
+// purgeMap permanently deletes a map that was moved to the trash at or
+// before trashedBefore, along with its revisions and any blobs nothing else
+// refers to. It reports whether the map was deleted; it is not if it has
+// been restored meanwhile.
+func (s *Server) purgeMap(ctx context.Context, m Map, trashedBefore time.Time) (bool, error) {
+	keys, err := s.blobKeys(ctx, m.ID)
+	if err != nil {
+		return false, fmt.Errorf("failed to list images: %v", err)
+	}
+
+	deleted, err := s.maps.Delete(ctx, m.ID, trashedBefore)
+	if err != nil || !deleted {
+		return false, err
+	}
+	if err := s.revisions.DeleteMap(ctx, m.ID); err != nil {
+		log.Printf("Error deleting revisions of map %s: %v", m.ID.Hex(), err)
+	}
+	s.releaseBlobs(ctx, keys...)
+
+	s.logMapDeleted(m, "purged")
+	return true, nil
+}
+
+// runTrashPurger purges maps that have been in the trash for longer than
+// the configured TrashRetention, checking every interval until ctx is cancelled.
+func (s *Server) runTrashPurger(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		s.purgeTrash(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Server) purgeTrash(ctx context.Context) {
+	cutoff := time.Now().Add(-s.limits.TrashRetention)
+	maps, err := s.maps.TrashedBefore(ctx, cutoff)
+	if err != nil {
+		log.Printf("Error finding maps to purge: %v", err)
+		return
+	}
+
+	purged := 0
+	for _, m := range maps {
+		deleted, err := s.purgeMap(ctx, m, cutoff)
+		if err != nil {
+			log.Printf("Error purging map %s: %v", m.ID.Hex(), err)
+			continue
+		}
+		if deleted {
+			purged++
+		}
+	}
+	if purged > 0 {
+		log.Printf("Purged %d maps from the trash", purged)
+	}
+}
+
+// handleGetTrash lists a user's maps in the trash, most recently deleted
+// first. It takes the same parameters as the normal listing.
+func (s *Server) handleGetTrash(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	if values.Get("sort") == "" {
+		values.Set("sort", "deleted")
+	}
+	query, ok := parseOwnListQuery(w, r, values)
+	if !ok {
+		return
+	}
+	query.Trash = true
+
+	s.writeMapPage(w, r, query)
+}
+
+// handleRestoreMap takes a map out of the trash.
+func (s *Server) handleRestoreMap(w http.ResponseWriter, r *http.Request) {
+	m, ok := s.loadMap(w, r, trashedMaps, accessOwner)
+	if !ok {
+		return
+	}
+
+	mapData, err := s.maps.Restore(context.Background(), m.ID)
+	if err == errNotFound {
+		http.Error(w, "Map not found in trash", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error restoring map: %v", err)
+		http.Error(w, "Failed to restore map", http.StatusInternalServerError)
+		return
+	}
+
+	if s.logger != nil {
+		metadata := map[string]string{
+			"map_id":   mapData.ID.Hex(),
+			"map_name": mapData.Name,
+		}
+
+		if err := s.logger.LogEvent(
+			"map_restored_from_trash",
+			mapData.UserID,
+			fmt.Sprintf("Map restored from trash: %s", mapData.Name),
+			metadata,
+		); err != nil {
+			log.Printf("Failed to log map restore: %v", err)
+		}
+	}
+
+	mapData.OwnerName = s.auth.OwnerNames([]string{mapData.UserID})[mapData.UserID]
+	s.setURLs(&mapData)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", mapETag(mapData.Version))
+	json.NewEncoder(w).Encode(mapData)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRestoreMap(t *testing.T) {
+	tests := []struct {
+		name     string
+		userID   string
+		trashed  bool
+		wantCode int
+	}{
+		{"owner", "1", true, http.StatusOK},
+		{"not in trash", "1", false, http.StatusNotFound},
+		{"another user", "2", true, http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			ctx := context.Background()
+			m := s.createTestMap(t, "1", "Level 1")
+			if tt.trashed {
+				if _, err := s.maps.Trash(ctx, m.ID, time.Now()); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			rec := call(s.handleRestoreMap, "POST", "/", tt.userID, map[string]string{"id": m.ID.Hex()}, nil)
+			if rec.Code != tt.wantCode {
+				t.Fatalf("got status %d, want %d: %s", rec.Code, tt.wantCode, rec.Body)
+			}
+
+			stored, err := s.maps.ByID(ctx, m.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantTrashed := tt.trashed && tt.wantCode != http.StatusOK
+			if (stored.DeletedAt != nil) != wantTrashed {
+				t.Fatalf("map in trash: %v, want %v", stored.DeletedAt != nil, wantTrashed)
+			}
+		})
+	}
+}
+
+func TestPurgeTrash(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+
+	expired := s.createTestMap(t, "1", "Expired")
+	ref, err := s.storeImage(ctx, bytes.NewReader(testPNG(t, 2, 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.maps.Update(ctx, expired.ID, nil, MapChange{Image: &ref, UpdatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.maps.Trash(ctx, expired.ID, time.Now().Add(-s.limits.TrashRetention-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	recent := s.createTestMap(t, "1", "Recent")
+	if _, err := s.maps.Trash(ctx, recent.ID, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	active := s.createTestMap(t, "1", "Active")
+
+	s.purgeTrash(ctx)
+
+	if _, err := s.maps.ByID(ctx, expired.ID); err != errNotFound {
+		t.Errorf("got %v looking up the expired map, want errNotFound", err)
+	}
+	if _, err := s.blobs.Get(ctx, ref.ImageKey); err != errBlobNotFound {
+		t.Errorf("image of the purged map was kept: %v", err)
+	}
+	for _, m := range []Map{recent, active} {
+		if _, err := s.maps.ByID(ctx, m.ID); err != nil {
+			t.Errorf("map %q was purged: %v", m.Name, err)
+		}
+	}
+}
+
+func TestPurgeMapRestoredMeanwhile(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+	m := s.createTestMap(t, "1", "Level 1")
+	ref, err := s.storeImage(ctx, bytes.NewReader(testPNG(t, 2, 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.maps.Update(ctx, m.ID, nil, MapChange{Image: &ref, UpdatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	trashed, err := s.maps.Trash(ctx, m.ID, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The purge found the map in the trash, but it is restored before the
+	// purge gets to delete it.
+	if _, err := s.maps.Restore(ctx, m.ID); err != nil {
+		t.Fatal(err)
+	}
+	deleted, err := s.purgeMap(ctx, trashed, time.Now())
+	if err != nil || deleted {
+		t.Fatalf("got %v, %v purging a restored map, want false", deleted, err)
+	}
+	if _, err := s.maps.ByID(ctx, m.ID); err != nil {
+		t.Fatalf("restored map was deleted: %v", err)
+	}
+	if _, err := s.blobs.Get(ctx, ref.ImageKey); err != nil {
+		t.Fatalf("image of the restored map was deleted: %v", err)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+const (
+	userEventsExchange       = "user_events"
+	userEventsQueue          = "map_storage_user_events"
+	userDeletedKey           = "user.deleted"
+	userDeletionCompletedKey = "user.deletion_completed"
+)
+
+// UserDeletedEvent is published by the authentication service when an
+// account is deleted.
+type UserDeletedEvent struct {
+	EventID    string    `json:"event_id"`
+	UserID     string    `json:"user_id"`
+	OccurredAt time.Time `json:"occurred_at"`
+}
+
+// UserDeletionCompleted reports that this service has finished cleaning up
+// after a deletion.
+type UserDeletionCompleted struct {
+	EventID     string    `json:"event_id"`
+	UserID      string    `json:"user_id"`
+	Service     string    `json:"service"`
+	Affected    int64     `json:"affected"`
+	CompletedAt time.Time `json:"completed_at"`
+}
+
+// consumeUserEvents deletes the maps of deleted users. It reconnects until
+// ctx is cancelled, so a broker outage only delays the cleanup.
+func (s *Server) consumeUserEvents(ctx context.Context, uri string) {
+	for {
+		if err := s.consumeUserEventsOnce(ctx, uri); err != nil {
+			log.Printf("User event consumer stopped: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+func (s *Server) consumeUserEventsOnce(ctx context.Context, uri string) error {
+	conn, err := amqp.Dial(uri)
+	if err != nil {
+		return fmt.Errorf("failed to connect to RabbitMQ: %v", err)
+	}
+	defer conn.Close()
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return fmt.Errorf("failed to open channel: %v", err)
+	}
+	defer ch.Close()
+
+	if err := ch.ExchangeDeclare(userEventsExchange, "topic", true, false, false, false, nil); err != nil {
+		return fmt.Errorf("failed to declare exchange: %v", err)
+	}
+	if _, err := ch.QueueDeclare(userEventsQueue, true, false, false, false, nil); err != nil {
+		return fmt.Errorf("failed to declare queue: %v", err)
+	}
+	if err := ch.QueueBind(userEventsQueue, userDeletedKey, userEventsExchange, false, nil); err != nil {
+		return fmt.Errorf("failed to bind queue: %v", err)
+	}
+	if err := ch.Qos(1, 0, false); err != nil {
+		return fmt.Errorf("failed to set QoS: %v", err)
+	}
+
+	msgs, err := ch.Consume(userEventsQueue, "", false, false, false, false, nil)
+	if err != nil {
+		return fmt.Errorf("failed to consume: %v", err)
+	}
+	log.Printf("Consuming %s events", userDeletedKey)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case msg, ok := <-msgs:
+			if !ok {
+				return fmt.Errorf("delivery channel closed")
+			}
+
+			var event UserDeletedEvent
+			if err := json.Unmarshal(msg.Body, &event); err != nil || event.EventID == "" || event.UserID == "" {
+				log.Printf("Discarding malformed user event: %s", msg.Body)
+				msg.Nack(false, false)
+				continue
+			}
+
+			if err := s.handleUserDeleted(ctx, ch, event); err != nil {
+				log.Printf("Error handling deletion of user %s: %v", event.UserID, err)
+				time.Sleep(time.Second)
+				msg.Nack(false, true)
+				continue
+			}
+			msg.Ack(false)
+		}
+	}
+}
+
+// handleUserDeleted removes the user's maps, folders and the grants they
+// were given, then reports completion. The event ID is recorded once the
+// maps are gone, so a redelivered event is acknowledged without reporting
+// twice; deleting by user ID is itself safe to repeat if the service stops
+// in between.
+func (s *Server) handleUserDeleted(ctx context.Context, ch *amqp.Channel, event UserDeletedEvent) error {
+	processed, err := s.events.Processed(ctx, event.EventID)
+	if err != nil {
+		return err
+	}
+	if processed {
+		log.Printf("Event %s already processed", event.EventID)
+		return nil
+	}
+
+	var keys []string
+	for _, refs := range []blobReferences{s.maps, s.revisions} {
+		values, err := refs.UserBlobKeys(ctx, event.UserID)
+		if err != nil {
+			return fmt.Errorf("failed to list images: %v", err)
+		}
+		keys = append(keys, values...)
+	}
+
+	deleted, err := s.maps.DeleteUser(ctx, event.UserID)
+	if err != nil {
+		return fmt.Errorf("failed to delete maps: %v", err)
+	}
+	log.Printf("Deleted %d maps of deleted user %s", deleted, event.UserID)
+
+	if err := s.revisions.DeleteUser(ctx, event.UserID); err != nil {
+		return fmt.Errorf("failed to delete map revisions: %v", err)
+	}
+	s.releaseBlobs(ctx, keys...)
+
+	if err := s.maps.RemoveGrantsTo(ctx, event.UserID); err != nil {
+		return fmt.Errorf("failed to revoke grants: %v", err)
+	}
+	if err := s.folders.DeleteUser(ctx, event.UserID); err != nil {
+		return fmt.Errorf("failed to delete folders: %v", err)
+	}
+
+	body, err := json.Marshal(UserDeletionCompleted{
+		EventID:     event.EventID,
+		UserID:      event.UserID,
+		Service:     "map_storage",
+		Affected:    deleted,
+		CompletedAt: time.Now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+	err = ch.Publish(userEventsExchange, userDeletionCompletedKey, false, false, amqp.Publishing{
+		ContentType:  "application/json",
+		DeliveryMode: amqp.Persistent,
+		Timestamp:    time.Now(),
+		Body:         body,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to report completion: %v", err)
+	}
+
+	return s.events.MarkProcessed(ctx, event.EventID)
+}